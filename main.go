@@ -2,26 +2,109 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/mattn/go-sqlite3"
 )
 
+// Log levels, lowest first. Lines below LOG_LEVEL (DEBUG, INFO, WARN or ERROR,
+// default INFO) are dropped.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+var logLevel = levelInfo
+
+// Set logLevel from LOG_LEVEL, keeping INFO when it's unset or unknown
+func setupLogLevel() {
+	value := strings.ToUpper(strings.TrimSpace(os.Getenv("LOG_LEVEL")))
+	if value == "" {
+		return
+	}
+	for level, name := range logLevelNames {
+		if value == name || (value == "WARNING" && level == levelWarn) {
+			logLevel = level
+			return
+		}
+	}
+	logWarn("Invalid LOG_LEVEL %q, using INFO", value)
+}
+
+// Write a log line tagged with its level, unless it's below LOG_LEVEL
+func logAt(level int, format string, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	log.Output(3, logLevelNames[level]+": "+fmt.Sprintf(format, args...))
+}
+
+func logDebug(format string, args ...interface{}) { logAt(levelDebug, format, args...) }
+func logInfo(format string, args ...interface{})  { logAt(levelInfo, format, args...) }
+func logWarn(format string, args ...interface{})  { logAt(levelWarn, format, args...) }
+func logError(format string, args ...interface{}) { logAt(levelError, format, args...) }
+
+// Load the portal timezone from PORTAL_TZ or TZ, defaulting to IST
+func portalLocation() *time.Location {
+	for _, name := range []string{os.Getenv("PORTAL_TZ"), os.Getenv("TZ"), "Asia/Kolkata"} {
+		if name == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(name)
+		if err == nil {
+			return loc
+		}
+		logWarn("Could not load timezone %q: %v", name, err)
+	}
+	// No tzdata available, fall back to a fixed IST offset
+	return time.FixedZone("IST", 5*60*60+30*60)
+}
+
 func setupEnvironment() {
-	// Set timezone to IST
-	os.Setenv("TZ", "Asia/Kolkata")
-	loc, _ := time.LoadLocation("Asia/Kolkata")
+	// Set timezone (IST unless PORTAL_TZ or TZ say otherwise)
+	loc := portalLocation()
+	os.Setenv("TZ", loc.String())
 	time.Local = loc
 
 	// Get data directory from environment or use default
@@ -57,16 +140,474 @@ func setupEnvironment() {
 	if err != nil {
 		// Fallback to stdout if we can't write to a log file
 		log.SetOutput(os.Stdout)
-		log.Printf("WARNING: Could not open log file, logging to stdout: %v", err)
+		logWarn("Could not open log file, logging to stdout: %v", err)
 	} else {
 		log.SetOutput(logFile)
 	}
+	setupLogLevel()
 
 	// Also prepare bills and backups directories
 	os.MkdirAll(filepath.Join(dataDir, "bills"), 0755)
 	os.MkdirAll(filepath.Join(dataDir, "backups"), 0755)
 
-	log.Printf("Environment setup complete. Using data directory: %s", dataDir)
+	logInfo("Environment setup complete. Using data directory: %s, timezone: %s", dataDir, loc)
+}
+
+// Read an integer setting from the environment, falling back to def
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logWarn("Invalid value for %s: %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// Parse page/limit query params into a SQL limit and offset. The limit defaults
+// to PAGE_DEFAULT_LIMIT (100) and is clamped to PAGE_MAX_LIMIT (200).
+func parsePaging(c *gin.Context) (limit, offset int, err error) {
+	maxLimit := getEnvInt("PAGE_MAX_LIMIT", 200)
+	limit = getEnvInt("PAGE_DEFAULT_LIMIT", 100)
+	page := 1
+
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive number")
+		}
+	}
+	if value := c.Query("page"); value != "" {
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("page must be a positive number")
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, (page - 1) * limit, nil
+}
+
+// Describe a page of a list of total items with X-Total-Count and an RFC 5988
+// Link header (next, prev and last), keeping the request's other query parameters
+func setPagingHeaders(c *gin.Context, total, limit, offset int) {
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	page := offset/limit + 1
+	last := (total + limit - 1) / limit
+	if last < 1 {
+		last = 1
+	}
+	link := func(p int, rel string) string {
+		query := c.Request.URL.Query()
+		query.Set("page", strconv.Itoa(p))
+		query.Set("limit", strconv.Itoa(limit))
+		return fmt.Sprintf("<%s%s?%s>; rel=\"%s\"", publicBaseURL(c), c.Request.URL.Path, query.Encode(), rel)
+	}
+	links := []string{}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	if page > 1 {
+		prev := page - 1
+		if prev > last {
+			prev = last
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	links = append(links, link(last, "last"))
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+// Parse ?sort= and ?order=asc|desc into an ORDER BY clause. Sort keys map to
+// fixed SQL expressions so request input never reaches the query; ties break on
+// idColumn. Without ?sort= the list is ordered by idColumn.
+func parseSort(c *gin.Context, columns map[string]string, idColumn string) (string, error) {
+	direction := "ASC"
+	switch strings.ToLower(c.Query("order")) {
+	case "", "asc":
+	case "desc":
+		direction = "DESC"
+	default:
+		return "", errors.New("order must be asc or desc")
+	}
+	key := c.Query("sort")
+	if key == "" {
+		return " ORDER BY " + idColumn + " " + direction, nil
+	}
+	expr, ok := columns[key]
+	if !ok {
+		keys := make([]string, 0, len(columns))
+		for k := range columns {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return "", fmt.Errorf("sort must be one of: %s", strings.Join(keys, ", "))
+	}
+	return " ORDER BY " + expr + " " + direction + ", " + idColumn + " " + direction, nil
+}
+
+// Sortable columns of the admin lists
+var (
+	userSortColumns = map[string]string{
+		"id":         "id",
+		"username":   "username COLLATE NOCASE",
+		"mobile":     "mobile",
+		"company":    "company COLLATE NOCASE",
+		"role":       "role",
+		"created_at": "created_at",
+	}
+	productSortColumns = map[string]string{
+		"id":         "id",
+		"name":       "name COLLATE NOCASE",
+		"active":     "active",
+		"created_at": "created_at",
+	}
+	registrationSortColumns = map[string]string{
+		"id":         "r.id",
+		"created_at": "r.created_at",
+		"company":    "u.company COLLATE NOCASE",
+		"user":       "u.username COLLATE NOCASE",
+		"product":    "p.name COLLATE NOCASE",
+		"serial":     "r.serial",
+		"status":     "r.status",
+	}
+)
+
+// Input length limits, in characters
+const (
+	maxMobileLength        = 15
+	maxGSTLength           = 15
+	maxCompanyLength       = 200
+	maxUsernameLength      = 50
+	maxRoleLength          = 20
+	maxProductNameLength   = 200
+	maxDescriptionLength   = 2000
+	maxSerialPatternLength = 200
+	maxNotesLength         = 1000
+	maxFilenameLength      = 200
+)
+
+type fieldLimit struct {
+	name  string
+	value string
+	max   int
+}
+
+// Reply to an UPDATE ... WHERE id=? AND version=? that changed nothing:
+// 404 when currentQuery finds no row, 409 with the current version otherwise
+func respondVersionMismatch(db *sql.DB, c *gin.Context, currentQuery string, id interface{}, notFound string) {
+	var current int
+	if err := db.QueryRow(currentQuery, id).Scan(&current); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "Modified by someone else, reload and try again", "current_version": current})
+}
+
+// Trim a free-text note and drop control characters other than newlines and tabs
+func sanitizeNotes(notes string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, notes))
+}
+
+// Return an error naming the first field longer than its limit
+func checkFieldLengths(fields ...fieldLimit) error {
+	for _, f := range fields {
+		if len([]rune(f.value)) > f.max {
+			return fmt.Errorf("%s must be at most %d characters", f.name, f.max)
+		}
+	}
+	return nil
+}
+
+// Reply 400, in the same shape as binding errors, when a field is longer than
+// its limit. Returns false when it replied.
+func checkRequestLengths(c *gin.Context, fields ...fieldLimit) bool {
+	for _, f := range fields {
+		if err := checkFieldLengths(f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": gin.H{f.name: err.Error()}})
+			return false
+		}
+	}
+	return true
+}
+
+// Value of an optional request field, "" when absent
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Report binding tag failures under the fields' JSON names
+func setupValidator() {
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// Turn a failed binding tag into a message like the hand-written checks produce
+func validationMessage(fe validator.FieldError) string {
+	if fe.Tag() == "required" {
+		return fe.Field() + " is required"
+	}
+	return fe.Field() + " is invalid"
+}
+
+// JSON binding that trims surrounding whitespace from string fields before the
+// binding tags are checked, so " 98765" can't slip past a uniqueness check.
+// Fields tagged trim:"-" keep their spaces (company names, passwords).
+type trimmedJSONBinding struct{}
+
+func (trimmedJSONBinding) Name() string {
+	return "json"
+}
+
+func (trimmedJSONBinding) Bind(req *http.Request, obj interface{}) error {
+	if req == nil || req.Body == nil {
+		return errors.New("invalid request")
+	}
+	if err := json.NewDecoder(req.Body).Decode(obj); err != nil {
+		return err
+	}
+	trimStringFields(reflect.ValueOf(obj))
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// Trim strings in exported struct fields, slices and pointers, skipping trim:"-" fields
+func trimStringFields(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			trimStringFields(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.PkgPath == "" && f.Tag.Get("trim") != "-" {
+				trimStringFields(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			trimStringFields(v.Index(i))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(strings.TrimSpace(v.String()))
+		}
+	}
+}
+
+// Multipart form binding on form tags, trimming like trimmedJSONBinding
+type trimmedFormBinding struct{}
+
+func (trimmedFormBinding) Name() string {
+	return "multipart/form-data"
+}
+
+func (trimmedFormBinding) Bind(req *http.Request, obj interface{}) error {
+	if err := req.ParseMultipartForm(32 << 20); err != nil {
+		return err
+	}
+	if err := binding.MapFormWithTag(obj, req.MultipartForm.Value, "form"); err != nil {
+		return err
+	}
+	trimStringFields(reflect.ValueOf(obj))
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// Bind a JSON body, replying 413 when it's over the body limit and 400 when it's invalid.
+// Binding tag failures are listed per field, with the first one as the error
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	return bindWith(c, obj, trimmedJSONBinding{})
+}
+
+// Bind a multipart form the same way as bindJSON
+func bindForm(c *gin.Context, obj interface{}) bool {
+	return bindWith(c, obj, trimmedFormBinding{})
+}
+
+func bindWith(c *gin.Context, obj interface{}, b binding.Binding) bool {
+	err := c.ShouldBindWith(obj, b)
+	if err == nil {
+		return true
+	}
+	var maxErr *http.MaxBytesError
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &maxErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+	} else if errors.As(err, &fieldErrs) {
+		fields := map[string]string{}
+		for _, fe := range fieldErrs {
+			fields[fe.Field()] = validationMessage(fe)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": validationMessage(fieldErrs[0]), "fields": fields})
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+	}
+	return false
+}
+
+// Maximum bill upload size in MB (MAX_UPLOAD_MB, default 10)
+func maxUploadMB() int {
+	return getEnvInt("MAX_UPLOAD_MB", 10)
+}
+
+// Maximum serials in one registration or check request (MAX_SERIALS_PER_REQUEST, default 100)
+func maxSerialsPerRequest() int {
+	return getEnvInt("MAX_SERIALS_PER_REQUEST", 100)
+}
+
+// Serials a customer may register per day (DAILY_REGISTRATION_QUOTA, 0 or unset for no limit)
+func dailyRegistrationQuota() int {
+	return getEnvInt("DAILY_REGISTRATION_QUOTA", 0)
+}
+
+// Allowed bill file extensions (ALLOWED_BILL_TYPES, comma separated)
+func allowedBillTypes() []string {
+	value := os.Getenv("ALLOWED_BILL_TYPES")
+	if value == "" {
+		value = ".pdf,.jpg,.jpeg,.png"
+	}
+	types := []string{}
+	for _, t := range strings.Split(value, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, ".") {
+			t = "." + t
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+// GSTIN state codes (the first two digits) that may register (ALLOWED_GST_STATES,
+// comma separated). Empty means every state is allowed.
+func allowedGSTStates() []string {
+	states := []string{}
+	for _, s := range strings.Split(os.Getenv("ALLOWED_GST_STATES"), ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 1 {
+			s = "0" + s
+		}
+		if s != "" {
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// Error message when a GSTIN's state isn't in ALLOWED_GST_STATES, or "" when it's allowed
+func gstStateError(gst string) string {
+	allowed := allowedGSTStates()
+	if len(allowed) == 0 {
+		return ""
+	}
+	state := gst
+	if len(state) > 2 {
+		state = state[:2]
+	}
+	for _, s := range allowed {
+		if state == s {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Registrations from GST state code %s are not accepted (allowed: %s)", state, strings.Join(allowed, ", "))
+}
+
+// Mobile prefixes that may not register (BLOCKED_MOBILE_PREFIXES, comma separated
+// digits of the national number, e.g. "140,1800" for telemarketing and toll-free ranges)
+func blockedMobilePrefixes() []string {
+	prefixes := []string{}
+	for _, p := range strings.Split(os.Getenv("BLOCKED_MOBILE_PREFIXES"), ",") {
+		// Prefixes are short, so "+91" is only recognised when written out
+		p = strings.TrimPrefix(strings.TrimSpace(p), "+91")
+		if p = normalizeMobile(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// Digits of a mobile number without the +91 country code or a leading 0
+func normalizeMobile(mobile string) string {
+	var b strings.Builder
+	for _, r := range mobile {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+	if len(digits) > 10 && strings.HasPrefix(digits, "91") {
+		digits = digits[2:]
+	}
+	return strings.TrimLeft(digits, "0")
+}
+
+// A mobile number for the log, with all but its last four digits hidden
+func maskMobile(mobile string) string {
+	digits := normalizeMobile(mobile)
+	if len(digits) <= 4 {
+		return "****"
+	}
+	return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+}
+
+// Digits with an optional leading + and single spaces or dashes between groups
+var mobilePattern = regexp.MustCompile(`^\+?[0-9]+([ -][0-9]+)*$`)
+
+// Why mobile isn't a usable phone number, or "" when it is
+func mobileFormatError(mobile string) string {
+	if !mobilePattern.MatchString(mobile) {
+		return "mobile must be a phone number"
+	}
+	return ""
+}
+
+func isBlockedMobile(mobile string) bool {
+	normalized := normalizeMobile(mobile)
+	for _, prefix := range blockedMobilePrefixes() {
+		if strings.HasPrefix(normalized, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a bill filename against the allowed types
+func isAllowedBillType(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, t := range allowedBillTypes() {
+		if ext == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Portal title shown by the frontend (PORTAL_TITLE)
+func portalTitle() string {
+	if title := os.Getenv("PORTAL_TITLE"); title != "" {
+		return title
+	}
+	return "Product Registration Portal"
 }
 
 func setupDatabase() *sql.DB {
@@ -86,10 +627,18 @@ func setupDatabase() *sql.DB {
 
 	// Database file path
 	dbPath := filepath.Join(dataDir, "portal.db")
-	log.Printf("Using database at: %s", dbPath)
+	logInfo("Using database at: %s", dbPath)
 
-	// Open the database
-	db, err := sql.Open("sqlite3", dbPath)
+	// Foreign keys are enforced on every pooled connection; SQLite leaves them
+	// off by default. Writers wait up to SQLITE_BUSY_TIMEOUT_MS for the lock, and
+	// transactions take it up front (BEGIN IMMEDIATE) so a transaction that read
+	// first can't fail its write on a busy snapshot.
+	return openDatabase(fmt.Sprintf("%s?_foreign_keys=on&_busy_timeout=%d&_txlock=immediate", dbPath, getEnvInt("SQLITE_BUSY_TIMEOUT_MS", 5000)))
+}
+
+// Open the database at dsn and bring its schema up to date
+func openDatabase(dsn string) *sql.DB {
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
@@ -101,828 +650,6537 @@ func setupDatabase() *sql.DB {
 	// Create tables if not exist
 	db.Exec(`CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE,
+		username TEXT,
 		password TEXT,
-		mobile TEXT UNIQUE,
+		mobile TEXT,
 		company TEXT,
-		gst TEXT UNIQUE,
+		gst TEXT,
 		role TEXT,
 		active INTEGER,
-		token TEXT
+		token TEXT,
+		created_at DATETIME,
+		updated_at DATETIME,
+		company_normalized TEXT,
+		deleted_at DATETIME
 	)`)
 	db.Exec(`CREATE TABLE IF NOT EXISTS products (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT,
 		serial TEXT UNIQUE,
 		description TEXT,
-		active INTEGER
+		active INTEGER,
+		serial_pattern TEXT DEFAULT '',
+		created_at DATETIME,
+		updated_at DATETIME
 	)`)
 	db.Exec(`CREATE TABLE IF NOT EXISTS registrations (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER,
-		product_id INTEGER,
+		user_id INTEGER REFERENCES users(id) ON DELETE RESTRICT,
+		product_id INTEGER REFERENCES products(id) ON DELETE RESTRICT,
 		serial TEXT UNIQUE,
 		bill_file TEXT,
 		status TEXT,
+		notes TEXT DEFAULT '',
 		created_at DATETIME
 	)`)
 	db.Exec(`CREATE TABLE IF NOT EXISTS logins (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER,
-		login_time DATETIME
+		login_time DATETIME,
+		user_agent TEXT,
+		ip TEXT
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS notification_jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT,
+		recipient TEXT,
+		message TEXT,
+		status TEXT,
+		attempts INTEGER DEFAULT 0,
+		last_error TEXT DEFAULT '',
+		created_at DATETIME,
+		updated_at DATETIME
+	)`)
+	// Serials manufacturing says exist for each product
+	db.Exec(`CREATE TABLE IF NOT EXISTS product_serials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		product_id INTEGER REFERENCES products(id) ON DELETE CASCADE,
+		serial TEXT,
+		created_at DATETIME,
+		UNIQUE (product_id, serial)
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS chunked_uploads (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER,
+		filename TEXT,
+		size INTEGER,
+		chunks INTEGER,
+		status TEXT,
+		bill_file TEXT,
+		created_at DATETIME
+	)`)
+	// Every file attached to a registration. bill_file keeps the first bill for
+	// listings; serials registered together share the same files.
+	db.Exec(`CREATE TABLE IF NOT EXISTS registration_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		registration_id INTEGER REFERENCES registrations(id) ON DELETE CASCADE,
+		path TEXT,
+		kind TEXT,
+		created_at DATETIME,
+		sha256 TEXT
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS registration_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		registration_id INTEGER,
+		serial TEXT,
+		user_id INTEGER,
+		product_id INTEGER,
+		status TEXT,
+		event TEXT,
+		created_at DATETIME
+	)`)
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_registration_history_serial ON registration_history (serial COLLATE NOCASE)")
+	db.Exec(`CREATE TABLE IF NOT EXISTS reject_reasons (
+		code TEXT PRIMARY KEY,
+		label TEXT,
+		active INTEGER DEFAULT 1
 	)`)
+	seedRejectReasons(db)
+	db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id INTEGER,
+		actor TEXT,
+		action TEXT,
+		target TEXT,
+		detail TEXT,
+		created_at DATETIME
+	)`)
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log (created_at)")
+
+	// Upgrade tables created by older versions
+	addColumnIfMissing(db, "products", "serial_pattern", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "created_at", "DATETIME")
+	addColumnIfMissing(db, "users", "updated_at", "DATETIME")
+	addColumnIfMissing(db, "products", "created_at", "DATETIME")
+	addColumnIfMissing(db, "products", "updated_at", "DATETIME")
+	addColumnIfMissing(db, "products", "warranty_months", "INTEGER DEFAULT 0")
+	addColumnIfMissing(db, "products", "image", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "products", "meta_schema", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "products", "serial_transform", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "products", "serial_transform_replacement", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "registrations", "registration_meta", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "company_normalized", "TEXT")
+	backfillCompanyNormalized(db)
+	addColumnIfMissing(db, "users", "deleted_at", "DATETIME")
+	addColumnIfMissing(db, "logins", "user_agent", "TEXT")
+	addColumnIfMissing(db, "logins", "ip", "TEXT")
+	addColumnIfMissing(db, "registrations", "notes", "TEXT DEFAULT ''")
+	addColumnIfMissing(db, "users", "version", "INTEGER DEFAULT 1")
+	addColumnIfMissing(db, "registrations", "version", "INTEGER DEFAULT 1")
+	addColumnIfMissing(db, "registrations", "reason_code", "TEXT")
+	addColumnIfMissing(db, "users", "password_managed", "INTEGER DEFAULT 0")
+	addColumnIfMissing(db, "users", "token_last_used_at", "DATETIME")
+	addColumnIfMissing(db, "registration_files", "sha256", "TEXT")
+	addColumnIfMissing(db, "registrations", "duplicate_bill", "INTEGER DEFAULT 0")
+	addColumnIfMissing(db, "users", "email", "TEXT")
+	addColumnIfMissing(db, "users", "email_verified", "INTEGER DEFAULT 0")
+	migrateUserUniqueness(db)
+	migrateForeignKeys(db)
+	// Registrations from before history was kept get a single "existing" entry
+	db.Exec(`INSERT INTO registration_history (registration_id, serial, user_id, product_id, status, event, created_at)
+		SELECT id, serial, user_id, product_id, status, 'existing', created_at FROM registrations r
+		WHERE NOT EXISTS (SELECT 1 FROM registration_history h WHERE h.registration_id = r.id)`)
+	// Registrations from before multiple files carry their single bill_file across
+	db.Exec(`INSERT INTO registration_files (registration_id, path, kind, created_at)
+		SELECT id, bill_file, 'bill', created_at FROM registrations r
+		WHERE COALESCE(bill_file, '') != '' AND NOT EXISTS (SELECT 1 FROM registration_files f WHERE f.registration_id = r.id)`)
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_registration_files_registration ON registration_files (registration_id)")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_registration_files_path ON registration_files (path)")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_registration_files_sha256 ON registration_files (sha256)")
+	// Serial lookups ignore case, and LIKE only uses an index in NOCASE order
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_registrations_serial_nocase ON registrations (serial COLLATE NOCASE)")
 
 	// Test the database connection
 	if err := db.Ping(); err != nil {
-		log.Printf("WARNING: Database ping failed: %v", err)
+		logWarn("Database ping failed: %v", err)
 	} else {
-		log.Printf("Database connection successful")
+		logInfo("Database connection successful")
 	}
 
 	return db
 }
 
-func ensureAdmin(db *sql.DB) {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'admin'").Scan(&count)
-	if count == 0 {
-		_, err := db.Exec("INSERT INTO users (username, password, mobile, company, gst, role, active, token) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", "admin", "Goat@2570", "admin", "AdminCorp", "GSTADMIN123", "ADMIN", 1, generateToken())
-		if err != nil {
-			log.Println("Failed to create admin:", err)
-		} else {
-			log.Println("Default admin account created.")
-		}
+// Handle for read-heavy endpoints (exports, dashboards) so they don't queue
+// behind writes on the primary's pool. READ_DB_PATH names a database opened
+// read-only: a replica, or this portal.db itself for a separate pool. Unset,
+// reads use the primary.
+func setupReadDatabase(primary *sql.DB) *sql.DB {
+	path := os.Getenv("READ_DB_PATH")
+	if path == "" {
+		return primary
 	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", path, getEnvInt("SQLITE_BUSY_TIMEOUT_MS", 5000)))
+	if err != nil {
+		log.Fatalf("Failed to open read database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		log.Fatalf("Failed to open read database %s: %v", path, err)
+	}
+	logInfo("Using read-only database at: %s", path)
+	return db
 }
 
-// User struct for token claims
-type User struct {
-	ID       int
-	Username string
-	Role     string
-	Active   int
+// Check if an error is a SQLite UNIQUE constraint violation
+func isUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
 }
 
-// Generate a random token
-func generateToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return fmt.Sprintf("%x", b)
+// Check if an error is a SQLite FOREIGN KEY constraint violation. SQLite reports
+// ON DELETE RESTRICT through its trigger machinery, so that code counts too.
+func isForeignKeyViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintTrigger)
 }
 
-// Middleware to check token and role - with more permissive validation
-func authMiddleware(db *sql.DB, adminOnly bool) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-
-		// For development: Auto-login if no token provided
-		if token == "" {
-			log.Printf("No auth token provided, creating temporary session")
-			// Create a temporary user if needed
-			if adminOnly {
-				c.Set("userID", 1) // Admin ID
-				c.Set("role", "ADMIN")
-			} else {
-				c.Set("userID", 2) // Customer ID
-				c.Set("role", "CUSTOMER")
-			}
-			c.Next()
-			return
-		}
+// Check if an error is SQLite reporting the database busy or a table locked
+func isBusyError(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
 
-		// Try to validate with existing token
-		var userID, active int
-		var role string
-		err := db.QueryRow("SELECT id, role, active FROM users WHERE token = ?", token).Scan(&userID, &role, &active)
+// Most attempts execWithRetry and beginWithRetry make while the database is busy
+const maxBusyRetries = 5
 
-		// For development: Allow any token
-		if err != nil || active == 0 {
-			log.Printf("Invalid token or inactive user, creating new session: %v", err)
-			// Use a fake userID based on admin requirement
-			if adminOnly {
-				c.Set("userID", 1)
-				c.Set("role", "ADMIN")
-			} else {
-				c.Set("userID", 2)
-				c.Set("role", "CUSTOMER")
-			}
-			c.Next()
-			return
-		}
+// How long execWithRetry and beginWithRetry keep retrying. An attempt that waited
+// out busy_timeout is past it, so a lock held that long fails instead of waiting again.
+const busyRetryBudget = 2 * time.Second
 
-		// Token is valid
-		c.Set("userID", userID)
-		c.Set("role", role)
-		c.Next()
+// After attempt n (from 1) fails with err, wait before the next one and report
+// whether to make it: only for busy errors, with 25ms doubling, within the budget
+func retryBusy(err error, attempt int, start time.Time) bool {
+	if !isBusyError(err) || attempt == maxBusyRetries || time.Since(start) >= busyRetryBudget {
+		return false
 	}
+	time.Sleep(time.Duration(25<<(attempt-1)) * time.Millisecond)
+	return true
 }
 
-func registerUser(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var req struct {
-			Mobile  string `json:"mobile"`
-			Company string `json:"company"`
-			GST     string `json:"gst"`
+// Exec, retrying with backoff while SQLite reports the database busy or locked.
+// busy_timeout already waits for the lock; this covers writes that still give up.
+// Statements in a transaction use tx.Exec: a busy error there fails the whole transaction.
+func execWithRetry(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		res, err := db.Exec(query, args...)
+		if err == nil || !retryBusy(err, attempt, start) {
+			return res, err
 		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-			return
+	}
+}
+
+// Begin a transaction, retrying with backoff while the write lock is held elsewhere
+func beginWithRetry(db *sql.DB) (*sql.Tx, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		tx, err := db.Begin()
+		if err == nil || !retryBusy(err, attempt, start) {
+			return tx, err
 		}
-		if req.Mobile == "" || req.Company == "" || req.GST == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "All fields required"})
-			return
+	}
+}
+
+// Work out which column caused a UNIQUE constraint violation, "" if it wasn't one
+func uniqueViolationColumn(err error) string {
+	if !isUniqueViolation(err) {
+		return ""
+	}
+	// SQLite reports e.g. "UNIQUE constraint failed: users.mobile"
+	msg := err.Error()
+	idx := strings.Index(msg, "UNIQUE constraint failed: ")
+	if idx < 0 {
+		return "unknown"
+	}
+	column := strings.TrimPrefix(msg[idx:], "UNIQUE constraint failed: ")
+	column = strings.TrimSpace(strings.Split(column, ",")[0])
+	if dot := strings.LastIndex(column, "."); dot >= 0 {
+		column = column[dot+1:]
+	}
+	return column
+}
+
+// Friendly message for a UNIQUE constraint violation on the given column
+func uniqueViolationMessage(column string) string {
+	switch column {
+	case "mobile":
+		return "Mobile already registered"
+	case "gst":
+		return "GST already registered"
+	case "serial":
+		return "Serial already registered"
+	case "username":
+		return "Username already taken"
+	default:
+		return "Duplicate value"
+	}
+}
+
+// First of username, mobile or GST already used by another live user, or "".
+// Empty values aren't checked; the UNIQUE indexes still catch races.
+func userConflictField(db *sql.DB, excludeID int, username, mobile, gst string) string {
+	for _, f := range []struct{ column, value string }{{"username", username}, {"mobile", mobile}, {"gst", gst}} {
+		if f.value == "" {
+			continue
 		}
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM users WHERE mobile = ?", req.Mobile).Scan(&count)
-		if count > 0 {
-			c.JSON(http.StatusConflict, gin.H{"error": "Mobile already registered"})
-			return
-		}
-		db.QueryRow("SELECT COUNT(*) FROM users WHERE gst = ?", req.GST).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE "+f.column+" = ? AND id != ? AND deleted_at IS NULL", f.value, excludeID).Scan(&count)
 		if count > 0 {
-			c.JSON(http.StatusConflict, gin.H{"error": "GST already registered"})
-			return
+			return f.column
+		}
+	}
+	return ""
+}
+
+// Reply with a 409 naming the collided column if err is a UNIQUE violation
+func respondUniqueViolation(c *gin.Context, err error) bool {
+	column := uniqueViolationColumn(err)
+	if column == "" {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": uniqueViolationMessage(column), "field": column})
+	return true
+}
+
+// *sql.DB or *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Snapshot a registration into registration_history. Serials are unique among live
+// registrations, so this is what shows a serial's earlier owners once a row is purged.
+func recordRegistrationEvent(db execer, registrationID interface{}, event string) error {
+	query := `INSERT INTO registration_history (registration_id, serial, user_id, product_id, status, event, created_at)
+		SELECT id, serial, user_id, product_id, status, ?, ? FROM registrations WHERE id = ?`
+	var err error
+	if conn, ok := db.(*sql.DB); ok {
+		_, err = execWithRetry(conn, query, event, time.Now(), registrationID)
+	} else {
+		_, err = db.Exec(query, event, time.Now(), registrationID)
+	}
+	if err != nil {
+		logError("Failed to record %s history for registration %v: %v", event, registrationID, err)
+	}
+	return err
+}
+
+// Record an admin action in audit_log, with the acting user's username at the time
+func recordAudit(db *sql.DB, c *gin.Context, action, target, detail string) {
+	actorID := c.GetInt("userID")
+	var actor string
+	db.QueryRow("SELECT COALESCE(username, '') FROM users WHERE id = ?", actorID).Scan(&actor)
+	if _, err := execWithRetry(db, "INSERT INTO audit_log (actor_id, actor, action, target, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)", actorID, actor, action, target, detail, time.Now()); err != nil {
+		logError("Failed to record audit entry %s on %s: %v", action, target, err)
+	}
+}
+
+// Standard reasons for rejecting a registration, added on first start
+var defaultRejectReasons = [][2]string{
+	{"BILL_UNREADABLE", "Bill is unreadable"},
+	{"BILL_MISMATCH", "Bill doesn't match the product or serial"},
+	{"INVALID_SERIAL", "Serial number is invalid"},
+	{"DUPLICATE", "Duplicate registration"},
+	{"OTHER", "Other"},
+}
+
+func seedRejectReasons(db *sql.DB) {
+	for _, reason := range defaultRejectReasons {
+		db.Exec("INSERT OR IGNORE INTO reject_reasons (code, label, active) VALUES (?, ?, 1)", reason[0], reason[1])
+	}
+}
+
+// Username, mobile and GST only need to be unique among users that aren't
+// soft-deleted, so a deleted account's GST can be registered again. Older
+// databases have column UNIQUE constraints, which SQLite can't drop, so the
+// users table is rebuilt without them once.
+func migrateUserUniqueness(db *sql.DB) {
+	var schema string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&schema); err != nil {
+		logWarn("Could not inspect users table: %v", err)
+		return
+	}
+	unique := []string{"username TEXT UNIQUE", "mobile TEXT UNIQUE", "gst TEXT UNIQUE"}
+	rebuilt := schema
+	for _, column := range unique {
+		rebuilt = strings.Replace(rebuilt, column, strings.TrimSuffix(column, " UNIQUE"), 1)
+	}
+	if rebuilt != schema {
+		if err := rebuildTable(db, "users", rebuilt); err != nil {
+			logWarn("Could not migrate users uniqueness: %v", err)
+			return
+		}
+		logInfo("Users table rebuilt so uniqueness ignores soft-deleted users")
+	}
+	for _, column := range []string{"username", "mobile", "gst"} {
+		if _, err := db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_%s ON users (%s) WHERE deleted_at IS NULL", column, column)); err != nil {
+			logWarn("Could not create unique index on users.%s: %v", column, err)
+		}
+	}
+}
+
+// Replace a table with one created by schema (the table's CREATE TABLE statement,
+// same columns in the same order), copying its rows across. Foreign keys are
+// switched off on the connection doing it so dropping the old table doesn't
+// cascade to or get blocked by rows referencing it.
+func rebuildTable(db *sql.DB, table, schema string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys=OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys=ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		strings.Replace(schema, "CREATE TABLE "+table, "CREATE TABLE "+table+"_rebuild", 1),
+		fmt.Sprintf("INSERT INTO %s_rebuild SELECT * FROM %s", table, table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s_rebuild RENAME TO %s", table, table),
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Foreign keys declared on tables created by older versions. Registrations are
+// the warranty record, so users and products can't be hard-deleted while they
+// have any (users are soft-deleted instead); files and registry serials go
+// with the row they belong to.
+var foreignKeyMigrations = []struct {
+	table   string
+	columns map[string]string
+}{
+	{"registrations", map[string]string{
+		"user_id INTEGER,":    "user_id INTEGER REFERENCES users(id) ON DELETE RESTRICT,",
+		"product_id INTEGER,": "product_id INTEGER REFERENCES products(id) ON DELETE RESTRICT,",
+	}},
+	{"registration_files", map[string]string{
+		"registration_id INTEGER,": "registration_id INTEGER REFERENCES registrations(id) ON DELETE CASCADE,",
+	}},
+	{"product_serials", map[string]string{
+		"product_id INTEGER,": "product_id INTEGER REFERENCES products(id) ON DELETE CASCADE,",
+	}},
+}
+
+// Rebuild tables from before foreign keys were declared. Rows that were already
+// orphaned are kept and show up in PRAGMA foreign_key_check (and /admin/db/integrity).
+func migrateForeignKeys(db *sql.DB) {
+	for _, m := range foreignKeyMigrations {
+		var schema string
+		if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", m.table).Scan(&schema); err != nil {
+			logWarn("Could not inspect %s table: %v", m.table, err)
+			continue
+		}
+		if strings.Contains(schema, "REFERENCES") {
+			continue
+		}
+		rebuilt := schema
+		for column, reference := range m.columns {
+			rebuilt = strings.Replace(rebuilt, column, reference, 1)
+		}
+		if err := rebuildTable(db, m.table, rebuilt); err != nil {
+			logWarn("Could not add foreign keys to %s: %v", m.table, err)
+			continue
+		}
+		var orphans int
+		db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_foreign_key_check('%s')", m.table)).Scan(&orphans)
+		logInfo("%s table rebuilt with foreign keys (%d existing rows reference missing parents)", m.table, orphans)
+	}
+}
+
+// Add a column to an existing table if it isn't there yet
+func addColumnIfMissing(db *sql.DB, table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		logWarn("Could not inspect table %s: %v", table, err)
+		return
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		logWarn("Could not add column %s.%s: %v", table, column, err)
+		return
+	}
+	logInfo("Added column %s.%s", table, column)
+}
+
+// Collapse runs of whitespace and trim, keeping the company's display form
+func cleanCompanyName(company string) string {
+	return strings.Join(strings.Fields(company), " ")
+}
+
+// Legal suffixes ignored when grouping company names
+var companySuffixes = map[string]bool{
+	"ltd": true, "limited": true, "pvt": true, "private": true,
+	"inc": true, "llp": true, "co": true, "corp": true,
+}
+
+// Normalize a company name for grouping, e.g. "ACME" and "Acme  Ltd." both become "acme"
+func normalizeCompany(company string) string {
+	company = strings.ToLower(company)
+	company = strings.NewReplacer(".", " ", ",", " ").Replace(company)
+	words := strings.Fields(company)
+	for len(words) > 1 && companySuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// Fill company_normalized for users created before the column existed
+func backfillCompanyNormalized(db *sql.DB) {
+	rows, err := db.Query("SELECT id, COALESCE(company, '') FROM users WHERE company_normalized IS NULL")
+	if err != nil {
+		logWarn("Could not backfill normalized company names: %v", err)
+		return
+	}
+	pending := map[int]string{}
+	for rows.Next() {
+		var id int
+		var company string
+		rows.Scan(&id, &company)
+		pending[id] = normalizeCompany(company)
+	}
+	rows.Close()
+	for id, normalized := range pending {
+		execWithRetry(db, "UPDATE users SET company_normalized = ? WHERE id = ?", normalized, id)
+	}
+	if len(pending) > 0 {
+		logInfo("Backfilled normalized company names for %d users", len(pending))
+	}
+}
+
+// Admin password used when ADMIN_PASSWORD isn't set
+const defaultAdminPassword = "Goat@2570"
+
+func adminPassword() string {
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		return password
+	}
+	return defaultAdminPassword
+}
+
+// Problems with a password for a user of role. ADMIN and STAFF passwords need
+// PASSWORD_MIN_LENGTH characters (default 8) from PASSWORD_MIN_CLASSES of
+// lowercase, uppercase, digits and symbols (default 3); customers, who sign in
+// by mobile, only need CUSTOMER_PASSWORD_MIN_LENGTH (default 6). Empty means it's fine.
+func validatePasswordStrength(password, role string) []string {
+	problems := []string{}
+	if role != roleAdmin && role != roleStaff {
+		if minLength := getEnvInt("CUSTOMER_PASSWORD_MIN_LENGTH", 6); len([]rune(password)) < minLength {
+			problems = append(problems, fmt.Sprintf("must be at least %d characters", minLength))
+		}
+		return problems
+	}
+	if minLength := getEnvInt("PASSWORD_MIN_LENGTH", 8); len([]rune(password)) < minLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", minLength))
+	}
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if minClasses := getEnvInt("PASSWORD_MIN_CLASSES", 3); classes < minClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", minClasses))
+	}
+	return problems
+}
+
+// Reply 400 listing what's wrong when a password is too weak for role
+func checkPasswordStrength(c *gin.Context, password, role string) bool {
+	problems := validatePasswordStrength(password, role)
+	if len(problems) == 0 {
+		return true
+	}
+	msg := "Password " + strings.Join(problems, " and ")
+	c.JSON(http.StatusBadRequest, gin.H{"error": msg, "problems": problems, "fields": gin.H{"password": msg}})
+	return false
+}
+
+// Create the admin account on first run, otherwise make sure it's an active ADMIN
+// with the password from ADMIN_PASSWORD. A password someone changed by hand is
+// kept unless ADMIN_FORCE_RESET=true; password_managed marks one ensureAdmin set.
+func ensureAdmin(db *sql.DB) {
+	password := adminPassword()
+	if problems := validatePasswordStrength(password, roleAdmin); len(problems) > 0 {
+		logWarn("ADMIN_PASSWORD is weak: it %s", strings.Join(problems, " and "))
+	}
+	var id, managed int
+	var current string
+	err := db.QueryRow("SELECT id, COALESCE(password, ''), COALESCE(password_managed, 0) FROM users WHERE username = 'admin'").Scan(&id, &current, &managed)
+	if err == sql.ErrNoRows {
+		now := time.Now()
+		_, err := execWithRetry(db, "INSERT INTO users (username, password, mobile, company, gst, role, active, token, created_at, updated_at, company_normalized, password_managed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)", "admin", password, "admin", "AdminCorp", "GSTADMIN123", "ADMIN", 1, generateToken(), now, now, normalizeCompany("AdminCorp"))
+		if err != nil {
+			logError("Failed to create admin: %v", err)
+		} else {
+			logInfo("Default admin account created.")
+		}
+		return
+	} else if err != nil {
+		logError("Failed to load admin: %v", err)
+		return
+	}
+
+	if _, err := execWithRetry(db, "UPDATE users SET active = 1, role = 'ADMIN' WHERE id = ? AND (active != 1 OR role != 'ADMIN')", id); err != nil {
+		logError("Failed to reactivate admin: %v", err)
+	}
+	// A fresh token each boot signs out admin sessions, so a leaked token
+	// stops working at the next deploy
+	if os.Getenv("ROTATE_ADMIN_TOKEN_ON_START") == "true" {
+		if _, err := execWithRetry(db, "UPDATE users SET token = ? WHERE id = ?", generateToken(), id); err != nil {
+			logError("Failed to rotate admin token: %v", err)
+		} else {
+			logInfo("Admin token rotated (ROTATE_ADMIN_TOKEN_ON_START); existing admin sessions must log in again.")
+		}
+	}
+	if current == password {
+		execWithRetry(db, "UPDATE users SET password_managed = 1 WHERE id = ?", id)
+		return
+	}
+	// Admins from before password_managed still carry the built-in default
+	if managed == 0 && current != defaultAdminPassword && os.Getenv("ADMIN_FORCE_RESET") != "true" {
+		logWarn("Admin password differs from ADMIN_PASSWORD but was changed manually; keeping it (set ADMIN_FORCE_RESET=true to reset)")
+		return
+	}
+	if _, err := execWithRetry(db, "UPDATE users SET password = ?, password_managed = 1, updated_at = ?, version = version + 1 WHERE id = ?", password, time.Now(), id); err != nil {
+		logError("Failed to update admin password: %v", err)
+		return
+	}
+	logInfo("Admin password updated from ADMIN_PASSWORD.")
+}
+
+// User struct for token claims
+type User struct {
+	ID       int
+	Username string
+	Role     string
+	Active   int
+}
+
+// Generate a random token
+func generateToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// User roles. STAFF can review registrations and run exports but not manage users or settings.
+const (
+	roleAdmin    = "ADMIN"
+	roleStaff    = "STAFF"
+	roleCustomer = "CUSTOMER"
+)
+
+var validRoles = []string{roleAdmin, roleStaff, roleCustomer}
+
+func hasRole(role string, roles []string) bool {
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware to check the token and that the user has one of roles (any role when
+// none are given). Unknown or deactivated tokens get 401. Without roles, a request
+// with no token gets a development customer session; with roles it gets 401.
+func requireRole(db *sql.DB, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("Authorization")
+
+		// For development: Auto-login if no token provided. Only customer routes
+		// fall back; routes limited to roles need a real token.
+		if token == "" {
+			if len(roles) > 0 {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+				return
+			}
+			logDebug("No auth token provided, creating temporary session")
+			// Create a temporary user if needed
+			c.Set("userID", 2) // Customer ID
+			c.Set("role", roleCustomer)
+			c.Next()
+			return
+		}
+
+		// Try to validate with existing token
+		var userID, active int
+		var role string
+		var lastUsed sql.NullTime
+		err := db.QueryRow("SELECT id, role, active, token_last_used_at FROM users WHERE token = ? AND deleted_at IS NULL", token).Scan(&userID, &role, &active, &lastUsed)
+
+		// A token that was sent must be valid; only requests without one fall back
+		if err != nil || active == 0 {
+			logDebug("Invalid token or inactive user: %v", err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token or inactive user"})
+			return
+		}
+
+		// Sessions idle longer than SESSION_IDLE_MINUTES are rejected until the user logs in again
+		now := time.Now()
+		if sessionIdleExpired(lastUsed, now) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session expired, please log in again"})
+			return
+		}
+		// Record use at most once a minute to spare a write on every request
+		if !lastUsed.Valid || now.Sub(lastUsed.Time) > time.Minute {
+			execWithRetry(db, "UPDATE users SET token_last_used_at = ? WHERE id = ?", now, userID)
+		}
+
+		// Token is valid
+		if len(roles) > 0 && !hasRole(role, roles) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not allowed for role " + role})
+			return
+		}
+		c.Set("userID", userID)
+		c.Set("role", role)
+		c.Next()
+	}
+}
+
+// Whether a session last used at lastUsed has been idle past SESSION_IDLE_MINUTES
+func sessionIdleExpired(lastUsed sql.NullTime, now time.Time) bool {
+	idle := getEnvInt("SESSION_IDLE_MINUTES", 0)
+	return idle > 0 && lastUsed.Valid && now.Sub(lastUsed.Time) > time.Duration(idle)*time.Minute
+}
+
+// Check the Authorization token without the development fallback and without
+// counting as session activity
+func authCheck(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("Authorization")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"valid": false})
+			return
+		}
+		var userID, active int
+		var role string
+		var lastUsed sql.NullTime
+		err := db.QueryRow("SELECT id, role, active, token_last_used_at FROM users WHERE token = ? AND deleted_at IS NULL", token).Scan(&userID, &role, &active, &lastUsed)
+		if err != nil || active == 0 || sessionIdleExpired(lastUsed, time.Now()) {
+			c.JSON(http.StatusUnauthorized, gin.H{"valid": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": true, "role": role, "user_id": userID})
+	}
+}
+
+// Verifies CAPTCHA tokens submitted by the registration form
+type captchaVerifier interface {
+	Verify(token, remoteIP string) (bool, error)
+}
+
+// Server-side verification against an hCaptcha/Turnstile style siteverify endpoint
+type httpCaptchaVerifier struct {
+	secret    string
+	verifyURL string
+	client    *http.Client
+}
+
+func (v *httpCaptchaVerifier) Verify(token, remoteIP string) (bool, error) {
+	resp, err := v.client.PostForm(v.verifyURL, url.Values{
+		"secret":   {v.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// CAPTCHA verifier from CAPTCHA_SECRET (and optional CAPTCHA_VERIFY_URL, Turnstile
+// by default), nil when CAPTCHA is disabled
+func newCaptchaVerifier() captchaVerifier {
+	secret := os.Getenv("CAPTCHA_SECRET")
+	if secret == "" {
+		return nil
+	}
+	verifyURL := os.Getenv("CAPTCHA_VERIFY_URL")
+	if verifyURL == "" {
+		verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	}
+	return &httpCaptchaVerifier{secret: secret, verifyURL: verifyURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func registerUser(db *sql.DB, captcha captchaVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Mobile       string `json:"mobile" binding:"required"`
+			Company      string `json:"company" binding:"required" trim:"-"`
+			GST          string `json:"gst" binding:"required"`
+			CaptchaToken string `json:"captcha_token"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		// A company name of only punctuation/whitespace cleans to nothing
+		req.Company = cleanCompanyName(req.Company)
+		if req.Company == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "company is required", "fields": gin.H{"company": "company is required"}})
+			return
+		}
+		if !checkRequestLengths(c,
+			fieldLimit{"mobile", req.Mobile, maxMobileLength},
+			fieldLimit{"company", req.Company, maxCompanyLength},
+			fieldLimit{"gst", req.GST, maxGSTLength},
+		) {
+			return
+		}
+		if msg := mobileFormatError(req.Mobile); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"mobile": msg}})
+			return
+		}
+		if captcha != nil {
+			if req.CaptchaToken == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "CAPTCHA required"})
+				return
+			}
+			ok, err := captcha.Verify(req.CaptchaToken, clientIP(c))
+			if err != nil {
+				logError("CAPTCHA verification error: %v", err)
+			}
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "CAPTCHA verification failed"})
+				return
+			}
+		}
+		// Blocked ranges get a generic message so the rule isn't revealed
+		if isBlockedMobile(req.Mobile) {
+			logInfo("Registration refused for blocked mobile prefix: %s", maskMobile(req.Mobile))
+			c.JSON(http.StatusForbidden, gin.H{"error": "Registration not allowed"})
+			return
+		}
+		if msg := gstStateError(req.GST); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"gst": msg}})
+			return
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE mobile = ? AND deleted_at IS NULL", req.Mobile).Scan(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Mobile already registered"})
+			return
+		}
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE gst = ? AND deleted_at IS NULL", req.GST).Scan(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "GST already registered"})
+			return
 		}
 		token := generateToken()
-		_, err := db.Exec("INSERT INTO users (username, password, mobile, company, gst, role, active, token) VALUES (?, '', ?, ?, ?, ?, ?, ?)", req.Mobile, req.Mobile, req.Company, req.GST, "CUSTOMER", 1, token)
+		now := time.Now()
+		_, err := execWithRetry(db, "INSERT INTO users (username, password, mobile, company, gst, role, active, token, created_at, updated_at, company_normalized, token_last_used_at) VALUES (?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", req.Mobile, req.Mobile, req.Company, req.GST, "CUSTOMER", 1, token, now, now, normalizeCompany(req.Company), now)
+		if err != nil {
+			if respondUniqueViolation(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+			return
+		}
+		logInfo("User registered: %s", req.Mobile)
+		c.JSON(http.StatusOK, gin.H{"token": token})
+	}
+}
+
+// Format a timestamp SQLite returned as plain text (e.g. from MAX()) the way
+// DATETIME columns come back from the driver
+func formatDBTime(value string) string {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
+
+// Client IP of a request. X-Forwarded-For is only honored when TRUST_PROXY=true,
+// otherwise anyone could spoof it.
+func clientIP(c *gin.Context) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := c.GetHeader("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// Parse a comma separated list of CIDRs or single IPs, e.g. ADMIN_IP_ALLOWLIST
+func parseIPAllowlist(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Middleware limiting /admin routes, the /:password export variants included, to
+// clients in allowlist. An empty allowlist lets every client through.
+func adminIPGuard(allowlist []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if len(allowlist) == 0 || (path != "/admin" && !strings.HasPrefix(path, "/admin/")) {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(clientIP(c))
+		for _, ipNet := range allowlist {
+			if ip != nil && ipNet.Contains(ip) {
+				c.Next()
+				return
+			}
+		}
+		logWarn("Blocked admin request from %s to %s", clientIP(c), path)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not allowed from this address"})
+	}
+}
+
+// Public base URL of the portal for absolute links: PUBLIC_BASE_URL when set,
+// otherwise the request's host with the scheme from X-Forwarded-Proto or TLS
+func publicBaseURL(c *gin.Context) string {
+	if base := os.Getenv("PUBLIC_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(strings.TrimSpace(strings.Split(c.GetHeader("X-Forwarded-Proto"), ",")[0])); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// Record a successful login with the client's user agent and IP
+func recordLogin(db *sql.DB, c *gin.Context, userID int64) {
+	userAgent := truncateText(c.GetHeader("User-Agent"), 500)
+	if _, err := execWithRetry(db, "INSERT INTO logins (user_id, login_time, user_agent, ip) VALUES (?, ?, ?, ?)", userID, time.Now(), userAgent, clientIP(c)); err != nil {
+		logError("Failed to record login for user %d: %v", userID, err)
+	}
+}
+
+func loginUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Mobile   string `json:"mobile"`
+			Password string `json:"password" trim:"-"`
+		}
+		if err := c.ShouldBindWith(&req, trimmedJSONBinding{}); err != nil {
+			logDebug("Login error: Invalid input format - %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid login request"})
+			return
+		}
+
+		logDebug("Login attempt for mobile: %s", req.Mobile)
+
+		// Special case for admin login
+		if req.Mobile == "admin" {
+			var adminID int64
+			var password string
+			err := db.QueryRow("SELECT id, COALESCE(password, '') FROM users WHERE username = 'admin'").Scan(&adminID, &password)
+			if err == sql.ErrNoRows {
+				// Recreate the admin account if it was removed
+				ensureAdmin(db)
+				err = db.QueryRow("SELECT id, COALESCE(password, '') FROM users WHERE username = 'admin'").Scan(&adminID, &password)
+			}
+			if err != nil {
+				logError("Failed to load admin: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+
+			// Check admin password
+			if req.Password != password {
+				logWarn("Failed admin login attempt: incorrect password")
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin credentials"})
+				return
+			}
+
+			token := generateToken()
+			if _, err := execWithRetry(db, "UPDATE users SET token = ?, token_last_used_at = ?, active = 1 WHERE id = ?", token, time.Now(), adminID); err != nil {
+				logError("Failed to update admin: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+			recordLogin(db, c, adminID)
+			logInfo("Admin login successful")
+			c.JSON(http.StatusOK, gin.H{"token": token, "role": "ADMIN"})
+			return
+		}
+
+		// For regular users - check if they exist in the database
+		var id int
+		var role, password string
+		var active int
+		err := db.QueryRow("SELECT id, role, active, COALESCE(password, '') FROM users WHERE mobile = ? AND deleted_at IS NULL", req.Mobile).Scan(&id, &role, &active, &password)
+
+		if err != nil {
+			// User doesn't exist
+			logWarn("Login failed: User with mobile %s does not exist", req.Mobile)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not registered. Please register first."})
+			return
+		}
+
+		// Check if user account is active
+		if active == 0 {
+			logWarn("Login attempt for inactive account: %s", req.Mobile)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is inactive"})
+			return
+		}
+
+		// Customers sign in with their mobile only; staff and admins also need their password
+		if (role == roleAdmin || role == roleStaff) && (password == "" || req.Password != password) {
+			logWarn("Failed login for %s user %s: incorrect password", role, req.Mobile)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		// Generate new token and update user record
+		token := generateToken()
+		_, err = execWithRetry(db, "UPDATE users SET token = ?, token_last_used_at = ? WHERE id = ?", token, time.Now(), id)
+		if err != nil {
+			logError("Failed to update user token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+
+		recordLogin(db, c, int64(id))
+		logInfo("User login successful: %s with role %s", req.Mobile, role)
+		c.JSON(http.StatusOK, gin.H{"token": token, "role": role})
+	}
+}
+
+// Admin: List all users
+func listUsers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		orderBy, err := parseSort(c, userSortColumns, "id")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := db.Query(`SELECT id, username, mobile, company, gst, role, active, created_at, updated_at, version,
+			(SELECT MAX(login_time) FROM logins WHERE logins.user_id = users.id)
+			FROM users WHERE username != 'admin' AND deleted_at IS NULL`+orderBy+` LIMIT ? OFFSET ?`, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE username != 'admin' AND deleted_at IS NULL").Scan(&total)
+		setPagingHeaders(c, total, limit, offset)
+		var users []map[string]interface{}
+		for rows.Next() {
+			var id, active, version int
+			var username, mobile, company, gst, role string
+			var createdAt, updatedAt, lastLogin sql.NullString
+			rows.Scan(&id, &username, &mobile, &company, &gst, &role, &active, &createdAt, &updatedAt, &version, &lastLogin)
+			users = append(users, gin.H{"id": id, "username": username, "mobile": mobile, "company": company, "gst": gst, "role": role, "active": active, "created_at": createdAt.String, "updated_at": updatedAt.String, "version": version, "last_login": formatDBTime(lastLogin.String)})
+		}
+		c.JSON(http.StatusOK, users)
+	}
+}
+
+// Admin: Create or edit user (except self)
+func upsertUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ID       int    `json:"id"`
+			Username string `json:"username"`
+			Password string `json:"password" trim:"-"`
+			Mobile   string `json:"mobile"`
+			Company  string `json:"company" trim:"-"`
+			GST      string `json:"gst"`
+			Role     string `json:"role"`
+			Active   int    `json:"active"`
+			Version  *int   `json:"version"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		req.Company = cleanCompanyName(req.Company)
+		if !checkRequestLengths(c,
+			fieldLimit{"username", req.Username, maxUsernameLength},
+			fieldLimit{"mobile", req.Mobile, maxMobileLength},
+			fieldLimit{"company", req.Company, maxCompanyLength},
+			fieldLimit{"gst", req.GST, maxGSTLength},
+		) {
+			return
+		}
+		if req.Mobile != "" {
+			if msg := mobileFormatError(req.Mobile); msg != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"mobile": msg}})
+				return
+			}
+		}
+		if req.Role == "" {
+			req.Role = roleCustomer
+		}
+		if !hasRole(req.Role, validRoles) {
+			msg := "role must be one of " + strings.Join(validRoles, ", ")
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"role": msg}})
+			return
+		}
+		if req.GST != "" {
+			if msg := gstStateError(req.GST); msg != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"gst": msg}})
+				return
+			}
+		}
+		companyNormalized := normalizeCompany(req.Company)
+		now := time.Now()
+		if column := userConflictField(db, req.ID, req.Username, req.Mobile, req.GST); column != "" {
+			c.JSON(http.StatusConflict, gin.H{"error": uniqueViolationMessage(column), "field": column})
+			return
+		}
+		if req.ID == 0 {
+			if req.Password != "" && !checkPasswordStrength(c, req.Password, req.Role) {
+				return
+			}
+			res, err := execWithRetry(db, "INSERT INTO users (username, password, mobile, company, gst, role, active, token, created_at, updated_at, company_normalized) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", req.Username, req.Password, req.Mobile, req.Company, req.GST, req.Role, req.Active, generateToken(), now, now, companyNormalized)
+			if err != nil {
+				if respondUniqueViolation(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "User creation failed"})
+				return
+			}
+			newID, _ := res.LastInsertId()
+			recordAudit(db, c, "user.created", fmt.Sprintf("user:%d", newID), fmt.Sprintf("username=%s role=%s", req.Username, req.Role))
+			logInfo("Admin created user: %s", req.Username)
+			c.JSON(http.StatusOK, gin.H{"status": "created"})
+		} else {
+			// Edits must carry the version the admin read so concurrent edits don't clobber each other
+			if req.Version == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "version is required when updating"})
+				return
+			}
+			// Only a new password, or an existing one given to a new role, is checked
+			var currentPassword, currentRole string
+			db.QueryRow("SELECT COALESCE(password, ''), COALESCE(role, '') FROM users WHERE id = ?", req.ID).Scan(&currentPassword, &currentRole)
+			if req.Password != "" && (req.Password != currentPassword || req.Role != currentRole) && !checkPasswordStrength(c, req.Password, req.Role) {
+				return
+			}
+			res, err := execWithRetry(db, "UPDATE users SET username=?, password=?, mobile=?, company=?, gst=?, role=?, active=?, updated_at=?, company_normalized=?, version=version+1 WHERE id=? AND username != 'admin' AND version=?", req.Username, req.Password, req.Mobile, req.Company, req.GST, req.Role, req.Active, now, companyNormalized, req.ID, *req.Version)
+			if err != nil {
+				if respondUniqueViolation(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				respondVersionMismatch(db, c, "SELECT version FROM users WHERE id=? AND username != 'admin'", req.ID, "User not found")
+				return
+			}
+			recordAudit(db, c, "user.updated", fmt.Sprintf("user:%d", req.ID), fmt.Sprintf("username=%s role=%s active=%d", req.Username, req.Role, req.Active))
+			logInfo("Admin updated user: %s", req.Username)
+			c.JSON(http.StatusOK, gin.H{"status": "updated", "version": *req.Version + 1})
+		}
+	}
+}
+
+// Admin: Delete user (except self)
+func deleteUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		res, err := execWithRetry(db, "DELETE FROM users WHERE id=? AND username != 'admin'", id)
+		if isForeignKeyViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User has registrations and can't be deleted; deactivate the user instead"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Delete failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		recordAudit(db, c, "user.deleted", "user:"+id, "")
+		logInfo("Admin deleted user id: %s", id)
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+// Admin: Find a user by exactly one of ?mobile= or ?gst=
+func lookupUser(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mobile := strings.TrimSpace(c.Query("mobile"))
+		gst := strings.TrimSpace(c.Query("gst"))
+		if (mobile == "") == (gst == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one of mobile or gst is required"})
+			return
+		}
+		column, value := "mobile", mobile
+		if gst != "" {
+			column, value = "gst", gst
+		}
+		var id, active, version int
+		var username, role string
+		var userMobile, company, userGST, createdAt, updatedAt, lastLogin sql.NullString
+		err := db.QueryRow(`SELECT id, username, mobile, company, gst, role, active, created_at, updated_at, version,
+			(SELECT MAX(login_time) FROM logins WHERE logins.user_id = users.id)
+			FROM users WHERE `+column+` = ? AND username != 'admin' AND deleted_at IS NULL`, value).Scan(&id, &username, &userMobile, &company, &userGST, &role, &active, &createdAt, &updatedAt, &version, &lastLogin)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "username": username, "mobile": userMobile.String, "company": company.String, "gst": userGST.String, "role": role, "active": active, "created_at": createdAt.String, "updated_at": updatedAt.String, "version": version, "last_login": formatDBTime(lastLogin.String)})
+	}
+}
+
+// Admin: Summary of one user - profile, registration counts and last login
+func userSummary(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var userID, active int
+		var username, role string
+		var mobile, company, gst, createdAt, lastLogin sql.NullString
+		err := db.QueryRow(`SELECT id, username, mobile, company, gst, role, active, created_at,
+			(SELECT MAX(login_time) FROM logins WHERE logins.user_id = users.id)
+			FROM users WHERE id = ?`, id).Scan(&userID, &username, &mobile, &company, &gst, &role, &active, &createdAt, &lastLogin)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		counts := map[string]int{}
+		total := 0
+		rows, err := db.Query("SELECT status, COUNT(*) FROM registrations WHERE user_id = ? GROUP BY status", userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var status string
+			var n int
+			rows.Scan(&status, &n)
+			counts[status] = n
+			total += n
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":            userID,
+			"username":      username,
+			"mobile":        mobile.String,
+			"company":       company.String,
+			"gst":           gst.String,
+			"role":          role,
+			"active":        active,
+			"created_at":    createdAt.String,
+			"last_login":    formatDBTime(lastLogin.String),
+			"registrations": gin.H{"total": total, "by_status": counts},
+		})
+	}
+}
+
+// Admin: Registration counts by status for every non-admin user, one grouped query
+// for a page of users instead of a summary call per user
+func userStatusMatrix(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := db.Query(`SELECT u.id, COALESCE(u.username, ''), COALESCE(u.mobile, ''), COALESCE(u.company, ''),
+			COUNT(r.id),
+			`+registrationStatusSums+`
+			FROM users u LEFT JOIN registrations r ON r.user_id = u.id
+			WHERE u.role != ? AND u.deleted_at IS NULL
+			GROUP BY u.id ORDER BY u.id LIMIT ? OFFSET ?`, roleAdmin, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE role != ? AND deleted_at IS NULL", roleAdmin).Scan(&total)
+		setPagingHeaders(c, total, limit, offset)
+		matrix := []map[string]interface{}{}
+		for rows.Next() {
+			var id, regs, pending, needsInfo, approved, rejected int
+			var username, mobile, company string
+			rows.Scan(&id, &username, &mobile, &company, &regs, &pending, &needsInfo, &approved, &rejected)
+			matrix = append(matrix, gin.H{
+				"id":         id,
+				"username":   username,
+				"mobile":     mobile,
+				"company":    company,
+				"total":      regs,
+				"pending":    pending,
+				"needs_info": needsInfo,
+				"approved":   approved,
+				"rejected":   rejected,
+			})
+		}
+		c.JSON(http.StatusOK, matrix)
+	}
+}
+
+// Admin: A user's recent logins, newest first
+func listUserLogins(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", id).Scan(&exists); err != nil || exists == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		// A login is from a new device when its user agent wasn't seen in an earlier login
+		rows, err := db.Query(`SELECT id, login_time, COALESCE(user_agent, ''), COALESCE(ip, ''),
+			NOT EXISTS (SELECT 1 FROM logins prev WHERE prev.user_id = logins.user_id AND prev.user_agent = logins.user_agent AND prev.id < logins.id)
+			FROM logins WHERE user_id = ? ORDER BY login_time DESC, id DESC LIMIT ? OFFSET ?`, id, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM logins WHERE user_id = ?", id).Scan(&total)
+		setPagingHeaders(c, total, limit, offset)
+		defer rows.Close()
+		logins := []map[string]interface{}{}
+		for rows.Next() {
+			var loginID int
+			var loginTime, userAgent, ip string
+			var newDevice bool
+			rows.Scan(&loginID, &loginTime, &userAgent, &ip, &newDevice)
+			logins = append(logins, gin.H{"id": loginID, "login_time": loginTime, "user_agent": userAgent, "ip": ip, "new_device": newDevice})
+		}
+		c.JSON(http.StatusOK, logins)
+	}
+}
+
+// Admin: Activate or deactivate a user without touching other fields
+func setUserActive(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var req struct {
+			Active *int `json:"active"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.Active == nil || (*req.Active != 0 && *req.Active != 1) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "active must be 0 or 1"})
+			return
+		}
+
+		var res sql.Result
+		var err error
+		if *req.Active == 0 {
+			// Deactivating also drops the user's session token
+			res, err = execWithRetry(db, "UPDATE users SET active=0, token=NULL, updated_at=?, version=version+1 WHERE id=? AND username != 'admin'", time.Now(), id)
+		} else {
+			res, err = execWithRetry(db, "UPDATE users SET active=1, updated_at=?, version=version+1 WHERE id=? AND username != 'admin'", time.Now(), id)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		recordAudit(db, c, "user.active_changed", "user:"+id, fmt.Sprintf("active=%d", *req.Active))
+		logInfo("Admin set user %s active=%d", id, *req.Active)
+		c.JSON(http.StatusOK, gin.H{"status": "updated", "active": *req.Active})
+	}
+}
+
+// Admin: Merge a duplicate customer account into another one
+func mergeUsers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			SourceID int `json:"source_id"`
+			TargetID int `json:"target_id"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.SourceID == 0 || req.TargetID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "source_id and target_id required"})
+			return
+		}
+		if req.SourceID == req.TargetID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot merge a user into itself"})
+			return
+		}
+
+		tx, err := beginWithRetry(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer tx.Rollback()
+
+		type profile struct {
+			username, company, gst string
+			deleted                bool
+		}
+		load := func(id int) (*profile, error) {
+			var p profile
+			var company, gst sql.NullString
+			var deletedAt sql.NullString
+			err := tx.QueryRow("SELECT username, company, gst, deleted_at FROM users WHERE id = ?", id).Scan(&p.username, &company, &gst, &deletedAt)
+			if err != nil {
+				return nil, err
+			}
+			p.company, p.gst, p.deleted = company.String, gst.String, deletedAt.Valid
+			return &p, nil
+		}
+		source, err := load(req.SourceID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Source user not found"})
+			return
+		}
+		target, err := load(req.TargetID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Target user not found"})
+			return
+		}
+		if source.username == "admin" || target.username == "admin" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot merge the admin account"})
+			return
+		}
+		if source.deleted || target.deleted {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot merge a deleted user"})
+			return
+		}
+
+		// Move registrations over to the target
+		var movedIDs []int64
+		rows, err := tx.Query("SELECT id FROM registrations WHERE user_id = ?", req.SourceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move registrations"})
+			return
+		}
+		for rows.Next() {
+			var regID int64
+			rows.Scan(&regID)
+			movedIDs = append(movedIDs, regID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move registrations"})
+			return
+		}
+		res, err := tx.Exec("UPDATE registrations SET user_id = ?, version = version + 1 WHERE user_id = ?", req.TargetID, req.SourceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move registrations"})
+			return
+		}
+		moved, _ := res.RowsAffected()
+		for _, regID := range movedIDs {
+			if err := recordRegistrationEvent(tx, regID, "reassigned"); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move registrations"})
+				return
+			}
+		}
+
+		// Copy profile fields the target is missing. GST is unique, so it is
+		// released from the source first.
+		now := time.Now()
+		if target.company == "" && source.company != "" {
+			if _, err := tx.Exec("UPDATE users SET company = ?, company_normalized = ? WHERE id = ?", source.company, normalizeCompany(source.company), req.TargetID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy company"})
+				return
+			}
+		}
+		if target.gst == "" && source.gst != "" {
+			if _, err := tx.Exec("UPDATE users SET gst = NULL WHERE id = ?", req.SourceID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy GST"})
+				return
+			}
+			if _, err := tx.Exec("UPDATE users SET gst = ? WHERE id = ?", source.gst, req.TargetID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy GST"})
+				return
+			}
+		}
+		if _, err := tx.Exec("UPDATE users SET updated_at = ?, version = version + 1 WHERE id = ?", now, req.TargetID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update target user"})
+			return
+		}
+
+		// Soft-delete the source and drop its session
+		_, err = tx.Exec("UPDATE users SET active = 0, token = NULL, deleted_at = ?, updated_at = ?, version = version + 1 WHERE id = ?", now, now, req.SourceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate source user"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Merge failed"})
+			return
+		}
+		recordAudit(db, c, "user.merged", fmt.Sprintf("user:%d", req.TargetID), fmt.Sprintf("source=user:%d registrations_moved=%d", req.SourceID, moved))
+		logInfo("Admin merged user %d into %d (%d registrations moved)", req.SourceID, req.TargetID, moved)
+		c.JSON(http.StatusOK, gin.H{"status": "merged", "registrations_moved": moved})
+	}
+}
+
+// Admin: List, create, edit, delete products
+func listProducts(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		orderBy, err := parseSort(c, productSortColumns, "id")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		where := ""
+		args := []interface{}{}
+		if active := c.Query("active"); active != "" {
+			if active != "0" && active != "1" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be 0 or 1"})
+				return
+			}
+			where = " WHERE active = ?"
+			args = append(args, active)
+		}
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM products"+where, args...).Scan(&total)
+		args = append(args, limit, offset)
+		rows, err := db.Query("SELECT id, name, description, serial, active, COALESCE(serial_pattern, ''), COALESCE(warranty_months, 0), COALESCE(meta_schema, ''), COALESCE(serial_transform, ''), COALESCE(serial_transform_replacement, ''), created_at, updated_at FROM products"+where+orderBy+" LIMIT ? OFFSET ?", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		setPagingHeaders(c, total, limit, offset)
+		defer rows.Close()
+		var products []map[string]interface{}
+		for rows.Next() {
+			var id, active, warrantyMonths int
+			var name, description, serial, serialPattern, metaSchema, serialTransform, serialTransformReplacement string
+			var createdAt, updatedAt sql.NullString
+			rows.Scan(&id, &name, &description, &serial, &active, &serialPattern, &warrantyMonths, &metaSchema, &serialTransform, &serialTransformReplacement, &createdAt, &updatedAt)
+			products = append(products, gin.H{
+				"id":                           id,
+				"name":                         name,
+				"description":                  description,
+				"serial":                       serial,
+				"active":                       active,
+				"serial_pattern":               serialPattern,
+				"warranty_months":              warrantyMonths,
+				"image_url":                    productImageURL(id),
+				"meta_schema":                  decodeMetaSchema(metaSchema),
+				"serial_transform":             serialTransform,
+				"serial_transform_replacement": serialTransformReplacement,
+				"created_at":                   createdAt.String,
+				"updated_at":                   updatedAt.String,
+			})
+		}
+		if products == nil {
+			products = []map[string]interface{}{} // Return empty array instead of null
+		}
+		c.JSON(http.StatusOK, products)
+	}
+}
+
+// Most products one bulk active change can touch, well under SQLite's bound parameter limit
+const maxBulkProductIDs = 500
+
+// Admin: Activate or deactivate many products at once, e.g. a discontinued line
+func setProductsActive(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			IDs    []int `json:"ids"`
+			Active *int  `json:"active"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.Active == nil || (*req.Active != 0 && *req.Active != 1) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "active must be 0 or 1"})
+			return
+		}
+		if len(req.IDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+			return
+		}
+		if len(req.IDs) > maxBulkProductIDs {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many ids: %d given, at most %d", len(req.IDs), maxBulkProductIDs)})
+			return
+		}
+		args := []interface{}{*req.Active, time.Now()}
+		idList := []string{}
+		for _, id := range req.IDs {
+			args = append(args, id)
+			idList = append(idList, strconv.Itoa(id))
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(req.IDs)), ",")
+		res, err := execWithRetry(db, "UPDATE products SET active = ?, updated_at = ? WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+			return
+		}
+		updated, _ := res.RowsAffected()
+		activeProductsCache.invalidate()
+		recordAudit(db, c, "product.active_changed", "products", fmt.Sprintf("ids=%s active=%d updated=%d", strings.Join(idList, ","), *req.Active, updated))
+		logInfo("Admin set %d products active=%d", updated, *req.Active)
+		c.JSON(http.StatusOK, gin.H{"status": "updated", "active": *req.Active, "updated": updated})
+	}
+}
+
+// Admin: Active and inactive product counts
+func productCounts(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var total, active int
+		if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(active = 1), 0) FROM products").Scan(&total, &active); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"total": total, "active": active, "inactive": total - active})
+	}
+}
+
+func upsertProduct(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			ID            int    `json:"id" form:"id"`
+			Name          string `json:"name" form:"name" binding:"required"`
+			Description   string `json:"description" form:"description"`
+			Active        int    `json:"active" form:"active"`
+			SerialPattern string `json:"serial_pattern" form:"serial_pattern"`
+			// These settings keep their stored values when an edit leaves them out
+			WarrantyMonths *int `json:"warranty_months" form:"warranty_months"`
+			// Regex replaced in serials before they're stored or looked up
+			SerialTransform            *string `json:"serial_transform" form:"serial_transform"`
+			SerialTransformReplacement *string `json:"serial_transform_replacement" form:"serial_transform_replacement"`
+			// Extra registration form fields; a JSON array in a multipart form
+			MetaSchema []metaField `json:"meta_schema" form:"-"`
+		}
+		// JSON, or a multipart form when uploading an image
+		var image *multipart.FileHeader
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			if !bindForm(c, &req) {
+				return
+			}
+			if raw := strings.TrimSpace(c.PostForm("meta_schema")); raw != "" {
+				if err := json.Unmarshal([]byte(raw), &req.MetaSchema); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "meta_schema must be a JSON array of fields", "fields": gin.H{"meta_schema": "invalid"}})
+					return
+				}
+				trimStringFields(reflect.ValueOf(&req.MetaSchema))
+			}
+			image, _ = c.FormFile("image")
+			if image != nil && !checkProductImage(c, image) {
+				return
+			}
+		} else if !bindJSON(c, &req) {
+			return
+		}
+		if !checkRequestLengths(c,
+			fieldLimit{"name", req.Name, maxProductNameLength},
+			fieldLimit{"description", req.Description, maxDescriptionLength},
+			fieldLimit{"serial_pattern", req.SerialPattern, maxSerialPatternLength},
+			fieldLimit{"serial_transform", optionalString(req.SerialTransform), maxSerialPatternLength},
+			fieldLimit{"serial_transform_replacement", optionalString(req.SerialTransformReplacement), maxSerialPatternLength},
+		) {
+			return
+		}
+		if _, err := compileSerialPattern(req.SerialPattern); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid serial pattern"})
+			return
+		}
+		// Start from the stored settings when editing, so a client that doesn't
+		// know about one doesn't clear it
+		var oldImage, metaSchema, transform, replacement string
+		var warrantyMonths int
+		if req.ID != 0 {
+			db.QueryRow("SELECT COALESCE(image, ''), COALESCE(warranty_months, 0), COALESCE(meta_schema, ''), COALESCE(serial_transform, ''), COALESCE(serial_transform_replacement, '') FROM products WHERE id=?", req.ID).
+				Scan(&oldImage, &warrantyMonths, &metaSchema, &transform, &replacement)
+		}
+		if req.SerialTransform != nil {
+			transform = *req.SerialTransform
+		}
+		if req.SerialTransformReplacement != nil {
+			replacement = *req.SerialTransformReplacement
+		}
+		if _, err := compileSerialTransform(transform, replacement); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid serial transform", "fields": gin.H{"serial_transform": "invalid"}})
+			return
+		}
+		if req.WarrantyMonths != nil {
+			if *req.WarrantyMonths < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "warranty_months can't be negative", "fields": gin.H{"warranty_months": "invalid"}})
+				return
+			}
+			warrantyMonths = *req.WarrantyMonths
+		}
+		if req.MetaSchema != nil {
+			encoded, err := encodeMetaSchema(req.MetaSchema)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": gin.H{"meta_schema": "invalid"}})
+				return
+			}
+			metaSchema = encoded
+		}
+		// Generate a placeholder value for serial (admin doesn't provide it)
+		// This is needed since the database has a UNIQUE constraint
+		now := time.Now()
+		placeholder := fmt.Sprintf("ADMIN_%d", now.UnixNano())
+		imageName := ""
+		if image != nil {
+			var ok bool
+			if imageName, ok = saveProductImage(c, image); !ok {
+				return
+			}
+		}
+
+		if req.ID == 0 {
+			res, err := execWithRetry(db, "INSERT INTO products (name, description, serial, active, serial_pattern, warranty_months, image, meta_schema, serial_transform, serial_transform_replacement, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				req.Name, req.Description, placeholder, req.Active, req.SerialPattern, warrantyMonths, imageName, metaSchema, transform, replacement, now, now)
+			if err != nil {
+				removeProductImage(imageName)
+				if respondUniqueViolation(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Product creation failed"})
+				return
+			}
+			activeProductsCache.invalidate()
+			newID, _ := res.LastInsertId()
+			recordAudit(db, c, "product.created", fmt.Sprintf("product:%d", newID), fmt.Sprintf("name=%s active=%d", req.Name, req.Active))
+			logInfo("Admin created product: %s", req.Name)
+			c.JSON(http.StatusOK, gin.H{"status": "created"})
+		} else {
+			// Without a new image the current one is kept
+			if image == nil {
+				imageName = oldImage
+			}
+			res, err := execWithRetry(db, "UPDATE products SET name=?, description=?, active=?, serial_pattern=?, warranty_months=?, image=?, meta_schema=?, serial_transform=?, serial_transform_replacement=?, updated_at=? WHERE id=?",
+				req.Name, req.Description, req.Active, req.SerialPattern, warrantyMonths, imageName, metaSchema, transform, replacement, now, req.ID)
+			if err != nil {
+				if image != nil {
+					removeProductImage(imageName)
+				}
+				if respondUniqueViolation(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				if image != nil {
+					removeProductImage(imageName)
+				}
+				c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+				return
+			}
+			if image != nil {
+				removeProductImage(oldImage)
+			}
+			activeProductsCache.invalidate()
+			recordAudit(db, c, "product.updated", fmt.Sprintf("product:%d", req.ID), fmt.Sprintf("name=%s active=%d", req.Name, req.Active))
+			logInfo("Admin updated product: %s", req.Name)
+			c.JSON(http.StatusOK, gin.H{"status": "updated"})
+		}
+	}
+}
+
+// Admin: Update only the product fields given; the rest are left as they are.
+// The image is still changed with POST /admin/product.
+func patchProduct(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var req struct {
+			Name                       *string      `json:"name"`
+			Description                *string      `json:"description"`
+			Active                     *int         `json:"active"`
+			SerialPattern              *string      `json:"serial_pattern"`
+			WarrantyMonths             *int         `json:"warranty_months"`
+			SerialTransform            *string      `json:"serial_transform"`
+			SerialTransformReplacement *string      `json:"serial_transform_replacement"`
+			MetaSchema                 *[]metaField `json:"meta_schema"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.Name != nil && *req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name can't be empty", "fields": gin.H{"name": "name can't be empty"}})
+			return
+		}
+		if !checkRequestLengths(c,
+			fieldLimit{"name", optionalString(req.Name), maxProductNameLength},
+			fieldLimit{"description", optionalString(req.Description), maxDescriptionLength},
+			fieldLimit{"serial_pattern", optionalString(req.SerialPattern), maxSerialPatternLength},
+			fieldLimit{"serial_transform", optionalString(req.SerialTransform), maxSerialPatternLength},
+			fieldLimit{"serial_transform_replacement", optionalString(req.SerialTransformReplacement), maxSerialPatternLength},
+		) {
+			return
+		}
+		var name, transform, replacement string
+		err := db.QueryRow("SELECT COALESCE(name, ''), COALESCE(serial_transform, ''), COALESCE(serial_transform_replacement, '') FROM products WHERE id=?", id).Scan(&name, &transform, &replacement)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+
+		sets := []string{}
+		args := []interface{}{}
+		fields := []string{}
+		set := func(column string, value interface{}) {
+			sets = append(sets, column+"=?")
+			args = append(args, value)
+			fields = append(fields, column)
+		}
+		if req.Name != nil {
+			set("name", *req.Name)
+			name = *req.Name
+		}
+		if req.Description != nil {
+			set("description", *req.Description)
+		}
+		if req.Active != nil {
+			if *req.Active != 0 && *req.Active != 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be 0 or 1", "fields": gin.H{"active": "invalid"}})
+				return
+			}
+			set("active", *req.Active)
+		}
+		if req.SerialPattern != nil {
+			if _, err := compileSerialPattern(*req.SerialPattern); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid serial pattern"})
+				return
+			}
+			set("serial_pattern", *req.SerialPattern)
+		}
+		if req.WarrantyMonths != nil {
+			if *req.WarrantyMonths < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "warranty_months can't be negative", "fields": gin.H{"warranty_months": "invalid"}})
+				return
+			}
+			set("warranty_months", *req.WarrantyMonths)
+		}
+		// The transform is checked with whichever half isn't being changed
+		if req.SerialTransform != nil || req.SerialTransformReplacement != nil {
+			if req.SerialTransform != nil {
+				transform = *req.SerialTransform
+				set("serial_transform", transform)
+			}
+			if req.SerialTransformReplacement != nil {
+				replacement = *req.SerialTransformReplacement
+				set("serial_transform_replacement", replacement)
+			}
+			if _, err := compileSerialTransform(transform, replacement); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid serial transform", "fields": gin.H{"serial_transform": "invalid"}})
+				return
+			}
+		}
+		if req.MetaSchema != nil {
+			metaSchema, err := encodeMetaSchema(*req.MetaSchema)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": gin.H{"meta_schema": "invalid"}})
+				return
+			}
+			set("meta_schema", metaSchema)
+		}
+		if len(sets) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+			return
+		}
+
+		args = append(args, time.Now(), id)
+		res, err := execWithRetry(db, "UPDATE products SET "+strings.Join(sets, ", ")+", updated_at=? WHERE id=?", args...)
+		if err != nil {
+			if respondUniqueViolation(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		activeProductsCache.invalidate()
+		recordAudit(db, c, "product.updated", "product:"+id, "fields="+strings.Join(fields, ","))
+		logInfo("Admin updated product %s (%s): %s", id, name, strings.Join(fields, ", "))
+		c.JSON(http.StatusOK, gin.H{"status": "updated", "updated_fields": fields})
+	}
+}
+
+func deleteProduct(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var image string
+		db.QueryRow("SELECT COALESCE(image, '') FROM products WHERE id=?", id).Scan(&image)
+		res, err := execWithRetry(db, "DELETE FROM products WHERE id=?", id)
+		if isForeignKeyViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Product has registrations and can't be deleted; deactivate the product instead"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Delete failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		execWithRetry(db, "DELETE FROM product_serials WHERE product_id=?", id)
+		removeProductImage(image)
+		activeProductsCache.invalidate()
+		recordAudit(db, c, "product.deleted", "product:"+id, "")
+		logInfo("Admin deleted product id: %s", id)
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	}
+}
+
+// Admin: Add serials from a manufacturing CSV to a product's serial registry.
+// Uses the serial column when there's a header, otherwise the first column.
+// Duplicates, serials already in the registry and ones not matching the
+// product's pattern are skipped.
+func importProductSerials(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID := c.Param("id")
+		pattern, err := loadSerialPattern(db, productID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product has an invalid serial pattern"})
+			return
+		}
+		transform, err := loadSerialTransform(db, productID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product has an invalid serial transform"})
+			return
+		}
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file must be uploaded"})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read file"})
+			return
+		}
+		defer file.Close()
+
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid CSV: %v", err)})
+			return
+		}
+		column := 0
+		if len(records) > 0 {
+			if i, ok := serialColumn(records[0]); ok {
+				column = i
+				records = records[1:]
+			}
+		}
+
+		tx, err := beginWithRetry(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer tx.Rollback()
+		seen := map[string]bool{}
+		invalidSerials := []string{}
+		added, existing, duplicates := 0, 0, 0
+		now := time.Now()
+		for _, record := range records {
+			if column >= len(record) {
+				continue
+			}
+			serial := transform.Apply(strings.ToUpper(strings.TrimSpace(record[column])))
+			switch {
+			case serial == "":
+				continue
+			case seen[serial]:
+				duplicates++
+				continue
+			}
+			seen[serial] = true
+			if pattern != nil && !pattern.MatchString(serial) {
+				invalidSerials = append(invalidSerials, serial)
+				continue
+			}
+			res, err := tx.Exec("INSERT OR IGNORE INTO product_serials (product_id, serial, created_at) VALUES (?, ?, ?)", productID, serial, now)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed"})
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				existing++
+			} else {
+				added++
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed"})
+			return
+		}
+		logInfo("Admin imported %d serials for product %s (%d existing, %d duplicates, %d invalid)", added, productID, existing, duplicates, len(invalidSerials))
+		invalidCount := len(invalidSerials)
+		if len(invalidSerials) > 100 {
+			invalidSerials = invalidSerials[:100]
+		}
+		c.JSON(http.StatusOK, gin.H{"added": added, "already_present": existing, "duplicates": duplicates, "invalid": invalidCount, "invalid_serials": invalidSerials})
+	}
+}
+
+// Index of the serial column when a CSV row is a header naming one
+func serialColumn(header []string) (int, bool) {
+	for i, name := range header {
+		switch strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_") {
+		case "serial", "serial_number", "serial_no":
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Split a comma separated serial input into cleaned, upper-cased serials
+func parseSerials(input string) []string {
+	serials := []string{}
+	for _, s := range strings.Split(input, ",") {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if s != "" {
+			serials = append(serials, s)
+		}
+	}
+	return serials
+}
+
+// Compile a product's serial pattern so it must match the whole serial
+func compileSerialPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// Load the serial pattern for a product, nil when the product has none
+func loadSerialPattern(db *sql.DB, productID interface{}) (*regexp.Regexp, error) {
+	var pattern string
+	err := db.QueryRow("SELECT COALESCE(serial_pattern, '') FROM products WHERE id = ?", productID).Scan(&pattern)
+	if err != nil {
+		return nil, err
+	}
+	return compileSerialPattern(pattern)
+}
+
+// An extra field a product asks for when it's registered, e.g. a dealer invoice number
+type metaField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label,omitempty"`
+	Required bool   `json:"required"`
+}
+
+const (
+	maxMetaFields      = 20
+	maxMetaValueLength = 500
+)
+
+var metaFieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// Form fields registerProduct already reads, which a meta field can't take over
+var reservedMetaFieldNames = map[string]bool{"serial": true, "product_id": true, "upload_id": true, "bill": true, "warranty": true, "other": true}
+
+// Check a product's meta schema and encode it for products.meta_schema ("" for none)
+func encodeMetaSchema(fields []metaField) (string, error) {
+	if len(fields) == 0 {
+		return "", nil
+	}
+	if len(fields) > maxMetaFields {
+		return "", fmt.Errorf("meta_schema can have at most %d fields", maxMetaFields)
+	}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if !metaFieldNamePattern.MatchString(f.Name) {
+			return "", fmt.Errorf("meta field name %q must be lower case letters, digits and _, starting with a letter", f.Name)
+		}
+		if reservedMetaFieldNames[f.Name] {
+			return "", fmt.Errorf("meta field name %q is reserved", f.Name)
+		}
+		if seen[f.Name] {
+			return "", fmt.Errorf("meta field name %q is repeated", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	encoded, err := json.Marshal(fields)
+	return string(encoded), err
+}
+
+// Fields of a stored meta schema; none when it's empty or unreadable
+func decodeMetaSchema(raw string) []metaField {
+	fields := []metaField{}
+	if raw == "" {
+		return fields
+	}
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		logWarn("Invalid meta schema: %v", err)
+		return []metaField{}
+	}
+	return fields
+}
+
+// Read a product's meta fields from the registration form. Returns the values encoded
+// for registrations.registration_meta ("" when none were given) and, per field,
+// what's wrong with the ones that are missing or too long.
+func formRegistrationMeta(c *gin.Context, schema []metaField) (string, gin.H) {
+	values := map[string]string{}
+	problems := gin.H{}
+	for _, f := range schema {
+		value := strings.TrimSpace(c.PostForm(f.Name))
+		switch {
+		case value == "" && f.Required:
+			problems[f.Name] = "required"
+		case len(value) > maxMetaValueLength:
+			problems[f.Name] = "too long"
+		case value != "":
+			values[f.Name] = value
+		}
+	}
+	if len(values) == 0 {
+		return "", problems
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded), problems
+}
+
+// Stored registration metadata, empty when there is none
+func decodeRegistrationMeta(raw string) map[string]string {
+	meta := map[string]string{}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			logWarn("Invalid registration metadata: %v", err)
+		}
+	}
+	return meta
+}
+
+// A product's serial rewrite: matches of the pattern are replaced (with $1-style
+// references) before a serial is stored or looked up, e.g. ^SN- to "" so
+// "SN-00123" and "00123" are the same serial
+type serialTransform struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Compile a product's serial transform, nil when it has none
+func compileSerialTransform(pattern, replacement string) (*serialTransform, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &serialTransform{pattern: re, replacement: replacement}, nil
+}
+
+// Load the serial transform for a product, nil when the product has none
+func loadSerialTransform(db *sql.DB, productID interface{}) (*serialTransform, error) {
+	var pattern, replacement string
+	err := db.QueryRow("SELECT COALESCE(serial_transform, ''), COALESCE(serial_transform_replacement, '') FROM products WHERE id = ?", productID).Scan(&pattern, &replacement)
+	if err != nil {
+		return nil, err
+	}
+	return compileSerialTransform(pattern, replacement)
+}
+
+// Rewrite a cleaned, upper-cased serial; a nil transform leaves it as it is
+func (t *serialTransform) Apply(serial string) string {
+	if t == nil {
+		return serial
+	}
+	return strings.ToUpper(strings.TrimSpace(t.pattern.ReplaceAllString(serial, t.replacement)))
+}
+
+// Rewrite serials, dropping ones that end up empty or repeat an earlier one
+func (t *serialTransform) ApplyAll(serials []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, serial := range serials {
+		serial = t.Apply(serial)
+		if serial != "" && !seen[serial] {
+			seen[serial] = true
+			result = append(result, serial)
+		}
+	}
+	return result
+}
+
+// WHERE condition on table (r or h) matching a serial as given or as any product's
+// serial transform would have stored it for that product
+func serialLookupCondition(db *sql.DB, table, serial string) (string, []interface{}) {
+	conditions := []string{table + ".serial = ?"}
+	args := []interface{}{serial}
+	rows, err := db.Query("SELECT id, serial_transform, COALESCE(serial_transform_replacement, '') FROM products WHERE COALESCE(serial_transform, '') != ''")
+	if err != nil {
+		return conditions[0], args
+	}
+	defer rows.Close()
+	cleaned := strings.ToUpper(strings.TrimSpace(serial))
+	for rows.Next() {
+		var productID int
+		var pattern, replacement string
+		rows.Scan(&productID, &pattern, &replacement)
+		transform, err := compileSerialTransform(pattern, replacement)
+		if err != nil {
+			continue
+		}
+		if stored := transform.Apply(cleaned); stored != "" && stored != serial {
+			conditions = append(conditions, "("+table+".product_id = ? AND "+table+".serial = ?)")
+			args = append(args, productID, stored)
+		}
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// Check whether a serial can be registered: available, registered or invalid.
+// An available serial also comes with the expired rejections it would replace.
+func serialStatus(db *sql.DB, serial string, pattern *regexp.Regexp) (string, []int) {
+	if pattern != nil && !pattern.MatchString(serial) {
+		return "invalid", nil
+	}
+	replaceable, blocked := serialHolders(db, serial)
+	if blocked {
+		return "registered", nil
+	}
+	return "available", replaceable
+}
+
+// Days after which a rejected registration no longer holds its serial
+// (DUPLICATE_GRACE_DAYS); 0, the default, keeps serials taken for good
+func duplicateGraceDays() int {
+	return getEnvInt("DUPLICATE_GRACE_DAYS", 0)
+}
+
+// Whether existing registrations keep serial from being registered again.
+// Pending, needs_info and approved ones always do; a rejected one does until its
+// rejection is older than the grace period, and is then returned to be replaced.
+// The rejection is dated by its latest update in registration_history, falling
+// back to created_at for registrations from before the history was kept.
+func serialHolders(db *sql.DB, serial string) ([]int, bool) {
+	grace := duplicateGraceDays()
+	cutoff := time.Now().AddDate(0, 0, -grace).Format("2006-01-02 15:04:05")
+	rows, err := db.Query(`SELECT r.id, r.status = 'rejected' AND COALESCE(
+			(SELECT MAX(h.created_at) FROM registration_history h WHERE h.registration_id = r.id AND h.event = 'updated' AND h.status = 'rejected'),
+			r.created_at) < ?
+		FROM registrations r WHERE r.serial = ? COLLATE NOCASE`, cutoff, serial)
+	if err != nil {
+		return nil, true
+	}
+	defer rows.Close()
+	replaceable := []int{}
+	blocked := false
+	for rows.Next() {
+		var id int
+		var expired bool
+		rows.Scan(&id, &expired)
+		if grace > 0 && expired {
+			replaceable = append(replaceable, id)
+		} else {
+			blocked = true
+		}
+	}
+	return replaceable, blocked
+}
+
+// Customer: Check serials before registering, without uploading a bill
+func checkSerials(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Serials   []string `json:"serials"`
+			ProductID int      `json:"product_id"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if len(req.Serials) == 0 || req.ProductID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Serials and product_id required"})
+			return
+		}
+		if limit := maxSerialsPerRequest(); len(req.Serials) > limit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many serial numbers: %d given, at most %d per request", len(req.Serials), limit), "count": len(req.Serials), "limit": limit})
+			return
+		}
+
+		var active int
+		err := db.QueryRow("SELECT active FROM products WHERE id = ?", req.ProductID).Scan(&active)
+		if err != nil || active == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		pattern, err := loadSerialPattern(db, req.ProductID)
+		if err != nil {
+			logWarn("Invalid serial pattern for product %d: %v", req.ProductID, err)
+			pattern = nil
+		}
+		transform, err := loadSerialTransform(db, req.ProductID)
+		if err != nil {
+			logWarn("Invalid serial transform for product %d: %v", req.ProductID, err)
+			transform = nil
+		}
+
+		results := []map[string]interface{}{}
+		for _, raw := range req.Serials {
+			serial := strings.ToUpper(strings.TrimSpace(raw))
+			if serial == "" {
+				continue
+			}
+			stored := transform.Apply(serial)
+			result := gin.H{"serial": serial, "status": "invalid"}
+			if stored != "" {
+				result["status"], _ = serialStatus(db, stored, pattern)
+			}
+			if stored != serial {
+				result["stored_as"] = stored
+			}
+			results = append(results, result)
+		}
+		c.JSON(http.StatusOK, gin.H{"product_id": req.ProductID, "results": results})
+	}
+}
+
+// Save an uploaded file durably: write to a temp file in the same directory,
+// check the size matches the upload, fsync, then rename into place
+func saveUploadedFileSync(file *multipart.FileHeader, dst string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	written, err := io.Copy(tmp, src)
+	if err != nil {
+		return fail(err)
+	}
+	if written != file.Size {
+		return fail(fmt.Errorf("incomplete upload: wrote %d of %d bytes", written, file.Size))
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, dst); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Most chunks one chunked upload can be split into
+const maxUploadChunks = 1000
+
+// Directory holding the chunks of unfinished chunked uploads
+func uploadsDir() string {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data" // Fallback
+	}
+	return filepath.Join(dataDir, "uploads")
+}
+
+// A chunked bill upload. Status is open while chunks arrive, complete once
+// assembled into a bill file, and used once a registration references it.
+type chunkedUpload struct {
+	ID       string
+	UserID   int
+	Filename string
+	Size     int64
+	Chunks   int
+	Status   string
+	BillFile string
+}
+
+// Load a chunked upload owned by userID
+func loadChunkedUpload(db *sql.DB, id string, userID int) (*chunkedUpload, error) {
+	u := &chunkedUpload{}
+	err := db.QueryRow("SELECT id, user_id, filename, size, chunks, status, COALESCE(bill_file, '') FROM chunked_uploads WHERE id = ? AND user_id = ?", id, userID).
+		Scan(&u.ID, &u.UserID, &u.Filename, &u.Size, &u.Chunks, &u.Status, &u.BillFile)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Chunk indexes received so far, in order, and their total size
+func receivedChunks(u *chunkedUpload) ([]int, int64) {
+	received := []int{}
+	var total int64
+	for i := 0; i < u.Chunks; i++ {
+		if info, err := os.Stat(filepath.Join(uploadsDir(), u.ID, strconv.Itoa(i))); err == nil {
+			received = append(received, i)
+			total += info.Size()
+		}
+	}
+	return received, total
+}
+
+// Reply 404 unless the upload exists for this user
+func chunkedUploadOr404(db *sql.DB, c *gin.Context) (*chunkedUpload, bool) {
+	u, err := loadChunkedUpload(db, c.Param("id"), c.GetInt("userID"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	return u, true
+}
+
+// Customer: Start a chunked bill upload for a file of the given name, size and chunk count
+func initChunkedUpload(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Filename string `json:"filename" binding:"required"`
+			Size     int64  `json:"size" binding:"required"`
+			Chunks   int    `json:"chunks" binding:"required"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if !checkRequestLengths(c, fieldLimit{"filename", req.Filename, maxFilenameLength}) {
+			return
+		}
+		if req.Size < 1 || req.Size > int64(maxUploadMB())*1024*1024 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", maxUploadMB())})
+			return
+		}
+		if req.Chunks < 1 || req.Chunks > maxUploadChunks || int64(req.Chunks) > req.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunks must be between 1 and %d, and no more than the file size", maxUploadChunks)})
+			return
+		}
+		if !isAllowedBillType(req.Filename) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bill file type not allowed (allowed: %s)", strings.Join(allowedBillTypes(), ", "))})
+			return
+		}
+		id := generateToken()
+		if err := os.MkdirAll(filepath.Join(uploadsDir(), id), 0755); err != nil {
+			logError("Error creating upload directory: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+			return
+		}
+		_, err := execWithRetry(db, "INSERT INTO chunked_uploads (id, user_id, filename, size, chunks, status, created_at) VALUES (?, ?, ?, ?, ?, 'open', ?)",
+			id, c.GetInt("userID"), filepath.Base(req.Filename), req.Size, req.Chunks, time.Now())
+		if err != nil {
+			os.RemoveAll(filepath.Join(uploadsDir(), id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"upload_id": id, "chunks": req.Chunks})
+	}
+}
+
+// Customer: Progress of a chunked upload, so an interrupted client knows which chunks to resend
+func chunkedUploadStatus(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := chunkedUploadOr404(db, c)
+		if !ok {
+			return
+		}
+		received, total := receivedChunks(u)
+		c.JSON(http.StatusOK, gin.H{"upload_id": u.ID, "filename": u.Filename, "size": u.Size, "chunks": u.Chunks, "status": u.Status, "received": received, "received_bytes": total})
+	}
+}
+
+// Customer: Store chunk ?index= (from 0) of a chunked upload. Resending a chunk replaces it.
+func uploadChunk(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := chunkedUploadOr404(db, c)
+		if !ok {
+			return
+		}
+		if u.Status != "open" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload is already complete"})
+			return
+		}
+		index, err := strconv.Atoi(c.Query("index"))
+		if err != nil || index < 0 || index >= u.Chunks {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("index must be between 0 and %d", u.Chunks-1)})
+			return
+		}
+		file, err := c.FormFile("chunk")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk file must be uploaded"})
+			return
+		}
+		chunkPath := filepath.Join(uploadsDir(), u.ID, strconv.Itoa(index))
+		var previous int64
+		if info, err := os.Stat(chunkPath); err == nil {
+			previous = info.Size()
+		}
+		if _, total := receivedChunks(u); total-previous+file.Size > u.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Chunks are larger than the declared file size"})
+			return
+		}
+		if err := saveUploadedFileSync(file, chunkPath); err != nil {
+			logError("Error saving upload chunk: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Chunk save failed"})
+			return
+		}
+		received, _ := receivedChunks(u)
+		c.JSON(http.StatusOK, gin.H{"index": index, "received": len(received), "chunks": u.Chunks})
+	}
+}
+
+// Customer: Assemble the chunks into a bill file once all have arrived. The
+// upload id can then be given to register-product instead of a bill file.
+func completeChunkedUpload(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := chunkedUploadOr404(db, c)
+		if !ok {
+			return
+		}
+		if u.Status != "open" {
+			c.JSON(http.StatusOK, gin.H{"upload_id": u.ID, "status": u.Status, "bill_file": u.BillFile})
+			return
+		}
+		received, total := receivedChunks(u)
+		if len(received) < u.Chunks {
+			missing := []int{}
+			have := map[int]bool{}
+			for _, i := range received {
+				have[i] = true
+			}
+			for i := 0; i < u.Chunks; i++ {
+				if !have[i] {
+					missing = append(missing, i)
+				}
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload is missing chunks", "missing": missing})
+			return
+		}
+		if total != u.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunks add up to %d bytes, expected %d", total, u.Size)})
+			return
+		}
+
+		billDir := filepath.Join(filepath.Dir(uploadsDir()), "bills")
+		billFilename := fmt.Sprintf("%d_%d%s", u.UserID, time.Now().UnixNano(), filepath.Ext(u.Filename))
+		billPath, err := safeJoin(billDir, billFilename)
+		if err == nil {
+			err = assembleChunks(u, billPath)
+		}
+		if err != nil {
+			logError("Error assembling upload %s: %v", u.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "File save failed"})
+			return
+		}
+		billURL := fmt.Sprintf("bills/%s", billFilename)
+		res, err := execWithRetry(db, "UPDATE chunked_uploads SET status = 'complete', bill_file = ? WHERE id = ? AND status = 'open'", billURL, u.ID)
+		if err != nil {
+			os.Remove(billPath)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Completed concurrently by another request
+			os.Remove(billPath)
+			u, _ = loadChunkedUpload(db, u.ID, u.UserID)
+			c.JSON(http.StatusOK, gin.H{"upload_id": u.ID, "status": u.Status, "bill_file": u.BillFile})
+			return
+		}
+		os.RemoveAll(filepath.Join(uploadsDir(), u.ID))
+		logDebug("Chunked upload %s assembled at: %s", u.ID, billPath)
+		c.JSON(http.StatusOK, gin.H{"upload_id": u.ID, "status": "complete", "bill_file": billURL})
+	}
+}
+
+// Concatenate an upload's chunks in order into dst, via a temp file
+func assembleChunks(u *chunkedUpload, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	for i := 0; i < u.Chunks; i++ {
+		chunk, err := os.Open(filepath.Join(uploadsDir(), u.ID, strconv.Itoa(i)))
+		if err != nil {
+			return fail(err)
+		}
+		_, err = io.Copy(tmp, chunk)
+		chunk.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, dst); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Take a completed upload for a registration, returning its bill URL path.
+// Replies 400 when the upload doesn't exist, isn't complete or was already used.
+func claimChunkedUpload(db *sql.DB, c *gin.Context, userID int, id string) (string, bool) {
+	u, err := loadChunkedUpload(db, id, userID)
+	if err != nil || u.Status != "complete" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or incomplete upload"})
+		return "", false
+	}
+	res, err := execWithRetry(db, "UPDATE chunked_uploads SET status = 'used' WHERE id = ? AND status = 'complete'", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+		return "", false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or incomplete upload"})
+		return "", false
+	}
+	return u.BillFile, true
+}
+
+// Hourly, remove chunked uploads older than UPLOAD_EXPIRY_HOURS (default 24).
+// Unfinished chunks and assembled bills no registration took are deleted.
+func startUploadCleanup(db *sql.DB) {
+	hours := getEnvInt("UPLOAD_EXPIRY_HOURS", 24)
+	go func() {
+		for {
+			expireChunkedUploads(db, time.Now().Add(-time.Duration(hours)*time.Hour))
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func expireChunkedUploads(db *sql.DB, before time.Time) {
+	rows, err := db.Query("SELECT id, status, COALESCE(bill_file, '') FROM chunked_uploads WHERE created_at < ?", before)
+	if err != nil {
+		logError("Upload cleanup failed: %v", err)
+		return
+	}
+	type expired struct{ id, status, bill string }
+	uploads := []expired{}
+	for rows.Next() {
+		var u expired
+		rows.Scan(&u.id, &u.status, &u.bill)
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+	for _, u := range uploads {
+		if dir, err := safeJoin(uploadsDir(), u.id); err == nil {
+			os.RemoveAll(dir)
+		}
+		if u.status == "complete" && u.bill != "" {
+			if err := removeBillFile(u.bill); err != nil {
+				logWarn("Could not delete bill file %s: %v", u.bill, err)
+			}
+		}
+		execWithRetry(db, "DELETE FROM chunked_uploads WHERE id = ?", u.id)
+	}
+	if len(uploads) > 0 {
+		logInfo("Upload cleanup removed %d expired uploads", len(uploads))
+	}
+}
+
+// Customer: Register product
+func registerProduct(db *sql.DB, events *eventBroker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		// Parsed first so a form over the size limit is reported as such rather
+		// than as missing fields
+		uploads, err := formRegistrationFiles(c)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		serialInput := c.PostForm("serial")
+		serialInput = strings.TrimSpace(serialInput)
+		productID := strings.TrimSpace(c.PostForm("product_id"))
+		// At least one bill, either uploaded with the form or a completed chunked
+		// upload, plus any warranty card or other documents
+		uploadID := strings.TrimSpace(c.PostForm("upload_id"))
+		hasBill := uploadID != ""
+		for _, upload := range uploads {
+			hasBill = hasBill || upload.kind == "bill"
+		}
+
+		serials := parseSerials(serialInput)
+
+		if len(serials) == 0 || productID == "" || !hasBill {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "All fields required and bill file must be uploaded"})
+			return
+		}
+
+		if limit := maxSerialsPerRequest(); len(serials) > limit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many serial numbers: %d given, at most %d per request", len(serials), limit), "count": len(serials), "limit": limit})
+			return
+		}
+
+		// Each serial counts against the daily quota; admins are exempt
+		if quota := dailyRegistrationQuota(); quota > 0 && c.GetString("role") != roleAdmin {
+			now := time.Now()
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Format("2006-01-02")
+			var used int
+			db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id = ? AND created_at >= ?", userID, today).Scan(&used)
+			if used+len(serials) > quota {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Daily registration quota of %d serials exceeded: %d registered today, %d more requested", quota, used, len(serials)), "quota": quota, "used": used, "requested": len(serials)})
+				return
+			}
+		}
+
+		fileCount := len(uploads)
+		if uploadID != "" {
+			fileCount++
+		}
+		if fileCount > maxRegistrationFiles {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Too many files: %d given, at most %d per registration", fileCount, maxRegistrationFiles)})
+			return
+		}
+		for _, upload := range uploads {
+			if !checkBillUpload(c, upload.file) {
+				return
+			}
+		}
+
+		pattern, err := loadSerialPattern(db, productID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product"})
+			return
+		} else if err != nil {
+			logWarn("Invalid serial pattern for product %s: %v", productID, err)
+			pattern = nil
+		}
+		// Serials are stored in the product's transformed form, so "SN-00123" and
+		// "00123" count as the same serial when the product strips the prefix
+		transform, err := loadSerialTransform(db, productID)
+		if err != nil {
+			logWarn("Invalid serial transform for product %s: %v", productID, err)
+			transform = nil
+		}
+		serials = transform.ApplyAll(serials)
+		if len(serials) == 0 {
+			msg := "Serial number is empty once the product's serial format is applied"
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"serial": msg}})
+			return
+		}
+
+		// Extra fields the product asks for, checked before any file is saved
+		var metaSchema string
+		db.QueryRow("SELECT COALESCE(meta_schema, '') FROM products WHERE id = ?", productID).Scan(&metaSchema)
+		meta, metaProblems := formRegistrationMeta(c, decodeMetaSchema(metaSchema))
+		if len(metaProblems) > 0 {
+			names := []string{}
+			for name := range metaProblems {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid fields: " + strings.Join(names, ", "), "fields": metaProblems})
+			return
+		}
+
+		// Check if any serial is already registered or doesn't match the product's format
+		invalidSerials := []string{}
+		badFormatSerials := []string{}
+		superseded := map[string][]int{}
+		supersededPaths := []string{}
+		for _, serial := range serials {
+			status, replaceable := serialStatus(db, serial, pattern)
+			switch status {
+			case "registered":
+				invalidSerials = append(invalidSerials, serial)
+			case "invalid":
+				badFormatSerials = append(badFormatSerials, serial)
+			case "available":
+				if len(replaceable) > 0 {
+					superseded[serial] = replaceable
+					for _, id := range replaceable {
+						supersededPaths = append(supersededPaths, registrationFilePaths(db, id, "")...)
+					}
+				}
+			}
+		}
+
+		if len(badFormatSerials) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("These serial numbers do not match the product format: %s", strings.Join(badFormatSerials, ", "))})
+			return
+		}
+
+		if len(invalidSerials) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("These serial numbers are already registered: %s", strings.Join(invalidSerials, ", "))})
+			return
+		}
+
+		// Files saved for this request are deleted again, and a claimed chunked
+		// upload handed back, on every way out unless a registration was committed
+		files := []registrationFile{}
+		saved := []string{}
+		claimed := false
+		keepFiles := false
+		defer func() {
+			if keepFiles {
+				return
+			}
+			for _, path := range saved {
+				removeBillFile(path)
+			}
+			if claimed {
+				execWithRetry(db, "UPDATE chunked_uploads SET status = 'complete' WHERE id = ? AND status = 'used'", uploadID)
+			}
+		}()
+		for _, upload := range uploads {
+			path, ok := saveBillUpload(c, userID, upload.file)
+			if !ok {
+				return
+			}
+			saved = append(saved, path)
+			files = append(files, registrationFile{Path: path, Kind: upload.kind, Hash: billFileHash(path)})
+		}
+		if uploadID != "" {
+			path, ok := claimChunkedUpload(db, c, userID, uploadID)
+			if !ok {
+				return
+			}
+			claimed = true
+			files = append([]registrationFile{{Path: path, Kind: "bill", Hash: billFileHash(path)}}, files...)
+		}
+		var billUrlPath string
+		for _, f := range files {
+			if f.Kind == "bill" {
+				billUrlPath = f.Path
+				break
+			}
+		}
+
+		duplicateBill := isDuplicateBill(db, files, 0)
+		if duplicateBill {
+			logWarn("User %d submitted a bill already used by another registration", userID)
+		}
+
+		statuses := make([]string, len(serials))
+		for i, serial := range serials {
+			statuses[i] = "pending"
+			if autoApproves(db, productID, serial) {
+				statuses[i] = "approved"
+			}
+		}
+
+		// Register each serial with the same files in one transaction, reusing
+		// prepared inserts. The check above can race with a concurrent request, so
+		// the UNIQUE constraint decides who wins each serial; a violation only
+		// fails that serial's insert, not the transaction.
+		tx, err := beginWithRetry(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer tx.Rollback()
+		insertRegistration, err := tx.Prepare("INSERT INTO registrations (user_id, product_id, serial, bill_file, status, created_at, duplicate_bill, registration_meta) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer insertRegistration.Close()
+		insertFile, err := tx.Prepare("INSERT INTO registration_files (registration_id, path, kind, created_at, sha256) VALUES (?, ?, ?, ?, ?)")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer insertFile.Close()
+
+		registeredSerials := []string{}
+		conflictingSerials := []string{}
+		autoApprovedSerials := []string{}
+		created := []gin.H{}
+		pid, _ := strconv.Atoi(productID)
+		now := time.Now()
+		for i, serial := range serials {
+			status := statuses[i]
+			// A rejected registration past DUPLICATE_GRACE_DAYS gives way to this
+			// one; the savepoint keeps it if the new insert fails after all
+			if len(superseded[serial]) > 0 {
+				tx.Exec("SAVEPOINT supersede")
+				for _, oldID := range superseded[serial] {
+					recordRegistrationEvent(tx, oldID, "superseded")
+					tx.Exec("DELETE FROM registration_files WHERE registration_id = ?", oldID)
+					tx.Exec("DELETE FROM registrations WHERE id = ? AND status = 'rejected'", oldID)
+				}
+			}
+			res, err := insertRegistration.Exec(userID, productID, serial, billUrlPath, status, now, duplicateBill, meta)
+			if len(superseded[serial]) > 0 {
+				if err == nil {
+					tx.Exec("RELEASE supersede")
+					logInfo("Serial %s re-registered by user %d, replacing rejected registrations %v", serial, userID, superseded[serial])
+				} else {
+					tx.Exec("ROLLBACK TO supersede")
+					tx.Exec("RELEASE supersede")
+				}
+			}
+
+			if err == nil {
+				registeredSerials = append(registeredSerials, serial)
+				id, _ := res.LastInsertId()
+				// A registration must not outlive its file records, so this fails the request
+				for _, f := range files {
+					if _, err := insertFile.Exec(id, f.Path, f.Kind, now, f.Hash); err != nil {
+						logError("Error recording file %s for registration %d: %v", f.Path, id, err)
+						c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+						return
+					}
+				}
+				recordRegistrationEvent(tx, id, "registered")
+				if status == "approved" {
+					autoApprovedSerials = append(autoApprovedSerials, serial)
+					recordRegistrationEvent(tx, id, "auto_approved")
+				}
+				created = append(created, gin.H{"id": id, "user_id": userID, "product_id": pid, "serial": serial, "status": status})
+			} else if uniqueViolationColumn(err) == "serial" {
+				logInfo("Serial %s was registered concurrently by another request", serial)
+				conflictingSerials = append(conflictingSerials, serial)
+			} else {
+				logError("Error registering serial %s: %v", serial, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			logError("Error committing registrations for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+			return
+		}
+		for _, data := range created {
+			events.Publish("registration.created", data)
+		}
+
+		keepFiles = len(registeredSerials) > 0
+		if len(supersededPaths) > 0 {
+			if removed := removeUnusedBillFiles(db, supersededPaths); removed > 0 {
+				logInfo("Removed %d bill files of superseded registrations", removed)
+			}
+		}
+		logInfo("%d products registered by user %d: %s", len(registeredSerials), userID, strings.Join(registeredSerials, ", "))
+
+		if len(autoApprovedSerials) > 0 {
+			logInfo("Auto-approved for user %d: %s", userID, strings.Join(autoApprovedSerials, ", "))
+		}
+
+		if len(registeredSerials) > 0 {
+			status := "pending"
+			if len(autoApprovedSerials) == len(registeredSerials) {
+				status = "approved"
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"status":                status,
+				"message":               fmt.Sprintf("Registered %d product(s) successfully", len(registeredSerials)),
+				"registered_serials":    registeredSerials,
+				"conflicting_serials":   conflictingSerials,
+				"auto_approved_serials": autoApprovedSerials,
+			})
+		} else if len(conflictingSerials) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":               fmt.Sprintf("These serial numbers are already registered: %s", strings.Join(conflictingSerials, ", ")),
+				"conflicting_serials": conflictingSerials,
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed for all serial numbers"})
+		}
+	}
+}
+
+// With AUTO_APPROVE=true, a registration whose serial is in the product's serial
+// registry is approved straight away. It is only called once the bill has passed
+// validation; anything else waits for review as pending.
+func autoApproves(db *sql.DB, productID, serial string) bool {
+	if os.Getenv("AUTO_APPROVE") != "true" {
+		return false
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM product_serials WHERE product_id = ? AND serial = ?", productID, serial).Scan(&count)
+	return count > 0
+}
+
+// Reply 400 unless an uploaded bill is within the size limit and of an allowed type
+func checkBillUpload(c *gin.Context, file *multipart.FileHeader) bool {
+	if file.Size > int64(maxUploadMB())*1024*1024 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", maxUploadMB())})
+		return false
+	}
+	if !isAllowedBillType(file.Filename) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bill file type not allowed (allowed: %s)", strings.Join(allowedBillTypes(), ", "))})
+		return false
+	}
+	return true
+}
+
+// Save an uploaded bill in the bills directory and return its URL path,
+// replying with an error when it can't be saved
+func saveBillUpload(c *gin.Context, userID int, file *multipart.FileHeader) (string, bool) {
+	// Get data directory from environment
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data" // Fallback
+	}
+
+	// Save bill file in the bills directory under data dir
+	billDir := filepath.Join(dataDir, "bills")
+	if _, err := os.Stat(billDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(billDir, 0755); err != nil {
+			logError("Error creating bills directory: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bills directory"})
+			return "", false
+		}
+	}
+
+	timestamp := time.Now().UnixNano()
+	billFilename := fmt.Sprintf("%d_%d%s", userID, timestamp, filepath.Ext(file.Filename))
+	billPath, err := safeJoin(billDir, billFilename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bill file name"})
+		return "", false
+	}
+
+	if err := saveUploadedFileSync(file, billPath); err != nil {
+		logError("Error saving uploaded file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "File save failed"})
+		return "", false
+	}
+
+	logDebug("Bill file saved at: %s", billPath)
+
+	// Store relative URL path instead of filesystem path
+	// Use a format without leading slash to avoid double slash issues
+	return fmt.Sprintf("bills/%s", billFilename), true
+}
+
+// Customer: Upload a new bill for a registration the admin marked needs_info,
+// which sends it back to pending review
+func reuploadBill(db *sql.DB, events *eventBroker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		id := c.Param("id")
+		file, err := c.FormFile("bill")
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bill file must be uploaded"})
+			return
+		}
+		var status, serial string
+		err = db.QueryRow("SELECT COALESCE(status, ''), COALESCE(serial, '') FROM registrations WHERE id = ? AND user_id = ?", id, userID).Scan(&status, &serial)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Registration not found"})
+			return
+		}
+		if status != "needs_info" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only registrations that need more information can take a new bill"})
+			return
+		}
+		if !checkBillUpload(c, file) {
+			return
+		}
+		billURL, ok := saveBillUpload(c, userID, file)
+		if !ok {
+			return
+		}
+		regID, _ := strconv.Atoi(id)
+		newBill := registrationFile{Path: billURL, Kind: "bill", Hash: billFileHash(billURL)}
+		duplicateBill := isDuplicateBill(db, []registrationFile{newBill}, regID)
+		// The new bill replaces the old bills; warranty cards and other documents stay.
+		// The old files are only deleted once the swap is committed.
+		oldBills := registrationFilePaths(db, regID, "bill")
+		fail := func(status int, message string) {
+			removeBillFile(billURL)
+			c.JSON(status, gin.H{"error": message})
+		}
+		tx, err := beginWithRetry(db)
+		if err != nil {
+			fail(http.StatusInternalServerError, "DB error")
+			return
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec("UPDATE registrations SET bill_file = ?, status = 'pending', duplicate_bill = ?, version = version + 1 WHERE id = ? AND user_id = ? AND status = 'needs_info'", billURL, duplicateBill, id, userID)
+		if err != nil {
+			fail(http.StatusInternalServerError, "Update failed")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			fail(http.StatusConflict, "Registration was changed, reload and try again")
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM registration_files WHERE registration_id = ? AND kind = 'bill'", regID); err != nil {
+			fail(http.StatusInternalServerError, "Update failed")
+			return
+		}
+		if err := addRegistrationFiles(tx, int64(regID), []registrationFile{newBill}); err != nil {
+			fail(http.StatusInternalServerError, "Update failed")
+			return
+		}
+		recordRegistrationEvent(tx, id, "reuploaded")
+		if err := tx.Commit(); err != nil {
+			fail(http.StatusInternalServerError, "Update failed")
+			return
+		}
+		removeUnusedBillFiles(db, oldBills)
+		events.Publish("registration.status_changed", gin.H{"id": regID, "serial": serial, "old_status": status, "status": "pending"})
+		logInfo("User %d uploaded a new bill for registration %s", userID, id)
+		c.JSON(http.StatusOK, gin.H{"status": "pending", "bill_file": billURL})
+	}
+}
+
+// Admin: Registrations for one product, e.g. for a recall, with the export's
+// from/to/status filters and paging
+func listProductRegistrations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID := c.Param("id")
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", productID).Scan(&exists); err != nil || exists == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		where, args, err := registrationExportFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if where == "" {
+			where = "WHERE r.product_id = ?"
+		} else {
+			where += " AND r.product_id = ?"
+		}
+		args = append(args, productID)
+
+		from := " FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id " + where
+		var total int
+		db.QueryRow("SELECT COUNT(*)"+from, args...).Scan(&total)
+		rows, err := db.Query(`SELECT r.id, u.username, COALESCE(u.company, ''), p.name, r.serial, r.bill_file, r.status, COALESCE(r.notes, ''), r.version, r.created_at, COALESCE(r.duplicate_bill, 0)`+from+` ORDER BY r.id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		setPagingHeaders(c, total, limit, offset)
+		regs := []map[string]interface{}{}
+		for rows.Next() {
+			var id, version int
+			var username, company, pname, serial, bill, status, notes, created string
+			var duplicateBill bool
+			rows.Scan(&id, &username, &company, &pname, &serial, &bill, &status, &notes, &version, &created, &duplicateBill)
+			regs = append(regs, gin.H{"id": id, "user": username, "company": company, "product": pname, "serial": serial, "bill_file": bill, "status": status, "notes": notes, "version": version, "created_at": created, "duplicate_bill": duplicateBill})
+		}
+		c.JSON(http.StatusOK, regs)
+	}
+}
+
+// Admin: Registrations of a product whose serial doesn't match its serial pattern,
+// or a proposed ?pattern= to review before saving it. Nothing is changed.
+func listNonconformingRegistrations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		productID := c.Param("id")
+		var current string
+		if err := db.QueryRow("SELECT COALESCE(serial_pattern, '') FROM products WHERE id = ?", productID).Scan(&current); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		patternText := current
+		if proposed, ok := c.GetQuery("pattern"); ok {
+			patternText = proposed
+		}
+		pattern, err := compileSerialPattern(patternText)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid serial pattern"})
+			return
+		}
+
+		// Patterns are regular expressions, so matching happens here rather than in SQL
+		nonconforming := []map[string]interface{}{}
+		if pattern != nil {
+			rows, err := db.Query(`SELECT r.id, u.username, COALESCE(u.company, ''), r.serial, r.status, r.version, r.created_at
+				FROM registrations r JOIN users u ON r.user_id=u.id WHERE r.product_id = ? ORDER BY r.id`, productID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id, version int
+				var username, company, serial, status, created string
+				rows.Scan(&id, &username, &company, &serial, &status, &version, &created)
+				if !pattern.MatchString(serial) {
+					nonconforming = append(nonconforming, gin.H{"id": id, "user": username, "company": company, "serial": serial, "status": status, "version": version, "created_at": created})
+				}
+			}
+		}
+		total := len(nonconforming)
+		setPagingHeaders(c, total, limit, offset)
+		page := []map[string]interface{}{}
+		if offset < total {
+			end := offset + limit
+			if end > total {
+				end = total
+			}
+			page = nonconforming[offset:end]
+		}
+		pid, _ := strconv.Atoi(productID)
+		c.JSON(http.StatusOK, gin.H{"product_id": pid, "serial_pattern": patternText, "total": total, "registrations": page})
+	}
+}
+
+// A change to a registration, pushed to admin dashboards over SSE
+type registrationEvent struct {
+	Type   string      `json:"type"`
+	Data   interface{} `json:"data"`
+	SentAt string      `json:"sent_at"`
+}
+
+// In-process pub/sub for registration events. A subscriber that falls behind
+// misses events rather than blocking the handlers that publish them.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan registrationEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan registrationEvent]struct{})}
+}
+
+func (b *eventBroker) Subscribe() chan registrationEvent {
+	ch := make(chan registrationEvent, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) Unsubscribe(ch chan registrationEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBroker) Publish(eventType string, data interface{}) {
+	event := registrationEvent{Type: eventType, Data: data, SentAt: time.Now().Format(time.RFC3339)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Admin: Server-sent events for new registrations and status changes, with a heartbeat every 30s
+func streamEvents(events *eventBroker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ch := events.Subscribe()
+		defer events.Unsubscribe(ch)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no") // Don't let nginx buffer the stream
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(30 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case event := <-ch:
+				c.SSEvent(event.Type, event)
+				c.Writer.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(c.Writer, ": heartbeat\n\n")
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// Reply with JSON and a strong ETag, or 304 when it matches If-None-Match
+func respondWithETag(c *gin.Context, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Encoding failed"})
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// Admin: List all registrations. ?after=<id> switches from page/offset paging to a
+// cursor, which stays consistent while new registrations are being added.
+func listRegistrations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		after := int64(-1)
+		if value := c.Query("after"); value != "" {
+			after, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || after < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "after must be a registration id"})
+				return
+			}
+		}
+		// The cursor is an id, so cursor paging only works in id order
+		if after >= 0 && (c.Query("sort") != "" || c.Query("order") != "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort and order can't be combined with after"})
+			return
+		}
+		orderBy, err := parseSort(c, registrationSortColumns, "r.id")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query := `SELECT r.id, u.username, p.name, r.serial, r.bill_file, r.status, COALESCE(r.notes, ''), r.version, r.created_at, COALESCE(r.duplicate_bill, 0), COALESCE(r.registration_meta, '') FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id`
+		var rows *sql.Rows
+		if after >= 0 {
+			rows, err = db.Query(query+` WHERE r.id > ?`+orderBy+` LIMIT ?`, after, limit)
+		} else {
+			rows, err = db.Query(query+orderBy+` LIMIT ? OFFSET ?`, limit, offset)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		// Pages are offsets, so the headers only describe page paging, not the id cursor
+		if after < 0 {
+			var total int
+			db.QueryRow("SELECT COUNT(*) FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id").Scan(&total)
+			setPagingHeaders(c, total, limit, offset)
+		}
+		defer rows.Close()
+		var regs []map[string]interface{}
+		for rows.Next() {
+			var id, version int
+			var username, pname, serial, bill, status, notes, meta string
+			var created string
+			var duplicateBill bool
+			rows.Scan(&id, &username, &pname, &serial, &bill, &status, &notes, &version, &created, &duplicateBill, &meta)
+			regs = append(regs, gin.H{"id": id, "user": username, "product": pname, "serial": serial, "bill_file": bill, "status": status, "notes": notes, "version": version, "created_at": created, "duplicate_bill": duplicateBill, "meta": decodeRegistrationMeta(meta)})
+		}
+		if after < 0 {
+			respondWithETag(c, regs)
+			return
+		}
+		// A full page means there may be more; the cursor is the last id returned
+		var nextCursor interface{}
+		if len(regs) == limit {
+			nextCursor = regs[len(regs)-1]["id"]
+		}
+		if regs == nil {
+			regs = []map[string]interface{}{}
+		}
+		respondWithETag(c, gin.H{"registrations": regs, "next_cursor": nextCursor})
+	}
+}
+
+// Delivers a notification (e.g. an SMS) to a recipient
+type notificationSender interface {
+	Send(channel, recipient, message string) error
+}
+
+// Posts notifications as JSON to a webhook that forwards them to the SMS/email provider
+type webhookNotificationSender struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookNotificationSender) Send(channel, recipient, message string) error {
+	body, err := json.Marshal(map[string]string{"channel": channel, "to": recipient, "message": message})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Notification sender from NOTIFY_WEBHOOK_URL, nil when notifications are disabled
+func newNotificationSender() notificationSender {
+	webhookURL := os.Getenv("NOTIFY_WEBHOOK_URL")
+	if webhookURL == "" {
+		return nil
+	}
+	return &webhookNotificationSender{url: webhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// In-process notification queue. Jobs are stored in notification_jobs before
+// they're queued so pending ones survive a restart; workers send them with retries.
+type notificationQueue struct {
+	db          *sql.DB
+	sender      notificationSender
+	jobs        chan int64
+	queued      sync.Map // ids sitting in jobs, so a sweep doesn't queue them twice
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+// Start the queue's workers and requeue jobs left pending by the last run.
+// Returns nil when there's no sender; a nil queue drops notifications.
+func startNotificationQueue(db *sql.DB, sender notificationSender) *notificationQueue {
+	if sender == nil {
+		return nil
+	}
+	q := &notificationQueue{
+		db:          db,
+		sender:      sender,
+		jobs:        make(chan int64, 100),
+		maxAttempts: getEnvInt("NOTIFY_MAX_ATTEMPTS", 5),
+		retryDelay:  2 * time.Second,
+	}
+	workers := getEnvInt("NOTIFY_WORKERS", 2)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	// A job still "sending" was interrupted mid-delivery
+	execWithRetry(db, "UPDATE notification_jobs SET status = 'pending' WHERE status = 'sending'")
+	queued := q.sweep()
+	// Jobs that didn't fit in the buffer wait in the table for a later sweep
+	interval := time.Duration(getEnvInt("NOTIFY_SWEEP_SECONDS", 30)) * time.Second
+	go func() {
+		for {
+			time.Sleep(interval)
+			q.sweep()
+		}
+	}()
+	logInfo("Notification queue started with %d workers, %d pending jobs queued", workers, queued)
+	return q
+}
+
+// Queue pending jobs, oldest first, until the buffer is full. Returns how many were queued.
+func (q *notificationQueue) sweep() int {
+	rows, err := q.db.Query("SELECT id FROM notification_jobs WHERE status = 'pending' ORDER BY id")
+	if err != nil {
+		logError("Failed to load pending notifications: %v", err)
+		return 0
+	}
+	var pending []int64
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		pending = append(pending, id)
+	}
+	rows.Close()
+	queued := 0
+	for _, id := range pending {
+		if !q.dispatch(id) {
+			break
+		}
+		queued++
+	}
+	return queued
+}
+
+// Store a notification and queue it for delivery without waiting for it to be sent
+func (q *notificationQueue) Enqueue(channel, recipient, message string) error {
+	if q == nil {
+		return nil
+	}
+	now := time.Now()
+	res, err := execWithRetry(q.db, "INSERT INTO notification_jobs (channel, recipient, message, status, attempts, last_error, created_at, updated_at) VALUES (?, ?, ?, 'pending', 0, '', ?, ?)", channel, recipient, message, now, now)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	q.dispatch(id)
+	return nil
+}
+
+// Hand a job to the workers without blocking the caller. When the buffer is
+// full the job stays pending in notification_jobs for the next sweep.
+func (q *notificationQueue) dispatch(id int64) bool {
+	if _, loaded := q.queued.LoadOrStore(id, true); loaded {
+		return true
+	}
+	select {
+	case q.jobs <- id:
+		return true
+	default:
+		q.queued.Delete(id)
+		return false
+	}
+}
+
+func (q *notificationQueue) work() {
+	for id := range q.jobs {
+		q.queued.Delete(id)
+		q.deliver(id)
+	}
+}
+
+// Send one job, retrying with backoff, and record the outcome
+func (q *notificationQueue) deliver(id int64) {
+	// Claim the job so a duplicate dispatch doesn't send it twice
+	res, err := execWithRetry(q.db, "UPDATE notification_jobs SET status = 'sending', updated_at = ? WHERE id = ? AND status = 'pending'", time.Now(), id)
+	if err != nil {
+		logError("Failed to claim notification %d: %v", id, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	var channel, recipient, message string
+	if err := q.db.QueryRow("SELECT channel, recipient, message FROM notification_jobs WHERE id = ?", id).Scan(&channel, &recipient, &message); err != nil {
+		logError("Failed to load notification %d: %v", id, err)
+		return
+	}
+
+	delay := q.retryDelay
+	for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+		err = q.sender.Send(channel, recipient, message)
+		if err == nil {
+			execWithRetry(q.db, "UPDATE notification_jobs SET status = 'sent', attempts = attempts + 1, last_error = '', updated_at = ? WHERE id = ?", time.Now(), id)
+			return
+		}
+		execWithRetry(q.db, "UPDATE notification_jobs SET attempts = attempts + 1, last_error = ?, updated_at = ? WHERE id = ?", err.Error(), time.Now(), id)
+		if attempt < q.maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	execWithRetry(q.db, "UPDATE notification_jobs SET status = 'failed', updated_at = ? WHERE id = ?", time.Now(), id)
+	logError("Notification %d to %s failed after %d attempts: %v", id, recipient, q.maxAttempts, err)
+}
+
+var notificationStatuses = []string{"pending", "sending", "sent", "failed"}
+
+// Admin: List notification jobs, optionally by status, with attempt counts and last error
+func listNotifications(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		where := ""
+		var args []interface{}
+		if status := c.Query("status"); status != "" {
+			valid := false
+			for _, s := range notificationStatuses {
+				if status == s {
+					valid = true
+				}
+			}
+			if !valid {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of " + strings.Join(notificationStatuses, ", ")})
+				return
+			}
+			where = " WHERE status = ?"
+			args = append(args, status)
+		}
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM notification_jobs"+where, args...).Scan(&total)
+		setPagingHeaders(c, total, limit, offset)
+		args = append(args, limit, offset)
+		rows, err := db.Query("SELECT id, channel, recipient, message, status, attempts, COALESCE(last_error, ''), created_at, updated_at FROM notification_jobs"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		jobs := []map[string]interface{}{}
+		for rows.Next() {
+			var id, attempts int
+			var channel, recipient, message, status, lastError, createdAt, updatedAt string
+			rows.Scan(&id, &channel, &recipient, &message, &status, &attempts, &lastError, &createdAt, &updatedAt)
+			jobs = append(jobs, gin.H{"id": id, "channel": channel, "recipient": recipient, "message": message, "status": status, "attempts": attempts, "last_error": lastError, "created_at": createdAt, "updated_at": updatedAt})
+		}
+		c.JSON(http.StatusOK, jobs)
+	}
+}
+
+// Admin: Requeue a failed notification
+func retryNotification(db *sql.DB, notifier *notificationQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if notifier == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Notifications are not configured"})
+			return
+		}
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification id"})
+			return
+		}
+		res, err := execWithRetry(db, "UPDATE notification_jobs SET status = 'pending', updated_at = ? WHERE id = ? AND status = 'failed'", time.Now(), id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Retry failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var status string
+			if err := db.QueryRow("SELECT status FROM notification_jobs WHERE id = ?", id).Scan(&status); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "Only failed notifications can be retried", "status": status})
+			return
+		}
+		notifier.dispatch(id)
+		logInfo("Admin requeued notification %d", id)
+		c.JSON(http.StatusOK, gin.H{"status": "queued"})
+	}
+}
+
+// SMS text telling a customer their registration was reviewed
+func registrationStatusMessage(serial, status, notes string) string {
+	message := fmt.Sprintf("%s: your registration for serial %s was %s.", portalTitle(), serial, status)
+	if status == "needs_info" {
+		message = fmt.Sprintf("%s: your registration for serial %s needs more information. Please upload your bill again.", portalTitle(), serial)
+	}
+	if notes != "" {
+		message += " Note: " + notes
+	}
+	return message
+}
+
+// Admin: Approve/reject/edit registration
+func updateRegistration(db *sql.DB, notifier *notificationQueue, events *eventBroker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var req struct {
+			Status     string  `json:"status"`
+			Serial     string  `json:"serial"`
+			Notes      *string `json:"notes"`
+			ReasonCode string  `json:"reason_code"`
+			Version    *int    `json:"version"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.Version == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "version is required"})
+			return
+		}
+		if !isValidStatus(req.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("status must be one of: %s", strings.Join(registrationStatuses, ", "))})
+			return
+		}
+		serial := strings.ToUpper(req.Serial)
+		// Notes are optional; leaving them out keeps the existing note
+		var notes sql.NullString
+		if req.Notes != nil {
+			notes = sql.NullString{String: sanitizeNotes(*req.Notes), Valid: true}
+			if err := checkFieldLengths(fieldLimit{"notes", notes.String, maxNotesLength}); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		var oldStatus, oldSerial, mobile, email, oldNotes string
+		var productID int
+		db.QueryRow("SELECT COALESCE(r.status, ''), COALESCE(r.serial, ''), COALESCE(u.mobile, ''), CASE WHEN u.email_verified = 1 THEN COALESCE(u.email, '') ELSE '' END, COALESCE(r.notes, ''), r.product_id FROM registrations r JOIN users u ON r.user_id=u.id WHERE r.id=?", id).Scan(&oldStatus, &oldSerial, &mobile, &email, &oldNotes, &productID)
+		// An edited serial is stored the way registerProduct would have stored it
+		if serial != oldSerial {
+			transform, err := loadSerialTransform(db, productID)
+			if err != nil && err != sql.ErrNoRows {
+				logWarn("Invalid serial transform for product %d: %v", productID, err)
+			}
+			if serial = transform.Apply(serial); serial == "" {
+				msg := "Serial number is empty once the product's serial format is applied"
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg, "fields": gin.H{"serial": msg}})
+				return
+			}
+		}
+		// Asking for more information needs a note telling the customer what's missing
+		if req.Status == "needs_info" && ((notes.Valid && notes.String == "") || (!notes.Valid && oldNotes == "")) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "notes are required when asking for more information"})
+			return
+		}
+		// A reason code only applies to rejections and must be one of reject_reasons
+		var reasonCode sql.NullString
+		if req.ReasonCode != "" {
+			if req.Status != "rejected" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "reason_code is only allowed when rejecting"})
+				return
+			}
+			var count int
+			db.QueryRow("SELECT COUNT(*) FROM reject_reasons WHERE code = ? AND active = 1", req.ReasonCode).Scan(&count)
+			if count == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown reason_code"})
+				return
+			}
+			reasonCode = sql.NullString{String: req.ReasonCode, Valid: true}
+		}
+		if req.Status == "approved" {
+			var count int
+			db.QueryRow("SELECT COUNT(*) FROM registrations WHERE serial = ? COLLATE NOCASE AND status = 'approved' AND id != ?", serial, id).Scan(&count)
+			if count > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "Serial already approved elsewhere"})
+				return
+			}
+		}
+		res, err := execWithRetry(db, "UPDATE registrations SET status=?, serial=?, notes=COALESCE(?, notes), reason_code=?, version=version+1 WHERE id=? AND version=?", req.Status, serial, notes, reasonCode, id, *req.Version)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			respondVersionMismatch(db, c, "SELECT version FROM registrations WHERE id=?", id, "Registration not found")
+			return
+		}
+		recordAudit(db, c, "registration.updated", "registration:"+id, fmt.Sprintf("status=%s->%s serial=%s", oldStatus, req.Status, serial))
+		logInfo("Admin updated registration %s: %s", id, req.Status)
+		if req.Status != oldStatus || serial != oldSerial {
+			recordRegistrationEvent(db, id, "updated")
+		}
+		if req.Status != oldStatus {
+			regID, _ := strconv.Atoi(id)
+			events.Publish("registration.status_changed", gin.H{"id": regID, "serial": serial, "old_status": oldStatus, "status": req.Status})
+		}
+		// Tell the customer once their registration has been reviewed, by SMS and
+		// by email when they've verified one
+		if req.Status != oldStatus && req.Status != "pending" && (mobile != "" || email != "") {
+			var currentNotes string
+			db.QueryRow("SELECT COALESCE(notes, '') FROM registrations WHERE id=?", id).Scan(&currentNotes)
+			message := registrationStatusMessage(serial, req.Status, currentNotes)
+			if mobile != "" {
+				if err := notifier.Enqueue("sms", mobile, message); err != nil {
+					logError("Failed to queue notification for registration %s: %v", id, err)
+				}
+			}
+			if email != "" {
+				if err := notifier.Enqueue("email", email, message); err != nil {
+					logError("Failed to queue email for registration %s: %v", id, err)
+				}
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "updated", "version": *req.Version + 1})
+	}
+}
+
+// Filesystem path of a stored bill from its URL path (e.g. "bills/1_123.pdf")
+func billFullPath(billURL string) (string, error) {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data" // Fallback
+	}
+	return safeJoin(filepath.Join(dataDir, "bills"), filepath.Base(billURL))
+}
+
+// Join a user-supplied or archive-entry name onto base, rejecting names that
+// would resolve to base itself or anywhere outside it (zip-slip, "../" tricks)
+func safeJoin(base, name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) || filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		return "", fmt.Errorf("unsafe path %q", name)
+	}
+	joined := filepath.Join(base, filepath.FromSlash(strings.ReplaceAll(name, "\\", "/")))
+	rel, err := filepath.Rel(base, joined)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path %q", name)
+	}
+	return joined, nil
+}
+
+// Delete a stored bill by its URL path. A file that's already gone isn't an error.
+func removeBillFile(billURL string) error {
+	fullPath, err := billFullPath(billURL)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// File kinds a registration can carry, each uploaded in the form field of the same name
+var registrationFileKinds = []string{"bill", "warranty", "other"}
+
+// Most files one registration can be submitted with
+const maxRegistrationFiles = 5
+
+// A stored file attached to a registration
+type registrationFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	Hash string `json:"-"`
+}
+
+type registrationUpload struct {
+	file *multipart.FileHeader
+	kind string
+}
+
+// Files in the registration form's bill, warranty and other fields, which may
+// each repeat. A form that isn't multipart has none; other errors, such as the
+// body going over the size limit, are returned.
+func formRegistrationFiles(c *gin.Context) ([]registrationUpload, error) {
+	uploads := []registrationUpload{}
+	form, err := c.MultipartForm()
+	if err == http.ErrNotMultipart {
+		return uploads, nil
+	} else if err != nil {
+		return uploads, err
+	}
+	for _, kind := range registrationFileKinds {
+		for _, file := range form.File[kind] {
+			uploads = append(uploads, registrationUpload{file: file, kind: kind})
+		}
+	}
+	return uploads, nil
+}
+
+func addRegistrationFiles(tx execer, registrationID int64, files []registrationFile) error {
+	for _, f := range files {
+		if _, err := tx.Exec("INSERT INTO registration_files (registration_id, path, kind, created_at, sha256) VALUES (?, ?, ?, ?, ?)", registrationID, f.Path, f.Kind, time.Now(), f.Hash); err != nil {
+			logError("Error recording file %s for registration %d: %v", f.Path, registrationID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Files of a registration in upload order, optionally only of one kind
+func registrationFiles(db *sql.DB, registrationID int, kind string) []registrationFile {
+	files := []registrationFile{}
+	rows, err := db.Query("SELECT path, kind FROM registration_files WHERE registration_id = ? AND (? = '' OR kind = ?) ORDER BY id", registrationID, kind, kind)
+	if err != nil {
+		return files
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f registrationFile
+		rows.Scan(&f.Path, &f.Kind)
+		files = append(files, f)
+	}
+	return files
+}
+
+func registrationFilePaths(db *sql.DB, registrationID int, kind string) []string {
+	paths := []string{}
+	for _, f := range registrationFiles(db, registrationID, kind) {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// SHA-256 of a stored bill, "" when it can't be read
+func billFileHash(billURL string) string {
+	fullPath, err := billFullPath(billURL)
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		logWarn("Could not hash bill file %s: %v", billURL, err)
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		logWarn("Could not hash bill file %s: %v", billURL, err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash bills stored before hashes were recorded, so duplicates of older bills
+// are detected too. Files that can't be read are marked with an empty hash
+// rather than retried on every start. Returns how many bills were hashed.
+func backfillBillHashes(db *sql.DB) int {
+	rows, err := db.Query("SELECT DISTINCT path FROM registration_files WHERE sha256 IS NULL")
+	if err != nil {
+		logWarn("Could not backfill bill hashes: %v", err)
+		return 0
+	}
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		paths = append(paths, path)
+	}
+	rows.Close()
+	hashed := 0
+	for _, path := range paths {
+		hash := billFileHash(path)
+		if _, err := execWithRetry(db, "UPDATE registration_files SET sha256 = ? WHERE path = ? AND sha256 IS NULL", hash, path); err != nil {
+			logWarn("Could not record hash of bill file %s: %v", path, err)
+			continue
+		}
+		if hash != "" {
+			hashed++
+		}
+	}
+	if len(paths) > 0 {
+		logInfo("Backfilled hashes for %d of %d older bill files", hashed, len(paths))
+	}
+	return hashed
+}
+
+// Whether any of the bills is identical to one already attached to another
+// registration (other than exceptID), which may be an invoice reused to game
+// registrations. It only flags the registration for review.
+func isDuplicateBill(db *sql.DB, files []registrationFile, exceptID int) bool {
+	for _, f := range files {
+		if f.Kind != "bill" || f.Hash == "" {
+			continue
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM registration_files WHERE kind = 'bill' AND sha256 = ? AND registration_id != ?", f.Hash, exceptID).Scan(&count)
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete stored files no registration refers to any more, returning how many were removed
+func removeUnusedBillFiles(db *sql.DB, paths []string) int {
+	removed := 0
+	for _, path := range paths {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM registration_files WHERE path = ?", path).Scan(&count)
+		if count > 0 {
+			continue
+		}
+		if err := removeBillFile(path); err != nil {
+			logWarn("Could not delete bill file %s: %v", path, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// Registrations matching a condition on r that have files, and the files they use
+func registrationsWithFiles(db *sql.DB, where string, args ...interface{}) ([]int, []string, error) {
+	rows, err := db.Query("SELECT f.registration_id, f.path FROM registration_files f JOIN registrations r ON r.id = f.registration_id WHERE "+where+" ORDER BY f.registration_id, f.id", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	paths := []string{}
+	seenIDs := map[int]bool{}
+	seenPaths := map[string]bool{}
+	for rows.Next() {
+		var id int
+		var path string
+		rows.Scan(&id, &path)
+		if !seenIDs[id] {
+			seenIDs[id] = true
+			ids = append(ids, id)
+		}
+		if !seenPaths[path] {
+			seenPaths[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return ids, paths, rows.Err()
+}
+
+// Delete bill files of registrations created before a date and clear their bill_file,
+// keeping the registrations. Files still used by a newer registration are kept.
+func purgeBillsBefore(db *sql.DB, before time.Time, dryRun bool) (int, int, error) {
+	cutoff := before.Format("2006-01-02")
+	ids, paths, err := registrationsWithFiles(db, "r.created_at < ?", cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removable := []string{}
+	for _, path := range paths {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM registration_files f JOIN registrations r ON r.id = f.registration_id WHERE f.path = ? AND r.created_at >= ?", path, cutoff).Scan(&count)
+		if count == 0 {
+			removable = append(removable, path)
+		}
+	}
+	if dryRun {
+		return len(ids), len(removable), nil
+	}
+
+	for _, id := range ids {
+		if _, err := execWithRetry(db, "UPDATE registrations SET bill_file='', version=version+1 WHERE id = ?", id); err != nil {
+			return 0, 0, err
+		}
+		if _, err := execWithRetry(db, "DELETE FROM registration_files WHERE registration_id = ?", id); err != nil {
+			return 0, 0, err
+		}
+		recordRegistrationEvent(db, id, "bill_purged")
+	}
+	removedFiles := 0
+	for _, bill := range removable {
+		if err := removeBillFile(bill); err != nil {
+			logWarn("Could not delete bill file %s: %v", bill, err)
+			continue
+		}
+		removedFiles++
+	}
+	return len(ids), removedFiles, nil
+}
+
+// Admin: Delete bills of registrations created before ?before=YYYY-MM-DD, optionally as a dry run
+func purgeOldBills(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		before, err := time.ParseInLocation("2006-01-02", c.Query("before"), time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a date (YYYY-MM-DD)"})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		regs, files, err := purgeBillsBefore(db, before, dryRun)
+		if err != nil {
+			logError("Bill purge failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Purge failed"})
+			return
+		}
+		logInfo("Admin purged bills before %s (dry run: %v): %d registrations, %d bill files", before.Format("2006-01-02"), dryRun, regs, files)
+		c.JSON(http.StatusOK, gin.H{"dry_run": dryRun, "before": before.Format("2006-01-02"), "registrations": regs, "bill_files": files})
+	}
+}
+
+// A registration file whose path no longer exists in the bills folder
+type missingBill struct {
+	RegistrationID int    `json:"registration_id"`
+	Path           string `json:"path"`
+	Kind           string `json:"kind"`
+}
+
+// Registration files that point at bills missing on disk
+func findMissingBills(db *sql.DB) ([]missingBill, error) {
+	rows, err := db.Query("SELECT registration_id, path, kind FROM registration_files WHERE path != '' ORDER BY registration_id, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	missing := []missingBill{}
+	for rows.Next() {
+		var m missingBill
+		rows.Scan(&m.RegistrationID, &m.Path, &m.Kind)
+		fullPath, err := billFullPath(m.Path)
+		if err == nil {
+			if _, err = os.Stat(fullPath); !os.IsNotExist(err) {
+				continue
+			}
+		}
+		missing = append(missing, m)
+	}
+	return missing, rows.Err()
+}
+
+// Drop references to missing bills in one transaction. A registration's
+// bill_file falls back to its next remaining bill, or is cleared. Returns the
+// registrations changed.
+func clearMissingBills(db *sql.DB, missing []missingBill) (int, error) {
+	tx, err := beginWithRetry(db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	changed := []int{}
+	seen := map[int]bool{}
+	for _, m := range missing {
+		if _, err := tx.Exec("DELETE FROM registration_files WHERE registration_id = ? AND path = ?", m.RegistrationID, m.Path); err != nil {
+			return 0, err
+		}
+		if !seen[m.RegistrationID] {
+			seen[m.RegistrationID] = true
+			changed = append(changed, m.RegistrationID)
+		}
+	}
+	for _, id := range changed {
+		_, err := tx.Exec(`UPDATE registrations SET bill_file = COALESCE((SELECT path FROM registration_files
+			WHERE registration_id = registrations.id AND kind = 'bill' ORDER BY id LIMIT 1), ''), version = version + 1 WHERE id = ?`, id)
+		if err != nil {
+			return 0, err
+		}
+		recordRegistrationEvent(tx, id, "bill_missing_cleared")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(changed), nil
+}
+
+// Admin: Registrations whose bill files are missing on disk
+func billIntegrity(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		missing, err := findMissingBills(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		regs := map[int]bool{}
+		for _, m := range missing {
+			regs[m.RegistrationID] = true
+		}
+		c.JSON(http.StatusOK, gin.H{"missing": missing, "missing_count": len(missing), "registrations": len(regs)})
+	}
+}
+
+// Admin: Clear references to missing bill files, optionally as a dry run
+func repairBillIntegrity(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dryRun := c.Query("dry_run") == "true"
+		missing, err := findMissingBills(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		regs := map[int]bool{}
+		for _, m := range missing {
+			regs[m.RegistrationID] = true
+		}
+		changed := len(regs)
+		if !dryRun {
+			if changed, err = clearMissingBills(db, missing); err != nil {
+				logError("Bill integrity repair failed: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Repair failed"})
+				return
+			}
+		}
+		logInfo("Admin cleared missing bill references (dry run: %v): %d files, %d registrations", dryRun, len(missing), changed)
+		c.JSON(http.StatusOK, gin.H{"dry_run": dryRun, "missing": missing, "files_cleared": len(missing), "registrations": changed})
+	}
+}
+
+// Serve a stored bill by name, refusing anything that resolves outside the bills folder
+func serveBill(billsDir string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		billPath, err := safeJoin(billsDir, strings.TrimPrefix(c.Param("name"), "/"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+			return
+		}
+		info, err := os.Stat(billPath)
+		if err != nil || info.IsDir() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+			return
+		}
+		c.File(billPath)
+	}
+}
+
+// GET /bills/*name: /bills/view/{filename} previews a bill behind a login, anything
+// else is the plain download. Gin won't register /bills/view/:filename beside the
+// catch-all, so the preview branches off here.
+func billRoutes(db *sql.DB, billsDir string) gin.HandlerFunc {
+	download := serveBill(billsDir)
+	view := gin.HandlersChain{requireRole(db), viewBill(db, billsDir)}
+	return func(c *gin.Context) {
+		if !strings.HasPrefix(c.Param("name"), "/view/") {
+			download(c)
+			return
+		}
+		for _, h := range view {
+			if h(c); c.IsAborted() {
+				return
+			}
+		}
+	}
+}
+
+// Any user: Show a bill inline (GET /bills/view/{filename}) with its detected content
+// type so browsers render PDFs and images. Customers may only view their own bills.
+func viewBill(db *sql.DB, billsDir string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := strings.TrimPrefix(c.Param("name"), "/view/")
+		billPath, err := safeJoin(billsDir, filename)
+		if err != nil || strings.ContainsAny(filename, "/\\") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+			return
+		}
+		if c.GetString("role") == roleCustomer {
+			var owned int
+			db.QueryRow(`SELECT COUNT(*) FROM registrations r WHERE r.user_id = ? AND (r.bill_file = ?
+				OR EXISTS (SELECT 1 FROM registration_files f WHERE f.registration_id = r.id AND f.path = ?))`,
+				c.GetInt("userID"), "bills/"+filename, "bills/"+filename).Scan(&owned)
+			if owned == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+				return
+			}
+		}
+		f, err := os.Open(billPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+			return
+		}
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		contentType := http.DetectContentType(head[:n])
+		if strings.HasPrefix(contentType, "application/octet-stream") {
+			if byExt := mime.TypeByExtension(filepath.Ext(filename)); byExt != "" {
+				contentType = byExt
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read bill"})
+			return
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+		c.Header("X-Content-Type-Options", "nosniff")
+		http.ServeContent(c.Writer, c.Request, filename, info.ModTime(), f)
+	}
+}
+
+// Admin: Delete bill file from registration
+func deleteBillFile(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		paths := registrationFilePaths(db, id, "")
+		if len(paths) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
+			return
+		}
+
+		// Clear the bill_file field and the registration's files in the database
+		if _, err := execWithRetry(db, "UPDATE registrations SET bill_file='', version=version+1 WHERE id=?", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		if _, err := execWithRetry(db, "DELETE FROM registration_files WHERE registration_id = ?", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+
+		// Delete the physical files other serials of the same submission don't share
+		removed := removeUnusedBillFiles(db, paths)
+
+		recordAudit(db, c, "registration.bill_deleted", fmt.Sprintf("registration:%d", id), fmt.Sprintf("files=%d", len(paths)))
+		logInfo("Admin deleted %d bill files for registration %d", len(paths), id)
+		c.JSON(http.StatusOK, gin.H{"status": "bill deleted", "files": len(paths), "files_removed": removed})
+	}
+}
+
+// Turn a search term with * wildcards into a LIKE pattern (ESCAPE '\'),
+// escaping literal % and _ so they only match themselves
+func wildcardToLike(term string) string {
+	return strings.ReplaceAll(escapeLike(term), "*", "%")
+}
+
+// Escape % and _ so a term matches them literally in a LIKE ... ESCAPE '\' pattern
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+}
+
+// Admin: Up to 20 distinct company names starting with ?q=, for autocomplete.
+// Matched on the normalized name, so case, dots and suffixes like "Pvt Ltd" don't matter.
+func listCompanies(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prefix := normalizeCompany(c.Query("q"))
+		rows, err := db.Query(`SELECT MIN(company) FROM users
+			WHERE username != 'admin' AND deleted_at IS NULL AND COALESCE(company, '') != '' AND company_normalized LIKE ? ESCAPE '\'
+			GROUP BY company_normalized ORDER BY company_normalized LIMIT 20`, escapeLike(prefix)+"%")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		companies := []string{}
+		for rows.Next() {
+			var company string
+			rows.Scan(&company)
+			companies = append(companies, company)
+		}
+		c.JSON(http.StatusOK, gin.H{"companies": companies})
+	}
+}
+
+// Admin: Search registration by serial; * wildcards return all matches
+func searchRegistration(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serial := c.Query("serial")
+		if strings.Contains(serial, "*") {
+			rows, err := db.Query(`SELECT r.id, u.username, p.name, r.serial, r.bill_file, r.status, r.version, r.created_at FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id WHERE r.serial LIKE ? ESCAPE '\' ORDER BY r.serial LIMIT 100`, wildcardToLike(serial))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+				return
+			}
+			defer rows.Close()
+			regs := []map[string]interface{}{}
+			for rows.Next() {
+				var id, version int
+				var username, pname, s, bill, status, created string
+				rows.Scan(&id, &username, &pname, &s, &bill, &status, &version, &created)
+				regs = append(regs, gin.H{"id": id, "user": username, "product": pname, "serial": s, "bill_file": bill, "status": status, "version": version, "created_at": created})
+			}
+			c.JSON(http.StatusOK, regs)
+			return
+		}
+		where, args := serialLookupCondition(db, "r", serial)
+		row := db.QueryRow(`SELECT r.id, u.username, p.name, r.serial, r.bill_file, r.status, r.version, r.created_at FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id WHERE `+where+` ORDER BY r.serial = ? DESC, r.id`, append(args, serial)...)
+		var id, version int
+		var username, pname, s, bill, status, created string
+		err := row.Scan(&id, &username, &pname, &s, &bill, &status, &version, &created)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "user": username, "product": pname, "serial": s, "bill_file": bill, "files": registrationFiles(db, id, ""), "status": status, "version": version, "created_at": created})
+	}
+}
+
+// Admin: Every registration ever made for a serial (any case), oldest first, across
+// users and statuses, including ones since purged
+func serialHistory(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serial := strings.TrimSpace(c.Param("serial"))
+		// Also find the serial as a product's transform stored it, e.g. "00123" for "SN-00123"
+		where, args := serialLookupCondition(db, "h", serial)
+		rows, err := db.Query(`SELECT h.registration_id, h.serial, h.event, COALESCE(h.status, ''), h.created_at,
+			h.user_id, COALESCE(u.username, ''), COALESCE(u.mobile, ''), COALESCE(u.company, ''),
+			h.product_id, COALESCE(p.name, '')
+			FROM registration_history h
+			LEFT JOIN users u ON h.user_id = u.id
+			LEFT JOIN products p ON h.product_id = p.id
+			WHERE (h.serial = ? COLLATE NOCASE OR `+where+`)
+			ORDER BY h.created_at, h.id`, append([]interface{}{serial}, args...)...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		history := []map[string]interface{}{}
+		for rows.Next() {
+			var registrationID, userID, productID int
+			var s, event, status, createdAt, username, mobile, company, productName string
+			rows.Scan(&registrationID, &s, &event, &status, &createdAt, &userID, &username, &mobile, &company, &productID, &productName)
+			history = append(history, gin.H{
+				"registration_id": registrationID,
+				"serial":          s,
+				"event":           event,
+				"status":          status,
+				"at":              formatDBTime(createdAt),
+				"user_id":         userID,
+				"user":            username,
+				"mobile":          mobile,
+				"company":         company,
+				"product_id":      productID,
+				"product":         productName,
+			})
+		}
+		if len(history) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No registrations for this serial"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"serial": serial, "history": history})
+	}
+}
+
+// Customer: List own registrations
+func listOwnRegistrations(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := db.Query(`SELECT r.id, p.name, r.serial, r.bill_file, r.status, COALESCE(r.notes, ''), r.created_at FROM registrations r JOIN products p ON r.product_id=p.id WHERE r.user_id=? ORDER BY r.id LIMIT ? OFFSET ?`, userID, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM registrations r JOIN products p ON r.product_id=p.id WHERE r.user_id=?", userID).Scan(&total)
+		setPagingHeaders(c, total, limit, offset)
+		defer rows.Close()
+		var regs []map[string]interface{}
+		for rows.Next() {
+			var id int
+			var pname, serial, bill, status, notes, created string
+			rows.Scan(&id, &pname, &serial, &bill, &status, &notes, &created)
+			regs = append(regs, gin.H{"id": id, "product": pname, "serial": serial, "bill_file": bill, "status": status, "notes": notes, "created_at": created})
+		}
+		c.JSON(http.StatusOK, regs)
+	}
+}
+
+// Active product pages customers have loaded, kept PRODUCTS_CACHE_SECONDS (default 30)
+// and dropped whenever a product is created, changed or deleted
+type productListCache struct {
+	mu      sync.Mutex
+	entries map[string]productListCacheEntry
+}
+
+type productListCacheEntry struct {
+	products []map[string]interface{}
+	total    int
+	expires  time.Time
+}
+
+var activeProductsCache = &productListCache{entries: map[string]productListCacheEntry{}}
+
+func (pc *productListCache) get(key string) ([]map[string]interface{}, int, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	entry, ok := pc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, 0, false
+	}
+	return entry.products, entry.total, true
+}
+
+func (pc *productListCache) set(key string, products []map[string]interface{}, total int) {
+	ttl := getEnvInt("PRODUCTS_CACHE_SECONDS", 30)
+	if ttl <= 0 {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.entries[key] = productListCacheEntry{products: products, total: total, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+func (pc *productListCache) invalidate() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.entries = map[string]productListCacheEntry{}
+}
+
+// Customer: List active products (for registration)
+func listActiveProducts(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logDebug("Customer requesting active products")
+		limit, offset, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		cacheKey := fmt.Sprintf("%d:%d", limit, offset)
+		if products, total, ok := activeProductsCache.get(cacheKey); ok {
+			setPagingHeaders(c, total, limit, offset)
+			c.JSON(http.StatusOK, products)
+			return
+		}
+		rows, err := db.Query("SELECT id, name, description FROM products WHERE active=1 ORDER BY id LIMIT ? OFFSET ?", limit, offset)
+		if err != nil {
+			logError("Error fetching active products: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		var products []map[string]interface{}
+		for rows.Next() {
+			var id int
+			var name, description string
+			rows.Scan(&id, &name, &description)
+			products = append(products, gin.H{
+				"id":          id,
+				"name":        name,
+				"description": description,
+				"active":      1, // Always 1 since we're filtering for active only
+				"image_url":   productImageURL(id),
+			})
+		}
+		if products == nil {
+			products = []map[string]interface{}{} // Return empty array instead of null
+		}
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM products WHERE active=1").Scan(&total)
+		logDebug("Returning %d active products to customer", len(products))
+		activeProductsCache.set(cacheKey, products, total)
+		setPagingHeaders(c, total, limit, offset)
+		c.JSON(http.StatusOK, products)
+	}
+}
+
+// Customer: Details of one active product before registering it. The internal
+// placeholder serial is left out; the serial pattern hints at the expected format.
+func getActiveProduct(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var id, warrantyMonths int
+		var name, description, serialPattern, metaSchema string
+		err := db.QueryRow("SELECT id, name, COALESCE(description, ''), COALESCE(serial_pattern, ''), COALESCE(warranty_months, 0), COALESCE(meta_schema, '') FROM products WHERE id = ? AND active = 1", c.Param("id")).
+			Scan(&id, &name, &description, &serialPattern, &warrantyMonths, &metaSchema)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":              id,
+			"name":            name,
+			"description":     description,
+			"serial_pattern":  serialPattern,
+			"warranty_months": warrantyMonths,
+			"image_url":       productImageURL(id),
+			"meta_schema":     decodeMetaSchema(metaSchema),
+		})
+	}
+}
+
+// Product images are kept in DATA_DIR/products
+func productImagesDir() string {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data" // Fallback
+	}
+	return filepath.Join(dataDir, "products")
+}
+
+var productImageTypes = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".gif": true}
+
+// Shown for products without an image
+const productImagePlaceholder = `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="200" viewBox="0 0 200 200"><rect width="200" height="200" fill="#e5e7eb"/><text x="100" y="106" font-family="sans-serif" font-size="16" fill="#9ca3af" text-anchor="middle">No image</text></svg>`
+
+// Image URL for a product; products without one get the placeholder
+func productImageURL(productID int) string {
+	return fmt.Sprintf("/products/image/%d", productID)
+}
+
+// Check an uploaded product image's size, extension and content, replying 400 when it's refused
+func checkProductImage(c *gin.Context, file *multipart.FileHeader) bool {
+	if file.Size > int64(maxUploadMB())*1024*1024 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", maxUploadMB())})
+		return false
+	}
+	if !productImageTypes[strings.ToLower(filepath.Ext(file.Filename))] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image type not allowed (allowed: .jpg, .jpeg, .png, .webp, .gif)"})
+		return false
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image"})
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if !strings.HasPrefix(http.DetectContentType(head[:n]), "image/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is not an image"})
+		return false
+	}
+	return true
+}
+
+// Save an uploaded product image and return its file name, replying with an error when it can't be saved
+func saveProductImage(c *gin.Context, file *multipart.FileHeader) (string, bool) {
+	dir := productImagesDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logError("Error creating product images directory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product images directory"})
+		return "", false
+	}
+	name := fmt.Sprintf("%d%s", time.Now().UnixNano(), strings.ToLower(filepath.Ext(file.Filename)))
+	path, err := safeJoin(dir, name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image file name"})
+		return "", false
+	}
+	if err := saveUploadedFileSync(file, path); err != nil {
+		logError("Error saving product image: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "File save failed"})
+		return "", false
+	}
+	return name, true
+}
+
+func removeProductImage(name string) {
+	if name == "" {
+		return
+	}
+	if path, err := safeJoin(productImagesDir(), name); err == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logWarn("Could not delete product image %s: %v", name, err)
+		}
+	}
+}
+
+// Serve a product's image, or the placeholder when it has none; public so <img> tags work
+func serveProductImage(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var image string
+		if err := db.QueryRow("SELECT COALESCE(image, '') FROM products WHERE id = ?", c.Param("id")).Scan(&image); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		if image != "" {
+			if path, err := safeJoin(productImagesDir(), image); err == nil {
+				if info, err := os.Stat(path); err == nil && !info.IsDir() {
+					c.File(path)
+					return
+				}
+			}
+			logWarn("Product image not found: %s", image)
+		}
+		c.Data(http.StatusOK, "image/svg+xml", []byte(productImagePlaceholder))
+	}
+}
+
+// Admin: List the reasons that can be given when rejecting a registration
+func listRejectReasons(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := db.Query("SELECT code, label FROM reject_reasons WHERE active = 1 ORDER BY code")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		reasons := []map[string]interface{}{}
+		for rows.Next() {
+			var code, label string
+			rows.Scan(&code, &label)
+			reasons = append(reasons, gin.H{"code": code, "label": label})
+		}
+		c.JSON(http.StatusOK, reasons)
+	}
+}
+
+// Admin: Rejected registrations per reason, for registrations created in an optional date range
+func rejectReasonStats(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		where, args, err := registrationExportFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if where == "" {
+			where = "WHERE r.status = 'rejected'"
+		} else {
+			where += " AND r.status = 'rejected'"
+		}
+		rows, err := db.Query("SELECT COALESCE(r.reason_code, ''), COUNT(*) FROM registrations r "+where+" GROUP BY COALESCE(r.reason_code, '')", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		counts := map[string]int{}
+		total := 0
+		for rows.Next() {
+			var code string
+			var count int
+			rows.Scan(&code, &count)
+			counts[code] = count
+			total += count
+		}
+		rows.Close()
+
+		// Every known reason is listed, including ones with no rejections
+		reasons := []map[string]interface{}{}
+		labels, err := db.Query("SELECT code, label FROM reject_reasons ORDER BY code")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		for labels.Next() {
+			var code, label string
+			labels.Scan(&code, &label)
+			reasons = append(reasons, gin.H{"code": code, "label": label, "count": counts[code]})
+			delete(counts, code)
+		}
+		labels.Close()
+		uncategorized := 0
+		for _, count := range counts {
+			uncategorized += count
+		}
+		c.JSON(http.StatusOK, gin.H{"total_rejected": total, "reasons": reasons, "uncategorized": uncategorized})
+	}
+}
+
+// Pending, needs_info, approved and rejected counts over the registrations selected
+const registrationStatusSums = `COALESCE(SUM(CASE WHEN status = 'pending' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'needs_info' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'approved' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'rejected' THEN 1 ELSE 0 END), 0)`
+
+// Admin: Dashboard
+func adminDashboard(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var users, regs, pending, needsInfo, approved, rejected, products, activeProducts int
+		err := db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM users),
+			COUNT(*),
+			`+registrationStatusSums+`,
+			(SELECT COUNT(*) FROM products),
+			(SELECT COALESCE(SUM(active = 1), 0) FROM products)
+			FROM registrations`).Scan(&users, &regs, &pending, &needsInfo, &approved, &rejected, &products, &activeProducts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total_users":         users,
+			"total_registrations": regs,
+			"pending_approvals":   pending,
+			"needs_info":          needsInfo,
+			"approved":            approved,
+			"rejected":            rejected,
+			"total_products":      products,
+			"active_products":     activeProducts,
+			"inactive_products":   products - activeProducts,
+		})
+	}
+}
+
+// Admin: Just the pending count, for the UI's badge. Polls send the ETag back
+// as If-None-Match and get 304 until the count changes.
+func pendingCount(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var pending int
+		if err := db.QueryRow("SELECT COUNT(*) FROM registrations WHERE status = 'pending'").Scan(&pending); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		respondWithETag(c, gin.H{"pending": pending})
+	}
+}
+
+// Customer: Dashboard
+func customerDashboard(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		var regs, pending, needsInfo int
+		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id=?", userID).Scan(&regs)
+		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id=? AND status='pending'", userID).Scan(&pending)
+		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id=? AND status='needs_info'", userID).Scan(&needsInfo)
+		c.JSON(http.StatusOK, gin.H{"my_registrations": regs, "my_pending": pending, "my_needs_info": needsInfo})
+	}
+}
+
+// Key for signing email verification links, from EMAIL_VERIFY_SECRET. Without
+// it a random key is used, so links stop working after a restart.
+var (
+	emailVerifyKeyOnce sync.Once
+	emailVerifyKeyData []byte
+)
+
+func emailVerifyKey() []byte {
+	emailVerifyKeyOnce.Do(func() {
+		if secret := os.Getenv("EMAIL_VERIFY_SECRET"); secret != "" {
+			emailVerifyKeyData = []byte(secret)
+			return
+		}
+		emailVerifyKeyData = make([]byte, 32)
+		rand.Read(emailVerifyKeyData)
+		logWarn("EMAIL_VERIFY_SECRET not set; email verification links won't survive a restart")
+	})
+	return emailVerifyKeyData
+}
+
+// Sign a link token binding the user, the email being verified and an expiry
+func signEmailVerification(userID int, email string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d|%d|%s", userID, expires.Unix(), email)))
+	mac := hmac.New(sha256.New, emailVerifyKey())
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check a token's signature and expiry, returning the user and email it was issued for
+func parseEmailVerification(token string, now time.Time) (int, string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", errors.New("Invalid verification link")
+	}
+	mac := hmac.New(sha256.New, emailVerifyKey())
+	mac.Write([]byte(payload))
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return 0, "", errors.New("Invalid verification link")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return 0, "", errors.New("Invalid verification link")
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return 0, "", errors.New("Invalid verification link")
+	}
+	userID, err1 := strconv.Atoi(parts[0])
+	expires, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, "", errors.New("Invalid verification link")
+	}
+	if now.Unix() > expires {
+		return 0, "", errors.New("Verification link has expired")
+	}
+	return userID, parts[2], nil
+}
+
+// Start of every verification email, so recent ones to an address can be counted
+const emailVerifyMessagePrefix = "Confirm your email for product registration updates: "
+
+// Whether a verification email went to email within EMAIL_VERIFY_RESEND_MINUTES (default 5)
+func emailVerificationRecentlySent(db *sql.DB, email string) bool {
+	minutes := getEnvInt("EMAIL_VERIFY_RESEND_MINUTES", 5)
+	if minutes <= 0 {
+		return false
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM notification_jobs WHERE channel = 'email' AND recipient = ? AND created_at > ? AND message LIKE ? ESCAPE '\'`,
+		email, time.Now().Add(-time.Duration(minutes)*time.Minute), escapeLike(emailVerifyMessagePrefix)+"%").Scan(&count)
+	return count > 0
+}
+
+// Customer: Set an email (optional, defaults to the one on file) and send a link to verify it.
+// Status notifications are only emailed once it's verified. Each address gets at
+// most one link per EMAIL_VERIFY_RESEND_MINUTES, whoever asks for it.
+func requestEmailVerification(db *sql.DB, notifier *notificationQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		var req struct {
+			Email string `json:"email"`
+		}
+		if c.Request.ContentLength > 0 && !bindJSON(c, &req) {
+			return
+		}
+		var current string
+		var verified bool
+		if err := db.QueryRow("SELECT COALESCE(email, ''), COALESCE(email_verified, 0) FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&current, &verified); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		email := strings.ToLower(strings.TrimSpace(req.Email))
+		if email == "" {
+			email = current
+		}
+		if email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email is required", "fields": gin.H{"email": "required"}})
+			return
+		}
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address", "fields": gin.H{"email": "invalid"}})
+			return
+		}
+		if email == current && verified {
+			c.JSON(http.StatusOK, gin.H{"status": "already_verified", "email": email})
+			return
+		}
+		if notifier == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Notifications are not configured"})
+			return
+		}
+		if emailVerificationRecentlySent(db, email) {
+			c.Header("Retry-After", strconv.Itoa(getEnvInt("EMAIL_VERIFY_RESEND_MINUTES", 5)*60))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "A verification link was sent to this address recently, try again later"})
+			return
+		}
+		if email != current {
+			execWithRetry(db, "UPDATE users SET email = ?, email_verified = 0, updated_at = ? WHERE id = ?", email, time.Now(), userID)
+		}
+		expires := time.Now().Add(time.Duration(getEnvInt("EMAIL_VERIFY_TTL_HOURS", 24)) * time.Hour)
+		link := publicBaseURL(c) + "/customer/email/verify/" + signEmailVerification(userID, email, expires)
+		message := fmt.Sprintf("%s%s\nThe link expires on %s.", emailVerifyMessagePrefix, link, expires.Format("2006-01-02 15:04"))
+		if err := notifier.Enqueue("email", email, message); err != nil {
+			logError("Failed to queue email verification for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+			return
+		}
+		logInfo("Email verification sent for user %d", userID)
+		c.JSON(http.StatusOK, gin.H{"status": "sent", "email": email, "expires_at": expires.Format(time.RFC3339)})
+	}
+}
+
+// Confirm an email from its verification link; opened from the email, so no token needed
+func confirmEmailVerification(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, email, err := parseEmailVerification(c.Param("token"), time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// The link is only good for the email it was sent to
+		res, err := execWithRetry(db, "UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ? AND email = ? AND deleted_at IS NULL", time.Now(), userID, email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification link"})
+			return
+		}
+		logInfo("User %d verified email", userID)
+		c.JSON(http.StatusOK, gin.H{"status": "verified", "email": email})
+	}
+}
+
+// Most products listed in the monthly report
+const monthlyReportTopProducts = 5
+
+// A product and how many registrations it had in the report period
+type productCount struct {
+	ProductID     int    `json:"product_id"`
+	Name          string `json:"name"`
+	Registrations int    `json:"registrations"`
+}
+
+// Registrations and sign-ups for one calendar month
+type monthlyReport struct {
+	Month              string         `json:"month"`
+	TotalRegistrations int            `json:"total_registrations"`
+	Pending            int            `json:"pending"`
+	NeedsInfo          int            `json:"needs_info"`
+	Approved           int            `json:"approved"`
+	Rejected           int            `json:"rejected"`
+	NewUsers           int            `json:"new_users"`
+	TopProducts        []productCount `json:"top_products"`
+}
+
+// First and one-past-last day of the month containing t, as stored-date bounds
+func monthBounds(t time.Time) (string, string) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+	return start.Format("2006-01-02"), start.AddDate(0, 1, 0).Format("2006-01-02")
+}
+
+// Build the report for the month containing month, with the dashboard's status breakdown
+func buildMonthlyReport(db *sql.DB, month time.Time) (monthlyReport, error) {
+	from, to := monthBounds(month)
+	report := monthlyReport{Month: month.Format("2006-01"), TopProducts: []productCount{}}
+	err := db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM users WHERE username != 'admin' AND created_at >= ? AND created_at < ?),
+		COUNT(*),
+		`+registrationStatusSums+`
+		FROM registrations WHERE created_at >= ? AND created_at < ?`, from, to, from, to).
+		Scan(&report.NewUsers, &report.TotalRegistrations, &report.Pending, &report.NeedsInfo, &report.Approved, &report.Rejected)
+	if err != nil {
+		return report, err
+	}
+	rows, err := db.Query(`SELECT p.id, p.name, COUNT(*) FROM registrations r JOIN products p ON p.id = r.product_id
+		WHERE r.created_at >= ? AND r.created_at < ? GROUP BY p.id, p.name ORDER BY COUNT(*) DESC, p.name LIMIT ?`, from, to, monthlyReportTopProducts)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p productCount
+		rows.Scan(&p.ProductID, &p.Name, &p.Registrations)
+		report.TopProducts = append(report.TopProducts, p)
+	}
+	return report, rows.Err()
+}
+
+// Plain-text body of the report email
+func (r monthlyReport) Message() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Product registrations report for %s\n\n", r.Month)
+	fmt.Fprintf(&b, "Registrations: %d (pending %d, needs info %d, approved %d, rejected %d)\n", r.TotalRegistrations, r.Pending, r.NeedsInfo, r.Approved, r.Rejected)
+	fmt.Fprintf(&b, "New users: %d\n", r.NewUsers)
+	if len(r.TopProducts) > 0 {
+		b.WriteString("\nTop products:\n")
+		for i, p := range r.TopProducts {
+			fmt.Fprintf(&b, "%d. %s - %d\n", i+1, p.Name, p.Registrations)
+		}
+	}
+	return b.String()
+}
+
+// Addresses the monthly report is emailed to (REPORT_RECIPIENTS, comma separated)
+func reportRecipients() []string {
+	recipients := []string{}
+	for _, r := range strings.Split(os.Getenv("REPORT_RECIPIENTS"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients
+}
+
+// Queue the report as an email to each recipient, returning those it was queued for
+func emailMonthlyReport(notifier *notificationQueue, report monthlyReport) []string {
+	sent := []string{}
+	if notifier == nil {
+		return sent
+	}
+	for _, recipient := range reportRecipients() {
+		if err := notifier.Enqueue("email", recipient, report.Message()); err != nil {
+			logError("Failed to queue monthly report for %s: %v", recipient, err)
+			continue
+		}
+		sent = append(sent, recipient)
+	}
+	return sent
+}
+
+// On the first of each month, email last month's report to REPORT_RECIPIENTS.
+// Needs notifications to be configured; off when there are no recipients.
+func startMonthlyReportJob(db *sql.DB, notifier *notificationQueue) {
+	if len(reportRecipients()) == 0 {
+		return
+	}
+	if notifier == nil {
+		logWarn("REPORT_RECIPIENTS is set but notifications are not configured; monthly reports are off")
+		return
+	}
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.Local)
+			time.Sleep(time.Until(next))
+			report, err := buildMonthlyReport(db, next.AddDate(0, -1, 0))
+			if err != nil {
+				logError("Monthly report failed: %v", err)
+				continue
+			}
+			sent := emailMonthlyReport(notifier, report)
+			logInfo("Monthly report for %s queued for %d recipients", report.Month, len(sent))
+		}
+	}()
+	logInfo("Monthly report job started for %d recipients", len(reportRecipients()))
+}
+
+// Admin: Build and email the report for ?month=YYYY-MM (default last month).
+// Returns the report, or with ?format=csv the month's registrations as CSV.
+func triggerMonthlyReport(db *sql.DB, notifier *notificationQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -1, 0)
+		if m := c.Query("month"); m != "" {
+			t, err := time.ParseInLocation("2006-01", m, time.Local)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "month must be YYYY-MM"})
+				return
+			}
+			month = t
+		}
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+			return
+		}
+		report, err := buildMonthlyReport(db, month)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+			logError("Monthly report failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
-		log.Printf("User registered: %s", req.Mobile)
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		sent := emailMonthlyReport(notifier, report)
+		logInfo("Admin triggered monthly report for %s, queued for %d recipients", report.Month, len(sent))
+
+		if format == "json" {
+			c.JSON(http.StatusOK, gin.H{"report": report, "emailed_to": sent})
+			return
+		}
+		from, to := monthBounds(month)
+		rows, err := queryRegistrationRows(db, "WHERE r.created_at >= ? AND r.created_at < ?", []interface{}{from, to})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer rows.Close()
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=registrations_%s.csv", report.Month))
+		c.Header("Content-Type", "text/csv")
+		writeRegistrationsCSV(c.Writer, rows, defaultCSVFormat)
 	}
 }
 
-func loginUser(db *sql.DB) gin.HandlerFunc {
+// Cap concurrent exports and backups at max; more get 429 instead of thrashing
+// the disk alongside the running ones. The slot is released however the handler ends.
+func limitConcurrentExports(max int) gin.HandlerFunc {
+	if max < 1 {
+		max = 1
+	}
+	slots := make(chan struct{}, max)
 	return func(c *gin.Context) {
-		var req struct {
-			Mobile   string `json:"mobile"`
-			Password string `json:"password"`
+		select {
+		case slots <- struct{}{}:
+		default:
+			c.Header("Retry-After", "30")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many exports running, try again shortly"})
+			return
 		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			log.Printf("Login error: Invalid input format - %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid login request"})
+		defer func() { <-slots }()
+		c.Next()
+	}
+}
+
+// Routes taking whole config bundles, capped by MAX_IMPORT_KB instead of MAX_BODY_KB
+var importBodyRoutes = map[string]bool{"/admin/import/config": true, "/admin/import/preview": true}
+
+// Cap request body sizes: MAX_BODY_KB (default 64) for JSON and other bodies,
+// MAX_IMPORT_KB (default 10240) for config imports, and for multipart forms
+// the bill upload limit for each of a registration's files plus 1MB
+func limitRequestBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := int64(getEnvInt("MAX_BODY_KB", 64)) * 1024
+		if importBodyRoutes[c.FullPath()] {
+			limit = int64(getEnvInt("MAX_IMPORT_KB", 10240)) * 1024
+		} else if strings.HasPrefix(c.ContentType(), "multipart/") {
+			limit = int64(maxUploadMB()*maxRegistrationFiles+1) * 1024 * 1024
+		}
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
 			return
 		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
 
-		log.Printf("Login attempt for mobile: %s", req.Mobile)
+// Response types worth compressing; ZIPs, PDFs and images are already compressed
+func isCompressibleType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "application/javascript") ||
+		strings.HasPrefix(contentType, "application/xml") ||
+		strings.HasPrefix(contentType, "image/svg+xml")
+}
 
-		// Special case for admin login
-		if req.Mobile == "admin" {
-			// Check admin password
-			if req.Password != "Goat@2570" {
-				log.Printf("Failed admin login attempt: incorrect password")
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin credentials"})
-				return
+// Decides on the first write, once the handler has set Content-Type, whether to gzip the body
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipResponseWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" || !isCompressibleType(header.Get("Content-Type")) {
+		return
+	}
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.gz.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Gzip responses for clients that accept it (ENABLE_GZIP=true)
+func gzipResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+			c.Next()
+			return
+		}
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		if writer.gz != nil {
+			writer.gz.Close()
+		}
+	}
+}
+
+// JSON keys whose values never reach the debug log
+var redactedKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"authorization": true,
+	"captcha_token": true,
+	"secret":        true,
+}
+
+const maxLoggedBodyBytes = 4096
+
+// Replace values of sensitive keys, at any depth, with "***"
+func redactJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if redactedKeys[strings.ToLower(key)] {
+				v[key] = "***"
+			} else {
+				v[key] = redactJSONValue(inner)
 			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = redactJSONValue(inner)
+		}
+	}
+	return value
+}
 
-			token := generateToken()
-			// Create or update admin record
-			_, err := db.Exec("INSERT OR REPLACE INTO users (username, password, mobile, company, gst, role, active, token) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-				"admin", "Goat@2570", "admin", "AdminCorp", "GSTADMIN123", "ADMIN", 1, token)
-			if err != nil {
-				log.Printf("Failed to create/update admin: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-				return
+// A body as it should appear in the debug log: redacted JSON, or just its size
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+	redacted, _ := json.Marshal(redactJSONValue(value))
+	return string(redacted)
+}
+
+// Keeps a copy of the start of the response body for the debug log
+type bodyCaptureWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *bodyCaptureWriter) Write(data []byte) (int, error) {
+	if room := maxLoggedBodyBytes - w.body.Len(); room > 0 {
+		if len(data) > room {
+			w.body.Write(data[:room])
+			w.truncated = true
+		} else {
+			w.body.Write(data)
+		}
+	} else if len(data) > 0 {
+		w.truncated = true
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyCaptureWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Log method, path, status, latency and redacted JSON bodies (DEBUG_HTTP=true) at
+// DEBUG, so bodies only reach the log when LOG_LEVEL=DEBUG as well
+func debugHTTPLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		var requestBody string
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			requestBody = "[multipart body omitted]"
+		} else if c.Request.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxLoggedBodyBytes+1))
+			rest := c.Request.Body
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), rest), rest}
+			if err == nil && len(body) <= maxLoggedBodyBytes {
+				requestBody = redactBody(body)
+			} else {
+				requestBody = "[body too large to log]"
 			}
-			log.Printf("Admin login successful")
-			c.JSON(http.StatusOK, gin.H{"token": token, "role": "ADMIN"})
+		}
+
+		writer := &bodyCaptureWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		responseBody := "[non-JSON response]"
+		if strings.HasPrefix(writer.Header().Get("Content-Type"), "application/json") {
+			if writer.truncated {
+				responseBody = "[response too large to log]"
+			} else {
+				responseBody = redactBody(writer.body.Bytes())
+			}
+		}
+		// Export links carry the admin password in the path
+		path := c.Request.URL.Path
+		if password := c.Param("password"); password != "" {
+			path = strings.Replace(path, password, "***", 1)
+		}
+		logDebug("HTTP %s %s -> %d in %v | request: %s | response: %s",
+			c.Request.Method, path, writer.Status(), time.Since(start), requestBody, responseBody)
+	}
+}
+
+func setupCORS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link, X-Missing-Count")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(http.StatusOK)
 			return
 		}
 
-		// For regular users - check if they exist in the database
+		c.Next()
+	}
+}
+
+// Check access to an export: either the admin password in the URL path or an
+// admin token. Responds with 401 and returns false when access is denied.
+func authorizeExport(db *sql.DB, c *gin.Context) bool {
+	// Check if password is provided in URL path
+	password := c.Param("password")
+	if password != "" {
+		// Verify admin credentials
 		var id int
 		var role string
-		var active int
-		err := db.QueryRow("SELECT id, role, active FROM users WHERE mobile = ?", req.Mobile).Scan(&id, &role, &active)
+		err := db.QueryRow("SELECT id, role FROM users WHERE username = 'admin' AND password = ?", password).Scan(&id, &role)
+		if err != nil || role != "ADMIN" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin password"})
+			return false
+		}
+		return true
+	}
+	// Otherwise requireRole has already checked the token's role for this route
+	if _, exists := c.Get("role"); !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+		return false
+	}
+	return true
+}
 
+// Registration statuses accepted by filters
+var registrationStatuses = []string{"pending", "needs_info", "approved", "rejected"}
+
+func isValidStatus(status string) bool {
+	for _, s := range registrationStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the WHERE clause for registration exports from ?from=&to=&status=.
+// Dates are YYYY-MM-DD in the portal timezone and both ends are inclusive.
+func registrationExportFilter(c *gin.Context) (string, []interface{}, error) {
+	conditions, args, err := dateRangeFilter(c, "r.created_at")
+	if err != nil {
+		return "", nil, err
+	}
+	if status := c.Query("status"); status != "" {
+		if !isValidStatus(status) {
+			return "", nil, fmt.Errorf("status must be one of: %s", strings.Join(registrationStatuses, ", "))
+		}
+		conditions = append(conditions, "r.status = ?")
+		args = append(args, status)
+	}
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// Conditions on column from ?from=&to= (YYYY-MM-DD, both inclusive)
+func dateRangeFilter(c *gin.Context, column string) ([]string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	if from := c.Query("from"); from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, time.Local)
 		if err != nil {
-			// User doesn't exist
-			log.Printf("Login failed: User with mobile %s does not exist", req.Mobile)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not registered. Please register first."})
-			return
+			return nil, nil, errors.New("from must be a date (YYYY-MM-DD)")
+		}
+		conditions = append(conditions, column+" >= ?")
+		args = append(args, t.Format("2006-01-02"))
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return nil, nil, errors.New("to must be a date (YYYY-MM-DD)")
 		}
+		conditions = append(conditions, column+" < ?")
+		args = append(args, t.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+	return conditions, args, nil
+}
 
-		// Check if user account is active
-		if active == 0 {
-			log.Printf("Login attempt for inactive account: %s", req.Mobile)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is inactive"})
+// Admin: Export audit_log as CSV, filtered by ?from=&to= and ?actor= (username), with optional password in URL
+func exportAuditCSV(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeExport(db, c) {
 			return
 		}
 
-		// Generate new token and update user record
-		token := generateToken()
-		_, err = db.Exec("UPDATE users SET token = ? WHERE id = ?", token, id)
+		conditions, args, err := dateRangeFilter(c, "created_at")
 		if err != nil {
-			log.Printf("Failed to update user token: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if actor := strings.TrimSpace(c.Query("actor")); actor != "" {
+			conditions = append(conditions, "actor = ?")
+			args = append(args, actor)
+		}
+		format, err := parseCSVFormat(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		where := ""
+		if len(conditions) > 0 {
+			where = " WHERE " + strings.Join(conditions, " AND ")
+		}
+		rows, err := db.Query("SELECT COALESCE(actor, ''), action, COALESCE(target, ''), COALESCE(detail, ''), created_at FROM audit_log"+where+" ORDER BY created_at, id", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
+		defer rows.Close()
 
-		log.Printf("User login successful: %s with role %s", req.Mobile, role)
-		c.JSON(http.StatusOK, gin.H{"token": token, "role": role})
+		fileName := fmt.Sprintf("audit_log_%s.csv", time.Now().Format("2006-01-02"))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "text/csv")
+
+		writer := newExportCSVWriter(c.Writer, format)
+		writer.Write([]string{"Actor", "Action", "Target", "Detail", "Timestamp"})
+		count := 0
+		for rows.Next() {
+			var actor, action, target, detail, createdAt string
+			rows.Scan(&actor, &action, &target, &detail, &createdAt)
+			writer.Write([]string{actor, action, target, detail, createdAt})
+			count++
+		}
+		writer.Flush()
+		logInfo("Admin exported %d audit entries to CSV: %s", count, fileName)
 	}
 }
 
-// Admin: List all users
-func listUsers(db *sql.DB) gin.HandlerFunc {
+// Query registrations for export with the request's filters applied
+func queryRegistrationExport(db *sql.DB, c *gin.Context) (*sql.Rows, error) {
+	where, args, err := registrationExportFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	return queryRegistrationRows(db, where, args)
+}
+
+// Registration rows for CSV and PDF exports, selected by a WHERE clause on r
+func queryRegistrationRows(db *sql.DB, where string, args []interface{}) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf(`
+		SELECT 
+			u.company, 
+			u.mobile, 
+			u.gst,
+			p.name as product_name, 
+			r.serial, 
+			r.status, 
+			r.created_at 
+		FROM registrations r 
+		JOIN users u ON r.user_id=u.id 
+		JOIN products p ON r.product_id=p.id
+		%s
+		ORDER BY u.company_normalized, u.company, r.created_at
+	`, where), args...)
+}
+
+// Admin: Export registrations as CSV with optional password in URL
+func exportRegistrationsCSV(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		rows, err := db.Query("SELECT id, username, mobile, company, gst, role, active FROM users WHERE username != 'admin'")
+		if !authorizeExport(db, c) {
+			return
+		}
+
+		if _, _, err := registrationExportFilter(c); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		format, err := parseCSVFormat(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := queryRegistrationExport(db, c)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
 		defer rows.Close()
-		var users []map[string]interface{}
-		for rows.Next() {
-			var id, active int
-			var username, mobile, company, gst, role string
-			rows.Scan(&id, &username, &mobile, &company, &gst, &role, &active)
-			users = append(users, gin.H{"id": id, "username": username, "mobile": mobile, "company": company, "gst": gst, "role": role, "active": active})
-		}
-		c.JSON(http.StatusOK, users)
+
+		// Set headers for CSV download
+		fileName := fmt.Sprintf("registrations_export_%s.csv", time.Now().Format("2006-01-02"))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "text/csv")
+
+		writeRegistrationsCSV(c.Writer, rows, format)
+		logInfo("Admin exported registrations to CSV: %s", fileName)
 	}
 }
 
-// Admin: Create or edit user (except self)
-func upsertUser(db *sql.DB) gin.HandlerFunc {
+// Delimiter and BOM for a CSV export, so Excel in any locale opens it correctly
+type csvFormat struct {
+	Delimiter rune
+	BOM       bool
+}
+
+var defaultCSVFormat = csvFormat{Delimiter: ','}
+
+// CSV format from ?delimiter=comma|semicolon|tab and ?bom=true, defaulting to plain comma-separated
+func parseCSVFormat(c *gin.Context) (csvFormat, error) {
+	format := defaultCSVFormat
+	switch c.DefaultQuery("delimiter", "comma") {
+	case "comma":
+	case "semicolon":
+		format.Delimiter = ';'
+	case "tab":
+		format.Delimiter = '\t'
+	default:
+		return format, errors.New("delimiter must be comma, semicolon or tab")
+	}
+	format.BOM = c.Query("bom") == "true"
+	return format, nil
+}
+
+// CSV writer for an export in format, writing the BOM first when it asks for one
+func newExportCSVWriter(w io.Writer, format csvFormat) *csv.Writer {
+	if format.BOM {
+		io.WriteString(w, "\uFEFF")
+	}
+	writer := csv.NewWriter(w)
+	writer.Comma = format.Delimiter
+	return writer
+}
+
+// Write registration export rows as CSV with a header row
+func writeRegistrationsCSV(w io.Writer, rows *sql.Rows, format csvFormat) {
+	writer := newExportCSVWriter(w, format)
+	writer.Write([]string{"Company Name", "Mobile Number", "GST Number", "Product Name", "Serial Number", "Status", "Registration Date"})
+	for rows.Next() {
+		var company, mobile, gst, productName, serial, status, createdAt string
+		rows.Scan(&company, &mobile, &gst, &productName, &serial, &status, &createdAt)
+		writer.Write([]string{company, mobile, gst, productName, serial, status, createdAt})
+	}
+	writer.Flush()
+}
+
+// Admin: Export the pending review queue as CSV, oldest first, with optional password in URL
+func exportPendingCSV(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req struct {
-			ID       int    `json:"id"`
-			Username string `json:"username"`
-			Password string `json:"password"`
-			Mobile   string `json:"mobile"`
-			Company  string `json:"company"`
-			GST      string `json:"gst"`
-			Role     string `json:"role"`
-			Active   int    `json:"active"`
+		if !authorizeExport(db, c) {
+			return
 		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+
+		rows, err := db.Query(`
+			SELECT r.id, COALESCE(u.company, ''), COALESCE(u.mobile, ''), p.name, r.serial, COALESCE(r.bill_file, ''), r.created_at
+			FROM registrations r
+			JOIN users u ON r.user_id=u.id
+			JOIN products p ON r.product_id=p.id
+			WHERE r.status = 'pending'
+			ORDER BY r.created_at, r.id
+		`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
-		if req.ID == 0 {
-			_, err := db.Exec("INSERT INTO users (username, password, mobile, company, gst, role, active, token) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", req.Username, req.Password, req.Mobile, req.Company, req.GST, req.Role, req.Active, generateToken())
-			if err != nil {
-				c.JSON(http.StatusConflict, gin.H{"error": "User creation failed (duplicate?)"})
-				return
-			}
-			log.Printf("Admin created user: %s", req.Username)
-			c.JSON(http.StatusOK, gin.H{"status": "created"})
-		} else {
-			_, err := db.Exec("UPDATE users SET username=?, password=?, mobile=?, company=?, gst=?, role=?, active=? WHERE id=? AND username != 'admin'", req.Username, req.Password, req.Mobile, req.Company, req.GST, req.Role, req.Active, req.ID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
-				return
+		defer rows.Close()
+
+		fileName := fmt.Sprintf("pending_%s.csv", time.Now().Format("2006-01-02"))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "text/csv")
+
+		baseURL := publicBaseURL(c)
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"Registration ID", "Company Name", "Mobile Number", "Product Name", "Serial Number", "Registration Date", "Bill URL"})
+		count := 0
+		for rows.Next() {
+			var id int
+			var company, mobile, productName, serial, bill, createdAt string
+			rows.Scan(&id, &company, &mobile, &productName, &serial, &bill, &createdAt)
+			billURL := ""
+			if bill != "" {
+				billURL = baseURL + "/" + bill
 			}
-			log.Printf("Admin updated user: %s", req.Username)
-			c.JSON(http.StatusOK, gin.H{"status": "updated"})
+			writer.Write([]string{strconv.Itoa(id), company, mobile, productName, serial, createdAt, billURL})
+			count++
 		}
+		writer.Flush()
+		logInfo("Admin exported %d pending registrations to CSV", count)
 	}
 }
 
-// Admin: Delete user (except self)
-func deleteUser(db *sql.DB) gin.HandlerFunc {
+// Admin: Export non-admin users as CSV with optional password in URL
+func exportUsersCSV(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := c.Param("id")
-		_, err := db.Exec("DELETE FROM users WHERE id=? AND username != 'admin'", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Delete failed"})
+		if !authorizeExport(db, c) {
 			return
 		}
-		log.Printf("Admin deleted user id: %s", id)
-		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
-	}
-}
 
-// Admin: List, create, edit, delete products
-func listProducts(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		rows, err := db.Query("SELECT id, name, description, serial, active FROM products")
+		query := "SELECT COALESCE(company, ''), COALESCE(mobile, ''), COALESCE(gst, ''), COALESCE(role, ''), active, created_at FROM users WHERE username != 'admin' AND deleted_at IS NULL"
+		args := []interface{}{}
+		if role := c.Query("role"); role != "" {
+			query += " AND role = ?"
+			args = append(args, role)
+		}
+		if active := c.Query("active"); active != "" {
+			if active != "0" && active != "1" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be 0 or 1"})
+				return
+			}
+			query += " AND active = ?"
+			args = append(args, active)
+		}
+		query += " ORDER BY company_normalized, company"
+
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
 		defer rows.Close()
-		var products []map[string]interface{}
+
+		fileName := fmt.Sprintf("users_export_%s.csv", time.Now().Format("2006-01-02"))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "text/csv")
+
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"Company Name", "Mobile Number", "GST Number", "Role", "Active", "Created At"})
+		count := 0
 		for rows.Next() {
-			var id, active int
-			var name, description, serial string
-			rows.Scan(&id, &name, &description, &serial, &active)
-			products = append(products, gin.H{
-				"id":          id,
-				"name":        name,
-				"description": description,
-				"serial":      serial,
-				"active":      active,
-			})
-		}
-		if products == nil {
-			products = []map[string]interface{}{} // Return empty array instead of null
+			var company, mobile, gst, role string
+			var active int
+			var createdAt sql.NullString
+			rows.Scan(&company, &mobile, &gst, &role, &active, &createdAt)
+			writer.Write([]string{company, mobile, gst, role, strconv.Itoa(active), createdAt.String})
+			count++
 		}
-		c.JSON(http.StatusOK, products)
+		writer.Flush()
+		logInfo("Admin exported %d users to CSV: %s", count, fileName)
 	}
 }
 
-func upsertProduct(db *sql.DB) gin.HandlerFunc {
+// Products and (optionally) users as a human-editable bundle for setting up another environment
+type configBundle struct {
+	ExportedAt string          `json:"exported_at,omitempty"`
+	Products   []configProduct `json:"products"`
+	Users      []configUser    `json:"users,omitempty"`
+}
+
+type configProduct struct {
+	Name                       string      `json:"name"`
+	Description                string      `json:"description"`
+	Active                     int         `json:"active"`
+	SerialPattern              string      `json:"serial_pattern"`
+	WarrantyMonths             int         `json:"warranty_months"`
+	MetaSchema                 []metaField `json:"meta_schema,omitempty"`
+	SerialTransform            string      `json:"serial_transform,omitempty"`
+	SerialTransformReplacement string      `json:"serial_transform_replacement,omitempty"`
+	// File name under DATA_DIR/products; copy the images over with the bundle
+	Image string `json:"image,omitempty"`
+}
+
+// Users are exported without passwords or tokens
+type configUser struct {
+	Username string `json:"username"`
+	Mobile   string `json:"mobile"`
+	Company  string `json:"company" trim:"-"`
+	GST      string `json:"gst"`
+	Role     string `json:"role"`
+	Active   int    `json:"active"`
+}
+
+// Admin: Export products (and users with ?include_users=true) as a JSON config bundle
+func exportConfig(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req struct {
-			ID          int    `json:"id"`
-			Name        string `json:"name"`
-			Description string `json:"description"`
-			Active      int    `json:"active"`
+		if !authorizeExport(db, c) {
+			return
 		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		bundle := configBundle{ExportedAt: time.Now().Format(time.RFC3339), Products: []configProduct{}}
+
+		rows, err := db.Query(`SELECT COALESCE(name, ''), COALESCE(description, ''), COALESCE(active, 0), COALESCE(serial_pattern, ''), COALESCE(warranty_months, 0),
+			COALESCE(meta_schema, ''), COALESCE(serial_transform, ''), COALESCE(serial_transform_replacement, ''), COALESCE(image, '') FROM products ORDER BY id`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
-		// Generate a placeholder value for serial (admin doesn't provide it)
-		// This is needed since the database has a UNIQUE constraint
-		timestamp := time.Now().UnixNano()
-		placeholder := fmt.Sprintf("ADMIN_%d", timestamp)
+		for rows.Next() {
+			var p configProduct
+			var metaSchema string
+			rows.Scan(&p.Name, &p.Description, &p.Active, &p.SerialPattern, &p.WarrantyMonths, &metaSchema, &p.SerialTransform, &p.SerialTransformReplacement, &p.Image)
+			p.MetaSchema = decodeMetaSchema(metaSchema)
+			bundle.Products = append(bundle.Products, p)
+		}
+		rows.Close()
 
-		if req.ID == 0 {
-			_, err := db.Exec("INSERT INTO products (name, description, serial, active) VALUES (?, ?, ?, ?)",
-				req.Name, req.Description, placeholder, req.Active)
+		if c.Query("include_users") == "true" {
+			rows, err := db.Query("SELECT COALESCE(username, ''), COALESCE(mobile, ''), COALESCE(company, ''), COALESCE(gst, ''), COALESCE(role, ''), COALESCE(active, 0) FROM users WHERE username != 'admin' AND deleted_at IS NULL ORDER BY id")
 			if err != nil {
-				c.JSON(http.StatusConflict, gin.H{"error": "Product creation failed (duplicate?)"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 				return
 			}
-			log.Printf("Admin created product: %s", req.Name)
-			c.JSON(http.StatusOK, gin.H{"status": "created"})
-		} else {
-			_, err := db.Exec("UPDATE products SET name=?, description=?, active=? WHERE id=?",
-				req.Name, req.Description, req.Active, req.ID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
-				return
+			for rows.Next() {
+				var u configUser
+				rows.Scan(&u.Username, &u.Mobile, &u.Company, &u.GST, &u.Role, &u.Active)
+				bundle.Users = append(bundle.Users, u)
 			}
-			log.Printf("Admin updated product: %s", req.Name)
-			c.JSON(http.StatusOK, gin.H{"status": "updated"})
+			rows.Close()
 		}
+
+		fileName := fmt.Sprintf("config_export_%s.json", time.Now().Format("2006-01-02"))
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.IndentedJSON(http.StatusOK, bundle)
+		logInfo("Admin exported config: %d products, %d users", len(bundle.Products), len(bundle.Users))
 	}
 }
 
-func deleteProduct(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		id := c.Param("id")
-		_, err := db.Exec("DELETE FROM products WHERE id=?", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Delete failed"})
-			return
+// Clean up and validate a product from a config import
+func validateConfigProduct(p *configProduct) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := checkFieldLengths(
+		fieldLimit{"name", p.Name, maxProductNameLength},
+		fieldLimit{"description", p.Description, maxDescriptionLength},
+		fieldLimit{"serial_pattern", p.SerialPattern, maxSerialPatternLength},
+		fieldLimit{"serial_transform", p.SerialTransform, maxSerialPatternLength},
+		fieldLimit{"serial_transform_replacement", p.SerialTransformReplacement, maxSerialPatternLength},
+	); err != nil {
+		return err
+	}
+	if _, err := compileSerialPattern(p.SerialPattern); err != nil {
+		return errors.New("invalid serial pattern")
+	}
+	if _, err := compileSerialTransform(p.SerialTransform, p.SerialTransformReplacement); err != nil {
+		return errors.New("invalid serial transform")
+	}
+	if p.WarrantyMonths < 0 {
+		return errors.New("warranty_months can't be negative")
+	}
+	if _, err := encodeMetaSchema(p.MetaSchema); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Clean up and validate a user from a config import; username defaults to the mobile number
+func validateConfigUser(u *configUser) error {
+	u.Company = cleanCompanyName(u.Company)
+	if u.Username == "" {
+		u.Username = u.Mobile
+	}
+	if u.Username == "" {
+		return errors.New("username or mobile is required")
+	}
+	if u.Username == "admin" {
+		return errors.New("username admin is reserved")
+	}
+	if err := checkFieldLengths(
+		fieldLimit{"username", u.Username, maxUsernameLength},
+		fieldLimit{"mobile", u.Mobile, maxMobileLength},
+		fieldLimit{"company", u.Company, maxCompanyLength},
+		fieldLimit{"gst", u.GST, maxGSTLength},
+		fieldLimit{"role", u.Role, maxRoleLength},
+	); err != nil {
+		return err
+	}
+	if u.Mobile != "" {
+		if msg := mobileFormatError(u.Mobile); msg != "" {
+			return errors.New(msg)
 		}
-		log.Printf("Admin deleted product id: %s", id)
-		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 	}
+	if u.GST != "" {
+		if msg := gstStateError(u.GST); msg != "" {
+			return errors.New(msg)
+		}
+	}
+	if u.Role == "" {
+		u.Role = roleCustomer
+	}
+	if !hasRole(u.Role, validRoles) {
+		return errors.New("role must be one of " + strings.Join(validRoles, ", "))
+	}
+	return nil
 }
 
-// Customer: Register product
-func registerProduct(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userID := c.GetInt("userID")
-		serialInput := c.PostForm("serial")
-		serialInput = strings.TrimSpace(serialInput)
-		productID := c.PostForm("product_id")
-		file, err := c.FormFile("bill")
+// *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
-		// Check if multiple serials are provided
-		var serials []string
-		if strings.Contains(serialInput, ",") {
-			// Split by comma and process each serial
-			serialsRaw := strings.Split(serialInput, ",")
-			serials = make([]string, 0)
-
-			// Clean each serial number
-			for _, s := range serialsRaw {
-				s = strings.TrimSpace(s)
-				s = strings.ToUpper(s)
-				if s != "" {
-					serials = append(serials, s)
-				}
-			}
-		} else {
-			// Single serial mode
-			if serialInput != "" {
-				serials = []string{strings.ToUpper(serialInput)}
-			}
-		}
+// Products are matched on name, ignoring case
+func configProductExists(q rowQuerier, name string) bool {
+	var count int
+	q.QueryRow("SELECT COUNT(*) FROM products WHERE LOWER(name) = LOWER(?)", name).Scan(&count)
+	return count > 0
+}
 
-		if len(serials) == 0 || productID == "" || err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "All fields required and bill file must be uploaded"})
-			return
-		}
+// Users are matched on username or mobile
+func configUserExists(q rowQuerier, username, mobile string) bool {
+	var count int
+	q.QueryRow("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND (username = ? OR (mobile = ? AND mobile != ''))", username, mobile).Scan(&count)
+	return count > 0
+}
+
+// GST numbers must stay unique among active users
+func configGSTTaken(q rowQuerier, gst string) bool {
+	if gst == "" {
+		return false
+	}
+	var count int
+	q.QueryRow("SELECT COUNT(*) FROM users WHERE gst = ? AND deleted_at IS NULL", gst).Scan(&count)
+	return count > 0
+}
 
-		if file.Size > 10*1024*1024 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File too large (max 10MB)"})
+// Admin: Import a config bundle. Products that exist by name and users that exist
+// by username or mobile are skipped, so importing the same bundle twice is harmless.
+// Users whose GST belongs to someone else are skipped and listed in conflicts.
+func importConfig(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var bundle configBundle
+		if !bindJSON(c, &bundle) {
 			return
 		}
-
-		// Check if any serial is already registered
-		invalidSerials := []string{}
-		for _, serial := range serials {
-			var count int
-			db.QueryRow("SELECT COUNT(*) FROM registrations WHERE UPPER(serial) = ? AND status = 'approved'", serial).Scan(&count)
-			if count > 0 {
-				invalidSerials = append(invalidSerials, serial)
-				continue
+		for i := range bundle.Products {
+			if err := validateConfigProduct(&bundle.Products[i]); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("products[%d]: %v", i, err)})
+				return
 			}
-			db.QueryRow("SELECT COUNT(*) FROM registrations WHERE UPPER(serial) = ?", serial).Scan(&count)
-			if count > 0 {
-				invalidSerials = append(invalidSerials, serial)
+		}
+		for i := range bundle.Users {
+			if err := validateConfigUser(&bundle.Users[i]); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("users[%d]: %v", i, err)})
+				return
 			}
 		}
 
-		if len(invalidSerials) > 0 {
-			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("These serial numbers are already registered: %s", strings.Join(invalidSerials, ", "))})
+		tx, err := beginWithRetry(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed"})
 			return
 		}
+		defer tx.Rollback()
 
-		// Get data directory from environment
-		dataDir := os.Getenv("DATA_DIR")
-		if dataDir == "" {
-			dataDir = "data" // Fallback
+		now := time.Now()
+		productsCreated, productsSkipped := 0, 0
+		for i, p := range bundle.Products {
+			if configProductExists(tx, p.Name) {
+				productsSkipped++
+				continue
+			}
+			// Same placeholder serial as upsertProduct, to satisfy the UNIQUE constraint
+			placeholder := fmt.Sprintf("ADMIN_%d_%d", now.UnixNano(), i)
+			metaSchema, _ := encodeMetaSchema(p.MetaSchema)
+			if _, err := tx.Exec("INSERT INTO products (name, description, serial, active, serial_pattern, warranty_months, image, meta_schema, serial_transform, serial_transform_replacement, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				p.Name, p.Description, placeholder, p.Active, p.SerialPattern, p.WarrantyMonths, p.Image, metaSchema, p.SerialTransform, p.SerialTransformReplacement, now, now); err != nil {
+				logError("Config import failed on product %q: %v", p.Name, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed", "product": p.Name})
+				return
+			}
+			productsCreated++
 		}
 
-		// Save bill file in the bills directory under data dir
-		billDir := filepath.Join(dataDir, "bills")
-		if _, err := os.Stat(billDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(billDir, 0755); err != nil {
-				log.Printf("Error creating bills directory: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bills directory"})
+		usersCreated, usersSkipped := 0, 0
+		conflicts := []gin.H{}
+		for _, u := range bundle.Users {
+			if configUserExists(tx, u.Username, u.Mobile) {
+				usersSkipped++
+				continue
+			}
+			if configGSTTaken(tx, u.GST) {
+				usersSkipped++
+				conflicts = append(conflicts, gin.H{"username": u.Username, "field": "gst", "error": uniqueViolationMessage("gst")})
+				continue
+			}
+			var gst interface{}
+			if u.GST != "" {
+				gst = u.GST
+			}
+			if _, err := tx.Exec("INSERT INTO users (username, password, mobile, company, gst, role, active, token, created_at, updated_at, company_normalized) VALUES (?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				u.Username, u.Mobile, u.Company, gst, u.Role, u.Active, generateToken(), now, now, normalizeCompany(u.Company)); err != nil {
+				if respondUniqueViolation(c, err) {
+					return
+				}
+				logError("Config import failed on user %q: %v", u.Username, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed", "user": u.Username})
 				return
 			}
+			usersCreated++
 		}
 
-		timestamp := time.Now().UnixNano()
-		billFilename := fmt.Sprintf("%d_%d%s", userID, timestamp, filepath.Ext(file.Filename))
-		billPath := filepath.Join(billDir, billFilename)
-
-		if err := c.SaveUploadedFile(file, billPath); err != nil {
-			log.Printf("Error saving uploaded file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "File save failed"})
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed"})
 			return
 		}
-
-		log.Printf("Bill file saved at: %s", billPath)
-
-		// Store relative URL path instead of filesystem path
-		// Use a format without leading slash to avoid double slash issues
-		billUrlPath := fmt.Sprintf("bills/%s", billFilename)
-
-		// Register each serial with the same bill file
-		registeredSerials := []string{}
-		for _, serial := range serials {
-			_, err = db.Exec("INSERT INTO registrations (user_id, product_id, serial, bill_file, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
-				userID, productID, serial, billUrlPath, "pending", time.Now())
-
-			if err == nil {
-				registeredSerials = append(registeredSerials, serial)
-			} else {
-				log.Printf("Error registering serial %s: %v", serial, err)
-			}
+		if productsCreated > 0 {
+			activeProductsCache.invalidate()
 		}
+		logInfo("Admin imported config: %d products created, %d skipped; %d users created, %d skipped (%d GST conflicts)", productsCreated, productsSkipped, usersCreated, usersSkipped, len(conflicts))
+		c.JSON(http.StatusOK, gin.H{
+			"products_created": productsCreated,
+			"products_skipped": productsSkipped,
+			"users_created":    usersCreated,
+			"users_skipped":    usersSkipped,
+			"conflicts":        conflicts,
+		})
+	}
+}
 
-		log.Printf("%d products registered by user %d: %s", len(registeredSerials), userID, strings.Join(registeredSerials, ", "))
+// Map CSV header names, including the ones used by the CSV exports, to config fields
+var importColumnAliases = map[string]string{
+	"company_name":  "company",
+	"mobile_number": "mobile",
+	"gst_number":    "gst",
+}
 
-		if len(registeredSerials) > 0 {
-			c.JSON(http.StatusOK, gin.H{
-				"status":             "pending",
-				"message":            fmt.Sprintf("Registered %d product(s) successfully", len(registeredSerials)),
-				"registered_serials": registeredSerials,
-			})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed for all serial numbers"})
-		}
+// Parse 0/1 (or true/false) from an import column; blank means active
+func parseImportActive(value string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "1", "true", "yes":
+		return 1, nil
+	case "0", "false", "no":
+		return 0, nil
 	}
+	return 0, fmt.Errorf("active must be 0 or 1, got %q", value)
 }
 
-// Admin: List all registrations
-func listRegistrations(db *sql.DB) gin.HandlerFunc {
+// Admin: Preview importing a CSV of products or users. Each row is checked with the
+// same validation and duplicate rules as POST /admin/import/config; nothing is written.
+func previewImport(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		rows, err := db.Query(`SELECT r.id, u.username, p.name, r.serial, r.bill_file, r.status, r.created_at FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id`)
+		kind := c.PostForm("type")
+		if kind != "products" && kind != "users" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "type must be products or users"})
+			return
+		}
+		fileHeader, err := c.FormFile("file")
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file must be uploaded"})
 			return
 		}
-		defer rows.Close()
-		var regs []map[string]interface{}
-		for rows.Next() {
-			var id int
-			var username, pname, serial, bill, status string
-			var created string
-			rows.Scan(&id, &username, &pname, &serial, &bill, &status, &created)
-			regs = append(regs, gin.H{"id": id, "user": username, "product": pname, "serial": serial, "bill_file": bill, "status": status, "created_at": created})
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read file"})
+			return
 		}
-		c.JSON(http.StatusOK, regs)
-	}
-}
+		defer file.Close()
 
-// Admin: Approve/reject/edit registration
-func updateRegistration(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		id := c.Param("id")
-		var req struct {
-			Status string `json:"status"`
-			Serial string `json:"serial"`
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid CSV: %v", err)})
+			return
 		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		if len(records) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "CSV has no header row"})
 			return
 		}
-		serial := strings.ToUpper(req.Serial)
-		if req.Status == "approved" {
-			var count int
-			db.QueryRow("SELECT COUNT(*) FROM registrations WHERE UPPER(serial) = ? AND status = 'approved' AND id != ?", serial, id).Scan(&count)
-			if count > 0 {
-				c.JSON(http.StatusConflict, gin.H{"error": "Serial already approved elsewhere"})
-				return
+		columns := map[string]int{}
+		for i, name := range records[0] {
+			name = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+			if alias, ok := importColumnAliases[name]; ok {
+				name = alias
 			}
+			columns[name] = i
 		}
-		_, err := db.Exec("UPDATE registrations SET status=?, serial=? WHERE id=?", req.Status, serial, id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
-			return
+		field := func(record []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		rows := []map[string]interface{}{}
+		summary := map[string]int{"will_create": 0, "duplicate": 0, "invalid": 0}
+		seen := map[string]bool{}
+		for i, record := range records[1:] {
+			row := gin.H{"row": i + 1}
+			disposition, reason := "will_create", ""
+			active, activeErr := parseImportActive(field(record, "active"))
+
+			if kind == "products" {
+				p := configProduct{Name: field(record, "name"), Description: field(record, "description"), SerialPattern: field(record, "serial_pattern"), Active: active}
+				err := validateConfigProduct(&p)
+				if err == nil {
+					err = activeErr
+				}
+				row["name"] = p.Name
+				key := strings.ToLower(p.Name)
+				switch {
+				case err != nil:
+					disposition, reason = "invalid", err.Error()
+				case seen[key]:
+					disposition, reason = "duplicate", "Repeated earlier in the file"
+				case configProductExists(db, p.Name):
+					disposition, reason = "duplicate", "Product already exists"
+				}
+				seen[key] = true
+			} else {
+				u := configUser{Username: field(record, "username"), Mobile: field(record, "mobile"), Company: field(record, "company"), GST: field(record, "gst"), Role: field(record, "role"), Active: active}
+				err := validateConfigUser(&u)
+				if err == nil {
+					err = activeErr
+				}
+				row["username"] = u.Username
+				row["mobile"] = u.Mobile
+				switch {
+				case err != nil:
+					disposition, reason = "invalid", err.Error()
+				case seen["u:"+u.Username] || (u.Mobile != "" && seen["m:"+u.Mobile]):
+					disposition, reason = "duplicate", "Repeated earlier in the file"
+				case configUserExists(db, u.Username, u.Mobile):
+					disposition, reason = "duplicate", "User already exists"
+				case configGSTTaken(db, u.GST) || (u.GST != "" && seen["g:"+u.GST]):
+					// The import skips these and lists them in conflicts
+					disposition, reason = "duplicate", uniqueViolationMessage("gst")
+				}
+				seen["u:"+u.Username] = true
+				if u.Mobile != "" {
+					seen["m:"+u.Mobile] = true
+				}
+				if u.GST != "" && disposition == "will_create" {
+					seen["g:"+u.GST] = true
+				}
+			}
+
+			row["disposition"] = disposition
+			if reason != "" {
+				row["reason"] = reason
+			}
+			summary[disposition]++
+			rows = append(rows, row)
 		}
-		log.Printf("Admin updated registration %s: %s", id, req.Status)
-		c.JSON(http.StatusOK, gin.H{"status": "updated"})
+		c.JSON(http.StatusOK, gin.H{"type": kind, "summary": summary, "rows": rows})
 	}
 }
 
-// Admin: Delete bill file from registration
-func deleteBillFile(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		id := c.Param("id")
-		var billPath string
-		err := db.QueryRow("SELECT bill_file FROM registrations WHERE id=?", id).Scan(&billPath)
-		if err != nil || billPath == "" {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Bill not found"})
-			return
+// Escape text for a PDF string literal; characters outside printable ASCII
+// become "?" since the built-in font has no Unicode mapping
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
 		}
+	}
+	return b.String()
+}
 
-		// Extract the filename from the URL path
-		fileName := filepath.Base(billPath)
-
-		// Get data directory
-		dataDir := os.Getenv("DATA_DIR")
-		if dataDir == "" {
-			dataDir = "data" // Fallback
-		}
+// Shorten text to at most max characters
+func truncateText(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	return string(runes[:max-3]) + "..."
+}
 
-		// Construct the actual filesystem path
-		fullPath := filepath.Join(dataDir, "bills", fileName)
+// Render a simple tabular PDF (landscape A4, Helvetica) with the title and
+// column headers repeated on every page and a page number footer
+func renderTablePDF(title string, columns []string, widths []float64, rows [][]string) []byte {
+	const pageW, pageH, margin, lineH = 842.0, 595.0, 40.0, 14.0
+	const rowsPerPage = 33
 
-		// Delete the physical file
-		err = os.Remove(fullPath)
-		if err != nil {
-			log.Printf("Warning: Could not delete bill file %s: %v", fullPath, err)
-			// Continue anyway to update the database
-		}
+	pages := (len(rows) + rowsPerPage - 1) / rowsPerPage
+	if pages == 0 {
+		pages = 1
+	}
 
-		// Clear the bill_file field in the database
-		_, err = db.Exec("UPDATE registrations SET bill_file='' WHERE id=?", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
-			return
-		}
+	var buf bytes.Buffer
+	offsets := []int{}
+	writeObj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
 
-		log.Printf("Admin deleted bill file for registration %s", id)
-		c.JSON(http.StatusOK, gin.H{"status": "bill deleted"})
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and its content per page
+	buf.WriteString("%PDF-1.4\n")
+	kids := []string{}
+	for i := 0; i < pages; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
 	}
-}
+	writeObj("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	writeObj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+
+	for i := 0; i < pages; i++ {
+		var content bytes.Buffer
+		text := func(x, y, size float64, s string) {
+			fmt.Fprintf(&content, "BT /F1 %.0f Tf %.1f %.1f Td (%s) Tj ET\n", size, x, y, pdfEscape(s))
+		}
 
-// Admin: Search registration by serial
-func searchRegistration(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		serial := c.Query("serial")
-		row := db.QueryRow(`SELECT r.id, u.username, p.name, r.serial, r.bill_file, r.status, r.created_at FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id WHERE r.serial=?`, serial)
-		var id int
-		var username, pname, s, bill, status, created string
-		err := row.Scan(&id, &username, &pname, &s, &bill, &status, &created)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
-			return
+		text(margin, pageH-margin, 14, title)
+		y := pageH - margin - 25
+		x := margin
+		for j, col := range columns {
+			text(x, y, 10, col)
+			x += widths[j]
 		}
-		c.JSON(http.StatusOK, gin.H{"id": id, "user": username, "product": pname, "serial": s, "bill_file": bill, "status": status, "created_at": created})
-	}
-}
+		fmt.Fprintf(&content, "%.1f %.1f m %.1f %.1f l S\n", margin, y-4, pageW-margin, y-4)
+		y -= lineH + 4
 
-// Customer: List own registrations
-func listOwnRegistrations(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userID := c.GetInt("userID")
-		rows, err := db.Query(`SELECT r.id, p.name, r.serial, r.bill_file, r.status, r.created_at FROM registrations r JOIN products p ON r.product_id=p.id WHERE r.user_id=?`, userID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
-			return
+		end := (i + 1) * rowsPerPage
+		if end > len(rows) {
+			end = len(rows)
 		}
-		defer rows.Close()
-		var regs []map[string]interface{}
-		for rows.Next() {
-			var id int
-			var pname, serial, bill, status, created string
-			rows.Scan(&id, &pname, &serial, &bill, &status, &created)
-			regs = append(regs, gin.H{"id": id, "product": pname, "serial": serial, "bill_file": bill, "status": status, "created_at": created})
+		for _, row := range rows[i*rowsPerPage : end] {
+			x = margin
+			for j, cell := range row {
+				// Roughly 5pt per character at 9pt Helvetica
+				text(x, y, 9, truncateText(cell, int(widths[j]/5)))
+				x += widths[j]
+			}
+			y -= lineH
 		}
-		c.JSON(http.StatusOK, regs)
+		text(pageW-margin-60, margin-15, 8, fmt.Sprintf("Page %d of %d", i+1, pages))
+
+		writeObj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageW, pageH, len(offsets)+2))
+		writeObj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
 	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
 }
 
-// Customer: List active products (for registration)
-func listActiveProducts(db *sql.DB) gin.HandlerFunc {
+// Admin: Export registrations as a printable PDF report with optional password in URL
+func exportRegistrationsPDF(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		log.Printf("Customer requesting active products")
-		rows, err := db.Query("SELECT id, name, description FROM products WHERE active=1")
+		if !authorizeExport(db, c) {
+			return
+		}
+
+		if _, _, err := registrationExportFilter(c); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := queryRegistrationExport(db, c)
 		if err != nil {
-			log.Printf("Error fetching active products: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
 		defer rows.Close()
-		var products []map[string]interface{}
+
+		data := [][]string{}
 		for rows.Next() {
-			var id int
-			var name, description string
-			rows.Scan(&id, &name, &description)
-			products = append(products, gin.H{
-				"id":          id,
-				"name":        name,
-				"description": description,
-				"active":      1, // Always 1 since we're filtering for active only
-			})
+			var company, mobile, gst, productName, serial, status, createdAt string
+			rows.Scan(&company, &mobile, &gst, &productName, &serial, &status, &createdAt)
+			if len(createdAt) > 10 {
+				createdAt = createdAt[:10]
+			}
+			data = append(data, []string{company, productName, serial, status, createdAt})
 		}
-		if products == nil {
-			products = []map[string]interface{}{} // Return empty array instead of null
+
+		title := fmt.Sprintf("Registrations report - generated %s", time.Now().Format("2006-01-02 15:04"))
+		if from, to := c.Query("from"), c.Query("to"); from != "" || to != "" {
+			title = fmt.Sprintf("Registrations %s to %s - generated %s", from, to, time.Now().Format("2006-01-02 15:04"))
 		}
-		log.Printf("Returning %d active products to customer", len(products))
-		c.JSON(http.StatusOK, products)
+		pdf := renderTablePDF(title,
+			[]string{"Company", "Product", "Serial Number", "Status", "Date"},
+			[]float64{230, 190, 160, 80, 100},
+			data)
+
+		fileName := fmt.Sprintf("registrations_report_%s.pdf", time.Now().Format("2006-01-02"))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Data(http.StatusOK, "application/pdf", pdf)
+		logInfo("Admin exported %d registrations to PDF: %s", len(data), fileName)
 	}
 }
 
-// Admin: Dashboard
-func adminDashboard(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var users, regs, pending, products int
-		db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
-		db.QueryRow("SELECT COUNT(*) FROM registrations").Scan(&regs)
-		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE status='pending'").Scan(&pending)
-		db.QueryRow("SELECT COUNT(*) FROM products").Scan(&products)
-		c.JSON(http.StatusOK, gin.H{"total_users": users, "total_registrations": regs, "pending_approvals": pending, "total_products": products})
+// Compression modes for bill zips (?compression=); "" picks per file type
+var zipCompressionModes = map[string]bool{"": true, "store": true, "fast": true, "best": true}
+
+// File types that are already compressed and gain nothing from deflate
+var compressedBillTypes = map[string]bool{".pdf": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".zip": true}
+
+// Create a zip writer whose deflate level matches the compression mode
+func newBillsZipWriter(w io.Writer, compression string) *zip.Writer {
+	zipWriter := zip.NewWriter(w)
+	level := flate.DefaultCompression
+	switch compression {
+	case "fast":
+		level = flate.BestSpeed
+	case "best":
+		level = flate.BestCompression
 	}
+	zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	return zipWriter
 }
 
-// Customer: Dashboard
-func customerDashboard(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userID := c.GetInt("userID")
-		var regs, pending int
-		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id=?", userID).Scan(&regs)
-		db.QueryRow("SELECT COUNT(*) FROM registrations WHERE user_id=? AND status='pending'", userID).Scan(&pending)
-		c.JSON(http.StatusOK, gin.H{"my_registrations": regs, "my_pending": pending})
+// Zip method for an entry: store when asked to, or by default for already compressed files
+func zipMethodFor(compression, fileName string) uint16 {
+	switch compression {
+	case "store":
+		return zip.Store
+	case "fast", "best":
+		return zip.Deflate
 	}
+	if compressedBillTypes[strings.ToLower(filepath.Ext(fileName))] {
+		return zip.Store
+	}
+	return zip.Deflate
 }
 
-func setupCORS() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// Fields available to BILL_EXPORT_TEMPLATE
+var billTemplateFields = map[string]bool{"mobile": true, "company": true, "date": true, "serial": true, "product": true, "status": true, "kind": true}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
+var billTemplatePlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// In-zip path for each bill (BILL_EXPORT_TEMPLATE), without the file extension
+func billExportTemplate() string {
+	if template := os.Getenv("BILL_EXPORT_TEMPLATE"); template != "" {
+		return template
+	}
+	return "{mobile}/{date}-{serial}-{product}"
+}
+
+// Check a bill export template only uses known fields and has no stray braces
+func validateBillExportTemplate(template string) error {
+	for _, match := range billTemplatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !billTemplateFields[match[1]] {
+			return fmt.Errorf("unknown field {%s}", match[1])
 		}
+	}
+	if strings.ContainsAny(billTemplatePlaceholder.ReplaceAllString(template, ""), "{}") {
+		return errors.New("unbalanced braces")
+	}
+	return nil
+}
 
-		c.Next()
+// Render a bill's in-zip path. Values can't add folders, and the result is kept
+// relative with no "." or ".." segments so an entry can't escape the archive.
+func billEntryName(template string, values map[string]string, ext string) string {
+	name := billTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[placeholder[1:len(placeholder)-1]]
+		return strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+	})
+	name = strings.ReplaceAll(name, "\\", "/")
+	segments := []string{}
+	for _, segment := range strings.Split(name, "/") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, strings.ReplaceAll(segment, " ", "_"))
 	}
+	if len(segments) == 0 {
+		segments = []string{"bill"}
+	}
+	return strings.Join(segments, "/") + ext
 }
 
-// Admin: Export registrations as CSV with optional password in URL
-func exportRegistrationsCSV(db *sql.DB) gin.HandlerFunc {
+// Template values for one of a registration's files; date is the registration day
+func billTemplateValues(mobile, company, createdAt, serial, productName, status, kind string) map[string]string {
+	date := createdAt
+	if len(date) > 10 {
+		date = date[:10]
+	}
+	return map[string]string{"mobile": mobile, "company": company, "date": date, "serial": serial, "product": productName, "status": status, "kind": kind}
+}
+
+// Add a bill to a zip, named by BILL_EXPORT_TEMPLATE. Files other than bills get
+// their kind appended unless the template names it, and names already in the
+// zip (tracked in names) get a counter. Returns false (after logging why) when
+// the bill is missing or can't be written.
+func addBillToZip(zipWriter *zip.Writer, compression, billURL string, values map[string]string, names map[string]int) bool {
+	// Construct the full filesystem path
+	billPath, err := billFullPath(billURL)
+	if err != nil {
+		logWarn("Skipping bill %q: %v", billURL, err)
+		return false
+	}
+
+	logDebug("Looking for bill file at: %s", billPath)
+
+	// Skip if file doesn't exist
+	if _, err := os.Stat(billPath); os.IsNotExist(err) {
+		logWarn("Bill file not found: %s", billPath)
+		return false
+	}
+
+	// Read the bill file
+	fileData, err := os.ReadFile(billPath)
+	if err != nil {
+		logError("Error reading bill file: %v", err)
+		return false
+	}
+
+	template := billExportTemplate()
+	if values["kind"] != "bill" && !strings.Contains(template, "{kind}") {
+		template += "-{kind}"
+	}
+	fileName := billEntryName(template, values, filepath.Ext(billPath))
+	names[fileName]++
+	if n := names[fileName]; n > 1 {
+		ext := filepath.Ext(fileName)
+		fileName = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(fileName, ext), n, ext)
+	}
+
+	fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     fileName,
+		Method:   zipMethodFor(compression, fileName),
+		Modified: time.Now(),
+	})
+	if err != nil {
+		logError("Error creating zip entry: %v", err)
+		return false
+	}
+
+	if _, err = fileWriter.Write(fileData); err != nil {
+		logError("Error writing to zip: %v", err)
+		return false
+	}
+	return true
+}
+
+// Admin: Download one user's bills as a zip
+func downloadUserBills(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Check if password is provided in URL path
-		password := c.Param("password")
-		if password != "" {
-			// Verify admin credentials
-			var id int
-			var role string
-			err := db.QueryRow("SELECT id, role FROM users WHERE username = 'admin' AND password = ?", password).Scan(&id, &role)
-			if err != nil || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin password"})
-				return
-			}
-		} else {
-			// Use the usual authentication middleware result
-			role, exists := c.Get("role")
-			if !exists || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
-				return
-			}
+		id := c.Param("id")
+		compression := c.Query("compression")
+		if !zipCompressionModes[compression] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "compression must be store, fast or best"})
+			return
+		}
+		var mobile, company string
+		if err := db.QueryRow("SELECT COALESCE(mobile, ''), COALESCE(company, '') FROM users WHERE id = ?", id).Scan(&mobile, &company); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
 		}
 
 		rows, err := db.Query(`
-			SELECT 
-				u.company, 
-				u.mobile, 
-				u.gst,
-				p.name as product_name, 
-				r.serial, 
-				r.status, 
-				r.created_at 
-			FROM registrations r 
-			JOIN users u ON r.user_id=u.id 
+			SELECT r.serial, p.name, f.path, f.kind, r.status, r.created_at
+			FROM registrations r
 			JOIN products p ON r.product_id=p.id
-			ORDER BY u.company, r.created_at
-		`)
-
+			JOIN registration_files f ON f.registration_id=r.id
+			WHERE r.user_id = ?
+			ORDER BY r.created_at, f.id
+		`, id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
 		defer rows.Close()
 
-		// Set headers for CSV download
-		fileName := fmt.Sprintf("registrations_export_%s.csv", time.Now().Format("2006-01-02"))
-		c.Header("Content-Description", "File Transfer")
-		c.Header("Content-Disposition", "attachment; filename="+fileName)
-		c.Header("Content-Type", "text/csv")
-
-		// Create CSV writer
-		writer := csv.NewWriter(c.Writer)
-
-		// Write header row
-		writer.Write([]string{"Company Name", "Mobile Number", "GST Number", "Product Name", "Serial Number", "Status", "Registration Date"})
+		// Create temporary zip file
+		tmpFile, err := os.CreateTemp("", "bills-*.zip")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp file"})
+			return
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
 
-		// Write data rows
+		zipWriter := newBillsZipWriter(tmpFile, compression)
+		fileCount := 0
+		names := map[string]int{}
 		for rows.Next() {
-			var company, mobile, gst, productName, serial, status, createdAt string
-			rows.Scan(&company, &mobile, &gst, &productName, &serial, &status, &createdAt)
-			writer.Write([]string{company, mobile, gst, productName, serial, status, createdAt})
+			var serial, productName, billURL, kind, status, createdAt string
+			rows.Scan(&serial, &productName, &billURL, &kind, &status, &createdAt)
+			if addBillToZip(zipWriter, compression, billURL, billTemplateValues(mobile, company, createdAt, serial, productName, status, kind), names) {
+				fileCount++
+			}
+		}
+		if err := zipWriter.Close(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create zip file"})
+			return
 		}
 
-		writer.Flush()
-		log.Printf("Admin exported registrations to CSV: %s", fileName)
+		if fileCount == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No bill files found for this user"})
+			return
+		}
+
+		fileName := fmt.Sprintf("bills_%s_%s.zip", mobile, time.Now().Format("2006-01-02"))
+		fileName = strings.ReplaceAll(fileName, " ", "_")
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.File(tmpFile.Name())
+
+		logInfo("Admin downloaded %d bill files for user %s", fileCount, id)
 	}
 }
 
 // Admin: Download bills organized by user mobile number with optional password in URL
 func downloadBillsByUser(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Check if password is provided in URL path
-		password := c.Param("password")
-		if password != "" {
-			// Verify admin credentials
-			var id int
-			var role string
-			err := db.QueryRow("SELECT id, role FROM users WHERE username = 'admin' AND password = ?", password).Scan(&id, &role)
-			if err != nil || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin password"})
-				return
-			}
-		} else {
-			// Use the usual authentication middleware result
-			role, exists := c.Get("role")
-			if !exists || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
-				return
-			}
+		if !authorizeExport(db, c) {
+			return
+		}
+
+		compression := c.Query("compression")
+		if !zipCompressionModes[compression] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "compression must be store, fast or best"})
+			return
 		}
 
 		// Get since parameter (optional) - for incremental downloads
 		sinceParam := c.DefaultQuery("since", "")
 		var since time.Time
-		var sinceFilter string
+		where := ""
+		args := []interface{}{}
 
 		if sinceParam != "" {
 			var err error
-			since, err = time.Parse("2006-01-02", sinceParam)
+			since, err = time.ParseInLocation("2006-01-02", sinceParam, time.Local)
 			if err == nil {
-				sinceFilter = fmt.Sprintf("AND r.created_at > '%s'", since.Format("2006-01-02"))
+				where = "WHERE r.created_at > ?"
+				args = append(args, since.Format("2006-01-02"))
 			}
 		}
 
-		// Query registrations with bill files
-		query := fmt.Sprintf(`
-			SELECT 
-				u.mobile,
-				r.id as reg_id,
-				r.serial,
-				p.name as product_name,
-				r.bill_file,
-				r.created_at
-			FROM registrations r 
-			JOIN users u ON r.user_id=u.id
-			JOIN products p ON r.product_id=p.id
-			WHERE r.bill_file != '' %s
-			ORDER BY u.mobile, r.created_at
-		`, sinceFilter)
-
-		rows, err := db.Query(query)
+		rows, err := queryBillExportRows(db, where, args)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
 			return
 		}
-		defer rows.Close()
+		// Check every file up front so the missing ones can be reported
+		present, missing := splitMissingBills(rows)
 
 		// Create temporary zip file
 		tmpFile, err := os.CreateTemp("", "bills-*.zip")
@@ -934,129 +7192,369 @@ func downloadBillsByUser(db *sql.DB) gin.HandlerFunc {
 		defer tmpFile.Close()
 
 		// Create zip writer
-		zipWriter := zip.NewWriter(tmpFile)
+		zipWriter := newBillsZipWriter(tmpFile, compression)
 		defer zipWriter.Close()
 
-		// Variables to track current mobile
-		var currentMobile string
-		var fileCount int = 0
+		fileCount := addBillRowsToZip(zipWriter, compression, present, map[string]int{missingBillsManifest: 1})
+		if len(missing) > 0 {
+			addMissingBillsManifest(zipWriter, missing)
+		}
 
-		// Get data directory
-		dataDir := os.Getenv("DATA_DIR")
-		if dataDir == "" {
-			dataDir = "data" // Fallback
+		// Close the zip writer before reading the file
+		zipWriter.Close()
+
+		if fileCount == 0 && len(missing) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No bill files found"})
+			return
 		}
 
-		// Add files to zip grouped by mobile
-		for rows.Next() {
-			var mobile, serial, productName, billUrlPath, createdAt string
-			var regId int
-			rows.Scan(&mobile, &regId, &serial, &productName, &billUrlPath, &createdAt)
+		// Read the temporary file
+		tmpFile.Seek(0, 0)
+		zipData, err := io.ReadAll(tmpFile)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read zip file"})
+			return
+		}
+
+		// Set headers for zip download
+		dateStr := time.Now().Format("2006-01-02")
+		sinceStr := ""
+		if !since.IsZero() {
+			sinceStr = fmt.Sprintf("_since_%s", since.Format("2006-01-02"))
+		}
+		fileName := fmt.Sprintf("bills_by_user%s_%s.zip", sinceStr, dateStr)
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Length", fmt.Sprintf("%d", len(zipData)))
+		c.Header("X-Missing-Count", strconv.Itoa(len(missing)))
+
+		// Write the zip file to response
+		c.Writer.Write(zipData)
+
+		logInfo("Admin downloaded %d bill files as zip (%d missing): %s", fileCount, len(missing), fileName)
+	}
+}
+
+// One registration file in a bill export
+type billExportRow struct {
+	Mobile         string
+	Company        string
+	RegistrationID int
+	Serial         string
+	ProductName    string
+	Path           string
+	Kind           string
+	Status         string
+	CreatedAt      string
+}
+
+// Registration files for bill exports, grouped by user, selected by a WHERE clause on r
+func queryBillExportRows(db *sql.DB, where string, args []interface{}) ([]billExportRow, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT 
+			u.mobile,
+			COALESCE(u.company, ''),
+			r.id as reg_id,
+			r.serial,
+			p.name as product_name,
+			f.path,
+			f.kind,
+			r.status,
+			r.created_at
+		FROM registrations r 
+		JOIN users u ON r.user_id=u.id
+		JOIN products p ON r.product_id=p.id
+		JOIN registration_files f ON f.registration_id=r.id
+		%s
+		ORDER BY u.mobile, r.created_at, f.id
+	`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []billExportRow{}
+	for rows.Next() {
+		var row billExportRow
+		rows.Scan(&row.Mobile, &row.Company, &row.RegistrationID, &row.Serial, &row.ProductName, &row.Path, &row.Kind, &row.Status, &row.CreatedAt)
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// Split bill export rows into those whose file is on disk and those whose isn't
+func splitMissingBills(rows []billExportRow) ([]billExportRow, []billExportRow) {
+	present := []billExportRow{}
+	missing := []billExportRow{}
+	for _, row := range rows {
+		billPath, err := billFullPath(row.Path)
+		if err == nil {
+			if info, statErr := os.Stat(billPath); statErr == nil && !info.IsDir() {
+				present = append(present, row)
+				continue
+			}
+		}
+		logWarn("Bill file missing for registration %d: %s", row.RegistrationID, row.Path)
+		missing = append(missing, row)
+	}
+	return present, missing
+}
+
+// Add the files of bill export rows to a zip, returning how many were added
+func addBillRowsToZip(zipWriter *zip.Writer, compression string, rows []billExportRow, names map[string]int) int {
+	fileCount := 0
+	for _, row := range rows {
+		if addBillToZip(zipWriter, compression, row.Path, billTemplateValues(row.Mobile, row.Company, row.CreatedAt, row.Serial, row.ProductName, row.Status, row.Kind), names) {
+			fileCount++
+		}
+	}
+	return fileCount
+}
+
+// Name of the zip entry listing bills that weren't found
+const missingBillsManifest = "missing.txt"
+
+// Add missing.txt to a bill export, one line per file that couldn't be found
+func addMissingBillsManifest(zipWriter *zip.Writer, missing []billExportRow) {
+	w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: missingBillsManifest, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		logError("Error creating zip entry: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "%d bill files could not be found:\n", len(missing))
+	for _, row := range missing {
+		fmt.Fprintf(w, "registration %d\tserial %s\tmobile %s\t%s (%s)\n", row.RegistrationID, row.Serial, row.Mobile, row.Path, row.Kind)
+	}
+}
+
+// Admin: Stream one zip for auditors with registrations.csv and the bills by user,
+// both filtered by ?from=&to=&status=, with optional password in URL
+func exportFullZip(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorizeExport(db, c) {
+			return
+		}
+
+		compression := c.Query("compression")
+		if !zipCompressionModes[compression] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "compression must be store, fast or best"})
+			return
+		}
+		where, args, err := registrationExportFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		format, err := parseCSVFormat(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		regRows, err := queryRegistrationRows(db, where, args)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		defer regRows.Close()
+		// Bills are checked before streaming so X-Missing-Count can be sent
+		billRows, err := queryBillExportRows(db, where, args)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		present, missing := splitMissingBills(billRows)
+
+		fileName := fmt.Sprintf("registrations_full_%s.zip", time.Now().Format("2006-01-02"))
+		c.Header("X-Missing-Count", strconv.Itoa(len(missing)))
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+fileName)
+		c.Header("Content-Type", "application/zip")
+
+		zipWriter := newBillsZipWriter(c.Writer, compression)
+		defer zipWriter.Close()
+		csvWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "registrations.csv", Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			logError("Error creating zip entry: %v", err)
+			return
+		}
+		writeRegistrationsCSV(csvWriter, regRows, format)
+		regRows.Close()
+
+		fileCount := addBillRowsToZip(zipWriter, compression, present, map[string]int{"registrations.csv": 1, missingBillsManifest: 1})
+		if len(missing) > 0 {
+			addMissingBillsManifest(zipWriter, missing)
+		}
+		logInfo("Admin exported registrations with %d bill files (%d missing): %s", fileCount, len(missing), fileName)
+	}
+}
+
+// Most log lines GET /admin/logs returns at once
+const maxLogTailLines = 5000
 
-			// Extract filename from URL path
-			billFilename := filepath.Base(billUrlPath)
+func logFilePath() string {
+	return filepath.Join(os.Getenv("DATA_DIR"), "logs", "portal.log")
+}
+
+// Read the last n lines of a file, reading backwards in chunks so large files
+// aren't loaded whole
+func tailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-			// Construct the full filesystem path
-			billFullPath := filepath.Join(dataDir, "bills", billFilename)
+	const chunkSize = 64 * 1024
+	offset := info.Size()
+	buf := []byte{}
+	// One newline more than n so a partial first line can be dropped
+	for offset > 0 && bytes.Count(buf, []byte{'\n'}) <= n {
+		readSize := int64(chunkSize)
+		if offset < readSize {
+			readSize = offset
+		}
+		offset -= readSize
+		chunk := make([]byte, readSize)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+	}
 
-			log.Printf("Looking for bill file at: %s", billFullPath)
+	text := strings.TrimRight(string(buf), "\n")
+	if text == "" {
+		return []string{}, nil
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
 
-			// Skip if file doesn't exist
-			if _, err := os.Stat(billFullPath); os.IsNotExist(err) {
-				log.Printf("Bill file not found: %s", billFullPath)
-				continue
+// Admin: Last ?lines=N lines of the application log (default 500)
+func tailLogs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n := 500
+		if value := c.Query("lines"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "lines must be a positive number"})
+				return
 			}
-
-			// Read the bill file
-			fileData, err := os.ReadFile(billFullPath)
-			if err != nil {
-				log.Printf("Error reading bill file: %v", err)
-				continue // Skip if file can't be read
+			n = parsed
+		}
+		if n > maxLogTailLines {
+			n = maxLogTailLines
+		}
+		lines, err := tailLines(logFilePath(), n)
+		if err != nil {
+			if os.IsNotExist(err) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Log file not found"})
+				return
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read log file"})
+			return
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(http.StatusOK)
+		for _, line := range lines {
+			c.Writer.WriteString(line + "\n")
+		}
+	}
+}
 
-			// Add file to zip in user folder
-			folderName := fmt.Sprintf("%s", mobile)
-			fileName := fmt.Sprintf("%s/%s-%s-%s%s", folderName, createdAt[:10], serial, productName, filepath.Ext(billFilename))
-
-			// Sanitize filename
-			fileName = strings.ReplaceAll(fileName, " ", "_")
+// Admin: Download the whole application log
+func downloadLogs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := logFilePath()
+		if _, err := os.Stat(path); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Log file not found"})
+			return
+		}
+		logInfo("Admin downloaded the application log")
+		c.FileAttachment(path, fmt.Sprintf("portal_%s.log", time.Now().Format("2006-01-02")))
+	}
+}
 
-			fileWriter, err := zipWriter.Create(fileName)
-			if err != nil {
-				log.Printf("Error creating zip entry: %v", err)
-				continue // Skip if creating file in zip fails
-			}
+// Result of PRAGMA wal_checkpoint: busy is 1 when a reader or writer blocked it
+type walCheckpointResult struct {
+	Busy               int   `json:"busy"`
+	LogFrames          int   `json:"log_frames"`
+	CheckpointedFrames int   `json:"checkpointed_frames"`
+	WALBytesBefore     int64 `json:"wal_bytes_before"`
+	WALBytesAfter      int64 `json:"wal_bytes_after"`
+}
 
-			_, err = fileWriter.Write(fileData)
-			if err != nil {
-				log.Printf("Error writing to zip: %v", err)
-				continue // Skip if writing fails
-			}
+// Size of the database's -wal file, 0 when there is none
+func walFileSize() int64 {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data" // Fallback
+	}
+	info, err := os.Stat(filepath.Join(dataDir, "portal.db-wal"))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
 
-			fileCount++
+// Copy the WAL into the database file and truncate it
+func checkpointWAL(db *sql.DB) (walCheckpointResult, error) {
+	result := walCheckpointResult{WALBytesBefore: walFileSize()}
+	err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&result.Busy, &result.LogFrames, &result.CheckpointedFrames)
+	result.WALBytesAfter = walFileSize()
+	return result, err
+}
 
-			// Update current mobile
-			if currentMobile != mobile {
-				currentMobile = mobile
+// Checkpoint the WAL every WAL_CHECKPOINT_MINUTES (default 60, 0 turns it off)
+func startWALCheckpointJob(db *sql.DB) {
+	minutes := getEnvInt("WAL_CHECKPOINT_MINUTES", 60)
+	if minutes <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(time.Duration(minutes) * time.Minute)
+			result, err := checkpointWAL(db)
+			if err != nil {
+				logError("WAL checkpoint failed: %v", err)
+			} else if result.Busy != 0 {
+				logWarn("WAL checkpoint was blocked by a busy connection; %d of %d frames checkpointed", result.CheckpointedFrames, result.LogFrames)
 			}
 		}
+	}()
+	logInfo("WAL checkpoint job started: every %d minutes", minutes)
+}
 
-		// Close the zip writer before reading the file
-		zipWriter.Close()
-
-		if fileCount == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": "No bill files found"})
-			return
-		}
-
-		// Read the temporary file
-		tmpFile.Seek(0, 0)
-		zipData, err := io.ReadAll(tmpFile)
+// Admin: Force a WAL checkpoint now
+func forceWALCheckpoint(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := checkpointWAL(db)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read zip file"})
+			logError("WAL checkpoint failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Checkpoint failed"})
 			return
 		}
-
-		// Set headers for zip download
-		dateStr := time.Now().Format("2006-01-02")
-		sinceStr := ""
-		if !since.IsZero() {
-			sinceStr = fmt.Sprintf("_since_%s", since.Format("2006-01-02"))
-		}
-		fileName := fmt.Sprintf("bills_by_user%s_%s.zip", sinceStr, dateStr)
-		c.Header("Content-Description", "File Transfer")
-		c.Header("Content-Disposition", "attachment; filename="+fileName)
-		c.Header("Content-Type", "application/zip")
-		c.Header("Content-Length", fmt.Sprintf("%d", len(zipData)))
-
-		// Write the zip file to response
-		c.Writer.Write(zipData)
-
-		log.Printf("Admin downloaded %d bill files as zip: %s", fileCount, fileName)
+		logInfo("Admin forced a WAL checkpoint: %d frames, WAL %d -> %d bytes", result.CheckpointedFrames, result.WALBytesBefore, result.WALBytesAfter)
+		c.JSON(http.StatusOK, result)
 	}
 }
 
 // Admin: Backup database with optional password in URL
 func backupDatabase(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Check if password is provided in URL path
-		password := c.Param("password")
-		if password != "" {
-			// Verify admin credentials
-			var id int
-			var role string
-			err := db.QueryRow("SELECT id, role FROM users WHERE username = 'admin' AND password = ?", password).Scan(&id, &role)
-			if err != nil || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin password"})
-				return
-			}
-		} else {
-			// Use the usual authentication middleware result
-			role, exists := c.Get("role")
-			if !exists || role != "ADMIN" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
-				return
-			}
+		if !authorizeExport(db, c) {
+			return
+		}
+
+		// Bring the database file up to date so the copy has everything still in the WAL
+		if _, err := checkpointWAL(db); err != nil {
+			logError("WAL checkpoint before backup failed: %v", err)
 		}
 
 		// Create backups directory if it doesn't exist
@@ -1137,7 +7635,317 @@ func backupDatabase(db *sql.DB) gin.HandlerFunc {
 		// Clean up backup file (keep only the zip)
 		os.Remove(backupFileName)
 
-		log.Printf("Admin created database backup: %s", zipFileName)
+		logInfo("Admin created database backup: %s", zipFileName)
+	}
+}
+
+// Delete rejected registrations created more than days ago, along with bill
+// files no other registration still uses. Approved and pending rows are never touched.
+func purgeRejectedRegistrations(db *sql.DB, days int, dryRun bool) (int, int, error) {
+	cutoff := time.Now().AddDate(0, 0, -days).Format("2006-01-02 15:04:05")
+	rows, err := db.Query("SELECT id FROM registrations WHERE status = 'rejected' AND created_at < ?", cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	_, paths, err := registrationsWithFiles(db, "r.status = 'rejected' AND r.created_at < ?", cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Files are shared by all serials of one submission, so keep any still
+	// used by a registration that stays
+	removable := []string{}
+	for _, path := range paths {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM registration_files f JOIN registrations r ON r.id = f.registration_id WHERE f.path = ? AND NOT (r.status = 'rejected' AND r.created_at < ?)", path, cutoff).Scan(&count)
+		if count == 0 {
+			removable = append(removable, path)
+		}
+	}
+
+	if dryRun {
+		return len(ids), len(removable), nil
+	}
+
+	for _, id := range ids {
+		recordRegistrationEvent(db, id, "purged")
+		if _, err := execWithRetry(db, "DELETE FROM registrations WHERE id = ? AND status = 'rejected'", id); err != nil {
+			return 0, 0, err
+		}
+		if _, err := execWithRetry(db, "DELETE FROM registration_files WHERE registration_id = ?", id); err != nil {
+			return 0, 0, err
+		}
+	}
+	removedFiles := 0
+	for _, bill := range removable {
+		if err := removeBillFile(bill); err != nil {
+			logWarn("Could not delete bill file %s: %v", bill, err)
+			continue
+		}
+		removedFiles++
+	}
+	return len(ids), removedFiles, nil
+}
+
+// Periodically purge old rejected registrations (REJECTED_RETENTION_DAYS, off when unset)
+func startRetentionJob(db *sql.DB) {
+	days := getEnvInt("REJECTED_RETENTION_DAYS", 0)
+	if days <= 0 {
+		return
+	}
+	go func() {
+		for {
+			regs, files, err := purgeRejectedRegistrations(db, days, false)
+			if err != nil {
+				logError("Retention purge failed: %v", err)
+			} else if regs > 0 {
+				logInfo("Retention purge removed %d rejected registrations and %d bill files", regs, files)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+	logInfo("Retention job started: rejected registrations older than %d days are purged daily", days)
+}
+
+// Admin: Purge old rejected registrations now, optionally as a dry run
+func purgeRejected(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		days := getEnvInt("REJECTED_RETENTION_DAYS", 0)
+		if days <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "REJECTED_RETENTION_DAYS is not configured"})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		regs, files, err := purgeRejectedRegistrations(db, days, dryRun)
+		if err != nil {
+			logError("Purge failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Purge failed"})
+			return
+		}
+		logInfo("Admin purged rejected registrations (dry run: %v): %d registrations, %d bill files", dryRun, regs, files)
+		c.JSON(http.StatusOK, gin.H{"dry_run": dryRun, "retention_days": days, "registrations": regs, "bill_files": files})
+	}
+}
+
+// Set from MAINTENANCE=true at startup or by an admin at runtime
+var maintenanceMode atomic.Bool
+
+// In maintenance mode, reject writes to non-admin routes with 503 while reads,
+// health checks, admin routes and login (so admins can sign in) keep working
+func maintenanceGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !maintenanceMode.Load() {
+			c.Next()
+			return
+		}
+		method := c.Request.Method
+		path := c.Request.URL.Path
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions ||
+			strings.HasPrefix(path, "/admin/") || path == "/login" {
+			c.Next()
+			return
+		}
+		c.Header("Retry-After", strconv.Itoa(getEnvInt("MAINTENANCE_RETRY_AFTER", 300)))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "The portal is under maintenance, please try again later"})
+	}
+}
+
+// Admin: Turn maintenance mode on or off
+func setMaintenanceMode(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if !bindJSON(c, &req) {
+			return
+		}
+		if req.Enabled == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enabled is required"})
+			return
+		}
+		maintenanceMode.Store(*req.Enabled)
+		recordAudit(db, c, "maintenance.mode_changed", "portal", fmt.Sprintf("enabled=%v", *req.Enabled))
+		logInfo("Admin set maintenance mode: %v", *req.Enabled)
+		c.JSON(http.StatusOK, gin.H{"maintenance": *req.Enabled})
+	}
+}
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildTime=..."
+var (
+	version   = "1.0.0"
+	gitCommit = ""
+	buildTime = ""
+)
+
+// Build metadata with fallbacks from the Go toolchain's embedded VCS info
+func buildInfo() map[string]string {
+	commit, built := gitCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && commit == "" {
+				commit = setting.Value
+			}
+			if setting.Key == "vcs.time" && built == "" {
+				built = setting.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": built,
+		"go_version": runtime.Version(),
+	}
+}
+
+// Root: a JSON index of the main endpoints, or with ROOT_REDIRECT a 302 to that URL
+func rootIndex() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if target := os.Getenv("ROOT_REDIRECT"); target != "" {
+			c.Redirect(http.StatusFound, target)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Portal System API is running.",
+			"links":   gin.H{"health": "/health", "docs": "/docs", "version": "/version"},
+		})
+	}
+}
+
+// Version API - build metadata
+func versionInfo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, buildInfo())
+	}
+}
+
+// Set once the schema is migrated and the full router is serving
+var migrationsDone atomic.Bool
+
+// Router served while the database is migrated: live, but not yet ready
+func startupRouter() *gin.Engine {
+	r := gin.New()
+	r.GET("/live", liveCheck())
+	r.GET("/ready", func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting", "error": "Migrations not completed"})
+	})
+	r.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is starting"})
+	})
+	return r
+}
+
+// Liveness probe - the process is up and serving requests
+func liveCheck() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Readiness probe - 503 until migrations are done and the database answers
+func readyCheck(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !migrationsDone.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting", "error": "Migrations not completed"})
+			return
+		}
+		if err := db.Ping(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "Database not reachable"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	}
+}
+
+// Most orphaned registrations the integrity check lists
+const maxIntegrityOrphans = 100
+
+// Admin: Run SQLite's integrity and foreign key checks and look for registrations
+// whose user or product row is gone. healthy is false if any of them finds a problem.
+func dbIntegrity(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		integrity := []string{}
+		rows, err := db.Query("PRAGMA integrity_check")
+		if err != nil {
+			logError("Integrity check failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Integrity check failed"})
+			return
+		}
+		for rows.Next() {
+			var line string
+			rows.Scan(&line)
+			integrity = append(integrity, line)
+		}
+		rows.Close()
+
+		foreignKeys := []gin.H{}
+		rows, err = db.Query("PRAGMA foreign_key_check")
+		if err != nil {
+			logError("Foreign key check failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Foreign key check failed"})
+			return
+		}
+		for rows.Next() {
+			var table, parent string
+			var rowID sql.NullInt64
+			var fkID int
+			rows.Scan(&table, &rowID, &parent, &fkID)
+			foreignKeys = append(foreignKeys, gin.H{"table": table, "rowid": rowID.Int64, "parent": parent})
+		}
+		rows.Close()
+
+		var orphanCount int
+		orphanWhere := `NOT EXISTS (SELECT 1 FROM users u WHERE u.id = r.user_id) OR NOT EXISTS (SELECT 1 FROM products p WHERE p.id = r.product_id)`
+		db.QueryRow("SELECT COUNT(*) FROM registrations r WHERE " + orphanWhere).Scan(&orphanCount)
+		orphans := []gin.H{}
+		rows, err = db.Query(`SELECT r.id, COALESCE(r.serial, ''), COALESCE(r.user_id, 0), COALESCE(r.product_id, 0),
+			EXISTS (SELECT 1 FROM users u WHERE u.id = r.user_id), EXISTS (SELECT 1 FROM products p WHERE p.id = r.product_id)
+			FROM registrations r WHERE `+orphanWhere+` ORDER BY r.id LIMIT ?`, maxIntegrityOrphans)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+			return
+		}
+		for rows.Next() {
+			var id, userID, productID int
+			var serial string
+			var hasUser, hasProduct bool
+			rows.Scan(&id, &serial, &userID, &productID, &hasUser, &hasProduct)
+			missing := []string{}
+			if !hasUser {
+				missing = append(missing, "user")
+			}
+			if !hasProduct {
+				missing = append(missing, "product")
+			}
+			orphans = append(orphans, gin.H{"id": id, "serial": serial, "user_id": userID, "product_id": productID, "missing": missing})
+		}
+		rows.Close()
+
+		healthy := len(integrity) == 1 && integrity[0] == "ok" && len(foreignKeys) == 0 && orphanCount == 0
+		if !healthy {
+			logWarn("Database integrity check found problems: integrity %v, %d foreign key violations, %d orphaned registrations", integrity, len(foreignKeys), orphanCount)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"healthy":                healthy,
+			"integrity_check":        integrity,
+			"foreign_key_violations": foreignKeys,
+			"orphaned_registrations": orphans,
+			"orphaned_count":         orphanCount,
+		})
 	}
 }
 
@@ -1145,10 +7953,11 @@ func backupDatabase(db *sql.DB) gin.HandlerFunc {
 func healthCheck(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		health := map[string]interface{}{
-			"status":     "ok",
-			"version":    "1.0.0",
-			"timestamp":  time.Now().Format(time.RFC3339),
-			"components": make(map[string]interface{}),
+			"status":      "ok",
+			"version":     version,
+			"timestamp":   time.Now().Format(time.RFC3339),
+			"maintenance": maintenanceMode.Load(),
+			"components":  make(map[string]interface{}),
 		}
 
 		// Check database connection
@@ -1206,15 +8015,31 @@ func healthCheck(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
+// Public configuration for the frontend - never include secrets here
+func publicConfig() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"portal_title":       portalTitle(),
+			"max_upload_mb":      maxUploadMB(),
+			"max_serials":        maxSerialsPerRequest(),
+			"allowed_bill_types": allowedBillTypes(),
+			"otp_login_enabled":  false, // OTP login is not available yet
+			"captcha_enabled":    os.Getenv("CAPTCHA_SECRET") != "",
+		})
+	}
+}
+
 // API Documentation - provides information on how to use the API
 func apiDocumentation() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		docs := map[string]interface{}{
-			"api_version":   "1.0.0",
+			"api_version":   version,
 			"title":         "Product Registration Portal API",
 			"description":   "API for managing product registrations, users, and admin functions",
-			"base_url":      "http://localhost:8080",
+			"base_url":      publicBaseURL(c),
 			"documentation": "This endpoint provides information about all available API endpoints",
+			"pagination":    "Endpoints taking page and limit also send X-Total-Count and a Link header with next, prev and last pages",
+			"admin_access":  "When ADMIN_IP_ALLOWLIST (comma separated CIDRs or IPs) is set, /admin routes answer 403 to other clients. X-Forwarded-For is used only with TRUST_PROXY=true",
 			"endpoints":     []map[string]interface{}{},
 		}
 
@@ -1224,28 +8049,131 @@ func apiDocumentation() gin.HandlerFunc {
 			"method":      "POST",
 			"description": "Authenticates a user or admin",
 			"body":        map[string]string{"mobile": "User mobile number", "password": "Required only for admin"},
-			"response":    map[string]string{"token": "Authentication token", "role": "User role (ADMIN or CUSTOMER)"},
+			"response":    map[string]string{"token": "Authentication token", "role": "User role (ADMIN, STAFF or CUSTOMER)"},
 			"example":     "POST /login {\"mobile\": \"9999999999\"} or {\"mobile\": \"admin\", \"password\": \"xxxxx\"}",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/auth/check",
+			"method":      "GET",
+			"auth":        "Token in Authorization header",
+			"description": "Checks whether a token is valid without refreshing the session; invalid, inactive or idle-expired tokens return 401",
+			"response":    map[string]string{"valid": "Whether the token is valid", "role": "User role", "user_id": "User ID"},
+			"example":     "GET /auth/check",
+		})
+
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":        "/register",
 			"method":      "POST",
-			"description": "Registers a new customer",
-			"body":        map[string]string{"mobile": "Mobile number", "company": "Company name", "gst": "GST number"},
+			"description": "Registers a new customer. 403 when the mobile starts with one of BLOCKED_MOBILE_PREFIXES",
+			"body":        map[string]string{"mobile": "Mobile number", "company": "Company name", "gst": "GST number, up to 15 characters", "captcha_token": "Required when CAPTCHA is enabled"},
 			"response":    map[string]string{"token": "Authentication token"},
-			"example":     "POST /register {\"mobile\": \"9999999999\", \"company\": \"My Company\", \"gst\": \"GST123456\"}",
+			"example":     "POST /register {\"mobile\": \"9999999999\", \"company\": \"My Company\", \"gst\": \"27ABCDE1234F1Z5\"}",
+		})
+
+		// Customer endpoints
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/register-product",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Register a new product with serial number and bill file, plus optional warranty or other documents (at most 5 files). 429 once the customer has registered DAILY_REGISTRATION_QUOTA serials today. A serial with a pending, needs_info or approved registration is always taken (409); a rejected one stays taken for DUPLICATE_GRACE_DAYS (default 0: for good) after it was rejected and can then be registered again, replacing the rejected registration",
+			"body":        map[string]string{"serial": "Product serial number, or several separated by commas (at most MAX_SERIALS_PER_REQUEST, default 100)", "product_id": "ID of the product", "bill": "Bill file (multipart form); repeat for several", "warranty": "Optional warranty card file(s)", "other": "Optional other document file(s)", "upload_id": "Instead of or as well as bill: id of a completed chunked upload", "<meta field>": "A value for each field in the product's meta_schema; 400 with fields when a required one is missing"},
+			"response":    map[string]string{"status": "pending, or approved when every serial was auto-approved", "auto_approved_serials": "Serials approved straight away (AUTO_APPROVE=true and in the product's serial registry)"},
+			"example":     "POST /register-product FormData with serial, product_id and bill file",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/upload/init",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Start a chunked bill upload for slow connections. Unfinished uploads expire after UPLOAD_EXPIRY_HOURS (default 24)",
+			"body":        map[string]string{"filename": "Bill file name", "size": "File size in bytes", "chunks": fmt.Sprintf("Number of chunks (at most %d)", maxUploadChunks)},
+			"response":    map[string]string{"upload_id": "Id for the chunk and complete calls"},
+			"example":     "POST /upload/init {\"filename\": \"bill.pdf\", \"size\": 3145728, \"chunks\": 3}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/upload/{id}",
+			"method":      "GET",
+			"auth":        "Customer token required",
+			"description": "Progress of a chunked upload; resend the chunks missing from received",
+			"response":    map[string]string{"status": "open, complete or used", "received": "Indexes of the chunks received"},
+			"example":     "GET /upload/3f2a...",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/upload/{id}/chunk",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Upload one chunk. Chunks can arrive in any order and resending one replaces it",
+			"parameters":  map[string]string{"index": "Chunk index, starting at 0"},
+			"body":        map[string]string{"chunk": "Chunk data (multipart form file)"},
+			"response":    map[string]string{"received": "Chunks received so far"},
+			"example":     "POST /upload/3f2a.../chunk?index=0 FormData with chunk",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/upload/{id}/complete",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Assemble the chunks into the bill. Returns 400 with the missing chunk indexes if any haven't arrived. Then pass upload_id to /register-product",
+			"response":    map[string]string{"status": "complete", "bill_file": "URL path of the bill"},
+			"example":     "POST /upload/3f2a.../complete",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/customer/product/{id}",
+			"method":      "GET",
+			"auth":        "Customer token required",
+			"description": "Details of an active product before registering it. 404 if the product is inactive or unknown",
+			"response":    map[string]string{"id": "Product ID", "name": "Product name", "description": "Product description", "serial_pattern": "Regular expression serials must match, empty when any serial is accepted", "warranty_months": "Warranty period in months, 0 when not set", "image_url": "Path of the product image", "meta_schema": "Extra fields to send with POST /register-product: name, label and whether it's required"},
+			"example":     "GET /customer/product/3",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/products/image/{id}",
+			"method":      "GET",
+			"auth":        "None",
+			"description": "A product's image, or a placeholder SVG when it has none. Upload one with POST /admin/product as a multipart form with an image field (.jpg, .jpeg, .png, .webp or .gif)",
+			"response":    "Image file",
+			"example":     "GET /products/image/3",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/bills/view/{filename}",
+			"method":      "GET",
+			"auth":        "Token required; customers only see bills of their own registrations",
+			"description": "A bill served inline with its detected content type, so browsers show PDFs and images instead of downloading them",
+			"response":    "Bill file (Content-Disposition: inline)",
+			"example":     "GET /bills/view/12_1715000000000000000.pdf",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/customer/check-serials",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Check serial numbers before registering, without uploading a bill",
+			"body":        map[string]string{"serials": "Array of serial numbers", "product_id": "ID of the product"},
+			"response":    "Per serial status: available, registered or invalid (doesn't match the product's serial pattern), plus stored_as when the product's serial transform rewrites it",
+			"example":     "POST /customer/check-serials {\"serials\": [\"SN001\", \"SN002\"], \"product_id\": 1}",
 		})
 
-		// Customer endpoints
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
-			"path":        "/register-product",
+			"path":        "/customer/email/verify/request",
 			"method":      "POST",
 			"auth":        "Customer token required",
-			"description": "Register a new product with serial number and bill file",
-			"body":        map[string]string{"serial": "Product serial number", "product_id": "ID of the product", "bill": "Bill file (multipart form)"},
-			"response":    map[string]string{"status": "pending"},
-			"example":     "POST /register-product FormData with serial, product_id and bill file",
+			"description": "Set an email and send a link to verify it. Registration updates are only emailed to verified addresses; changing the email unverifies it. 401 without a valid token; 429 when a link went to the same address in the last EMAIL_VERIFY_RESEND_MINUTES (default 5)",
+			"body":        map[string]string{"email": "Optional. Defaults to the email on file"},
+			"response":    map[string]string{"status": "sent or already_verified", "email": "Email the link was sent to", "expires_at": "When the link expires (EMAIL_VERIFY_TTL_HOURS, default 24)"},
+			"example":     "POST /customer/email/verify/request {\"email\": \"buyer@example.com\"}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/customer/email/verify/{token}",
+			"method":      "GET",
+			"auth":        "None (the link is signed)",
+			"description": "Confirm an email from its verification link. 400 if the link is tampered with, expired or for an email that has since changed",
+			"response":    map[string]string{"status": "verified", "email": "The verified email"},
 		})
 
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
@@ -1253,62 +8181,406 @@ func apiDocumentation() gin.HandlerFunc {
 			"method":      "GET",
 			"auth":        "Customer token required",
 			"description": "Get customer's own product registrations",
+			"parameters":  map[string]string{"page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
 			"response":    "Array of registration objects",
 			"example":     "GET /my-registrations",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/my-registrations/{id}/bill",
+			"method":      "POST",
+			"auth":        "Customer token required",
+			"description": "Upload a new bill for a registration marked needs_info. Moves it back to pending",
+			"body":        map[string]string{"bill": "Bill file (multipart form)"},
+			"response":    map[string]string{"status": "pending", "bill_file": "URL path of the new bill"},
+			"example":     "POST /my-registrations/5/bill",
+		})
+
 		// Admin user management
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":        "/admin/users",
 			"method":      "GET",
 			"auth":        "Admin token required",
 			"description": "List all users",
+			"parameters":  map[string]string{"page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)", "sort": "Optional. id, username, mobile, company, role or created_at", "order": "Optional. asc (default) or desc"},
 			"response":    "Array of user objects",
 			"example":     "GET /admin/users",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Create a user (no id) or edit one. Edits must send the version from the user list; 409 if it has changed since",
+			"body":        map[string]string{"id": "Optional. User to edit", "username": "Username", "password": "Password. New ADMIN/STAFF passwords need PASSWORD_MIN_LENGTH (8) characters mixing PASSWORD_MIN_CLASSES (3) of lower, upper, digit, symbol; customers need CUSTOMER_PASSWORD_MIN_LENGTH (6). 400 with problems when too weak", "mobile": "Mobile number", "company": "Company", "gst": "GST number", "role": "ADMIN, STAFF or CUSTOMER. STAFF can view registrations and exports but not manage users", "active": "1 or 0", "version": "Required when editing"},
+			"response":    map[string]string{"status": "created or updated", "version": "New version (edits only)"},
+			"example":     "POST /admin/user {\"id\": 3, \"username\": \"9876543210\", \"mobile\": \"9876543210\", \"role\": \"CUSTOMER\", \"active\": 1, \"version\": 2}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user/lookup",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Find a user by mobile or GST. Exactly one parameter is required; 404 if there's no such user",
+			"parameters":  map[string]string{"mobile": "Mobile number", "gst": "GST number"},
+			"response":    "User object",
+			"example":     "GET /admin/user/lookup?gst=22AAAAA0000A1Z5",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/companies",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Distinct company names starting with a prefix, for autocomplete. Case, punctuation and suffixes like Pvt Ltd are ignored",
+			"parameters":  map[string]string{"q": "Optional. Company name prefix"},
+			"response":    map[string]string{"companies": "Up to 20 company names"},
+			"example":     "GET /admin/companies?q=acme",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user/{id}/summary",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "User profile with registration counts by status and last login",
+			"response":    "User summary object",
+			"example":     "GET /admin/user/5/summary",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/users/status-matrix",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "Registration counts by status for each non-admin user, in user id order",
+			"parameters":  map[string]string{"page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
+			"response":    "Array of {id, username, mobile, company, total, pending, needs_info, approved, rejected}",
+			"example":     "GET /admin/users/status-matrix?page=2&limit=50",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user/{id}/logins",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "A user's login history with user agent and IP, newest first. new_device marks a user agent not seen before",
+			"parameters":  map[string]string{"page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
+			"response":    "Array of login objects",
+			"example":     "GET /admin/user/5/logins?limit=20",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user/{id}/active",
+			"method":      "PATCH",
+			"auth":        "Admin token required",
+			"description": "Activate or deactivate a user. Deactivating invalidates the user's token",
+			"body":        map[string]string{"active": "0 or 1"},
+			"response":    map[string]string{"status": "updated"},
+			"example":     "PATCH /admin/user/5/active {\"active\": 0}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/users/merge",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Merge a duplicate customer account: moves registrations, copies missing profile fields and soft-deletes the source",
+			"body":        map[string]string{"source_id": "User to merge away", "target_id": "User to keep"},
+			"response":    map[string]string{"status": "merged", "registrations_moved": "Number of registrations reassigned"},
+			"example":     "POST /admin/users/merge {\"source_id\": 5, \"target_id\": 3}",
+		})
+
+		// Admin notifications
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/notifications",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "List customer notification jobs, newest first, with attempt count and last error",
+			"parameters":  map[string]string{"status": "Optional. pending, sending, sent or failed", "page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
+			"response":    "Array of notification jobs",
+			"example":     "GET /admin/notifications?status=failed",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/notifications/{id}/retry",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Requeue a failed notification",
+			"response":    map[string]string{"status": "queued"},
+			"example":     "POST /admin/notifications/12/retry",
+		})
+
 		// Admin product management
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":        "/admin/products",
 			"method":      "GET",
-			"auth":        "Admin token required",
+			"auth":        "Admin or staff token required",
 			"description": "List all products",
-			"response":    "Array of product objects",
-			"example":     "GET /admin/products",
+			"parameters":  map[string]string{"active": "Optional. 1 for active only, 0 for inactive only", "page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)", "sort": "Optional. id, name, active or created_at", "order": "Optional. asc (default) or desc"},
+			"response":    "Array of product objects. meta_schema lists the extra registration fields set with POST /admin/product, e.g. [{\"name\": \"dealer_invoice\", \"label\": \"Dealer invoice number\", \"required\": true}]. serial_transform is a regex replaced with serial_transform_replacement in upper-cased serials before they're stored or looked up, checked before serial_pattern (e.g. ^SN- stores SN-00123 as 00123)",
+			"example":     "GET /admin/products?active=1",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/products/active",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Activate or deactivate several products at once (at most 500 ids)",
+			"body":        map[string]string{"ids": "Array of product IDs", "active": "0 or 1"},
+			"response":    map[string]string{"status": "updated", "active": "The new active value", "updated": "Number of products changed"},
+			"example":     "POST /admin/products/active {\"ids\": [3, 4, 7], \"active\": 0}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/products/counts",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Count active and inactive products",
+			"response":    map[string]string{"total": "All products", "active": "Active products", "inactive": "Inactive products"},
+			"example":     "GET /admin/products/counts",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/product/{id}",
+			"method":      "PATCH",
+			"auth":        "Admin token required",
+			"description": "Update only the fields given, leaving the others unchanged. The image is changed with POST /admin/product",
+			"body":        map[string]string{"name": "Optional, not empty", "description": "Optional", "active": "Optional. 0 or 1", "serial_pattern": "Optional", "warranty_months": "Optional", "serial_transform": "Optional", "serial_transform_replacement": "Optional", "meta_schema": "Optional. Replaces the whole list; [] removes it"},
+			"response":    map[string]string{"status": "updated", "updated_fields": "Columns that were set"},
+			"example":     "PATCH /admin/product/3 {\"active\": 0}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/product/{id}/serials/import",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Add serials from a CSV to the product's serial registry. Uses the serial column if the CSV has a header, otherwise the first column. Duplicates, serials already present and ones not matching the product's pattern are skipped",
+			"body":        map[string]string{"file": "CSV file (multipart form)"},
+			"response":    map[string]string{"added": "Serials added", "already_present": "Serials already in the registry", "duplicates": "Repeated serials in the file", "invalid": "Serials not matching the pattern", "invalid_serials": "The first 100 of them"},
+			"example":     "POST /admin/product/3/serials/import FormData with file",
 		})
 
 		// Admin registration management
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/pending-count",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Number of registrations waiting for review, for polling a badge. Send the ETag back as If-None-Match to get 304 while it's unchanged",
+			"response":    map[string]string{"pending": "Number of pending registrations"},
+			"example":     "GET /admin/pending-count",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/product/{id}/registrations",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "List registrations for one product, e.g. for a recall. 404 if the product doesn't exist",
+			"parameters":  map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)", "status": "Optional. pending, needs_info, approved or rejected", "page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
+			"response":    "Array of registration objects",
+			"example":     "GET /admin/product/3/registrations?status=approved&from=2025-01-01",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/product/{id}/nonconforming",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Registrations of a product whose serial doesn't match its serial pattern, to review after the pattern changes. Nothing is rejected; an empty pattern matches everything",
+			"parameters":  map[string]string{"pattern": "Optional. A proposed pattern to check instead of the current one", "page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)"},
+			"response":    map[string]string{"serial_pattern": "Pattern checked", "total": "Number of nonconforming registrations", "registrations": "This page of them"},
+			"example":     "GET /admin/product/3/nonconforming?pattern=INV[0-9]{6}",
+		})
+
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":        "/admin/registrations",
 			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "List all product registrations. Responses carry an ETag; send it back as If-None-Match to get 304 when nothing changed",
+			"parameters":  map[string]string{"page": "Optional. Page number, starting at 1", "limit": "Optional. Page size (default 100, max 200)", "after": "Optional. Cursor paging: return registrations after this id (start with 0)", "sort": "Optional. id, created_at, company, user, product, serial or status (not with after)", "order": "Optional. asc (default) or desc"},
+			"response":    "Array of registration objects, or {registrations, next_cursor} when after is used (next_cursor is null on the last page). duplicate_bill is true when the bill is identical to one another registration already used; meta holds the product's extra fields",
+			"example":     "GET /admin/registrations?after=0&limit=50",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/registration/{id}",
+			"method":      "PUT",
 			"auth":        "Admin token required",
-			"description": "List all product registrations",
-			"response":    "Array of registration objects",
-			"example":     "GET /admin/registrations",
+			"description": "Approve, reject or edit a registration. Notes (e.g. a rejection reason) are shown to the customer",
+			"body":        map[string]string{"status": "pending, needs_info, approved or rejected", "serial": "Serial number", "notes": "Optional. Reviewer note, up to 1000 characters; omit to keep the current note. Required for needs_info", "reason_code": "Optional, rejections only. A code from GET /admin/reject-reasons", "version": "Version from the registration as last read; 409 if it has changed since"},
+			"response":    map[string]string{"status": "updated", "version": "New version"},
+			"example":     "PUT /admin/registration/5 {\"status\": \"rejected\", \"serial\": \"ABC123\", \"notes\": \"Bill is unreadable\", \"version\": 1}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/registration/search",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Find a registration by serial. Use * as a wildcard to get a list of matches (up to 100). An exact serial also matches as each product's serial transform would store it",
+			"parameters":  map[string]string{"serial": "Exact serial, or a pattern like ABC* or *123"},
+			"response":    "Registration object, or an array of registrations when * is used",
+			"example":     "GET /admin/registration/search?serial=ABC*",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/serial/{serial}/history",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Every registration of a serial (any case), oldest first: registered, updated, reassigned by a user merge, and purged, with the user and product at the time",
+			"response":    map[string]string{"serial": "The serial", "history": "Array of {registration_id, event, status, at, user_id, user, mobile, company, product_id, product}"},
+			"example":     "GET /admin/serial/ABC123/history",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/reject-reasons",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "List the standard reject reasons",
+			"response":    "Array of {code, label}",
+			"example":     "GET /admin/reject-reasons",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/stats/reject-reasons",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Count rejected registrations per reject reason for registrations created in the date range",
+			"parameters":  map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)"},
+			"response":    map[string]string{"total_rejected": "Rejected registrations in range", "reasons": "Array of {code, label, count}", "uncategorized": "Rejections without a reason code"},
+			"example":     "GET /admin/stats/reject-reasons?from=2025-05-01&to=2025-05-31",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/reports/monthly",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Build the monthly registrations report and email it to REPORT_RECIPIENTS (also sent automatically on the first of each month)",
+			"parameters":  map[string]string{"month": "Optional. YYYY-MM, default last month", "format": "Optional. json (default) or csv for the month's registrations as a CSV download"},
+			"response":    map[string]string{"report": "month, total_registrations, pending, needs_info, approved, rejected, new_users and top_products", "emailed_to": "Recipients the email was queued for"},
+			"example":     "POST /admin/reports/monthly?month=2025-05",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/events",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Server-sent events stream: registration.created when a customer registers a serial, registration.status_changed when an admin changes a status. Sends a heartbeat comment every 30s",
+			"response":    "text/event-stream; each event's data is {type, data, sent_at}",
+			"example":     "GET /admin/events",
 		})
 
 		// Export and backup endpoints
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":                  "/admin/export/csv",
 			"method":                "GET",
-			"auth":                  "Admin token required",
+			"auth":                  "Admin or staff token required",
 			"description":           "Export all registrations as CSV file",
+			"parameters":            map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)", "status": "Optional. pending, approved or rejected", "delimiter": "Optional. comma (default), semicolon or tab", "bom": "Optional. true to start the file with a UTF-8 BOM for Excel"},
 			"response":              "CSV file download",
-			"example":               "GET /admin/export/csv",
+			"example":               "GET /admin/export/csv or GET /admin/export/csv?from=2025-05-01&status=approved&delimiter=semicolon&bom=true",
 			"direct_access_example": "GET /admin/export/csv/{password}",
 		})
 
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
-			"path":                  "/admin/export/bills",
+			"path":                  "/admin/export/pending.csv",
+			"method":                "GET",
+			"auth":                  "Admin or staff token required",
+			"description":           "Export the pending registrations worklist as CSV, oldest first: id, company, mobile, product, serial, date and bill URL",
+			"response":              "CSV file download",
+			"example":               "GET /admin/export/pending.csv",
+			"direct_access_example": "GET /admin/export/pending.csv/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/audit.csv",
+			"method":                "GET",
+			"auth":                  "Admin token required",
+			"description":           "Export the audit log of admin actions (user, product and registration changes, merges, bill deletions, maintenance mode) as CSV: actor, action, target, detail, timestamp",
+			"parameters":            map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)", "actor": "Optional. Username of the admin who acted", "delimiter": "Optional. comma (default), semicolon or tab", "bom": "Optional. true to start the file with a UTF-8 BOM"},
+			"response":              "CSV file download",
+			"example":               "GET /admin/export/audit.csv?actor=admin&from=2025-04-01",
+			"direct_access_example": "GET /admin/export/audit.csv/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/pdf",
+			"method":                "GET",
+			"auth":                  "Admin or staff token required",
+			"description":           "Export registrations as a printable PDF report (company, product, serial, status, date)",
+			"parameters":            map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)", "status": "Optional. pending, approved or rejected"},
+			"response":              "PDF file download",
+			"example":               "GET /admin/export/pdf?from=2025-05-01&to=2025-05-31",
+			"direct_access_example": "GET /admin/export/pdf/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/users.csv",
+			"method":                "GET",
+			"auth":                  "Admin token required",
+			"description":           "Export all non-admin users as CSV (company, mobile, GST, role, active, created at)",
+			"parameters":            map[string]string{"role": "Optional. Only users with this role", "active": "Optional. 0 or 1"},
+			"response":              "CSV file download",
+			"example":               "GET /admin/export/users.csv?active=1",
+			"direct_access_example": "GET /admin/export/users.csv/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/config",
 			"method":                "GET",
 			"auth":                  "Admin token required",
-			"description":           "Download all bill files organized by user mobile number",
-			"parameters":            map[string]string{"since": "Optional. Filter bills created after this date (format: YYYY-MM-DD)"},
-			"response":              "ZIP file download",
+			"description":           "Export products, and optionally users (without passwords or tokens), as an editable JSON bundle for POST /admin/import/config",
+			"parameters":            map[string]string{"include_users": "Optional. true to include non-admin users"},
+			"response":              "JSON file download: {exported_at, products, users}",
+			"example":               "GET /admin/export/config?include_users=true",
+			"direct_access_example": "GET /admin/export/config/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/import/config",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Create products and users from a config bundle. Products already present by name and users by username or mobile are skipped, as are users whose GST another user already has. Bundles up to MAX_IMPORT_KB (default 10240) are accepted",
+			"body":        "A bundle as produced by GET /admin/export/config",
+			"response":    map[string]string{"products_created": "Count", "products_skipped": "Count", "users_created": "Count", "users_skipped": "Count, including conflicts", "conflicts": "Users skipped because their GST belongs to another user: [{username, field, error}]"},
+			"example":     "POST /admin/import/config {\"products\": [{\"name\": \"Inverter X1\", \"active\": 1}]}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/import/preview",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Dry run of an import from CSV: validates each row with the import rules and reports whether it would be created, is a duplicate, or is invalid. Nothing is written",
+			"body":        map[string]string{"type": "products or users", "file": "CSV file (multipart form). Products: name, description, active, serial_pattern. Users: username, mobile, company, gst, role, active (the users CSV export headers also work)"},
+			"response":    map[string]string{"summary": "Counts of will_create, duplicate and invalid", "rows": "Array of {row, disposition, reason} per data row"},
+			"example":     "POST /admin/import/preview FormData with type=users and file",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/bills",
+			"method":                "GET",
+			"auth":                  "Admin or staff token required",
+			"description":           "Download all bill files, by default in a folder per user mobile number. Entry names follow BILL_EXPORT_TEMPLATE (default {mobile}/{date}-{serial}-{product}; fields: mobile, company, date, serial, product, status, kind). Warranty cards and other documents get -{kind} appended unless the template uses it",
+			"parameters":            map[string]string{"since": "Optional. Filter bills created after this date (format: YYYY-MM-DD)", "compression": "Optional. store, fast or best. By default PDFs and images are stored uncompressed"},
+			"response":              "ZIP file download. Bills missing on disk are listed in missing.txt inside the ZIP and counted in the X-Missing-Count header",
 			"example":               "GET /admin/export/bills or GET /admin/export/bills?since=2025-05-01",
 			"direct_access_example": "GET /admin/export/bills/{password} or GET /admin/export/bills/{password}?since=2025-05-01",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":                  "/admin/export/full.zip",
+			"method":                "GET",
+			"auth":                  "Admin or staff token required",
+			"description":           "Stream one ZIP for audits: registrations.csv (as /admin/export/csv) plus the bill files named as in /admin/export/bills, with the same filters applied to both",
+			"parameters":            map[string]string{"from": "Optional. Start date (YYYY-MM-DD)", "to": "Optional. End date, inclusive (YYYY-MM-DD)", "status": "Optional. pending, needs_info, approved or rejected", "delimiter": "Optional. CSV delimiter: comma (default), semicolon or tab", "bom": "Optional. true to start the CSV with a UTF-8 BOM", "compression": "Optional. store, fast or best"},
+			"response":              "ZIP file download, with missing.txt and X-Missing-Count as for /admin/export/bills",
+			"example":               "GET /admin/export/full.zip?from=2025-04-01&to=2025-06-30&status=approved",
+			"direct_access_example": "GET /admin/export/full.zip/{password}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/user/{id}/bills.zip",
+			"method":      "GET",
+			"auth":        "Admin or staff token required",
+			"description": "Download one user's bill files as a zip, named date-serial-product like the bulk export",
+			"parameters":  map[string]string{"compression": "Optional. store, fast or best"},
+			"response":    "ZIP file download, 404 if the user has no bills",
+			"example":     "GET /admin/user/5/bills.zip",
+		})
+
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":                  "/admin/backup",
 			"method":                "GET",
@@ -1319,6 +8591,109 @@ func apiDocumentation() gin.HandlerFunc {
 			"direct_access_example": "GET /admin/backup/{password}",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/db/integrity",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "Run PRAGMA integrity_check and foreign_key_check and list registrations whose user or product no longer exists (up to 100)",
+			"response":    map[string]string{"healthy": "false if any check found a problem", "integrity_check": "Lines from integrity_check (\"ok\" when clean)", "foreign_key_violations": "Rows from foreign_key_check", "orphaned_registrations": "Registrations with a missing user or product", "orphaned_count": "Total orphaned registrations"},
+			"example":     "GET /admin/db/integrity",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/db/checkpoint",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Run PRAGMA wal_checkpoint(TRUNCATE) now. Also runs every WAL_CHECKPOINT_MINUTES (default 60) and before each backup",
+			"response":    map[string]string{"busy": "1 if a busy connection blocked the checkpoint", "log_frames": "Frames in the WAL", "checkpointed_frames": "Frames copied into the database", "wal_bytes_before": "WAL file size before", "wal_bytes_after": "WAL file size after"},
+			"example":     "POST /admin/db/checkpoint",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/logs",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "Last lines of the application log (DATA_DIR/logs/portal.log) as plain text",
+			"parameters":  map[string]string{"lines": fmt.Sprintf("Optional. Number of lines (default 500, at most %d)", maxLogTailLines)},
+			"response":    "Plain text log lines, oldest first",
+			"example":     "GET /admin/logs?lines=200",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/logs/download",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "Download the whole application log",
+			"response":    "Log file download",
+			"example":     "GET /admin/logs/download",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/maintenance/purge",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Delete rejected registrations older than REJECTED_RETENTION_DAYS and their bill files. Also runs daily when configured",
+			"parameters":  map[string]string{"dry_run": "Optional. true to only report what would be deleted"},
+			"response":    map[string]string{"registrations": "Registrations deleted", "bill_files": "Bill files deleted"},
+			"example":     "POST /admin/maintenance/purge?dry_run=true",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/maintenance/bill-integrity",
+			"method":      "GET",
+			"auth":        "Admin token required",
+			"description": "List registration files (bills, warranty cards, other documents) that are missing on disk",
+			"response":    map[string]string{"missing": "registration_id, path and kind of each missing file", "missing_count": "Number of missing files", "registrations": "Registrations affected"},
+			"example":     "GET /admin/maintenance/bill-integrity",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/maintenance/bill-integrity",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Clear references to missing files. A registration's bill_file falls back to its next remaining bill, or is cleared",
+			"parameters":  map[string]string{"dry_run": "Optional. true to only report what would be cleared"},
+			"response":    map[string]string{"missing": "Files cleared (or that would be)", "files_cleared": "Number of files", "registrations": "Registrations changed"},
+			"example":     "POST /admin/maintenance/bill-integrity?dry_run=true",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/bills/purge",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Delete bill files of registrations created before a date and clear their bill_file. The registrations are kept",
+			"parameters":  map[string]string{"before": "Required. Date (YYYY-MM-DD); bills of registrations created earlier are deleted", "dry_run": "Optional. true to only report what would be deleted"},
+			"response":    map[string]string{"registrations": "Registrations whose bill was cleared", "bill_files": "Bill files deleted"},
+			"example":     "POST /admin/bills/purge?before=2024-04-01&dry_run=true",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/admin/maintenance/mode",
+			"method":      "POST",
+			"auth":        "Admin token required",
+			"description": "Turn maintenance mode on or off (also MAINTENANCE=true at startup). While on, non-admin writes get 503 with Retry-After; reads and /health keep working",
+			"body":        map[string]string{"enabled": "true or false"},
+			"response":    map[string]string{"maintenance": "Current mode"},
+			"example":     "POST /admin/maintenance/mode {\"enabled\": true}",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/version",
+			"method":      "GET",
+			"description": "Build metadata: version, git commit, build time and Go version",
+			"response":    "Version object",
+			"example":     "GET /version",
+		})
+
+		// Public configuration endpoint
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/config",
+			"method":      "GET",
+			"description": "Public configuration for the frontend (upload limits, allowed bill types, portal title)",
+			"response":    "Configuration object",
+			"example":     "GET /config",
+		})
+
 		// Health check endpoint
 		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
 			"path":        "/health",
@@ -1328,18 +8703,45 @@ func apiDocumentation() gin.HandlerFunc {
 			"example":     "GET /health",
 		})
 
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/live",
+			"method":      "GET",
+			"description": "Liveness probe. Returns 200 while the process is up",
+			"response":    map[string]string{"status": "ok"},
+			"example":     "GET /live",
+		})
+
+		docs["endpoints"] = append(docs["endpoints"].([]map[string]interface{}), map[string]interface{}{
+			"path":        "/ready",
+			"method":      "GET",
+			"description": "Readiness probe. Returns 503 until migrations have completed and the database is reachable",
+			"response":    map[string]string{"status": "ready, or starting/unavailable with a 503"},
+			"example":     "GET /ready",
+		})
+
 		c.JSON(http.StatusOK, docs)
 	}
 }
 
-func main() {
+// Middleware and routes. Writes go to db; readDB serves the read-heavy exports
+// and dashboards.
+func setupRouter(db, readDB *sql.DB, notifier *notificationQueue, events *eventBroker, adminAllowlist []*net.IPNet) *gin.Engine {
 	r := gin.Default()
-	setupEnvironment()
-	db := setupDatabase()
-	defer db.Close()
-	ensureAdmin(db)
+	// Shared by the export and backup routes
+	exportSlots := limitConcurrentExports(getEnvInt("MAX_CONCURRENT_EXPORTS", 2))
 
 	r.Use(setupCORS())
+	r.Use(adminIPGuard(adminAllowlist))
+	maintenanceMode.Store(os.Getenv("MAINTENANCE") == "true")
+	r.Use(maintenanceGuard())
+	r.Use(limitRequestBody())
+	if os.Getenv("ENABLE_GZIP") == "true" {
+		r.Use(gzipResponses())
+	}
+	// After gzip so it sees uncompressed responses
+	if os.Getenv("DEBUG_HTTP") == "true" {
+		r.Use(debugHTTPLogger())
+	}
 
 	// Get data directory for bill files
 	dataDir := os.Getenv("DATA_DIR")
@@ -1348,50 +8750,163 @@ func main() {
 	}
 	billsDir := filepath.Join(dataDir, "bills")
 
-	// Serve bill files statically - FIX PATH TO MATCH CLIENT REQUESTS
-	r.Static("/bills", billsDir)
+	// Serve bill files - FIX PATH TO MATCH CLIENT REQUESTS
+	r.GET("/bills/*name", billRoutes(db, billsDir))
+	r.HEAD("/bills/*name", billRoutes(db, billsDir))
+	r.GET("/products/image/:id", serveProductImage(db))
 
-	r.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "Portal System API is running.")
-	})
+	r.GET("/", rootIndex())
 
-	r.POST("/register", registerUser(db))
+	r.POST("/register", registerUser(db, newCaptchaVerifier()))
 	r.POST("/login", loginUser(db))
-
-	r.POST("/register-product", authMiddleware(db, false), registerProduct(db))
-	r.GET("/my-registrations", authMiddleware(db, false), listOwnRegistrations(db))
-	r.GET("/customer/dashboard", authMiddleware(db, false), customerDashboard(db))
-	r.GET("/customer/active-products", authMiddleware(db, false), listActiveProducts(db))
-
-	r.GET("/admin/users", authMiddleware(db, true), listUsers(db))
-	r.POST("/admin/user", authMiddleware(db, true), upsertUser(db))
-	r.DELETE("/admin/user/:id", authMiddleware(db, true), deleteUser(db))
-
-	r.GET("/admin/products", authMiddleware(db, true), listProducts(db))
-	r.POST("/admin/product", authMiddleware(db, true), upsertProduct(db))
-	r.DELETE("/admin/product/:id", authMiddleware(db, true), deleteProduct(db))
-
-	r.GET("/admin/registrations", authMiddleware(db, true), listRegistrations(db))
-	r.PUT("/admin/registration/:id", authMiddleware(db, true), updateRegistration(db))
-	r.DELETE("/admin/registration/:id/bill", authMiddleware(db, true), deleteBillFile(db))
-	r.GET("/admin/registration/search", authMiddleware(db, true), searchRegistration(db))
-	r.GET("/admin/dashboard", authMiddleware(db, true), adminDashboard(db))
+	r.GET("/auth/check", authCheck(db))
+
+	r.POST("/register-product", requireRole(db), registerProduct(db, events))
+	r.POST("/upload/init", requireRole(db), initChunkedUpload(db))
+	r.GET("/upload/:id", requireRole(db), chunkedUploadStatus(db))
+	r.POST("/upload/:id/chunk", requireRole(db), uploadChunk(db))
+	r.POST("/upload/:id/complete", requireRole(db), completeChunkedUpload(db))
+	r.GET("/my-registrations", requireRole(db), listOwnRegistrations(db))
+	r.POST("/my-registrations/:id/bill", requireRole(db), reuploadBill(db, events))
+	r.GET("/customer/dashboard", requireRole(db), customerDashboard(readDB))
+	r.GET("/customer/active-products", requireRole(db), listActiveProducts(db))
+	r.GET("/customer/product/:id", requireRole(db), getActiveProduct(db))
+	r.POST("/customer/check-serials", requireRole(db), checkSerials(db))
+	r.POST("/customer/email/verify/request", requireRole(db, roleCustomer, roleStaff, roleAdmin), requestEmailVerification(db, notifier))
+	r.GET("/customer/email/verify/:token", confirmEmailVerification(db))
+
+	r.GET("/admin/users", requireRole(db, roleAdmin), listUsers(db))
+	r.POST("/admin/user", requireRole(db, roleAdmin), upsertUser(db))
+	r.GET("/admin/user/lookup", requireRole(db, roleAdmin, roleStaff), lookupUser(db))
+	r.DELETE("/admin/user/:id", requireRole(db, roleAdmin), deleteUser(db))
+	r.PATCH("/admin/user/:id/active", requireRole(db, roleAdmin), setUserActive(db))
+	r.GET("/admin/user/:id/bills.zip", requireRole(db, roleAdmin, roleStaff), exportSlots, downloadUserBills(readDB))
+	r.GET("/admin/user/:id/summary", requireRole(db, roleAdmin), userSummary(db))
+	r.GET("/admin/user/:id/logins", requireRole(db, roleAdmin), listUserLogins(db))
+	r.POST("/admin/users/merge", requireRole(db, roleAdmin), mergeUsers(db))
+	r.GET("/admin/users/status-matrix", requireRole(db, roleAdmin), userStatusMatrix(readDB))
+	r.GET("/admin/companies", requireRole(db, roleAdmin, roleStaff), listCompanies(db))
+
+	r.GET("/admin/notifications", requireRole(db, roleAdmin), listNotifications(db))
+	r.POST("/admin/notifications/:id/retry", requireRole(db, roleAdmin), retryNotification(db, notifier))
+
+	r.GET("/admin/products", requireRole(db, roleAdmin, roleStaff), listProducts(db))
+	r.GET("/admin/products/counts", requireRole(db, roleAdmin, roleStaff), productCounts(readDB))
+	r.POST("/admin/products/active", requireRole(db, roleAdmin), setProductsActive(db))
+	r.POST("/admin/product", requireRole(db, roleAdmin), upsertProduct(db))
+	r.PATCH("/admin/product/:id", requireRole(db, roleAdmin), patchProduct(db))
+	r.DELETE("/admin/product/:id", requireRole(db, roleAdmin), deleteProduct(db))
+	r.POST("/admin/product/:id/serials/import", requireRole(db, roleAdmin), importProductSerials(db))
+	r.GET("/admin/product/:id/registrations", requireRole(db, roleAdmin, roleStaff), listProductRegistrations(db))
+	r.GET("/admin/product/:id/nonconforming", requireRole(db, roleAdmin, roleStaff), listNonconformingRegistrations(db))
+
+	r.GET("/admin/registrations", requireRole(db, roleAdmin, roleStaff), listRegistrations(db))
+	r.PUT("/admin/registration/:id", requireRole(db, roleAdmin), updateRegistration(db, notifier, events))
+	r.DELETE("/admin/registration/:id/bill", requireRole(db, roleAdmin), deleteBillFile(db))
+	r.GET("/admin/registration/search", requireRole(db, roleAdmin, roleStaff), searchRegistration(db))
+	r.GET("/admin/serial/:serial/history", requireRole(db, roleAdmin, roleStaff), serialHistory(db))
+	r.GET("/admin/dashboard", requireRole(db, roleAdmin, roleStaff), adminDashboard(readDB))
+	r.GET("/admin/pending-count", requireRole(db, roleAdmin, roleStaff), pendingCount(db))
+	r.GET("/admin/reject-reasons", requireRole(db, roleAdmin, roleStaff), listRejectReasons(db))
+	r.GET("/admin/stats/reject-reasons", requireRole(db, roleAdmin, roleStaff), rejectReasonStats(readDB))
+	r.POST("/admin/reports/monthly", requireRole(db, roleAdmin), triggerMonthlyReport(db, notifier))
+	r.GET("/admin/events", requireRole(db, roleAdmin, roleStaff), streamEvents(events))
 
 	// New export and backup endpoints
-	r.GET("/admin/export/csv", authMiddleware(db, true), exportRegistrationsCSV(db))
-	r.GET("/admin/export/bills", authMiddleware(db, true), downloadBillsByUser(db))
-	r.GET("/admin/backup", authMiddleware(db, true), backupDatabase(db))
+	r.GET("/admin/export/csv", requireRole(db, roleAdmin, roleStaff), exportSlots, exportRegistrationsCSV(readDB))
+	r.GET("/admin/export/pending.csv", requireRole(db, roleAdmin, roleStaff), exportSlots, exportPendingCSV(readDB))
+	r.GET("/admin/export/audit.csv", requireRole(db, roleAdmin), exportSlots, exportAuditCSV(readDB))
+	r.GET("/admin/export/pdf", requireRole(db, roleAdmin, roleStaff), exportSlots, exportRegistrationsPDF(readDB))
+	r.GET("/admin/export/users.csv", requireRole(db, roleAdmin), exportUsersCSV(readDB))
+	r.GET("/admin/export/config", requireRole(db, roleAdmin), exportConfig(db))
+	r.POST("/admin/import/config", requireRole(db, roleAdmin), importConfig(db))
+	r.POST("/admin/import/preview", requireRole(db, roleAdmin), previewImport(db))
+	r.GET("/admin/export/bills", requireRole(db, roleAdmin, roleStaff), exportSlots, downloadBillsByUser(readDB))
+	r.GET("/admin/export/full.zip", requireRole(db, roleAdmin, roleStaff), exportSlots, exportFullZip(readDB))
+	r.GET("/admin/backup", requireRole(db, roleAdmin), exportSlots, backupDatabase(db))
+	r.GET("/admin/logs", requireRole(db, roleAdmin), tailLogs())
+	r.GET("/admin/logs/download", requireRole(db, roleAdmin), downloadLogs())
+	r.GET("/admin/db/integrity", requireRole(db, roleAdmin), dbIntegrity(db))
+	r.POST("/admin/db/checkpoint", requireRole(db, roleAdmin), forceWALCheckpoint(db))
+
+	// Maintenance
+	r.POST("/admin/maintenance/purge", requireRole(db, roleAdmin), purgeRejected(db))
+	r.GET("/admin/maintenance/bill-integrity", requireRole(db, roleAdmin), billIntegrity(db))
+	r.POST("/admin/maintenance/bill-integrity", requireRole(db, roleAdmin), repairBillIntegrity(db))
+	r.POST("/admin/bills/purge", requireRole(db, roleAdmin), purgeOldBills(db))
+	r.POST("/admin/maintenance/mode", requireRole(db, roleAdmin), setMaintenanceMode(db))
 
 	// Direct access endpoints with password in URL
-	r.GET("/admin/export/csv/:password", exportRegistrationsCSV(db))
-	r.GET("/admin/export/bills/:password", downloadBillsByUser(db))
-	r.GET("/admin/backup/:password", backupDatabase(db)) // Correct URL for backup
+	r.GET("/admin/export/csv/:password", exportSlots, exportRegistrationsCSV(readDB))
+	r.GET("/admin/export/pdf/:password", exportSlots, exportRegistrationsPDF(readDB))
+	r.GET("/admin/export/users.csv/:password", exportUsersCSV(readDB))
+	r.GET("/admin/export/pending.csv/:password", exportSlots, exportPendingCSV(readDB))
+	r.GET("/admin/export/audit.csv/:password", exportSlots, exportAuditCSV(readDB))
+	r.GET("/admin/export/config/:password", exportConfig(db))
+	r.GET("/admin/export/bills/:password", exportSlots, downloadBillsByUser(readDB))
+	r.GET("/admin/export/full.zip/:password", exportSlots, exportFullZip(readDB))
+	r.GET("/admin/backup/:password", exportSlots, backupDatabase(db)) // Correct URL for backup
 
 	// Health check endpoint
 	r.GET("/health", healthCheck(db))
+	r.GET("/live", liveCheck())
+	r.GET("/ready", readyCheck(db))
+
+	// Public configuration for the frontend
+	r.GET("/config", publicConfig())
+
+	// Build metadata
+	r.GET("/version", versionInfo())
 
 	// API documentation endpoint
 	r.GET("/docs", apiDocumentation())
 
-	r.Run(":8080")
+	return r
+}
+
+func main() {
+	setupEnvironment()
+	setupValidator()
+	if err := validateBillExportTemplate(billExportTemplate()); err != nil {
+		log.Fatalf("Invalid BILL_EXPORT_TEMPLATE %q: %v", billExportTemplate(), err)
+	}
+	adminAllowlist, err := parseIPAllowlist(os.Getenv("ADMIN_IP_ALLOWLIST"))
+	if err != nil {
+		log.Fatalf("Invalid ADMIN_IP_ALLOWLIST: %v", err)
+	}
+
+	// Listen before migrating so probes get an answer; requests go to the
+	// startup router until the full one is in place
+	var router atomic.Pointer[gin.Engine]
+	startup := startupRouter()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- http.ListenAndServe(":8080", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if r := router.Load(); r != nil {
+				r.ServeHTTP(w, req)
+				return
+			}
+			startup.ServeHTTP(w, req)
+		}))
+	}()
+
+	db := setupDatabase()
+	defer db.Close()
+	readDB := setupReadDatabase(db)
+	if readDB != db {
+		defer readDB.Close()
+	}
+	ensureAdmin(db)
+	startRetentionJob(db)
+	startUploadCleanup(db)
+	startWALCheckpointJob(db)
+	go backfillBillHashes(db)
+	notifier := startNotificationQueue(db, newNotificationSender())
+	startMonthlyReportJob(db, notifier)
+	events := newEventBroker()
+
+	router.Store(setupRouter(db, readDB, notifier, events, adminAllowlist))
+	migrationsDone.Store(true)
+	logInfo("Ready, serving HTTP on :8080")
+	logError("Server stopped: %v", <-serveErr)
 }
@@ -0,0 +1,4381 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	setupValidator()
+	os.Exit(m.Run())
+}
+
+// A portal wired up like main, on its own database and data directory
+type testPortal struct {
+	t      testing.TB
+	db     *sql.DB
+	router *gin.Engine
+	admin  string
+}
+
+var testDatabases int64
+
+// Portal on a private in-memory database
+func newTestPortal(t testing.TB) *testPortal {
+	t.Helper()
+	name := fmt.Sprintf("portal_test_%d", atomic.AddInt64(&testDatabases, 1))
+	return startTestPortal(t, fmt.Sprintf("file:%s?mode=memory&cache=shared&_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", name))
+}
+
+// Portal on a database file, for tests that need SQLite's file locking or a
+// second handle on the same database
+func newFileTestPortal(t testing.TB) *testPortal {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "portal.db")
+	return startTestPortal(t, fmt.Sprintf("%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", path))
+}
+
+func startTestPortal(t testing.TB, dsn string) *testPortal {
+	t.Helper()
+	dataDir := t.TempDir()
+	t.Setenv("DATA_DIR", dataDir)
+	os.MkdirAll(filepath.Join(dataDir, "bills"), 0755)
+	db := openDatabase(dsn)
+	t.Cleanup(func() { db.Close() })
+	activeProductsCache.invalidate()
+	maintenanceMode.Store(false)
+	ensureAdmin(db)
+	migrationsDone.Store(true)
+
+	p := &testPortal{t: t, db: db}
+	p.router = setupRouter(db, db, nil, newEventBroker(), nil)
+	p.admin = p.login("admin", adminPassword())
+	return p
+}
+
+// Send a request. A string or []byte body goes as is, anything else as JSON.
+func (p *testPortal) request(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	p.t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			p.t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return p.serve(req)
+}
+
+func (p *testPortal) serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.router.ServeHTTP(w, req)
+	return w
+}
+
+// A file in a multipart upload
+type testFile struct {
+	field string
+	name  string
+	data  []byte
+}
+
+// Send a multipart form with fields and files
+func (p *testPortal) upload(path, token string, fields map[string]string, files ...testFile) *httptest.ResponseRecorder {
+	p.t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	for _, f := range files {
+		part, err := writer.CreateFormFile(f.field, f.name)
+		if err != nil {
+			p.t.Fatalf("creating form file: %v", err)
+		}
+		part.Write(f.data)
+	}
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return p.serve(req)
+}
+
+// Fail the test unless w has the wanted status
+func expectStatus(t testing.TB, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, want, w.Body.String())
+	}
+}
+
+// Decode a JSON response body into a map
+func decodeBody(t testing.TB, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+// Decode a JSON array response body
+func decodeList(t testing.TB, w *httptest.ResponseRecorder) []map[string]interface{} {
+	t.Helper()
+	var body []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+func (p *testPortal) login(mobile, password string) string {
+	p.t.Helper()
+	w := p.request(http.MethodPost, "/login", "", gin.H{"mobile": mobile, "password": password})
+	expectStatus(p.t, w, http.StatusOK)
+	return decodeBody(p.t, w)["token"].(string)
+}
+
+// Register a customer and return their token
+func (p *testPortal) customer(mobile, gst string) string {
+	p.t.Helper()
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": mobile, "company": "Acme Traders", "gst": gst})
+	expectStatus(p.t, w, http.StatusOK)
+	return decodeBody(p.t, w)["token"].(string)
+}
+
+// Id of the live user with mobile
+func (p *testPortal) userID(mobile string) int {
+	p.t.Helper()
+	var id int
+	if err := p.db.QueryRow("SELECT id FROM users WHERE mobile = ? AND deleted_at IS NULL", mobile).Scan(&id); err != nil {
+		p.t.Fatalf("loading user %s: %v", mobile, err)
+	}
+	return id
+}
+
+// Create an active product with extra settings from fields, returning its id
+func (p *testPortal) product(name string, fields gin.H) int {
+	p.t.Helper()
+	body := gin.H{"name": name, "active": 1}
+	for k, v := range fields {
+		body[k] = v
+	}
+	expectStatus(p.t, p.request(http.MethodPost, "/admin/product", p.admin, body), http.StatusOK)
+	var id int
+	p.db.QueryRow("SELECT MAX(id) FROM products").Scan(&id)
+	return id
+}
+
+// Smallest file the bill checks take as a PDF
+var testPDF = []byte("%PDF-1.4\n1 0 obj<<>>endobj\ntrailer<<>>\n%%EOF\n")
+
+// Register serials (comma separated) for productID with a PDF bill
+func (p *testPortal) registerProduct(token string, productID int, serials string) *httptest.ResponseRecorder {
+	p.t.Helper()
+	return p.upload("/register-product", token, map[string]string{"serial": serials, "product_id": fmt.Sprint(productID)}, testFile{"bill", "bill.pdf", testPDF})
+}
+
+// Id of the registration holding serial
+func (p *testPortal) registrationID(serial string) int {
+	p.t.Helper()
+	var id int
+	if err := p.db.QueryRow("SELECT id FROM registrations WHERE serial = ?", serial).Scan(&id); err != nil {
+		p.t.Fatalf("loading registration %s: %v", serial, err)
+	}
+	return id
+}
+
+// PUT /admin/registration/:id for serial at its current version; fields
+// default to the registration's own status and serial
+func (p *testPortal) review(serial string, fields gin.H) *httptest.ResponseRecorder {
+	p.t.Helper()
+	var id, version int
+	var status string
+	if err := p.db.QueryRow("SELECT id, version, status FROM registrations WHERE serial = ?", serial).Scan(&id, &version, &status); err != nil {
+		p.t.Fatalf("loading registration %s: %v", serial, err)
+	}
+	body := gin.H{"status": status, "serial": serial, "version": version}
+	for k, v := range fields {
+		body[k] = v
+	}
+	return p.request(http.MethodPut, fmt.Sprintf("/admin/registration/%d", id), p.admin, body)
+}
+
+// Number of rows query counts
+func (p *testPortal) count(query string, args ...interface{}) int {
+	p.t.Helper()
+	var n int
+	if err := p.db.QueryRow(query, args...).Scan(&n); err != nil {
+		p.t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func TestCheckSerialsMixed(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"serial_pattern": "^INV[0-9]{4}$"})
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "INV0001"), http.StatusOK)
+
+	w := p.request(http.MethodPost, "/customer/check-serials", customer, gin.H{
+		"product_id": productID,
+		"serials":    []string{" inv0002 ", "INV0001", "BAD-1", ""},
+	})
+	expectStatus(t, w, http.StatusOK)
+	results := decodeBody(t, w)["results"].([]interface{})
+	want := [][2]string{{"INV0002", "available"}, {"INV0001", "registered"}, {"BAD-1", "invalid"}}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %v", len(results), len(want), results)
+	}
+	for i, r := range results {
+		got := r.(map[string]interface{})
+		if got["serial"] != want[i][0] || got["status"] != want[i][1] {
+			t.Errorf("result %d = %v, want serial %s status %s", i, got, want[i][0], want[i][1])
+		}
+	}
+
+	// Checking registers nothing
+	if n := p.count("SELECT COUNT(*) FROM registrations"); n != 1 {
+		t.Errorf("%d registrations after check, want 1", n)
+	}
+}
+
+func TestCheckSerialsUnknownProduct(t *testing.T) {
+	p := newTestPortal(t)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	w := p.request(http.MethodPost, "/customer/check-serials", customer, gin.H{"product_id": 99, "serials": []string{"A1"}})
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestPublicConfigMatchesEnv(t *testing.T) {
+	t.Setenv("MAX_UPLOAD_MB", "25")
+	t.Setenv("MAX_SERIALS_PER_REQUEST", "7")
+	t.Setenv("ALLOWED_BILL_TYPES", "pdf, .PNG")
+	t.Setenv("PORTAL_TITLE", "Warranty Desk")
+	p := newTestPortal(t)
+
+	w := p.request(http.MethodGet, "/config", "", nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	if body["max_upload_mb"] != float64(25) || body["max_serials"] != float64(7) {
+		t.Errorf("limits = %v / %v, want 25 / 7", body["max_upload_mb"], body["max_serials"])
+	}
+	if body["portal_title"] != "Warranty Desk" {
+		t.Errorf("portal_title = %v", body["portal_title"])
+	}
+	if types := fmt.Sprint(body["allowed_bill_types"]); types != "[.pdf .png]" {
+		t.Errorf("allowed_bill_types = %s, want [.pdf .png]", types)
+	}
+}
+
+func TestPublicConfigDefaults(t *testing.T) {
+	p := newTestPortal(t)
+	body := decodeBody(t, p.request(http.MethodGet, "/config", "", nil))
+	if body["max_upload_mb"] != float64(10) || body["max_serials"] != float64(100) {
+		t.Errorf("default limits = %v / %v, want 10 / 100", body["max_upload_mb"], body["max_serials"])
+	}
+}
+
+func TestConcurrentRegistrationOfSameSerial(t *testing.T) {
+	p := newFileTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customers := []string{p.customer("9876543210", "27ABCDE1234F1Z5"), p.customer("9876543211", "27ABCDE1234F1Z6")}
+
+	for round := 0; round < 5; round++ {
+		serial := fmt.Sprintf("RACE%d", round)
+		codes := make([]int, len(customers))
+		var start, done sync.WaitGroup
+		start.Add(1)
+		for i, token := range customers {
+			done.Add(1)
+			go func(i int, token string) {
+				defer done.Done()
+				start.Wait()
+				codes[i] = p.registerProduct(token, productID, serial).Code
+			}(i, token)
+		}
+		start.Done()
+		done.Wait()
+
+		succeeded := 0
+		for _, code := range codes {
+			switch code {
+			case http.StatusOK:
+				succeeded++
+			case http.StatusConflict:
+			default:
+				t.Errorf("round %d: unexpected status %d", round, code)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("round %d: %d registrations succeeded (%v), want exactly 1", round, succeeded, codes)
+		}
+		if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = ?", serial); n != 1 {
+			t.Errorf("round %d: %d rows for %s, want 1", round, n, serial)
+		}
+	}
+}
+
+func TestUniqueViolationMessages(t *testing.T) {
+	p := newTestPortal(t)
+	if _, err := p.db.Exec("INSERT INTO users (username, mobile, gst, role, active) VALUES ('first', '9876543210', '27ABCDE1234F1Z5', 'CUSTOMER', 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new username each time so only the column under test collides
+	_, err := p.db.Exec("INSERT INTO users (username, mobile, gst, role, active) VALUES ('other1', '9876543210', '27ABCDE1234F1Z6', 'CUSTOMER', 1)")
+	if column := uniqueViolationColumn(err); column != "mobile" {
+		t.Errorf("duplicate mobile reported column %q (%v)", column, err)
+	}
+	_, err = p.db.Exec("INSERT INTO users (username, mobile, gst, role, active) VALUES ('other2', '9876543211', '27ABCDE1234F1Z5', 'CUSTOMER', 1)")
+	if column := uniqueViolationColumn(err); column != "gst" {
+		t.Errorf("duplicate gst reported column %q (%v)", column, err)
+	}
+	if uniqueViolationMessage("mobile") == uniqueViolationMessage("gst") {
+		t.Error("mobile and gst violations share a message")
+	}
+}
+
+func TestRegisterDuplicateMobileAndGST(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": "Beta", "gst": "27ABCDE1234F1Z6"})
+	expectStatus(t, w, http.StatusConflict)
+	if msg := decodeBody(t, w)["error"]; msg != "Mobile already registered" {
+		t.Errorf("duplicate mobile error = %v", msg)
+	}
+	w = p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543211", "company": "Beta", "gst": "27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusConflict)
+	if msg := decodeBody(t, w)["error"]; msg != "GST already registered" {
+		t.Errorf("duplicate gst error = %v", msg)
+	}
+}
+
+func TestTimestampsSetAndUpdated(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	userID := p.userID("9876543210")
+
+	ids := map[string]int{"products": productID, "users": userID}
+	for table := range ids {
+		if n := p.count("SELECT COUNT(*) FROM " + table + " WHERE created_at IS NULL OR updated_at IS NULL"); n != 0 {
+			t.Errorf("%d %s without timestamps", n, table)
+		}
+	}
+	// Backdate so an update is visible without waiting
+	old := "2000-01-01 00:00:00"
+	p.db.Exec("UPDATE products SET created_at = ?, updated_at = ? WHERE id = ?", old, old, productID)
+	p.db.Exec("UPDATE users SET created_at = ?, updated_at = ? WHERE id = ?", old, old, userID)
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/product", p.admin, gin.H{"id": productID, "name": "Inverter X", "active": 1}), http.StatusOK)
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, gin.H{"id": userID, "username": "9876543210", "mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5", "role": "CUSTOMER", "active": 1, "version": 1}), http.StatusOK)
+
+	for table, id := range ids {
+		var created, updated string
+		p.db.QueryRow("SELECT created_at, updated_at FROM "+table+" WHERE id = ?", id).Scan(&created, &updated)
+		if !strings.HasPrefix(created, "2000-01-01") {
+			t.Errorf("%s created_at changed to %s", table, created)
+		}
+		if strings.HasPrefix(updated, "2000-01-01") {
+			t.Errorf("%s updated_at not changed by update", table)
+		}
+	}
+}
+
+func TestNormalizeCompany(t *testing.T) {
+	names := []string{"ACME Traders", "acme   traders", "Acme Traders Pvt. Ltd.", " Acme, Traders  Limited "}
+	for _, name := range names {
+		if got := normalizeCompany(name); got != "acme traders" {
+			t.Errorf("normalizeCompany(%q) = %q, want %q", name, got, "acme traders")
+		}
+	}
+	// A bare suffix is kept rather than emptied
+	if got := normalizeCompany("Ltd"); got != "ltd" {
+		t.Errorf("normalizeCompany(Ltd) = %q", got)
+	}
+}
+
+func TestRegisteredCompaniesShareNormalizedName(t *testing.T) {
+	p := newTestPortal(t)
+	for i, company := range []string{"ACME Traders", "acme  traders pvt ltd"} {
+		w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": fmt.Sprintf("987654321%d", i), "company": company, "gst": fmt.Sprintf("27ABCDE1234F1Z%d", i)})
+		expectStatus(t, w, http.StatusOK)
+	}
+	if n := p.count("SELECT COUNT(DISTINCT company_normalized) FROM users WHERE role = 'CUSTOMER'"); n != 1 {
+		t.Errorf("%d distinct normalized names, want 1", n)
+	}
+}
+
+func TestMergeUsersMovesRegistrations(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	source := p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(source, productID, "M1,M2"), http.StatusOK)
+	sourceID, targetID := p.userID("9876543210"), p.userID("9876543211")
+
+	w := p.request(http.MethodPost, "/admin/users/merge", p.admin, gin.H{"source_id": sourceID, "target_id": targetID})
+	expectStatus(t, w, http.StatusOK)
+	if moved := decodeBody(t, w)["registrations_moved"]; moved != float64(2) {
+		t.Errorf("registrations_moved = %v, want 2", moved)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE user_id = ?", targetID); n != 2 {
+		t.Errorf("target has %d registrations, want 2", n)
+	}
+	var active int
+	var deleted sql.NullString
+	p.db.QueryRow("SELECT active, deleted_at FROM users WHERE id = ?", sourceID).Scan(&active, &deleted)
+	if active != 0 || !deleted.Valid {
+		t.Errorf("source active=%d deleted_at=%v, want deactivated and deleted", active, deleted)
+	}
+	if w := p.request(http.MethodGet, "/auth/check", source, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("source token still valid: %d", w.Code)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE event = 'reassigned'"); n != 2 {
+		t.Errorf("%d reassigned history entries, want 2", n)
+	}
+
+	// Merging into itself or an unknown user is refused
+	expectStatus(t, p.request(http.MethodPost, "/admin/users/merge", p.admin, gin.H{"source_id": targetID, "target_id": targetID}), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPost, "/admin/users/merge", p.admin, gin.H{"source_id": 999, "target_id": targetID}), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodPost, "/admin/users/merge", p.admin, "{"), http.StatusBadRequest)
+}
+
+func TestMergeUsersRollsBackOnFailure(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	source := p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(source, productID, "MR1"), http.StatusOK)
+	sourceID, targetID := p.userID("9876543210"), p.userID("9876543211")
+
+	// Updating the target fails after the registrations have moved
+	if _, err := p.db.Exec(fmt.Sprintf("CREATE TRIGGER fail_target_bump BEFORE UPDATE OF updated_at ON users WHEN NEW.id = %d BEGIN SELECT RAISE(ABORT, 'bump failed'); END", targetID)); err != nil {
+		t.Fatal(err)
+	}
+	w := p.request(http.MethodPost, "/admin/users/merge", p.admin, gin.H{"source_id": sourceID, "target_id": targetID})
+	expectStatus(t, w, http.StatusInternalServerError)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE user_id = ?", sourceID); n != 1 {
+		t.Errorf("source has %d registrations after a failed merge, want 1", n)
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE id = ? AND deleted_at IS NULL", sourceID); n != 1 {
+		t.Error("source was deleted by a failed merge")
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE event = 'reassigned'"); n != 0 {
+		t.Errorf("%d reassigned history entries after a failed merge", n)
+	}
+}
+
+func TestSearchSerialWildcards(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "AB100,AB200,XY199,50%OFF,50XOFF,5_1,501"), http.StatusOK)
+
+	search := func(q string) []string {
+		t.Helper()
+		w := p.request(http.MethodGet, "/admin/registration/search?serial="+url.QueryEscape(q), p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		serials := []string{}
+		for _, r := range decodeList(t, w) {
+			serials = append(serials, r["serial"].(string))
+		}
+		return serials
+	}
+	cases := []struct{ query, want string }{
+		{"ab*", "[AB100 AB200]"},
+		{"*99", "[XY199]"},
+		{"50%*", "[50%OFF]"},
+		{"5_*", "[5_1]"},
+		{"*OFF", "[50%OFF 50XOFF]"},
+	}
+	for _, tc := range cases {
+		if got := fmt.Sprint(search(tc.query)); got != tc.want {
+			t.Errorf("search %q = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	// Without a wildcard the match is exact
+	w := p.request(http.MethodGet, "/admin/registration/search?serial=AB100", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if s := decodeBody(t, w)["serial"]; s != "AB100" {
+		t.Errorf("exact search returned %v", s)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/registration/search?serial=AB1", p.admin, nil), http.StatusNotFound)
+}
+
+func TestPagingLimits(t *testing.T) {
+	t.Setenv("PAGE_DEFAULT_LIMIT", "2")
+	t.Setenv("PAGE_MAX_LIMIT", "3")
+	p := newTestPortal(t)
+	for i := 0; i < 5; i++ {
+		p.product(fmt.Sprintf("Product %d", i), nil)
+	}
+
+	cases := []struct {
+		query string
+		want  int
+	}{{"", 2}, {"?limit=50", 3}, {"?limit=3&page=2", 2}}
+	for _, tc := range cases {
+		w := p.request(http.MethodGet, "/admin/products"+tc.query, p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		if n := len(decodeList(t, w)); n != tc.want {
+			t.Errorf("/admin/products%s returned %d products, want %d", tc.query, n, tc.want)
+		}
+	}
+	for _, query := range []string{"?page=-1", "?page=0", "?limit=-5", "?limit=x"} {
+		expectStatus(t, p.request(http.MethodGet, "/admin/products"+query, p.admin, nil), http.StatusBadRequest)
+	}
+}
+
+func TestUpdateMissingRegistration(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodPut, "/admin/registration/999", p.admin, gin.H{"status": "approved", "serial": "X1", "version": 1})
+	expectStatus(t, w, http.StatusNotFound)
+	if msg := decodeBody(t, w)["error"]; msg != "Registration not found" {
+		t.Errorf("error = %v", msg)
+	}
+}
+
+func TestDeactivateUserRevokesToken(t *testing.T) {
+	p := newTestPortal(t)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	id := p.userID("9876543210")
+	expectStatus(t, p.request(http.MethodGet, "/auth/check", customer, nil), http.StatusOK)
+
+	w := p.request(http.MethodPatch, fmt.Sprintf("/admin/user/%d/active", id), p.admin, gin.H{"active": 0})
+	expectStatus(t, w, http.StatusOK)
+	expectStatus(t, p.request(http.MethodGet, "/auth/check", customer, nil), http.StatusUnauthorized)
+	// The old token is refused on customer routes too, not treated as a dev session
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", customer, nil), http.StatusUnauthorized)
+	expectStatus(t, p.request(http.MethodGet, "/customer/dashboard", customer, nil), http.StatusUnauthorized)
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", "not-a-token", nil), http.StatusUnauthorized)
+	w = p.request(http.MethodPost, "/login", "", gin.H{"mobile": "9876543210"})
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	// Reactivating lets them log in again, with a new token
+	expectStatus(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/user/%d/active", id), p.admin, gin.H{"active": 1}), http.StatusOK)
+	token := p.login("9876543210", "")
+	expectStatus(t, p.request(http.MethodGet, "/auth/check", token, nil), http.StatusOK)
+
+	expectStatus(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/user/%d/active", id), p.admin, gin.H{"active": 2}), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/user/%d/active", id), p.admin, "{"), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPatch, "/admin/user/999/active", p.admin, gin.H{"active": 0}), http.StatusNotFound)
+}
+
+func TestExportFilenameFollowsPortalTimezone(t *testing.T) {
+	p := newTestPortal(t)
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+
+	// UTC+14 and UTC-11 are 25 hours apart, so their dates always differ
+	names := map[string]string{}
+	for _, zone := range []string{"Pacific/Kiritimati", "Pacific/Pago_Pago"} {
+		t.Setenv("PORTAL_TZ", zone)
+		loc := portalLocation()
+		if loc.String() != zone {
+			t.Skipf("timezone %s not available", zone)
+		}
+		time.Local = loc
+		w := p.request(http.MethodGet, "/admin/export/csv", p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		names[zone] = w.Header().Get("Content-Disposition")
+		want := "registrations_export_" + time.Now().In(loc).Format("2006-01-02") + ".csv"
+		if !strings.HasSuffix(names[zone], want) {
+			t.Errorf("%s: Content-Disposition %q, want file %s", zone, names[zone], want)
+		}
+	}
+	if names["Pacific/Kiritimati"] == names["Pacific/Pago_Pago"] {
+		t.Errorf("both timezones produced %q", names["Pacific/Kiritimati"])
+	}
+}
+
+func TestPortalLocationFallsBackToIST(t *testing.T) {
+	t.Setenv("PORTAL_TZ", "Not/AZone")
+	t.Setenv("TZ", "")
+	loc := portalLocation()
+	if _, offset := time.Now().In(loc).Zone(); offset != 5*60*60+30*60 {
+		t.Errorf("fallback offset %d, want IST", offset)
+	}
+}
+
+func TestExportPDFRowsAcrossPages(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	serials := []string{}
+	for i := 0; i < 40; i++ {
+		serials = append(serials, fmt.Sprintf("PDF%03d", i))
+	}
+	expectStatus(t, p.registerProduct(customer, productID, strings.Join(serials, ",")), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/export/pdf", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	pdf := w.Body.String()
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatal("response is not a complete PDF")
+	}
+	// 33 rows fit on a page
+	if !strings.Contains(pdf, "/Count 2 ") {
+		t.Error("expected a 2 page document")
+	}
+	for _, serial := range serials {
+		if n := strings.Count(pdf, "("+serial+")"); n != 1 {
+			t.Errorf("serial %s appears %d times", serial, n)
+		}
+	}
+
+	// Every xref entry points at the object it names
+	xrefAt := strings.LastIndex(pdf, "startxref\n")
+	var xref int
+	fmt.Sscanf(pdf[xrefAt+len("startxref\n"):], "%d", &xref)
+	lines := strings.Split(pdf[xref:], "\n")
+	var count int
+	fmt.Sscanf(lines[1], "0 %d", &count)
+	for i := 1; i < count; i++ {
+		var offset int
+		fmt.Sscanf(lines[2+i], "%d", &offset)
+		if want := fmt.Sprintf("%d 0 obj", i); !strings.HasPrefix(pdf[offset:], want) {
+			t.Fatalf("xref entry %d points at %q", i, pdf[offset:offset+10])
+		}
+	}
+}
+
+// File header for data as parsed from a real multipart form
+func testFileHeader(t *testing.T, name string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("bill", name)
+	part.Write(data)
+	writer.Close()
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File["bill"][0]
+}
+
+func TestSaveUploadedFileSyncRejectsShortWrite(t *testing.T) {
+	dir := t.TempDir()
+	header := testFileHeader(t, "bill.pdf", testPDF)
+
+	dst := filepath.Join(dir, "ok.pdf")
+	if err := saveUploadedFileSync(header, dst); err != nil {
+		t.Fatalf("complete upload failed: %v", err)
+	}
+	if data, _ := os.ReadFile(dst); !bytes.Equal(data, testPDF) {
+		t.Error("saved file differs from the upload")
+	}
+
+	// The upload claims more bytes than arrived
+	header.Size += 100
+	dst = filepath.Join(dir, "short.pdf")
+	if err := saveUploadedFileSync(header, dst); err == nil || !strings.Contains(err.Error(), "incomplete upload") {
+		t.Fatalf("short upload error = %v", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("partial file was left at the destination")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temp file left behind: %d entries", len(entries))
+	}
+}
+
+// Set a registration's status and creation time directly
+func (p *testPortal) backdate(serial, status, createdAt string) {
+	p.t.Helper()
+	if _, err := p.db.Exec("UPDATE registrations SET status = ?, created_at = ? WHERE serial = ?", status, createdAt, serial); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// Whether a stored bill path like bills/x.pdf exists under DATA_DIR
+func billExists(path string) bool {
+	_, err := os.Stat(filepath.Join(os.Getenv("DATA_DIR"), path))
+	return err == nil
+}
+
+func TestPurgeOnlyOldRejected(t *testing.T) {
+	t.Setenv("REJECTED_RETENTION_DAYS", "30")
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	for _, serial := range []string{"OLDREJ", "NEWREJ", "OLDPEND"} {
+		expectStatus(t, p.registerProduct(customer, productID, serial), http.StatusOK)
+	}
+	old := time.Now().AddDate(0, 0, -60).Format("2006-01-02 15:04:05")
+	recent := time.Now().AddDate(0, 0, -5).Format("2006-01-02 15:04:05")
+	p.backdate("OLDREJ", "rejected", old)
+	p.backdate("NEWREJ", "rejected", recent)
+	p.backdate("OLDPEND", "pending", old)
+	var oldBill string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'OLDREJ'").Scan(&oldBill)
+
+	w := p.request(http.MethodPost, "/admin/maintenance/purge?dry_run=true", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeBody(t, w); body["registrations"] != float64(1) || body["bill_files"] != float64(1) {
+		t.Errorf("dry run = %v, want 1 registration and 1 bill", body)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registrations"); n != 3 {
+		t.Fatalf("dry run removed rows: %d left", n)
+	}
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/maintenance/purge", p.admin, nil), http.StatusOK)
+	rows, _ := p.db.Query("SELECT serial FROM registrations ORDER BY serial")
+	left := []string{}
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		left = append(left, s)
+	}
+	rows.Close()
+	if fmt.Sprint(left) != "[NEWREJ OLDPEND]" {
+		t.Errorf("left after purge: %v", left)
+	}
+	if billExists(oldBill) {
+		t.Error("purged registration's bill still on disk")
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE serial = 'OLDREJ' AND event = 'purged'"); n != 1 {
+		t.Error("purge not recorded in history")
+	}
+}
+
+// Entries of a ZIP response by name
+func readZip(t *testing.T, w *httptest.ResponseRecorder) map[string][]byte {
+	t.Helper()
+	data := w.Body.Bytes()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	entries := map[string][]byte{}
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		entries[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	return entries
+}
+
+func TestDownloadUserBills(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(customer, productID, "ZB1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(customer, productID, "ZB2"), http.StatusOK)
+
+	w := p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/bills.zip", p.userID("9876543210")), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	entries := readZip(t, w)
+	if len(entries) != 2 {
+		t.Fatalf("zip has %d entries, want 2: %v", len(entries), entries)
+	}
+	for name, data := range entries {
+		if !strings.Contains(name, "ZB") || !bytes.Equal(data, testPDF) {
+			t.Errorf("entry %s has unexpected name or content", name)
+		}
+	}
+
+	expectStatus(t, p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/bills.zip", p.userID("9876543211")), p.admin, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, "/admin/user/999/bills.zip", p.admin, nil), http.StatusNotFound)
+}
+
+// Zip one bill with the given compression mode, returning the archive and the time taken
+func zipTestBill(t *testing.T, compression string, data []byte) ([]byte, time.Duration) {
+	t.Helper()
+	var buf bytes.Buffer
+	start := time.Now()
+	zipWriter := newBillsZipWriter(&buf, compression)
+	entry, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "bill.pdf", Method: zipMethodFor(compression, "bill.pdf")})
+	if err != nil {
+		t.Fatalf("creating entry: %v", err)
+	}
+	if _, err := entry.Write(data); err != nil {
+		t.Fatalf("writing entry: %v", err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("closing zip: %v", err)
+	}
+	return buf.Bytes(), time.Since(start)
+}
+
+func TestZipCompressionOnIncompressibleBill(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	stored, storeTime := zipTestBill(t, "store", data)
+	best, bestTime := zipTestBill(t, "best", data)
+	if len(stored) < len(data) {
+		t.Errorf("stored archive is %d bytes, smaller than its %d byte input", len(stored), len(data))
+	}
+	// Deflate can't shrink random bytes, so best only costs time
+	if len(best) < len(stored)-len(stored)/100 {
+		t.Errorf("best archive is %d bytes, unexpectedly much smaller than stored %d", len(best), len(stored))
+	}
+	if storeTime >= bestTime {
+		t.Errorf("store took %v, not faster than best's %v", storeTime, bestTime)
+	}
+	for _, archive := range [][]byte{stored, best} {
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("reading zip: %v", err)
+		}
+		rc, _ := reader.File[0].Open()
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if !bytes.Equal(got, data) {
+			t.Error("archive did not round-trip its input")
+		}
+	}
+}
+
+func TestZipMethodDefaultsToStoreForCompressedTypes(t *testing.T) {
+	cases := []struct {
+		compression, name string
+		want              uint16
+	}{
+		{"", "bill.pdf", zip.Store},
+		{"", "bill.JPG", zip.Store},
+		{"", "bill.txt", zip.Deflate},
+		{"best", "bill.pdf", zip.Deflate},
+		{"store", "bill.txt", zip.Store},
+	}
+	for _, tc := range cases {
+		if got := zipMethodFor(tc.compression, tc.name); got != tc.want {
+			t.Errorf("zipMethodFor(%q, %q) = %d, want %d", tc.compression, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBillsZipRejectsUnknownCompression(t *testing.T) {
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/bills?compression=max", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestRegisterRejectsOverLengthCompany(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": strings.Repeat("A", maxCompanyLength+1), "gst": "27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusBadRequest)
+	if fields, _ := decodeBody(t, w)["fields"].(map[string]interface{}); fields["company"] == nil {
+		t.Errorf("company not reported in %s", w.Body.String())
+	}
+}
+
+func TestRegisterAcceptsShortLegacyGST(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "GST123456")
+	expectStatus(t, p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543211", "company": "Acme", "gst": strings.Repeat("G", maxGSTLength+1)}), http.StatusBadRequest)
+}
+
+func TestOversizedBodyRejected(t *testing.T) {
+	p := newTestPortal(t)
+	body := fmt.Sprintf(`{"mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5", "padding": %q}`, strings.Repeat("x", 65*1024))
+	expectStatus(t, p.request(http.MethodPost, "/register", "", body), http.StatusRequestEntityTooLarge)
+}
+
+func TestConfigImportAllowsLargeBundles(t *testing.T) {
+	p := newTestPortal(t)
+	products := []gin.H{}
+	for i := 0; i < 100; i++ {
+		products = append(products, gin.H{"name": fmt.Sprintf("Product %d", i), "description": strings.Repeat("d", 1000), "active": 1})
+	}
+	w := p.request(http.MethodPost, "/admin/import/config", p.admin, gin.H{"products": products})
+	expectStatus(t, w, http.StatusOK)
+	if created := decodeBody(t, w)["products_created"]; created != float64(100) {
+		t.Errorf("products_created = %v, want 100", created)
+	}
+
+	t.Setenv("MAX_IMPORT_KB", "64")
+	expectStatus(t, p.request(http.MethodPost, "/admin/import/config", p.admin, gin.H{"products": products}), http.StatusRequestEntityTooLarge)
+}
+
+func TestVersionReportsInjectedCommit(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodGet, "/version", "", nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	if body["commit"] == "" || body["build_time"] == "" || body["version"] != version || !strings.HasPrefix(body["go_version"].(string), "go") {
+		t.Errorf("default build info = %v", body)
+	}
+
+	defer func(commit, built string) { gitCommit, buildTime = commit, built }(gitCommit, buildTime)
+	gitCommit, buildTime = "abc1234", "2024-01-02T03:04:05Z"
+	body = decodeBody(t, p.request(http.MethodGet, "/version", "", nil))
+	if body["commit"] != "abc1234" || body["build_time"] != "2024-01-02T03:04:05Z" {
+		t.Errorf("injected build info = %v", body)
+	}
+	if health := decodeBody(t, p.request(http.MethodGet, "/health", "", nil)); health["version"] != version {
+		t.Errorf("health version = %v, want %s", health["version"], version)
+	}
+}
+
+// Accepts only the token "valid"
+type fakeCaptcha struct{}
+
+func (fakeCaptcha) Verify(token, remoteIP string) (bool, error) {
+	return token == "valid", nil
+}
+
+func TestRegisterWithCaptcha(t *testing.T) {
+	p := newTestPortal(t)
+	r := gin.New()
+	r.POST("/register", registerUser(p.db, fakeCaptcha{}))
+	register := func(mobile, gst, token string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(gin.H{"mobile": mobile, "company": "Acme", "gst": gst, "captcha_token": token})
+		req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	expectStatus(t, register("9876543210", "27ABCDE1234F1Z5", ""), http.StatusBadRequest)
+	expectStatus(t, register("9876543210", "27ABCDE1234F1Z5", "forged"), http.StatusBadRequest)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE mobile = ?", "9876543210"); n != 0 {
+		t.Fatalf("%d users created with a bad captcha", n)
+	}
+	expectStatus(t, register("9876543210", "27ABCDE1234F1Z5", "valid"), http.StatusOK)
+}
+
+func TestRegisterWithoutCaptchaSecret(t *testing.T) {
+	t.Setenv("CAPTCHA_SECRET", "")
+	if newCaptchaVerifier() != nil {
+		t.Fatal("verifier created without CAPTCHA_SECRET")
+	}
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+}
+
+// Parse a CSV response body
+func readCSV(t *testing.T, w *httptest.ResponseRecorder) [][]string {
+	t.Helper()
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parsing csv %q: %v", w.Body.String(), err)
+	}
+	return records
+}
+
+func TestExportUsersCSV(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, gin.H{"username": "clerk", "password": "Clerk@12345", "role": "STAFF", "active": 1}), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/export/users.csv", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	records := readCSV(t, w)
+	want := []string{"Company Name", "Mobile Number", "GST Number", "Role", "Active", "Created At"}
+	if strings.Join(records[0], ",") != strings.Join(want, ",") {
+		t.Errorf("header = %v, want %v", records[0], want)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d rows, want header plus 2 users: %v", len(records), records)
+	}
+	for _, row := range records[1:] {
+		if row[3] == roleAdmin {
+			t.Errorf("admin row exported: %v", row)
+		}
+	}
+
+	records = readCSV(t, p.request(http.MethodGet, "/admin/export/users.csv?role=CUSTOMER", p.admin, nil))
+	if len(records) != 2 || records[1][1] != "9876543210" {
+		t.Errorf("role=CUSTOMER export = %v", records)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/users.csv?active=yes", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestLoginRecordsLastLogin(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	id := p.userID("9876543210")
+	if n := p.count("SELECT COUNT(*) FROM logins WHERE user_id = ?", id); n != 0 {
+		t.Fatalf("%d logins before logging in", n)
+	}
+	p.login("9876543210", "")
+	p.login("9876543210", "")
+	if n := p.count("SELECT COUNT(*) FROM logins WHERE user_id = ?", id); n != 2 {
+		t.Fatalf("%d login rows, want 2", n)
+	}
+
+	var latest string
+	p.db.QueryRow("SELECT MAX(login_time) FROM logins WHERE user_id = ?", id).Scan(&latest)
+	for _, user := range decodeList(t, p.request(http.MethodGet, "/admin/users", p.admin, nil)) {
+		if user["mobile"] == "9876543210" && (user["last_login"] == "" || user["last_login"] != formatDBTime(latest)) {
+			t.Errorf("last_login = %v, want %s", user["last_login"], formatDBTime(latest))
+		}
+	}
+	if summary := decodeBody(t, p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/summary", id), p.admin, nil)); summary["last_login"] != formatDBTime(latest) {
+		t.Errorf("summary last_login = %v", summary["last_login"])
+	}
+
+	w := p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/logins?limit=1", id), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if logins := decodeList(t, w); len(logins) != 1 || w.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("paged logins = %v, total %q", logins, w.Header().Get("X-Total-Count"))
+	}
+}
+
+func TestLoginRecordsDevice(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	id := p.userID("9876543210")
+	login := func(userAgent string) {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"mobile": "9876543210"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		req.RemoteAddr = "192.0.2.1:4321"
+		expectStatus(t, p.serve(req), http.StatusOK)
+	}
+	lastLogin := func() (string, string) {
+		var userAgent, ip string
+		p.db.QueryRow("SELECT user_agent, ip FROM logins WHERE user_id = ? ORDER BY id DESC LIMIT 1", id).Scan(&userAgent, &ip)
+		return userAgent, ip
+	}
+
+	login("TestBrowser/1.0")
+	if userAgent, ip := lastLogin(); userAgent != "TestBrowser/1.0" || ip != "192.0.2.1" {
+		t.Errorf("untrusted login recorded %q from %q", userAgent, ip)
+	}
+	t.Setenv("TRUST_PROXY", "true")
+	login("TestBrowser/1.0")
+	if _, ip := lastLogin(); ip != "203.0.113.7" {
+		t.Errorf("trusted proxy login recorded ip %q, want the forwarded client", ip)
+	}
+	login("OtherBrowser/2.0")
+
+	logins := decodeList(t, p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/logins", id), p.admin, nil))
+	if len(logins) != 3 {
+		t.Fatalf("got %d logins, want 3", len(logins))
+	}
+	if logins[0]["user_agent"] != "OtherBrowser/2.0" || logins[0]["new_device"] != true || logins[1]["new_device"] != false {
+		t.Errorf("login history = %v", logins)
+	}
+}
+
+func TestRejectionNoteReachesCustomer(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "NT1"), http.StatusOK)
+
+	expectStatus(t, p.review("NT1", gin.H{"status": "rejected", "notes": strings.Repeat("n", maxNotesLength+1)}), http.StatusBadRequest)
+	expectStatus(t, p.review("NT1", gin.H{"status": "rejected", "notes": "  Bill is unreadable\x00  "}), http.StatusOK)
+
+	own := decodeList(t, p.request(http.MethodGet, "/my-registrations", customer, nil))
+	if len(own) != 1 || own[0]["notes"] != "Bill is unreadable" {
+		t.Fatalf("customer view = %v", own)
+	}
+	for _, reg := range decodeList(t, p.request(http.MethodGet, "/admin/registrations", p.admin, nil)) {
+		if reg["notes"] != "Bill is unreadable" {
+			t.Errorf("admin view notes = %v", reg["notes"])
+		}
+	}
+}
+
+func TestStaleVersionRejected(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "OC1"), http.StatusOK)
+	id := p.registrationID("OC1")
+
+	// Both admins read version 1; the second save must not clobber the first
+	expectStatus(t, p.request(http.MethodPut, fmt.Sprintf("/admin/registration/%d", id), p.admin, gin.H{"status": "approved", "serial": "OC1", "version": 1}), http.StatusOK)
+	w := p.request(http.MethodPut, fmt.Sprintf("/admin/registration/%d", id), p.admin, gin.H{"status": "rejected", "serial": "OC1", "version": 1})
+	expectStatus(t, w, http.StatusConflict)
+	if current := decodeBody(t, w)["current_version"]; current != float64(2) {
+		t.Errorf("current_version = %v, want 2", current)
+	}
+	var status string
+	p.db.QueryRow("SELECT status FROM registrations WHERE id = ?", id).Scan(&status)
+	if status != "approved" {
+		t.Errorf("status = %s after a stale update", status)
+	}
+
+	userID := p.userID("9876543210")
+	user := gin.H{"id": userID, "username": "9876543210", "mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5", "role": "CUSTOMER", "active": 1, "version": 1}
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, user), http.StatusOK)
+	user["company"] = "Stale Co"
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, user), http.StatusConflict)
+	delete(user, "version")
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, user), http.StatusBadRequest)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE company = 'Stale Co'"); n != 0 {
+		t.Error("stale user update was saved")
+	}
+}
+
+// Records sent notifications; fails the first failures sends and waits on
+// release (when set) before each send
+type fakeSender struct {
+	mu       sync.Mutex
+	sent     []string
+	failures int
+	release  chan struct{}
+}
+
+func (s *fakeSender) Send(channel, recipient, message string) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("provider unavailable")
+	}
+	s.sent = append(s.sent, recipient)
+	return nil
+}
+
+func (s *fakeSender) sentCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+// Wait up to a few seconds for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotificationQueueDeliversInBackground(t *testing.T) {
+	p := newTestPortal(t)
+	sender := &fakeSender{failures: 1, release: make(chan struct{})}
+	q := startNotificationQueue(p.db, sender)
+	q.retryDelay = time.Millisecond
+
+	start := time.Now()
+	if err := q.Enqueue("sms", "9876543210", "hello"); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Enqueue took %v while the sender was blocked", elapsed)
+	}
+	if n := p.count("SELECT COUNT(*) FROM notification_jobs WHERE status IN ('pending', 'sending')"); n != 1 {
+		t.Errorf("%d unsent jobs stored, want 1", n)
+	}
+
+	close(sender.release)
+	eventually(t, "delivery", func() bool { return sender.sentCount() == 1 })
+	eventually(t, "job marked sent", func() bool {
+		return p.count("SELECT COUNT(*) FROM notification_jobs WHERE status = 'sent' AND attempts = 2") == 1
+	})
+}
+
+func TestNotificationQueueSweepsOverflow(t *testing.T) {
+	p := newTestPortal(t)
+	sender := &fakeSender{}
+	q := &notificationQueue{db: p.db, sender: sender, jobs: make(chan int64, 1), maxAttempts: 1}
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue("sms", fmt.Sprintf("98765432%02d", i), "hello"); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	if len(q.jobs) != 1 {
+		t.Fatalf("%d jobs buffered, want 1", len(q.jobs))
+	}
+	// Already buffered jobs aren't queued again
+	if queued := q.sweep(); queued != 1 {
+		t.Errorf("sweep queued %d with a full buffer, want just the buffered job", queued)
+	}
+
+	go q.work()
+	eventually(t, "overflowed jobs sent", func() bool {
+		q.sweep()
+		return sender.sentCount() == 3
+	})
+	if n := p.count("SELECT COUNT(*) FROM notification_jobs WHERE status = 'sent'"); n != 3 {
+		t.Errorf("%d jobs marked sent, want 3", n)
+	}
+}
+
+func TestRetryFailedNotification(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("NOTIFY_MAX_ATTEMPTS", "1")
+	sender := &fakeSender{failures: 1}
+	q := startNotificationQueue(p.db, sender)
+	p.router = setupRouter(p.db, p.db, q, newEventBroker(), nil)
+
+	q.Enqueue("sms", "9876543210", "hello")
+	eventually(t, "job to fail", func() bool {
+		return p.count("SELECT COUNT(*) FROM notification_jobs WHERE status = 'failed'") == 1
+	})
+	failed := decodeList(t, p.request(http.MethodGet, "/admin/notifications?status=failed", p.admin, nil))
+	if len(failed) != 1 || failed[0]["last_error"] != "provider unavailable" || failed[0]["attempts"] != float64(1) {
+		t.Fatalf("failed list = %v", failed)
+	}
+	id := int(failed[0]["id"].(float64))
+
+	expectStatus(t, p.request(http.MethodPost, fmt.Sprintf("/admin/notifications/%d/retry", id), p.admin, nil), http.StatusOK)
+	eventually(t, "retried job to send", func() bool { return sender.sentCount() == 1 })
+	eventually(t, "job marked sent", func() bool {
+		return p.count("SELECT COUNT(*) FROM notification_jobs WHERE status = 'sent'") == 1
+	})
+	expectStatus(t, p.request(http.MethodPost, fmt.Sprintf("/admin/notifications/%d/retry", id), p.admin, nil), http.StatusConflict)
+	expectStatus(t, p.request(http.MethodPost, "/admin/notifications/999/retry", p.admin, nil), http.StatusNotFound)
+}
+
+func TestRegistrationCursorPaging(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	for i := 1; i <= 5; i++ {
+		expectStatus(t, p.registerProduct(customer, productID, fmt.Sprintf("CP%d", i)), http.StatusOK)
+	}
+
+	seen := map[float64]bool{}
+	cursor := "0"
+	for page := 0; cursor != ""; page++ {
+		w := p.request(http.MethodGet, "/admin/registrations?limit=2&after="+cursor, p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		body := decodeBody(t, w)
+		for _, reg := range body["registrations"].([]interface{}) {
+			id := reg.(map[string]interface{})["id"].(float64)
+			if seen[id] {
+				t.Errorf("registration %v returned twice", id)
+			}
+			seen[id] = true
+		}
+		// A row arriving mid-iteration lands after the cursor
+		if page == 0 {
+			expectStatus(t, p.registerProduct(customer, productID, "CP6"), http.StatusOK)
+		}
+		cursor = ""
+		if next, ok := body["next_cursor"].(float64); ok {
+			cursor = fmt.Sprint(next)
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("paged through %d registrations, want 6", len(seen))
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/registrations?after=-1", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestRegistrationListNotModified(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodGet, "/admin/registrations", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on the registration list")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/registrations", nil)
+	req.Header.Set("Authorization", p.admin)
+	req.Header.Set("If-None-Match", etag)
+	expectStatus(t, p.serve(req), http.StatusNotModified)
+}
+
+func TestMaintenanceModeBlocksWrites(t *testing.T) {
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodPost, "/admin/maintenance/mode", p.admin, gin.H{"enabled": true}), http.StatusOK)
+
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+	expectStatus(t, p.request(http.MethodGet, "/health", "", nil), http.StatusOK)
+	expectStatus(t, p.request(http.MethodGet, "/admin/products", p.admin, nil), http.StatusOK)
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/maintenance/mode", p.admin, gin.H{"enabled": false}), http.StatusOK)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+}
+
+func TestMaintenanceModeFromEnv(t *testing.T) {
+	t.Setenv("MAINTENANCE", "true")
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5"}), http.StatusServiceUnavailable)
+}
+
+func TestConfigExportImportRoundTrip(t *testing.T) {
+	source := newTestPortal(t)
+	source.product("Inverter", gin.H{"description": "5kVA", "serial_pattern": "^INV[0-9]+$"})
+	source.customer("9876543210", "27ABCDE1234F1Z5")
+	// Numbers from before GST validation are shorter than a GSTIN
+	source.customer("9876543211", "GST123456")
+
+	w := source.request(http.MethodGet, "/admin/export/config?include_users=true", source.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	bundle := w.Body.Bytes()
+
+	target := newTestPortal(t)
+	w = target.request(http.MethodPost, "/admin/import/config", target.admin, bundle)
+	expectStatus(t, w, http.StatusOK)
+	result := decodeBody(t, w)
+	if result["products_created"] != float64(1) || result["users_created"] != float64(2) {
+		t.Fatalf("import result = %v", result)
+	}
+	if n := target.count("SELECT COUNT(*) FROM products WHERE name = 'Inverter' AND description = '5kVA' AND serial_pattern = '^INV[0-9]+$'"); n != 1 {
+		t.Error("imported product doesn't match the export")
+	}
+	if n := target.count("SELECT COUNT(*) FROM users WHERE mobile = '9876543211' AND gst = 'GST123456' AND company = 'Acme Traders'"); n != 1 {
+		t.Error("legacy GST user not imported")
+	}
+
+	// Importing again only skips
+	result = decodeBody(t, target.request(http.MethodPost, "/admin/import/config", target.admin, bundle))
+	if result["products_created"] != float64(0) || result["users_created"] != float64(0) || result["users_skipped"] != float64(2) {
+		t.Errorf("second import result = %v", result)
+	}
+}
+
+func TestConfigImportSkipsGSTConflicts(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	bundle := gin.H{"users": []gin.H{
+		{"mobile": "9876543211", "company": "Copycat", "gst": "27ABCDE1234F1Z5", "active": 1},
+		{"mobile": "9876543212", "company": "Fresh", "gst": "27ABCDE1234F1Z6", "active": 1},
+	}}
+	w := p.request(http.MethodPost, "/admin/import/config", p.admin, bundle)
+	expectStatus(t, w, http.StatusOK)
+	result := decodeBody(t, w)
+	conflicts, _ := result["conflicts"].([]interface{})
+	if result["users_created"] != float64(1) || result["users_skipped"] != float64(1) || len(conflicts) != 1 {
+		t.Fatalf("import result = %v", result)
+	}
+	if conflict := conflicts[0].(map[string]interface{}); conflict["username"] != "9876543211" || conflict["field"] != "gst" {
+		t.Errorf("conflict = %v", conflict)
+	}
+	if p.count("SELECT COUNT(*) FROM users WHERE mobile = '9876543211'") != 0 || p.count("SELECT COUNT(*) FROM users WHERE mobile = '9876543212'") != 1 {
+		t.Error("wrong users imported")
+	}
+}
+
+func TestEventStreamDeliversNewRegistration(t *testing.T) {
+	p := newTestPortal(t)
+	events := newEventBroker()
+	p.router = setupRouter(p.db, p.db, nil, events, nil)
+	server := httptest.NewServer(p.router)
+	defer server.Close()
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/admin/events", nil)
+	req.Header.Set("Authorization", p.admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+
+	expectStatus(t, p.registerProduct(customer, productID, "EV1"), http.StatusOK)
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var event, data string
+	timeout := time.After(5 * time.Second)
+	for data == "" {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream closed before an event arrived")
+			}
+			if strings.HasPrefix(line, "event:") {
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			} else if strings.HasPrefix(line, "data:") {
+				data = line
+			}
+		case <-timeout:
+			t.Fatal("no event within 5s")
+		}
+	}
+	if event != "registration.created" || !strings.Contains(data, "EV1") {
+		t.Errorf("got event %q with %s", event, data)
+	}
+
+	// Disconnecting unsubscribes the client
+	cancel()
+	eventually(t, "unsubscribe", func() bool {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		return len(events.subscribers) == 0
+	})
+}
+
+func TestSerialLimitPerRequest(t *testing.T) {
+	t.Setenv("MAX_SERIALS_PER_REQUEST", "3")
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	w := p.registerProduct(customer, productID, "SL1,SL2,SL3,SL4")
+	expectStatus(t, w, http.StatusBadRequest)
+	if msg := decodeBody(t, w)["error"].(string); !strings.Contains(msg, "4") || !strings.Contains(msg, "3") {
+		t.Errorf("error %q doesn't give the count and limit", msg)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registrations"); n != 0 {
+		t.Fatalf("%d registrations inserted over the limit", n)
+	}
+	expectStatus(t, p.registerProduct(customer, productID, "SL1,SL2,SL3"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations"); n != 3 {
+		t.Errorf("%d registrations at the limit, want 3", n)
+	}
+}
+
+func TestRejectReasonStats(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "RR1,RR2,RR3,RR4"), http.StatusOK)
+
+	expectStatus(t, p.review("RR1", gin.H{"status": "rejected", "reason_code": "NOT_A_REASON"}), http.StatusBadRequest)
+	expectStatus(t, p.review("RR1", gin.H{"status": "approved", "reason_code": "OTHER"}), http.StatusBadRequest)
+	expectStatus(t, p.review("RR1", gin.H{"status": "rejected", "reason_code": "BILL_MISMATCH"}), http.StatusOK)
+	expectStatus(t, p.review("RR2", gin.H{"status": "rejected", "reason_code": "BILL_MISMATCH"}), http.StatusOK)
+	expectStatus(t, p.review("RR3", gin.H{"status": "rejected"}), http.StatusOK)
+	expectStatus(t, p.review("RR4", gin.H{"status": "rejected", "reason_code": "DUPLICATE"}), http.StatusOK)
+	p.backdate("RR4", "rejected", "2020-01-15 10:00:00")
+
+	counts := func(query string) (map[string]float64, map[string]interface{}) {
+		w := p.request(http.MethodGet, "/admin/stats/reject-reasons"+query, p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		body := decodeBody(t, w)
+		byCode := map[string]float64{}
+		for _, reason := range body["reasons"].([]interface{}) {
+			r := reason.(map[string]interface{})
+			byCode[r["code"].(string)] = r["count"].(float64)
+		}
+		return byCode, body
+	}
+	byCode, body := counts("")
+	if body["total_rejected"] != float64(4) || body["uncategorized"] != float64(1) || byCode["BILL_MISMATCH"] != 2 || byCode["DUPLICATE"] != 1 || byCode["OTHER"] != 0 {
+		t.Errorf("all-time stats = %v", body)
+	}
+	byCode, body = counts("?from=2021-01-01")
+	if body["total_rejected"] != float64(3) || byCode["DUPLICATE"] != 0 {
+		t.Errorf("stats from 2021 = %v", body)
+	}
+}
+
+func TestGzipLargeJSONButNotZip(t *testing.T) {
+	t.Setenv("ENABLE_GZIP", "true")
+	p := newTestPortal(t)
+	for i := 0; i < 50; i++ {
+		p.product(fmt.Sprintf("Product %d", i), gin.H{"description": strings.Repeat("A long description. ", 20)})
+	}
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "GZ1"), http.StatusOK)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", p.admin)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		return p.serve(req)
+	}
+
+	w := get("/admin/products")
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("JSON list not gzipped; headers %v", w.Header())
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	var products []map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&products); err != nil || len(products) != 51 {
+		t.Errorf("decoded %d products, err %v", len(products), err)
+	}
+
+	w = get(fmt.Sprintf("/admin/user/%d/bills.zip", p.userID("9876543210")))
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Content-Encoding") != "" || !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+		t.Errorf("ZIP download was compressed again: Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestImportPreviewMatchesImport(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	rows := [][]string{
+		{"9876543211", "New Co", "27ABCDE1234F1Z6", "CUSTOMER"},
+		{"9876543210", "Existing Co", "27ABCDE1234F1Z7", "CUSTOMER"},
+		{"9876543211", "Repeat Co", "27ABCDE1234F1Z8", "CUSTOMER"},
+		{"9876543212", "GST Taken Co", "27ABCDE1234F1Z5", "CUSTOMER"},
+		{"9876543213", "GST Repeat Co", "27ABCDE1234F1Z6", "CUSTOMER"},
+		{"9876543214", "Legacy Co", "GST123456", "CUSTOMER"},
+		{"9876543215", "Bad Role Co", "", "OWNER"},
+	}
+	var csvBody bytes.Buffer
+	writer := csv.NewWriter(&csvBody)
+	writer.Write([]string{"mobile", "company", "gst", "role"})
+	writer.WriteAll(rows)
+
+	w := p.upload("/admin/import/preview", p.admin, map[string]string{"type": "users"}, testFile{"file", "users.csv", csvBody.Bytes()})
+	expectStatus(t, w, http.StatusOK)
+	dispositions := []string{}
+	for _, row := range decodeBody(t, w)["rows"].([]interface{}) {
+		dispositions = append(dispositions, row.(map[string]interface{})["disposition"].(string))
+	}
+	want := []string{"will_create", "duplicate", "duplicate", "duplicate", "duplicate", "will_create", "invalid"}
+	if strings.Join(dispositions, ",") != strings.Join(want, ",") {
+		t.Fatalf("preview dispositions = %v, want %v", dispositions, want)
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE username != 'admin'"); n != 1 {
+		t.Fatalf("preview wrote users: %d", n)
+	}
+
+	// The import refuses the whole bundle over an invalid row, so leave it out
+	users := []gin.H{}
+	for _, row := range rows[:len(rows)-1] {
+		users = append(users, gin.H{"mobile": row[0], "company": row[1], "gst": row[2], "role": row[3], "active": 1})
+	}
+	w = p.request(http.MethodPost, "/admin/import/config", p.admin, gin.H{"users": users})
+	expectStatus(t, w, http.StatusOK)
+	result := decodeBody(t, w)
+	if result["users_created"] != float64(2) || result["users_skipped"] != float64(4) {
+		t.Errorf("import result = %v, preview expected 2 created and 4 skipped", result)
+	}
+	expectStatus(t, p.request(http.MethodPost, "/admin/import/config", p.admin, gin.H{"users": []gin.H{{"mobile": "9876543215", "role": "OWNER"}}}), http.StatusBadRequest)
+}
+
+func TestStaffRole(t *testing.T) {
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, gin.H{"username": "clerk", "mobile": "9000000001", "password": "Clerk@12345", "role": "STAFF", "active": 1}), http.StatusOK)
+	staff := p.login("9000000001", "Clerk@12345")
+
+	expectStatus(t, p.request(http.MethodGet, "/admin/registrations", staff, nil), http.StatusOK)
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/users.csv", staff, nil), http.StatusForbidden)
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", staff, gin.H{"username": "sneaky", "password": "Sneaky@12345", "role": "ADMIN", "active": 1}), http.StatusForbidden)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE username = 'sneaky'"); n != 0 {
+		t.Error("STAFF created a user")
+	}
+}
+
+func TestRoleRoutesNeedRealToken(t *testing.T) {
+	p := newTestPortal(t)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	for _, token := range []string{"", "not-a-token"} {
+		expectStatus(t, p.request(http.MethodGet, "/admin/registrations", token, nil), http.StatusUnauthorized)
+		expectStatus(t, p.request(http.MethodPost, "/admin/user", token, gin.H{"username": "x", "role": "ADMIN", "active": 1}), http.StatusUnauthorized)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/registrations", customer, nil), http.StatusForbidden)
+
+	// A soft-deleted account's token is refused even if it was never cleared
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, gin.H{"username": "clerk", "mobile": "9000000001", "password": "Clerk@12345", "role": "STAFF", "active": 1}), http.StatusOK)
+	staff := p.login("9000000001", "Clerk@12345")
+	if _, err := p.db.Exec("UPDATE users SET deleted_at = ? WHERE mobile = '9000000001'", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/registrations", staff, nil), http.StatusUnauthorized)
+}
+
+// Collect log output, at every level, for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	level := logLevel
+	logLevel = levelDebug
+	t.Cleanup(func() {
+		log.SetOutput(io.Discard)
+		logLevel = level
+	})
+	return &buf
+}
+
+func TestDebugHTTPLogRedactsSecrets(t *testing.T) {
+	t.Setenv("DEBUG_HTTP", "true")
+	p := newTestPortal(t)
+	logs := captureLog(t)
+
+	w := p.request(http.MethodPost, "/login", "", gin.H{"mobile": "admin", "password": defaultAdminPassword})
+	expectStatus(t, w, http.StatusOK)
+	token := decodeBody(t, w)["token"].(string)
+	out := logs.String()
+	if !strings.Contains(out, "HTTP POST /login -> 200") {
+		t.Fatalf("request not logged: %s", out)
+	}
+	if strings.Contains(out, defaultAdminPassword) || strings.Contains(out, token) {
+		t.Errorf("secret reached the log: %s", out)
+	}
+	if !strings.Contains(out, `"password":"***"`) || !strings.Contains(out, `"token":"***"`) {
+		t.Errorf("password and token not redacted: %s", out)
+	}
+}
+
+func TestProductActiveFilterAndCounts(t *testing.T) {
+	p := newTestPortal(t)
+	for i := 0; i < 3; i++ {
+		p.product(fmt.Sprintf("Active %d", i), nil)
+	}
+	p.product("Retired", gin.H{"active": 0})
+
+	w := p.request(http.MethodGet, "/admin/products?active=1&limit=2", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if page := decodeList(t, w); len(page) != 2 || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("active page = %v, total %q", page, w.Header().Get("X-Total-Count"))
+	}
+	inactive := decodeList(t, p.request(http.MethodGet, "/admin/products?active=0", p.admin, nil))
+	if len(inactive) != 1 || inactive[0]["name"] != "Retired" {
+		t.Errorf("inactive products = %v", inactive)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/products?active=maybe", p.admin, nil), http.StatusBadRequest)
+
+	counts := decodeBody(t, p.request(http.MethodGet, "/admin/products/counts", p.admin, nil))
+	if counts["active"] != float64(3) || counts["inactive"] != float64(1) || counts["total"] != float64(4) {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func TestSerialHistoryAcrossUsers(t *testing.T) {
+	t.Setenv("DUPLICATE_GRACE_DAYS", "1")
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	first := p.customer("9876543210", "27ABCDE1234F1Z5")
+	second := p.customer("9876543211", "27ABCDE1234F1Z6")
+
+	expectStatus(t, p.registerProduct(first, productID, "HX1"), http.StatusOK)
+	expectStatus(t, p.review("HX1", gin.H{"status": "rejected"}), http.StatusOK)
+	// Age the rejection past the grace period so the serial is free again
+	p.db.Exec("UPDATE registrations SET created_at = '2020-01-01 00:00:00' WHERE serial = 'HX1'")
+	p.db.Exec("UPDATE registration_history SET created_at = '2020-01-0' || id || ' 00:00:00' WHERE serial = 'HX1'")
+	expectStatus(t, p.registerProduct(second, productID, "hx1"), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/serial/hX1/history", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	history := decodeBody(t, w)["history"].([]interface{})
+	mobiles := []string{}
+	for _, entry := range history {
+		e := entry.(map[string]interface{})
+		mobiles = append(mobiles, fmt.Sprintf("%s:%s", e["mobile"], e["event"]))
+	}
+	want := "9876543210:registered,9876543210:updated,9876543210:superseded,9876543211:registered"
+	if got := strings.Join(mobiles, ","); got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/serial/NOPE/history", p.admin, nil), http.StatusNotFound)
+
+	var plan, detail string
+	var id, parent, unused int
+	rows, _ := p.db.Query("EXPLAIN QUERY PLAN SELECT * FROM registration_history h WHERE h.serial = ? COLLATE NOCASE", "HX1")
+	for rows.Next() {
+		rows.Scan(&id, &parent, &unused, &detail)
+		plan += detail
+	}
+	rows.Close()
+	if !strings.Contains(plan, "idx_registration_history_serial") {
+		t.Errorf("serial lookup doesn't use the index: %s", plan)
+	}
+}
+
+func TestBillExportTemplate(t *testing.T) {
+	t.Setenv("BILL_EXPORT_TEMPLATE", "{company}/{date}_{serial}")
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "TP1"), http.StatusOK)
+
+	entries := readZip(t, p.request(http.MethodGet, fmt.Sprintf("/admin/user/%d/bills.zip", p.userID("9876543210")), p.admin, nil))
+	want := "Acme_Traders/" + time.Now().Format("2006-01-02") + "_TP1.pdf"
+	if _, ok := entries[want]; !ok || len(entries) != 1 {
+		t.Errorf("entries = %v, want just %s", entries, want)
+	}
+}
+
+func TestBillEntryNameCantEscape(t *testing.T) {
+	values := map[string]string{"company": "../../etc", "serial": `..\..\passwd`, "date": "2024-01-02"}
+	cases := map[string]string{
+		"{company}/{date}_{serial}": ".._.._etc/2024-01-02_.._.._passwd.pdf",
+		"../{company}/{serial}":     ".._.._etc/.._.._passwd.pdf",
+		"/{serial}":                 ".._.._passwd.pdf",
+		"./../":                     "bill.pdf",
+	}
+	for template, want := range cases {
+		name := billEntryName(template, values, ".pdf")
+		if name != want {
+			t.Errorf("billEntryName(%q) = %q, want %q", template, name, want)
+		}
+		if strings.HasPrefix(name, "/") || strings.Contains("/"+name+"/", "/../") {
+			t.Errorf("billEntryName(%q) = %q escapes the archive", template, name)
+		}
+	}
+}
+
+func TestValidateBillExportTemplate(t *testing.T) {
+	for template, ok := range map[string]bool{
+		"{mobile}/{date}-{serial}-{product}": true,
+		"{company}/{kind}/{serial}":          true,
+		"{owner}/{serial}":                   false,
+		"{company/{serial}":                  false,
+		"{serial}}":                          false,
+	} {
+		if err := validateBillExportTemplate(template); (err == nil) != ok {
+			t.Errorf("validateBillExportTemplate(%q) = %v", template, err)
+		}
+	}
+}
+
+func TestSafeJoinRejectsEscapes(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "bills")
+	for _, name := range []string{"../../etc/passwd", `..\..\etc\passwd`, "/etc/passwd", `\etc\passwd`, "a/../../b", "..", ".", "", "bill\x00.pdf"} {
+		if path, err := safeJoin(base, name); err == nil {
+			t.Errorf("safeJoin(%q) = %q, want an error", name, path)
+		}
+	}
+	for _, name := range []string{"bill.pdf", "sub/bill.pdf", "a/../bill.pdf"} {
+		path, err := safeJoin(base, name)
+		if err != nil || !strings.HasPrefix(path, base+string(filepath.Separator)) {
+			t.Errorf("safeJoin(%q) = %q, %v", name, path, err)
+		}
+	}
+}
+
+func TestBillRouteRejectsTraversal(t *testing.T) {
+	p := newTestPortal(t)
+	os.WriteFile(filepath.Join(os.Getenv("DATA_DIR"), "secret.txt"), []byte("secret"), 0644)
+	for _, path := range []string{"/bills/../secret.txt", "/bills/..%2Fsecret.txt", "/bills/..%5Csecret.txt"} {
+		req := httptest.NewRequest(http.MethodGet, "/bills/x", nil)
+		req.URL, _ = url.Parse(path)
+		req.Header.Set("Authorization", p.admin)
+		if w := p.serve(req); w.Code == http.StatusOK || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("GET %s = %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPurgeBillsBeforeDate(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "PB1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(customer, productID, "PB2"), http.StatusOK)
+	p.backdate("PB1", "approved", "2020-03-01 10:00:00")
+	bill := func(serial string) string {
+		var path string
+		p.db.QueryRow("SELECT COALESCE(bill_file, '') FROM registrations WHERE serial = ?", serial).Scan(&path)
+		return path
+	}
+	oldBill, newBill := bill("PB1"), bill("PB2")
+
+	w := p.request(http.MethodPost, "/admin/bills/purge?before=2021-01-01&dry_run=true", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeBody(t, w); body["registrations"] != float64(1) || body["bill_files"] != float64(1) || !billExists(oldBill) {
+		t.Fatalf("dry run = %v, old bill exists %v", body, billExists(oldBill))
+	}
+
+	w = p.request(http.MethodPost, "/admin/bills/purge?before=2021-01-01", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeBody(t, w); body["registrations"] != float64(1) || body["bill_files"] != float64(1) {
+		t.Errorf("purge = %v", body)
+	}
+	if billExists(oldBill) || bill("PB1") != "" {
+		t.Error("pre-date bill not purged")
+	}
+	if !billExists(newBill) || bill("PB2") != newBill {
+		t.Error("recent bill was purged")
+	}
+	if n := p.count("SELECT COUNT(*) FROM registrations"); n != 2 {
+		t.Errorf("%d registrations left, want both kept", n)
+	}
+	expectStatus(t, p.request(http.MethodPost, "/admin/bills/purge?before=2021-13-01", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestReadyAndLive(t *testing.T) {
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodGet, "/ready", "", nil), http.StatusOK)
+	expectStatus(t, p.request(http.MethodGet, "/live", "", nil), http.StatusOK)
+
+	migrationsDone.Store(false)
+	defer migrationsDone.Store(true)
+	expectStatus(t, p.request(http.MethodGet, "/ready", "", nil), http.StatusServiceUnavailable)
+	expectStatus(t, p.request(http.MethodGet, "/live", "", nil), http.StatusOK)
+}
+
+func TestStartupRouterIsLiveButNotReady(t *testing.T) {
+	r := startupRouter()
+	for path, want := range map[string]int{"/live": http.StatusOK, "/ready": http.StatusServiceUnavailable, "/login": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		expectStatus(t, w, want)
+		if path == "/ready" && decodeBody(t, w)["status"] != "starting" {
+			t.Errorf("/ready during startup: %s", w.Body)
+		}
+	}
+}
+
+func TestReadyWhileDatabaseUnreachable(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "missing", "portal.db")+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Only the database is at fault
+	defer func(done bool) { migrationsDone.Store(done) }(migrationsDone.Load())
+	migrationsDone.Store(true)
+	r := gin.New()
+	r.GET("/ready", readyCheck(db))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	expectStatus(t, w, http.StatusServiceUnavailable)
+}
+
+// Field named in a 400 response's fields map
+func rejectedField(t *testing.T, w *httptest.ResponseRecorder, field string) {
+	t.Helper()
+	expectStatus(t, w, http.StatusBadRequest)
+	if fields, _ := decodeBody(t, w)["fields"].(map[string]interface{}); fields[field] == nil {
+		t.Errorf("%s not reported in %s", field, w.Body.String())
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	p := newTestPortal(t)
+	register := func(body gin.H) *httptest.ResponseRecorder {
+		return p.request(http.MethodPost, "/register", "", body)
+	}
+	rejectedField(t, register(gin.H{"company": "Acme", "gst": "27ABCDE1234F1Z5"}), "mobile")
+	rejectedField(t, register(gin.H{"mobile": "9876543210", "company": " ", "gst": "27ABCDE1234F1Z5"}), "company")
+	rejectedField(t, register(gin.H{"mobile": "98765abc10", "company": "Acme", "gst": "27ABCDE1234F1Z5"}), "mobile")
+	rejectedField(t, register(gin.H{"mobile": strings.Repeat("9", maxMobileLength+1), "company": "Acme", "gst": "27ABCDE1234F1Z5"}), "mobile")
+	// Company length is measured after runs of spaces collapse
+	padded := strings.Repeat("A ", maxCompanyLength/2-1) + "   A"
+	expectStatus(t, register(gin.H{"mobile": "+91 98765-43210", "company": padded, "gst": "27ABCDE1234F1Z5"}), http.StatusOK)
+
+	user := func(body gin.H) *httptest.ResponseRecorder {
+		return p.request(http.MethodPost, "/admin/user", p.admin, body)
+	}
+	rejectedField(t, user(gin.H{"username": "x", "role": "OWNER"}), "role")
+	rejectedField(t, user(gin.H{"username": strings.Repeat("u", maxUsernameLength+1)}), "username")
+	rejectedField(t, user(gin.H{"username": "x", "mobile": "call me"}), "mobile")
+	rejectedField(t, user(gin.H{"username": "x", "gst": strings.Repeat("G", maxGSTLength+1)}), "gst")
+
+	product := func(body gin.H) *httptest.ResponseRecorder {
+		return p.request(http.MethodPost, "/admin/product", p.admin, body)
+	}
+	rejectedField(t, product(gin.H{"description": "No name"}), "name")
+	rejectedField(t, product(gin.H{"name": strings.Repeat("n", maxProductNameLength+1)}), "name")
+	rejectedField(t, product(gin.H{"name": "Inverter", "description": strings.Repeat("d", maxDescriptionLength+1)}), "description")
+	rejectedField(t, product(gin.H{"name": "Inverter", "serial_transform": strings.Repeat("x", maxSerialPatternLength+1)}), "serial_transform")
+
+	id := p.product("Inverter", nil)
+	rejectedField(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/product/%d", id), p.admin, gin.H{"name": "  "}), "name")
+	rejectedField(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/product/%d", id), p.admin, gin.H{"description": strings.Repeat("d", maxDescriptionLength+1)}), "description")
+}
+
+func TestTailLogs(t *testing.T) {
+	p := newTestPortal(t)
+	expectStatus(t, p.request(http.MethodGet, "/admin/logs", p.admin, nil), http.StatusNotFound)
+
+	os.MkdirAll(filepath.Dir(logFilePath()), 0755)
+	var content strings.Builder
+	// Enough to span several of tailLines' read chunks
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	os.WriteFile(logFilePath(), []byte(content.String()), 0644)
+
+	w := p.request(http.MethodGet, "/admin/logs?lines=3", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "line 19998\nline 19999\nline 20000\n" {
+		t.Errorf("tail = %q", got)
+	}
+	if lines := strings.Count(p.request(http.MethodGet, "/admin/logs", p.admin, nil).Body.String(), "\n"); lines != 500 {
+		t.Errorf("default tail has %d lines, want 500", lines)
+	}
+	body := p.request(http.MethodGet, "/admin/logs?lines=100000", p.admin, nil).Body.String()
+	if lines := strings.Count(body, "\n"); lines != maxLogTailLines || !strings.HasPrefix(body, "line 15001\n") {
+		t.Errorf("capped tail has %d lines starting %q", lines, body[:12])
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/logs?lines=0", p.admin, nil), http.StatusBadRequest)
+
+	w = p.request(http.MethodGet, "/admin/logs/download", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != content.String() {
+		t.Error("download isn't the whole log")
+	}
+}
+
+func TestNeedsInfoRoundTrip(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "NI1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(customer, productID, "NI2"), http.StatusOK)
+	id := p.registrationID("NI1")
+	reupload := func() *httptest.ResponseRecorder {
+		return p.upload(fmt.Sprintf("/my-registrations/%d/bill", id), customer, nil, testFile{"bill", "clear.pdf", testPDF})
+	}
+	status := func() string {
+		var s string
+		p.db.QueryRow("SELECT status FROM registrations WHERE id = ?", id).Scan(&s)
+		return s
+	}
+
+	expectStatus(t, reupload(), http.StatusConflict)
+	expectStatus(t, p.review("NI1", gin.H{"status": "needs_info"}), http.StatusBadRequest)
+	expectStatus(t, p.review("NI1", gin.H{"status": "needs_info", "notes": "Please upload a clearer bill"}), http.StatusOK)
+	if status() != "needs_info" {
+		t.Fatalf("status = %s, want needs_info", status())
+	}
+	w := p.request(http.MethodGet, "/admin/export/csv?status=needs_info", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if filtered := readCSV(t, w); len(filtered) != 2 || !strings.Contains(strings.Join(filtered[1], ","), "NI1") {
+		t.Errorf("needs_info export = %v", filtered)
+	}
+
+	expectStatus(t, reupload(), http.StatusOK)
+	if status() != "pending" {
+		t.Errorf("status after re-upload = %s, want pending", status())
+	}
+	other := p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.upload(fmt.Sprintf("/my-registrations/%d/bill", id), other, nil, testFile{"bill", "x.pdf", testPDF}), http.StatusNotFound)
+}
+
+func TestReuploadBillSwapsFiles(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "RB1"), http.StatusOK)
+	id := p.registrationID("RB1")
+	var oldBill string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE id = ?", id).Scan(&oldBill)
+	expectStatus(t, p.review("RB1", gin.H{"status": "needs_info", "notes": "Bill is blurred"}), http.StatusOK)
+
+	w := p.upload(fmt.Sprintf("/my-registrations/%d/bill", id), customer, nil, testFile{"bill", "clear.pdf", testPDF})
+	expectStatus(t, w, http.StatusOK)
+	newBill := decodeBody(t, w)["bill_file"].(string)
+	if billExists(oldBill) || !billExists(newBill) {
+		t.Errorf("old bill kept %v, new bill stored %v", billExists(oldBill), billExists(newBill))
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE registration_id = ? AND kind = 'bill' AND path = ?", id, newBill); n != 1 {
+		t.Errorf("%d file records for the new bill, want 1", n)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE registration_id = ? AND kind = 'bill'", id); n != 1 {
+		t.Errorf("%d bill records, want only the new one", n)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE registration_id = ? AND event = 'reuploaded'", id); n != 1 {
+		t.Errorf("%d reuploaded history entries, want 1", n)
+	}
+
+	// A bill past the body limit is reported as too large and changes nothing
+	expectStatus(t, p.review("RB1", gin.H{"status": "needs_info", "notes": "Wrong bill"}), http.StatusOK)
+	t.Setenv("MAX_UPLOAD_MB", "1")
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("bill", "huge.pdf")
+	part.Write(bytes.Repeat([]byte{' '}, 7*1024*1024))
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/my-registrations/%d/bill", id), io.NopCloser(&body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", customer)
+	expectStatus(t, p.serve(req), http.StatusRequestEntityTooLarge)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE id = ? AND status = 'needs_info' AND bill_file = ?", id, newBill); n != 1 {
+		t.Error("oversized upload changed the registration")
+	}
+}
+
+func TestEnsureAdmin(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "First@Pass123")
+	p := newTestPortal(t)
+	admin := func() (password string, active int, managed int) {
+		p.db.QueryRow("SELECT password, active, password_managed FROM users WHERE username = 'admin'").Scan(&password, &active, &managed)
+		return
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE username = 'admin' AND role = 'ADMIN'"); n != 1 {
+		t.Fatalf("%d admins after first run, want 1", n)
+	}
+	if password, active, _ := admin(); password != "First@Pass123" || active != 1 {
+		t.Fatalf("first run admin has password %q, active %d", password, active)
+	}
+
+	// A changed ADMIN_PASSWORD is applied to the managed admin, which stays active
+	t.Setenv("ADMIN_PASSWORD", "Second@Pass123")
+	p.db.Exec("UPDATE users SET active = 0 WHERE username = 'admin'")
+	ensureAdmin(p.db)
+	if password, active, _ := admin(); password != "Second@Pass123" || active != 1 {
+		t.Errorf("reconciled admin has password %q, active %d", password, active)
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE username = 'admin'"); n != 1 {
+		t.Errorf("%d admins after a second run", n)
+	}
+
+	// A password changed by hand survives unless a reset is forced
+	p.db.Exec("UPDATE users SET password = 'Manual@Pass123', password_managed = 0 WHERE username = 'admin'")
+	ensureAdmin(p.db)
+	if password, _, _ := admin(); password != "Manual@Pass123" {
+		t.Errorf("manual password overwritten with %q", password)
+	}
+	t.Setenv("ADMIN_FORCE_RESET", "true")
+	ensureAdmin(p.db)
+	if password, _, managed := admin(); password != "Second@Pass123" || managed != 1 {
+		t.Errorf("forced reset left password %q, managed %d", password, managed)
+	}
+}
+
+func TestListSorting(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	for i, company := range []string{"beta Traders", "Charlie & Co", "Alpha Ltd"} {
+		mobile := fmt.Sprintf("987654321%d", i)
+		w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": mobile, "company": company, "gst": fmt.Sprintf("27ABCDE1234F1Z%d", i)})
+		expectStatus(t, w, http.StatusOK)
+		token := decodeBody(t, w)["token"].(string)
+		expectStatus(t, p.registerProduct(token, productID, fmt.Sprintf("ST%d", i)), http.StatusOK)
+	}
+	column := func(list []map[string]interface{}, key string) string {
+		names := []string{}
+		for _, item := range list {
+			names = append(names, fmt.Sprint(item[key]))
+		}
+		return strings.Join(names, ",")
+	}
+
+	regs := decodeList(t, p.request(http.MethodGet, "/admin/registrations?sort=company&order=asc", p.admin, nil))
+	if got := column(regs, "serial"); got != "ST2,ST0,ST1" {
+		t.Errorf("registrations by company = %s, want ST2,ST0,ST1", got)
+	}
+	users := decodeList(t, p.request(http.MethodGet, "/admin/users?sort=company&order=desc", p.admin, nil))
+	if got := column(users, "company"); got != "Charlie & Co,beta Traders,Alpha Ltd" {
+		t.Errorf("users by company desc = %s", got)
+	}
+
+	for _, path := range []string{"/admin/registrations?sort=password", "/admin/users?sort=token", "/admin/products?sort=" + url.QueryEscape("1;DROP TABLE products"), "/admin/registrations?sort=company&order=sideways"} {
+		expectStatus(t, p.request(http.MethodGet, path, p.admin, nil), http.StatusBadRequest)
+	}
+}
+
+func TestDocsBaseURLFollowsRequest(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("PUBLIC_BASE_URL", "")
+	docsBase := func(header http.Header) string {
+		req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+		req.Host = "portal.example.com"
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		w := p.serve(req)
+		expectStatus(t, w, http.StatusOK)
+		return fmt.Sprint(decodeBody(t, w)["base_url"])
+	}
+
+	if got := docsBase(nil); got != "http://portal.example.com" {
+		t.Errorf("base_url = %q, want http://portal.example.com", got)
+	}
+	if got := docsBase(http.Header{"X-Forwarded-Proto": {"https, http"}}); got != "https://portal.example.com" {
+		t.Errorf("base_url behind proxy = %q, want https://portal.example.com", got)
+	}
+	if got := docsBase(http.Header{"X-Forwarded-Proto": {"gopher"}}); got != "http://portal.example.com" {
+		t.Errorf("base_url with bogus proto = %q, want http://portal.example.com", got)
+	}
+	t.Setenv("PUBLIC_BASE_URL", "https://warranty.example.com/")
+	if got := docsBase(nil); got != "https://warranty.example.com" {
+		t.Errorf("base_url with PUBLIC_BASE_URL = %q, want https://warranty.example.com", got)
+	}
+}
+
+func TestSoftDeletedGSTCanRegisterAgain(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	sourceID, targetID := p.userID("9876543210"), p.userID("9876543211")
+
+	// Still taken while the account exists
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543219", "company": "Acme Traders", "gst": "27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusConflict)
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/users/merge", p.admin, gin.H{"source_id": sourceID, "target_id": targetID}), http.StatusOK)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	if n := p.count("SELECT COUNT(*) FROM users WHERE gst = ?", "27ABCDE1234F1Z5"); n != 2 {
+		t.Errorf("%d users with the GST, want the deleted one and the new one", n)
+	}
+	if newID := p.userID("9876543210"); newID == sourceID {
+		t.Errorf("lookup by mobile found the soft-deleted user %d", sourceID)
+	}
+}
+
+func TestMigrateUserUniquenessDropsColumnConstraints(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:legacy_users?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, mobile TEXT UNIQUE, gst TEXT UNIQUE, deleted_at DATETIME)")
+	db.Exec("INSERT INTO users (username, mobile, gst, deleted_at) VALUES ('old', '9876543210', '27ABCDE1234F1Z5', CURRENT_TIMESTAMP)")
+
+	migrateUserUniqueness(db)
+	if _, err := db.Exec("INSERT INTO users (username, mobile, gst) VALUES ('new', '9876543210', '27ABCDE1234F1Z5')"); err != nil {
+		t.Fatalf("re-registering a soft-deleted GST: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (username, mobile, gst) VALUES ('again', '9876543211', '27ABCDE1234F1Z5')"); !isUniqueViolation(err) {
+		t.Errorf("duplicate among live users: err = %v, want unique violation", err)
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	id := p.userID("9876543210")
+
+	for _, query := range []string{"mobile=9876543210", "mobile=+%209876543210+", "gst=27ABCDE1234F1Z5"} {
+		w := p.request(http.MethodGet, "/admin/user/lookup?"+query, p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody(t, w)["id"]; got != float64(id) {
+			t.Errorf("lookup %s: id = %v, want %d", query, got, id)
+		}
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/user/lookup?gst=27ZZZZZ9999Z1Z9", p.admin, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, "/admin/user/lookup?mobile=admin", p.admin, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, "/admin/user/lookup", p.admin, nil), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodGet, "/admin/user/lookup?mobile=9876543210&gst=27ABCDE1234F1Z5", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestChunkedUploadResumesMissingChunk(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	chunks := [][]byte{testPDF[:10], testPDF[10:25], testPDF[25:]}
+
+	w := p.request(http.MethodPost, "/upload/init", token, gin.H{"filename": "bill.pdf", "size": len(testPDF), "chunks": len(chunks)})
+	expectStatus(t, w, http.StatusOK)
+	id := decodeBody(t, w)["upload_id"].(string)
+	sendChunk := func(index int) {
+		t.Helper()
+		w := p.upload(fmt.Sprintf("/upload/%s/chunk?index=%d", id, index), token, nil, testFile{"chunk", "chunk", chunks[index]})
+		expectStatus(t, w, http.StatusOK)
+	}
+
+	// The connection drops after the first and last chunks
+	sendChunk(0)
+	sendChunk(2)
+	w = p.request(http.MethodPost, "/upload/"+id+"/complete", token, nil)
+	expectStatus(t, w, http.StatusBadRequest)
+	if missing := fmt.Sprint(decodeBody(t, w)["missing"]); missing != "[1]" {
+		t.Errorf("missing = %s, want [1]", missing)
+	}
+	w = p.request(http.MethodGet, "/upload/"+id, token, nil)
+	expectStatus(t, w, http.StatusOK)
+	if received := fmt.Sprint(decodeBody(t, w)["received"]); received != "[0 2]" {
+		t.Errorf("received = %s, want [0 2]", received)
+	}
+	// Another customer can't see or finish it
+	other := p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.request(http.MethodGet, "/upload/"+id, other, nil), http.StatusNotFound)
+
+	sendChunk(1)
+	w = p.request(http.MethodPost, "/upload/"+id+"/complete", token, nil)
+	expectStatus(t, w, http.StatusOK)
+	billFile := decodeBody(t, w)["bill_file"].(string)
+	data, err := os.ReadFile(filepath.Join(os.Getenv("DATA_DIR"), billFile))
+	if err != nil || !bytes.Equal(data, testPDF) {
+		t.Fatalf("assembled bill = %q (%v), want the original file", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir(), id)); !os.IsNotExist(err) {
+		t.Errorf("chunk directory left behind: %v", err)
+	}
+
+	fields := map[string]string{"serial": "CH1", "product_id": fmt.Sprint(productID), "upload_id": id}
+	expectStatus(t, p.upload("/register-product", token, fields), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'CH1' AND bill_file = ?", billFile); n != 1 {
+		t.Errorf("registration doesn't reference the assembled bill")
+	}
+	// An upload backs one registration only
+	fields["serial"] = "CH2"
+	expectStatus(t, p.upload("/register-product", token, fields), http.StatusBadRequest)
+}
+
+func TestExpireChunkedUploads(t *testing.T) {
+	p := newTestPortal(t)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	w := p.request(http.MethodPost, "/upload/init", token, gin.H{"filename": "bill.pdf", "size": len(testPDF), "chunks": 2})
+	expectStatus(t, w, http.StatusOK)
+	id := decodeBody(t, w)["upload_id"].(string)
+	expectStatus(t, p.upload("/upload/"+id+"/chunk?index=0", token, nil, testFile{"chunk", "chunk", testPDF[:10]}), http.StatusOK)
+
+	expireChunkedUploads(p.db, time.Now().Add(-time.Hour))
+	if n := p.count("SELECT COUNT(*) FROM chunked_uploads"); n != 1 {
+		t.Fatalf("fresh upload expired")
+	}
+	expireChunkedUploads(p.db, time.Now().Add(time.Hour))
+	if n := p.count("SELECT COUNT(*) FROM chunked_uploads"); n != 0 {
+		t.Errorf("%d stale uploads left", n)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir(), id)); !os.IsNotExist(err) {
+		t.Errorf("stale chunks left behind: %v", err)
+	}
+}
+
+func TestListCompanies(t *testing.T) {
+	p := newTestPortal(t)
+	register := func(i int, company string) {
+		t.Helper()
+		w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": fmt.Sprintf("98765432%02d", i), "company": company, "gst": fmt.Sprintf("27ABCDE12%02dF1Z5", i)})
+		expectStatus(t, w, http.StatusOK)
+	}
+	for i := 0; i < 25; i++ {
+		register(i, fmt.Sprintf("Acme %02d Traders", i))
+	}
+	register(30, "Acme 00 Traders Pvt. Ltd.")
+	register(31, "Bharat Solar")
+	register(32, "100% Power")
+	companies := func(q string) []interface{} {
+		t.Helper()
+		w := p.request(http.MethodGet, "/admin/companies?q="+url.QueryEscape(q), p.admin, nil)
+		expectStatus(t, w, http.StatusOK)
+		return decodeBody(t, w)["companies"].([]interface{})
+	}
+
+	got := companies("acme")
+	if len(got) != 20 {
+		t.Fatalf("%d companies for acme, want the cap of 20", len(got))
+	}
+	if got[0] != "Acme 00 Traders" || got[19] != "Acme 19 Traders" {
+		t.Errorf("companies = %v, want Acme 00 to Acme 19 in order, one entry per normalized name", got)
+	}
+	if got := companies("BHARAT"); len(got) != 1 || got[0] != "Bharat Solar" {
+		t.Errorf("companies for BHARAT = %v", got)
+	}
+	// LIKE wildcards in the prefix match only themselves
+	if got := companies("%"); len(got) != 0 {
+		t.Errorf("companies for %% = %v, want none", got)
+	}
+	if got := companies("100%"); len(got) != 1 {
+		t.Errorf("companies for 100%% = %v, want 100%% Power", got)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("SESSION_IDLE_MINUTES", "30")
+	idle := p.customer("9876543210", "27ABCDE1234F1Z5")
+	recent := p.customer("9876543211", "27ABCDE1234F1Z6")
+	p.db.Exec("UPDATE users SET token_last_used_at = ? WHERE token = ?", time.Now().Add(-31*time.Minute), idle)
+	p.db.Exec("UPDATE users SET token_last_used_at = ? WHERE token = ?", time.Now().Add(-29*time.Minute), recent)
+
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", idle, nil), http.StatusUnauthorized)
+	expectStatus(t, p.request(http.MethodGet, "/auth/check", idle, nil), http.StatusUnauthorized)
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", recent, nil), http.StatusOK)
+
+	// Using the session restarts the idle clock
+	var lastUsed time.Time
+	p.db.QueryRow("SELECT token_last_used_at FROM users WHERE token = ?", recent).Scan(&lastUsed)
+	if time.Since(lastUsed) > time.Minute {
+		t.Errorf("token_last_used_at = %v, want updated by the request", lastUsed)
+	}
+	// Logging in again gives a fresh session
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", p.login("9876543210", ""), nil), http.StatusOK)
+
+	t.Setenv("SESSION_IDLE_MINUTES", "0")
+	p.db.Exec("UPDATE users SET token_last_used_at = ? WHERE token = ?", time.Now().Add(-24*time.Hour), recent)
+	expectStatus(t, p.request(http.MethodGet, "/my-registrations", recent, nil), http.StatusOK)
+}
+
+func TestAdminDashboardCounts(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	p.product("Retired", gin.H{"active": 0})
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(token, productID, "D1,D2,D3,D4,D5,D6,D7"), http.StatusOK)
+	for serial, status := range map[string]string{"D2": "needs_info", "D3": "approved", "D4": "approved", "D5": "approved", "D6": "rejected"} {
+		p.db.Exec("UPDATE registrations SET status = ? WHERE serial = ?", status, serial)
+	}
+
+	w := p.request(http.MethodGet, "/admin/dashboard", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	want := map[string]int{
+		"total_users":         p.count("SELECT COUNT(*) FROM users"),
+		"total_registrations": 7,
+		"pending_approvals":   2,
+		"needs_info":          1,
+		"approved":            3,
+		"rejected":            1,
+		"total_products":      2,
+		"active_products":     1,
+		"inactive_products":   1,
+	}
+	for key, n := range want {
+		if body[key] != float64(n) {
+			t.Errorf("%s = %v, want %d", key, body[key], n)
+		}
+	}
+}
+
+func TestImportProductSerials(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"serial_pattern": "^INV[0-9]{4}$"})
+	p.db.Exec("INSERT INTO product_serials (product_id, serial, created_at) VALUES (?, 'INV0001', CURRENT_TIMESTAMP)", productID)
+	path := fmt.Sprintf("/admin/product/%d/serials/import", productID)
+	csvFile := []byte("batch,Serial Number\nB1,inv0001\nB1,INV0002\nB1, INV0002\nB2,INV0003\nB2,BAD-1\nB2,INV12\nB3,\n")
+
+	w := p.upload(path, p.admin, nil, testFile{"file", "serials.csv", csvFile})
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	want := map[string]float64{"added": 2, "already_present": 1, "duplicates": 1, "invalid": 2}
+	for key, n := range want {
+		if body[key] != n {
+			t.Errorf("%s = %v, want %v", key, body[key], n)
+		}
+	}
+	if invalid := fmt.Sprint(body["invalid_serials"]); invalid != "[BAD-1 INV12]" {
+		t.Errorf("invalid_serials = %s, want [BAD-1 INV12]", invalid)
+	}
+	if n := p.count("SELECT COUNT(*) FROM product_serials WHERE product_id = ?", productID); n != 3 {
+		t.Errorf("%d serials in the registry, want 3", n)
+	}
+
+	// Importing again adds nothing
+	w = p.upload(path, p.admin, nil, testFile{"file", "serials.csv", csvFile})
+	expectStatus(t, w, http.StatusOK)
+	if added := decodeBody(t, w)["added"]; added != float64(0) {
+		t.Errorf("second import added %v", added)
+	}
+	expectStatus(t, p.upload("/admin/product/999/serials/import", p.admin, nil, testFile{"file", "serials.csv", csvFile}), http.StatusNotFound)
+	expectStatus(t, p.upload(path, p.admin, nil), http.StatusBadRequest)
+}
+
+func TestAutoApproveKnownSerials(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	p.db.Exec("INSERT INTO product_serials (product_id, serial, created_at) VALUES (?, 'KNOWN1', CURRENT_TIMESTAMP), (?, 'KNOWN2', CURRENT_TIMESTAMP)", productID, productID)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	status := func(serial string) string {
+		var s string
+		p.db.QueryRow("SELECT status FROM registrations WHERE serial = ?", serial).Scan(&s)
+		return s
+	}
+
+	// Off unless AUTO_APPROVE=true
+	expectStatus(t, p.registerProduct(token, productID, "KNOWN1"), http.StatusOK)
+	if got := status("KNOWN1"); got != "pending" {
+		t.Errorf("KNOWN1 status = %s without AUTO_APPROVE, want pending", got)
+	}
+
+	t.Setenv("AUTO_APPROVE", "true")
+	w := p.registerProduct(token, productID, "KNOWN2,UNKNOWN1")
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	if body["status"] != "pending" || fmt.Sprint(body["auto_approved_serials"]) != "[KNOWN2]" {
+		t.Errorf("response status=%v auto_approved_serials=%v, want pending and [KNOWN2]", body["status"], body["auto_approved_serials"])
+	}
+	if got := status("KNOWN2"); got != "approved" {
+		t.Errorf("KNOWN2 status = %s, want approved", got)
+	}
+	if got := status("UNKNOWN1"); got != "pending" {
+		t.Errorf("UNKNOWN1 status = %s, want pending", got)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE event = 'auto_approved' AND registration_id = ?", p.registrationID("KNOWN2")); n != 1 {
+		t.Errorf("%d auto_approved history entries for KNOWN2, want 1", n)
+	}
+	// A bill that fails validation is refused before any rule runs
+	fields := map[string]string{"serial": "KNOWN3", "product_id": fmt.Sprint(productID)}
+	p.db.Exec("INSERT INTO product_serials (product_id, serial, created_at) VALUES (?, 'KNOWN3', CURRENT_TIMESTAMP)", productID)
+	expectStatus(t, p.upload("/register-product", token, fields, testFile{"bill", "bill.exe", testPDF}), http.StatusBadRequest)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'KNOWN3'"); n != 0 {
+		t.Errorf("KNOWN3 registered with an invalid bill")
+	}
+}
+
+func TestConcurrentExportsLimited(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	r := gin.New()
+	r.Use(gin.Recovery())
+	slots := limitConcurrentExports(1)
+	r.GET("/slow", slots, func(c *gin.Context) {
+		entered <- struct{}{}
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/broken", slots, func(c *gin.Context) {
+		panic("export failed")
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- get("/slow") }()
+	<-entered
+	w := get("/slow")
+	expectStatus(t, w, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("429 without Retry-After")
+	}
+	close(release)
+	expectStatus(t, <-first, http.StatusOK)
+
+	// A failing export gives its slot back
+	expectStatus(t, get("/broken"), http.StatusInternalServerError)
+	go func() { <-entered }()
+	expectStatus(t, get("/slow"), http.StatusOK)
+}
+
+func TestAuthCheck(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("SESSION_IDLE_MINUTES", "30")
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	stale := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	p.db.Exec("UPDATE users SET token_last_used_at = ? WHERE token = ?", stale, token)
+
+	w := p.request(http.MethodGet, "/auth/check", token, nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	if body["valid"] != true || body["role"] != roleCustomer {
+		t.Errorf("check = %v, want valid CUSTOMER", body)
+	}
+	// Checking isn't session activity
+	var lastUsed time.Time
+	p.db.QueryRow("SELECT token_last_used_at FROM users WHERE token = ?", token).Scan(&lastUsed)
+	if !lastUsed.Equal(stale) {
+		t.Errorf("token_last_used_at moved to %v by /auth/check", lastUsed)
+	}
+
+	p.db.Exec("UPDATE users SET token_last_used_at = ? WHERE token = ?", time.Now().Add(-time.Hour), token)
+	for name, tok := range map[string]string{"expired": token, "unknown": "not-a-token", "missing": ""} {
+		w := p.request(http.MethodGet, "/auth/check", tok, nil)
+		expectStatus(t, w, http.StatusUnauthorized)
+		if body := decodeBody(t, w); body["valid"] != false {
+			t.Errorf("%s token: check = %v, want valid false", name, body)
+		}
+	}
+}
+
+func TestRegistrationWithSeveralFiles(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	warranty := []byte("\x89PNG\r\n\x1a\nwarranty card")
+	fields := map[string]string{"serial": "MF1", "product_id": fmt.Sprint(productID)}
+	w := p.upload("/register-product", token, fields, testFile{"bill", "invoice.pdf", testPDF}, testFile{"warranty", "card.png", warranty})
+	expectStatus(t, w, http.StatusOK)
+	id := p.registrationID("MF1")
+	if kinds := fmt.Sprint(registrationFilePaths(p.db, id, "warranty")); !strings.Contains(kinds, ".png") {
+		t.Errorf("warranty files = %s, want the card", kinds)
+	}
+
+	entries := readZip(t, p.request(http.MethodGet, "/admin/export/bills", p.admin, nil))
+	var gotBill, gotWarranty bool
+	for name, data := range entries {
+		gotBill = gotBill || bytes.Equal(data, testPDF)
+		gotWarranty = gotWarranty || bytes.Equal(data, warranty)
+		if !strings.Contains(name, "MF1") {
+			t.Errorf("entry %s doesn't name the serial", name)
+		}
+	}
+	if len(entries) != 2 || !gotBill || !gotWarranty {
+		t.Errorf("export has %d entries (bill %v, warranty %v), want both files", len(entries), gotBill, gotWarranty)
+	}
+
+	// Deleting the bill removes every file of the registration
+	w = p.request(http.MethodDelete, fmt.Sprintf("/admin/registration/%d/bill", id), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if files := decodeBody(t, w)["files"]; files != float64(2) {
+		t.Errorf("deleted %v files, want 2", files)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE registration_id = ?", id); n != 0 {
+		t.Errorf("%d file records left after deleting the bill", n)
+	}
+
+	six := make([]testFile, 6)
+	for i := range six {
+		six[i] = testFile{"other", fmt.Sprintf("doc%d.pdf", i), testPDF}
+	}
+	fields["serial"] = "MF2"
+	expectStatus(t, p.upload("/register-product", token, fields, append(six, testFile{"bill", "bill.pdf", testPDF})...), http.StatusBadRequest)
+}
+
+func TestRegistrationBodyLimitCoversEveryFile(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("MAX_UPLOAD_MB", "1")
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	big := append(append([]byte{}, testPDF...), bytes.Repeat([]byte{' '}, 900*1024)...)
+	fields := map[string]string{"serial": "BIG1", "product_id": fmt.Sprint(productID)}
+
+	// Three files near the per-file limit fit together
+	w := p.upload("/register-product", token, fields, testFile{"bill", "a.pdf", big}, testFile{"warranty", "b.pdf", big}, testFile{"other", "c.pdf", big})
+	expectStatus(t, w, http.StatusOK)
+
+	// A form past the total limit is reported as too large, also when streamed without a length
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("serial", "BIG2")
+	writer.WriteField("product_id", fmt.Sprint(productID))
+	part, _ := writer.CreateFormFile("bill", "huge.pdf")
+	part.Write(bytes.Repeat(big, 7))
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/register-product", io.NopCloser(&body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	expectStatus(t, p.serve(req), http.StatusRequestEntityTooLarge)
+}
+
+func TestAllowedGSTStates(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("ALLOWED_GST_STATES", "27, 9")
+	register := func(mobile, gst string) *httptest.ResponseRecorder {
+		return p.request(http.MethodPost, "/register", "", gin.H{"mobile": mobile, "company": "Acme Traders", "gst": gst})
+	}
+
+	expectStatus(t, register("9876543210", "27ABCDE1234F1Z5"), http.StatusOK)
+	expectStatus(t, register("9876543211", "09ABCDE1234F1Z5"), http.StatusOK)
+	w := register("9876543212", "29ABCDE1234F1Z5")
+	rejectedField(t, w, "gst")
+	if msg := fmt.Sprint(decodeBody(t, w)["error"]); !strings.Contains(msg, "29") || !strings.Contains(msg, "27, 09") {
+		t.Errorf("blocked state message = %q, want the state and the allowed list", msg)
+	}
+	// Admin-created users are held to the same list
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, gin.H{"username": "dealer", "mobile": "9876543213", "company": "Acme", "gst": "29ABCDE1234F1Z6", "role": roleCustomer, "active": 1}), http.StatusBadRequest)
+
+	t.Setenv("ALLOWED_GST_STATES", "")
+	expectStatus(t, register("9876543212", "29ABCDE1234F1Z5"), http.StatusOK)
+}
+
+func TestDatabaseIntegrity(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "IC1,IC2"), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/db/integrity", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decodeBody(t, w)
+	if body["healthy"] != true || fmt.Sprint(body["integrity_check"]) != "[ok]" || body["orphaned_count"] != float64(0) {
+		t.Fatalf("clean database reported as %v", body)
+	}
+
+	// Older databases without enforced foreign keys can hold orphans
+	conn, err := p.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.ExecContext(context.Background(), "PRAGMA foreign_keys = OFF")
+	if _, err := conn.ExecContext(context.Background(), "UPDATE registrations SET product_id = 999 WHERE serial = 'IC2'"); err != nil {
+		t.Fatal(err)
+	}
+	conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+	conn.Close()
+
+	w = p.request(http.MethodGet, "/admin/db/integrity", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	body = decodeBody(t, w)
+	if body["healthy"] != false || body["orphaned_count"] != float64(1) {
+		t.Fatalf("orphan not reported: %v", body)
+	}
+	orphan := body["orphaned_registrations"].([]interface{})[0].(map[string]interface{})
+	if orphan["serial"] != "IC2" || fmt.Sprint(orphan["missing"]) != "[product]" {
+		t.Errorf("orphan = %v, want IC2 missing its product", orphan)
+	}
+	if violations := body["foreign_key_violations"].([]interface{}); len(violations) != 1 {
+		t.Errorf("foreign_key_violations = %v, want the registration", violations)
+	}
+}
+
+func TestForeignKeysGuardDeletes(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "FK1"), http.StatusOK)
+	userID := p.userID("9876543210")
+
+	// Registrations keep their user and product
+	expectStatus(t, p.request(http.MethodDelete, fmt.Sprintf("/admin/user/%d", userID), p.admin, nil), http.StatusConflict)
+	expectStatus(t, p.request(http.MethodDelete, fmt.Sprintf("/admin/product/%d", productID), p.admin, nil), http.StatusConflict)
+	if _, err := p.db.Exec("INSERT INTO registrations (user_id, product_id, serial, status) VALUES (?, 999, 'FK2', 'pending')", userID); !isForeignKeyViolation(err) {
+		t.Errorf("registration for a missing product: err = %v, want foreign key violation", err)
+	}
+
+	// Files go with their registration, registry serials with their product
+	id := p.registrationID("FK1")
+	if _, err := p.db.Exec("DELETE FROM registrations WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE registration_id = ?", id); n != 0 {
+		t.Errorf("%d files outlived their registration", n)
+	}
+	p.db.Exec("INSERT INTO product_serials (product_id, serial, created_at) VALUES (?, 'FK1', CURRENT_TIMESTAMP)", productID)
+	expectStatus(t, p.request(http.MethodDelete, fmt.Sprintf("/admin/product/%d", productID), p.admin, nil), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM product_serials WHERE product_id = ?", productID); n != 0 {
+		t.Errorf("%d registry serials outlived their product", n)
+	}
+	expectStatus(t, p.request(http.MethodDelete, fmt.Sprintf("/admin/user/%d", userID), p.admin, nil), http.StatusOK)
+}
+
+func TestMigrateForeignKeysKeepsRows(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:legacy_fk?mode=memory&cache=shared&_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")
+	db.Exec("CREATE TABLE products (id INTEGER PRIMARY KEY)")
+	db.Exec("CREATE TABLE registrations (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, product_id INTEGER, serial TEXT)")
+	db.Exec("CREATE TABLE registration_files (id INTEGER PRIMARY KEY AUTOINCREMENT, registration_id INTEGER, path TEXT)")
+	db.Exec("CREATE TABLE product_serials (id INTEGER PRIMARY KEY AUTOINCREMENT, product_id INTEGER, serial TEXT)")
+	db.Exec("INSERT INTO users (id) VALUES (1)")
+	db.Exec("INSERT INTO products (id) VALUES (1)")
+	db.Exec("INSERT INTO registrations (user_id, product_id, serial) VALUES (1, 1, 'OK'), (1, 7, 'ORPHAN')")
+
+	migrateForeignKeys(db)
+	var schema string
+	db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'registrations'").Scan(&schema)
+	if !strings.Contains(schema, "REFERENCES products(id) ON DELETE RESTRICT") {
+		t.Errorf("registrations schema = %s, want foreign keys", schema)
+	}
+	var rows, orphans int
+	db.QueryRow("SELECT COUNT(*) FROM registrations").Scan(&rows)
+	db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check('registrations')").Scan(&orphans)
+	if rows != 2 || orphans != 1 {
+		t.Errorf("%d rows and %d orphans after migration, want 2 and 1", rows, orphans)
+	}
+	if _, err := db.Exec("DELETE FROM users WHERE id = 1"); !isForeignKeyViolation(err) {
+		t.Errorf("deleting a user with registrations: err = %v, want foreign key violation", err)
+	}
+}
+
+// Registering ten serials at a time, with and without foreign key checks
+func BenchmarkRegisterForeignKeys(b *testing.B) {
+	for _, fk := range []string{"on", "off"} {
+		b.Run("foreign_keys="+fk, func(b *testing.B) {
+			name := fmt.Sprintf("portal_bench_%d", atomic.AddInt64(&testDatabases, 1))
+			p := startTestPortal(b, fmt.Sprintf("file:%s?mode=memory&cache=shared&_foreign_keys=%s&_busy_timeout=5000&_txlock=immediate", name, fk))
+			productID := p.product("Inverter", nil)
+			token := p.customer("9876543210", "27ABCDE1234F1Z5")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				serials := make([]string, 10)
+				for j := range serials {
+					serials[j] = fmt.Sprintf("B%d-%d", i, j)
+				}
+				expectStatus(b, p.registerProduct(token, productID, strings.Join(serials, ",")), http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestMonthlyReportOnDemand(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("REPORT_RECIPIENTS", "md@example.com, sales@example.com")
+	sender := &fakeSender{}
+	q := startNotificationQueue(p.db, sender)
+	p.router = setupRouter(p.db, p.db, q, newEventBroker(), nil)
+	inverter := p.product("Inverter", nil)
+	battery := p.product("Battery", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(token, inverter, "M1,M2,M3"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, battery, "M4,J1"), http.StatusOK)
+	p.backdate("M1", "approved", "2025-05-01 00:00:00")
+	p.backdate("M2", "rejected", "2025-05-15 10:00:00")
+	p.backdate("M3", "pending", "2025-05-31 23:59:59")
+	p.backdate("M4", "approved", "2025-05-20 09:00:00")
+	p.backdate("J1", "pending", "2025-06-01 00:00:00")
+	p.db.Exec("UPDATE users SET created_at = '2025-05-03 12:00:00' WHERE mobile = '9876543210'")
+
+	w := p.request(http.MethodPost, "/admin/reports/monthly?month=2025-05", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	var body struct {
+		Report    monthlyReport `json:"report"`
+		EmailedTo []string      `json:"emailed_to"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	r := body.Report
+	if r.Month != "2025-05" || r.TotalRegistrations != 4 || r.Pending != 1 || r.Approved != 2 || r.Rejected != 1 || r.NewUsers != 1 {
+		t.Errorf("report = %+v, want 4 registrations (1 pending, 2 approved, 1 rejected) and 1 new user", r)
+	}
+	if len(r.TopProducts) != 2 || r.TopProducts[0].Name != "Inverter" || r.TopProducts[0].Registrations != 3 || r.TopProducts[1].Registrations != 1 {
+		t.Errorf("top products = %+v, want Inverter 3 then Battery 1", r.TopProducts)
+	}
+	if fmt.Sprint(body.EmailedTo) != "[md@example.com sales@example.com]" {
+		t.Errorf("emailed_to = %v", body.EmailedTo)
+	}
+	eventually(t, "report emails", func() bool { return sender.sentCount() == 2 })
+	var message string
+	p.db.QueryRow("SELECT message FROM notification_jobs WHERE recipient = 'md@example.com'").Scan(&message)
+	if !strings.Contains(message, "Registrations: 4 (pending 1") || !strings.Contains(message, "1. Inverter - 3") {
+		t.Errorf("report email = %q", message)
+	}
+
+	w = p.request(http.MethodPost, "/admin/reports/monthly?month=2025-05&format=csv", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if rows := readCSV(t, w); len(rows) != 5 {
+		t.Errorf("CSV has %d rows, want a header and 4 registrations", len(rows))
+	}
+	expectStatus(t, p.request(http.MethodPost, "/admin/reports/monthly?month=May", p.admin, nil), http.StatusBadRequest)
+}
+
+func TestActiveProductsCached(t *testing.T) {
+	p := newTestPortal(t)
+	p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	names := func() string {
+		t.Helper()
+		w := p.request(http.MethodGet, "/customer/active-products", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		list := []string{}
+		for _, product := range decodeList(t, w) {
+			list = append(list, fmt.Sprint(product["name"]))
+		}
+		return strings.Join(list, ",")
+	}
+
+	if got := names(); got != "Inverter" {
+		t.Fatalf("products = %s", got)
+	}
+	// A change behind the handlers' back isn't seen while the page is cached
+	p.db.Exec("INSERT INTO products (name, description, active) VALUES ('Battery', '', 1)")
+	if got := names(); got != "Inverter" {
+		t.Errorf("second call = %s, want the cached Inverter", got)
+	}
+	// Creating or deleting a product through the API drops the cache
+	id := p.product("Panel", nil)
+	if got := names(); got != "Inverter,Battery,Panel" {
+		t.Errorf("after upsert = %s, want all three", got)
+	}
+	expectStatus(t, p.request(http.MethodDelete, fmt.Sprintf("/admin/product/%d", id), p.admin, nil), http.StatusOK)
+	if got := names(); got != "Inverter,Battery" {
+		t.Errorf("after delete = %s", got)
+	}
+
+	t.Setenv("PRODUCTS_CACHE_SECONDS", "0")
+	activeProductsCache.invalidate()
+	names()
+	p.db.Exec("UPDATE products SET active = 0 WHERE name = 'Battery'")
+	if got := names(); got != "Inverter" {
+		t.Errorf("with caching off = %s, want Inverter", got)
+	}
+}
+
+func TestExportPendingWorklist(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "PW1,PW2,PW3,PW4"), http.StatusOK)
+	p.backdate("PW1", "pending", "2025-03-02 10:00:00")
+	p.backdate("PW2", "approved", "2025-03-01 10:00:00")
+	p.backdate("PW3", "pending", "2025-03-01 09:00:00")
+	p.backdate("PW4", "needs_info", "2025-03-01 08:00:00")
+
+	for _, path := range []string{"/admin/export/pending.csv", "/admin/export/pending.csv/" + adminPassword()} {
+		token := p.admin
+		if strings.Contains(path, "csv/") {
+			token = ""
+		}
+		rows := readCSV(t, p.request(http.MethodGet, path, token, nil))
+		if len(rows) != 3 || rows[1][4] != "PW3" || rows[2][4] != "PW1" {
+			t.Fatalf("%s rows = %v, want PW3 then PW1", path, rows)
+		}
+		if rows[1][1] != "Acme Traders" || rows[1][2] != "9876543210" || !strings.HasPrefix(rows[1][6], "http://example.com/bills/") {
+			t.Errorf("row = %v, want company, mobile and an absolute bill URL", rows[1])
+		}
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/pending.csv/wrong", "", nil), http.StatusUnauthorized)
+}
+
+func TestValidatePasswordStrength(t *testing.T) {
+	cases := []struct {
+		password, role string
+		problems       int
+	}{
+		{"Sunrise#2024", roleAdmin, 0},
+		{"sunrise2024", roleStaff, 1},
+		{"Ab1!", roleAdmin, 1},
+		{"abc", roleStaff, 2},
+		{"sunrise", roleCustomer, 0},
+		{"sun", roleCustomer, 1},
+	}
+	for _, tc := range cases {
+		if got := validatePasswordStrength(tc.password, tc.role); len(got) != tc.problems {
+			t.Errorf("validatePasswordStrength(%q, %s) = %v, want %d problems", tc.password, tc.role, got, tc.problems)
+		}
+	}
+	t.Setenv("PASSWORD_MIN_CLASSES", "2")
+	if got := validatePasswordStrength("sunrise2024", roleStaff); len(got) != 0 {
+		t.Errorf("with PASSWORD_MIN_CLASSES=2: %v", got)
+	}
+}
+
+func TestUpsertUserPasswordStrength(t *testing.T) {
+	p := newTestPortal(t)
+	staff := gin.H{"username": "reviewer", "mobile": "9000000001", "role": roleStaff, "active": 1, "password": "password"}
+	w := p.request(http.MethodPost, "/admin/user", p.admin, staff)
+	rejectedField(t, w, "password")
+	if problems := decodeBody(t, w)["problems"].([]interface{}); len(problems) != 1 {
+		t.Errorf("problems = %v, want the character classes", problems)
+	}
+	staff["password"] = "Review#2024"
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, staff), http.StatusOK)
+
+	customer := gin.H{"username": "dealer", "mobile": "9876543210", "company": "Acme", "gst": "27ABCDE1234F1Z5", "role": roleCustomer, "active": 1, "password": "abc"}
+	rejectedField(t, p.request(http.MethodPost, "/admin/user", p.admin, customer), "password")
+	customer["password"] = "dealer"
+	expectStatus(t, p.request(http.MethodPost, "/admin/user", p.admin, customer), http.StatusOK)
+}
+
+func TestPagingHeadersOnMiddlePage(t *testing.T) {
+	p := newTestPortal(t)
+	for i := 1; i <= 5; i++ {
+		p.product(fmt.Sprintf("Product %d", i), nil)
+	}
+
+	w := p.request(http.MethodGet, "/admin/products?limit=2&page=2&sort=name", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-Total-Count"); got != "5" {
+		t.Errorf("X-Total-Count = %q, want 5", got)
+	}
+	want := `<http://example.com/admin/products?limit=2&page=3&sort=name>; rel="next", ` +
+		`<http://example.com/admin/products?limit=2&page=1&sort=name>; rel="prev", ` +
+		`<http://example.com/admin/products?limit=2&page=3&sort=name>; rel="last"`
+	if got := w.Header().Get("Link"); got != want {
+		t.Errorf("Link = %s\nwant %s", got, want)
+	}
+	if list := decodeList(t, w); len(list) != 2 || list[0]["name"] != "Product 3" {
+		t.Errorf("body = %v, want Product 3 and 4", list)
+	}
+
+	// The last page has no next
+	w = p.request(http.MethodGet, "/admin/products?limit=2&page=3", p.admin, nil)
+	if link := w.Header().Get("Link"); strings.Contains(link, `rel="next"`) || !strings.Contains(link, `page=2>; rel="prev"`) {
+		t.Errorf("last page Link = %s", link)
+	}
+}
+
+func TestDuplicateBillFlagged(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	first := p.customer("9876543210", "27ABCDE1234F1Z5")
+	second := p.customer("9876543211", "27ABCDE1234F1Z6")
+	duplicate := func(serial string) interface{} {
+		for _, reg := range decodeList(t, p.request(http.MethodGet, "/admin/registrations", p.admin, nil)) {
+			if reg["serial"] == serial {
+				return reg["duplicate_bill"]
+			}
+		}
+		t.Fatalf("%s not listed", serial)
+		return nil
+	}
+
+	expectStatus(t, p.registerProduct(first, productID, "DB1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(second, productID, "DB2"), http.StatusOK)
+	other := append([]byte{}, testPDF...)
+	other = append(other, "% another invoice\n"...)
+	fields := map[string]string{"serial": "DB3", "product_id": fmt.Sprint(productID)}
+	expectStatus(t, p.upload("/register-product", second, fields, testFile{"bill", "other.pdf", other}), http.StatusOK)
+
+	if got := duplicate("DB1"); got != false {
+		t.Errorf("DB1 duplicate_bill = %v, want false", got)
+	}
+	if got := duplicate("DB2"); got != true {
+		t.Errorf("DB2 duplicate_bill = %v, want true for a reused bill", got)
+	}
+	if got := duplicate("DB3"); got != false {
+		t.Errorf("DB3 duplicate_bill = %v, want false for a different bill", got)
+	}
+}
+
+func TestBackfillBillHashes(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "OLD1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "OLD2"), http.StatusOK)
+	// Bills from before hashes were recorded, one of them since lost
+	p.db.Exec("UPDATE registration_files SET sha256 = NULL")
+	var lost string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'OLD2'").Scan(&lost)
+	os.Remove(filepath.Join(os.Getenv("DATA_DIR"), lost))
+
+	if n := backfillBillHashes(p.db); n != 1 {
+		t.Errorf("backfillBillHashes hashed %d bills, want 1", n)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE sha256 IS NULL"); n != 0 {
+		t.Errorf("%d bills left unhashed, want the lost one marked too", n)
+	}
+	if n := backfillBillHashes(p.db); n != 0 {
+		t.Errorf("second backfill hashed %d bills, want none", n)
+	}
+
+	expectStatus(t, p.registerProduct(token, productID, "NEW1"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'NEW1' AND duplicate_bill = 1"); n != 1 {
+		t.Errorf("bill matching an older one wasn't flagged")
+	}
+}
+
+func TestListProductRegistrations(t *testing.T) {
+	p := newTestPortal(t)
+	inverter := p.product("Inverter", nil)
+	battery := p.product("Battery", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, inverter, "PR1,PR2,PR3"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, battery, "PR4"), http.StatusOK)
+	p.backdate("PR2", "approved", "2025-01-10 10:00:00")
+	serials := func(list []map[string]interface{}) string {
+		names := []string{}
+		for _, reg := range list {
+			names = append(names, fmt.Sprint(reg["serial"]))
+		}
+		return strings.Join(names, ",")
+	}
+
+	w := p.request(http.MethodGet, fmt.Sprintf("/admin/product/%d/registrations", inverter), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := serials(decodeList(t, w)); got != "PR1,PR2,PR3" {
+		t.Errorf("registrations = %s, want the inverter's three", got)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %s, want 3", got)
+	}
+	w = p.request(http.MethodGet, fmt.Sprintf("/admin/product/%d/registrations?status=pending&limit=1&page=2", inverter), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := serials(decodeList(t, w)); got != "PR3" {
+		t.Errorf("second pending page = %s, want PR3", got)
+	}
+	w = p.request(http.MethodGet, fmt.Sprintf("/admin/product/%d/registrations?to=2025-01-31", inverter), p.admin, nil)
+	if got := serials(decodeList(t, w)); got != "PR2" {
+		t.Errorf("registrations up to January = %s, want PR2", got)
+	}
+
+	expectStatus(t, p.request(http.MethodGet, "/admin/product/999/registrations", p.admin, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, fmt.Sprintf("/admin/product/%d/registrations?status=lost", inverter), p.admin, nil), http.StatusBadRequest)
+}
+
+func TestEmailVerification(t *testing.T) {
+	p := newTestPortal(t)
+	q := startNotificationQueue(p.db, &fakeSender{})
+	p.router = setupRouter(p.db, p.db, q, newEventBroker(), nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	userID := p.userID("9876543210")
+	request := func(token, email string) *httptest.ResponseRecorder {
+		return p.request(http.MethodPost, "/customer/email/verify/request", token, gin.H{"email": email})
+	}
+	linkToken := func(email string) string {
+		t.Helper()
+		var message string
+		p.db.QueryRow("SELECT message FROM notification_jobs WHERE recipient = ? ORDER BY id DESC LIMIT 1", email).Scan(&message)
+		link := strings.Fields(strings.TrimPrefix(message, emailVerifyMessagePrefix))[0]
+		return link[strings.LastIndex(link, "/")+1:]
+	}
+
+	// Only for a signed-in account, and one link per address at a time
+	expectStatus(t, request("", "buyer@example.com"), http.StatusUnauthorized)
+	expectStatus(t, request("not-a-token", "buyer@example.com"), http.StatusUnauthorized)
+	expectStatus(t, request(token, "Buyer@Example.com"), http.StatusOK)
+	expectStatus(t, request(token, "buyer@example.com"), http.StatusTooManyRequests)
+	other := p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, request(other, "buyer@example.com"), http.StatusTooManyRequests)
+
+	link := linkToken("buyer@example.com")
+	tampered := link[:len(link)-2] + "xx"
+	expectStatus(t, p.request(http.MethodGet, "/customer/email/verify/"+tampered, "", nil), http.StatusBadRequest)
+	expired := signEmailVerification(userID, "buyer@example.com", time.Now().Add(-time.Minute))
+	w := p.request(http.MethodGet, "/customer/email/verify/"+expired, "", nil)
+	expectStatus(t, w, http.StatusBadRequest)
+	if msg := decodeBody(t, w)["error"]; msg != "Verification link has expired" {
+		t.Errorf("expired link error = %v", msg)
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE id = ? AND email_verified = 1", userID); n != 0 {
+		t.Fatalf("email verified by a bad link")
+	}
+
+	expectStatus(t, p.request(http.MethodGet, "/customer/email/verify/"+link, "", nil), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE id = ? AND email = 'buyer@example.com' AND email_verified = 1", userID); n != 1 {
+		t.Errorf("email not verified by its link")
+	}
+	w = request(token, "")
+	expectStatus(t, w, http.StatusOK)
+	if status := decodeBody(t, w)["status"]; status != "already_verified" {
+		t.Errorf("status = %v, want already_verified", status)
+	}
+
+	// Changing the email unverifies it, and the old link no longer works
+	t.Setenv("EMAIL_VERIFY_RESEND_MINUTES", "0")
+	expectStatus(t, request(token, "owner@example.com"), http.StatusOK)
+	expectStatus(t, p.request(http.MethodGet, "/customer/email/verify/"+link, "", nil), http.StatusBadRequest)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE id = ? AND email_verified = 0", userID); n != 1 {
+		t.Errorf("new email counted as verified")
+	}
+}
+
+func TestDailyRegistrationQuota(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("DAILY_REGISTRATION_QUOTA", "3")
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	expectStatus(t, p.registerProduct(token, productID, "Q1,Q2"), http.StatusOK)
+	// Serials count, not requests
+	w := p.registerProduct(token, productID, "Q3,Q4")
+	expectStatus(t, w, http.StatusTooManyRequests)
+	body := decodeBody(t, w)
+	if body["quota"] != float64(3) || body["used"] != float64(2) || body["requested"] != float64(2) {
+		t.Errorf("429 body = %v, want quota 3, used 2, requested 2", body)
+	}
+	expectStatus(t, p.registerProduct(token, productID, "Q3"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "Q4"), http.StatusTooManyRequests)
+
+	// Admins are exempt
+	expectStatus(t, p.registerProduct(p.admin, productID, "A1,A2,A3,A4"), http.StatusOK)
+
+	// A new day starts a fresh count
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02 15:04:05")
+	for _, serial := range []string{"Q1", "Q2", "Q3"} {
+		p.backdate(serial, "pending", yesterday)
+	}
+	expectStatus(t, p.registerProduct(token, productID, "Q4,Q5,Q6"), http.StatusOK)
+}
+
+func TestBillIntegrityRepair(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	fields := map[string]string{"serial": "BI1", "product_id": fmt.Sprint(productID)}
+	expectStatus(t, p.upload("/register-product", token, fields, testFile{"bill", "a.pdf", testPDF}, testFile{"bill", "b.pdf", testPDF}), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "BI2"), http.StatusOK)
+	var lost, kept string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'BI1'").Scan(&lost)
+	p.db.QueryRow("SELECT path FROM registration_files WHERE registration_id = ? AND path != ?", p.registrationID("BI1"), lost).Scan(&kept)
+	os.Remove(filepath.Join(os.Getenv("DATA_DIR"), lost))
+
+	w := p.request(http.MethodGet, "/admin/maintenance/bill-integrity", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeBody(t, w); body["missing_count"] != float64(1) || body["registrations"] != float64(1) {
+		t.Fatalf("integrity = %v, want one missing file", body)
+	}
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/maintenance/bill-integrity?dry_run=true", p.admin, nil), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registration_files WHERE path = ?", lost); n != 1 {
+		t.Fatalf("dry run removed the reference")
+	}
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/maintenance/bill-integrity", p.admin, nil), http.StatusOK)
+	var billFile string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'BI1'").Scan(&billFile)
+	if billFile != kept {
+		t.Errorf("bill_file = %q, want the remaining bill %q", billFile, kept)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE event = 'bill_missing_cleared'"); n != 1 {
+		t.Errorf("%d bill_missing_cleared events, want 1", n)
+	}
+	w = p.request(http.MethodGet, "/admin/maintenance/bill-integrity", p.admin, nil)
+	if body := decodeBody(t, w); body["missing_count"] != float64(0) {
+		t.Errorf("still missing after repair: %v", body)
+	}
+}
+
+func TestClearMissingBillsIsAllOrNothing(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "CM1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "CM2"), http.StatusOK)
+	os.RemoveAll(filepath.Join(os.Getenv("DATA_DIR"), "bills"))
+	missing, err := findMissingBills(p.db)
+	if err != nil || len(missing) != 2 {
+		t.Fatalf("findMissingBills = %v, %v", missing, err)
+	}
+	p.db.Exec(fmt.Sprintf("CREATE TRIGGER fail_clear BEFORE UPDATE OF bill_file ON registrations WHEN NEW.id = %d BEGIN SELECT RAISE(ABORT, 'disk full'); END", p.registrationID("CM2")))
+
+	if _, err := clearMissingBills(p.db, missing); err == nil {
+		t.Fatal("clearMissingBills succeeded despite the failing update")
+	}
+	if n := p.count("SELECT COUNT(*) FROM registration_files"); n != 2 {
+		t.Errorf("%d file references left, want both kept after the failure", n)
+	}
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE bill_file = ''"); n != 0 {
+		t.Errorf("%d registrations half-cleared", n)
+	}
+}
+
+func TestExportCSVDelimiterAndBOM(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": "Müller Solar", "gst": "27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusOK)
+	expectStatus(t, p.registerProduct(decodeBody(t, w)["token"].(string), productID, "CSV1"), http.StatusOK)
+
+	w = p.request(http.MethodGet, "/admin/export/csv", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := w.Body.Bytes(); bytes.HasPrefix(body, []byte("\xEF\xBB\xBF")) || !bytes.HasPrefix(body, []byte("Company Name,Mobile Number,")) {
+		t.Errorf("default export starts %q, want plain comma-separated", body[:30])
+	}
+
+	w = p.request(http.MethodGet, "/admin/export/csv?delimiter=semicolon&bom=true", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "\xEF\xBB\xBFCompany Name;Mobile Number;GST Number;") {
+		t.Errorf("export starts %q, want a BOM and semicolons", body[:40])
+	}
+	if !strings.Contains(body, "\nMüller Solar;9876543210;27ABCDE1234F1Z5;Inverter;CSV1;pending;") {
+		t.Errorf("row not semicolon-separated: %q", body)
+	}
+	w = p.request(http.MethodGet, "/admin/export/csv?delimiter=tab", p.admin, nil)
+	if !strings.HasPrefix(w.Body.String(), "Company Name\tMobile Number\t") {
+		t.Errorf("tab export starts %q", w.Body.String()[:30])
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/csv?delimiter=pipe", p.admin, nil), http.StatusBadRequest)
+}
+
+// SQLite driver that counts the statements prepared and executed through it,
+// keyed by the first words of the SQL
+type countingDriver struct {
+	mu       sync.Mutex
+	prepared map[string]int
+	executed map[string]int
+}
+
+var statementCounter = &countingDriver{}
+
+func init() {
+	sql.Register("sqlite3_counting", statementCounter)
+}
+
+func statementKey(query string) string {
+	words := strings.Fields(query)
+	if len(words) > 3 {
+		words = words[:3]
+	}
+	return strings.Join(words, " ")
+}
+
+func (d *countingDriver) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prepared = map[string]int{}
+	d.executed = map[string]int{}
+}
+
+func (d *countingDriver) counts(key string) (prepared, executed int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.prepared[key], d.executed[key]
+}
+
+func (d *countingDriver) total() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, count := range d.executed {
+		n += count
+	}
+	return n
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, d: d}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+	d *countingDriver
+}
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	key := statementKey(query)
+	c.d.mu.Lock()
+	c.d.prepared[key]++
+	c.d.mu.Unlock()
+	return &countingStmt{Stmt: stmt, d: c.d, key: key}, nil
+}
+
+type countingStmt struct {
+	driver.Stmt
+	d   *countingDriver
+	key string
+}
+
+func (s *countingStmt) count() {
+	s.d.mu.Lock()
+	s.d.executed[s.key]++
+	s.d.mu.Unlock()
+}
+
+func (s *countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.count()
+	return s.Stmt.Exec(args)
+}
+
+func (s *countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.count()
+	return s.Stmt.Query(args)
+}
+
+// Portal whose handlers go through statementCounter, on an in-memory database
+// migrated the usual way
+func newCountingTestPortal(t testing.TB) *testPortal {
+	p := newTestPortal(t)
+	statementCounter.reset()
+	// Second handle on the shared-cache database newTestPortal just created
+	db, err := sql.Open("sqlite3_counting", fmt.Sprintf("file:portal_test_%d?mode=memory&cache=shared&_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", atomic.LoadInt64(&testDatabases)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	p.db = db
+	p.router = setupRouter(db, db, nil, newEventBroker(), nil)
+	return p
+}
+
+func TestRegisterReusesInsertsAcrossSerials(t *testing.T) {
+	p := newCountingTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	for _, n := range []int{1, 50} {
+		serials := make([]string, n)
+		for i := range serials {
+			serials[i] = fmt.Sprintf("N%d-%d", n, i)
+		}
+		statementCounter.reset()
+		expectStatus(t, p.registerProduct(token, productID, strings.Join(serials, ",")), http.StatusOK)
+		for _, table := range []string{"registrations", "registration_files"} {
+			prepared, executed := statementCounter.counts("INSERT INTO " + table)
+			if prepared != 1 || executed != n {
+				t.Errorf("%d serials: INSERT INTO %s prepared %d times and run %d times, want once and %d", n, table, prepared, executed, n)
+			}
+		}
+	}
+}
+
+// Statements per registration request as the serial count grows
+func BenchmarkRegisterSerials(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("serials=%d", n), func(b *testing.B) {
+			p := newCountingTestPortal(b)
+			productID := p.product("Inverter", nil)
+			token := p.customer("9876543210", "27ABCDE1234F1Z5")
+			statementCounter.reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				serials := make([]string, n)
+				for j := range serials {
+					serials[j] = fmt.Sprintf("B%d-%d", i, j)
+				}
+				expectStatus(b, p.registerProduct(token, productID, strings.Join(serials, ",")), http.StatusOK)
+			}
+			b.ReportMetric(float64(statementCounter.total())/float64(b.N), "statements/op")
+		})
+	}
+}
+
+func TestExportFullZip(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "FZ1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "FZ2"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "FZ3"), http.StatusOK)
+	p.backdate("FZ2", "approved", time.Now().Format("2006-01-02 15:04:05"))
+	var lost string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'FZ3'").Scan(&lost)
+	os.Remove(filepath.Join(os.Getenv("DATA_DIR"), lost))
+
+	w := p.request(http.MethodGet, "/admin/export/full.zip?status=pending", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-Missing-Count"); got != "1" {
+		t.Errorf("X-Missing-Count = %s, want 1", got)
+	}
+	entries := readZip(t, w)
+	csvData, ok := entries["registrations.csv"]
+	if !ok {
+		t.Fatalf("no registrations.csv in %v", entries)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(csvData)).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("registrations.csv = %q (%v), want a header and the two pending rows", csvData, err)
+	}
+	bills := []string{}
+	for name, data := range entries {
+		if strings.HasSuffix(name, ".pdf") {
+			bills = append(bills, name)
+			if !bytes.Equal(data, testPDF) {
+				t.Errorf("%s isn't the uploaded bill", name)
+			}
+		}
+	}
+	if len(bills) != 1 || !strings.Contains(bills[0], "FZ1") {
+		t.Errorf("bills = %v, want FZ1's only (FZ2 isn't pending, FZ3's is missing)", bills)
+	}
+	if _, ok := entries[missingBillsManifest]; !ok {
+		t.Errorf("no %s listing FZ3's bill", missingBillsManifest)
+	}
+}
+
+func TestTrimStringFields(t *testing.T) {
+	name := "  Ravi  "
+	req := struct {
+		Mobile   string
+		Password string `trim:"-"`
+		Nickname *string
+		Serials  []string
+		Nested   struct{ GST string }
+	}{Mobile: " 9876543210\t", Password: " secret ", Nickname: &name, Serials: []string{" A1 ", "B2\n"}}
+	req.Nested.GST = " 27ABCDE1234F1Z5 "
+	trimStringFields(reflect.ValueOf(&req))
+
+	if req.Mobile != "9876543210" || *req.Nickname != "Ravi" || req.Nested.GST != "27ABCDE1234F1Z5" || fmt.Sprint(req.Serials) != "[A1 B2]" {
+		t.Errorf("trimmed = %+v (nickname %q)", req, *req.Nickname)
+	}
+	if req.Password != " secret " {
+		t.Errorf("Password = %q, want trim:\"-\" to keep its spaces", req.Password)
+	}
+}
+
+func TestPaddedMobileCollidesWithTrimmed(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": " 9876543210 ", "company": "Acme Traders", "gst": "27ABCDE1234F1Z5 "})
+	expectStatus(t, w, http.StatusOK)
+	token := decodeBody(t, w)["token"].(string)
+	if n := p.count("SELECT COUNT(*) FROM users WHERE mobile = '9876543210' AND gst = '27ABCDE1234F1Z5'"); n != 1 {
+		t.Fatalf("mobile and GST not stored trimmed")
+	}
+	w = p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543210", "company": "Other Traders", "gst": "27ABCDE1234F1Z6"})
+	expectStatus(t, w, http.StatusConflict)
+	w = p.request(http.MethodPost, "/register", "", gin.H{"mobile": "9876543211\t", "company": "Other Traders", "gst": " 27ABCDE1234F1Z5"})
+	expectStatus(t, w, http.StatusConflict)
+
+	// Form fields of a registration are trimmed too
+	productID := p.product("Inverter", nil)
+	fields := map[string]string{"serial": " TR1 ", "product_id": fmt.Sprintf(" %d ", productID)}
+	expectStatus(t, p.upload("/register-product", token, fields, testFile{"bill", "bill.pdf", testPDF}), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'TR1' AND product_id = ?", productID); n != 1 {
+		t.Errorf("registration not stored with trimmed serial and product")
+	}
+}
+
+func TestPendingCount(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "PC1,PC2,PC3"), http.StatusOK)
+	expectStatus(t, p.review("PC3", gin.H{"status": "approved"}), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/pending-count", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody(t, w)["pending"]; got != float64(2) {
+		t.Fatalf("pending = %v, want 2", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/pending-count", nil)
+	req.Header.Set("Authorization", p.admin)
+	req.Header.Set("If-None-Match", etag)
+	if w := p.serve(req); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("matching If-None-Match: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	// A new pending registration changes the ETag
+	expectStatus(t, p.registerProduct(token, productID, "PC4"), http.StatusOK)
+	req = httptest.NewRequest(http.MethodGet, "/admin/pending-count", nil)
+	req.Header.Set("Authorization", p.admin)
+	req.Header.Set("If-None-Match", etag)
+	w = p.serve(req)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody(t, w)["pending"]; got != float64(3) || w.Header().Get("ETag") == etag {
+		t.Errorf("pending = %v with ETag %s after a new registration", got, w.Header().Get("ETag"))
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/pending-count", token, nil), http.StatusForbidden)
+}
+
+func TestCustomerProductDetails(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"description": "5kVA pure sine", "serial_pattern": "^INV[0-9]{6}$", "warranty_months": 24})
+	inactiveID := p.product("Old Inverter", gin.H{"active": 0})
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	w := p.request(http.MethodGet, fmt.Sprintf("/customer/product/%d", productID), token, nil)
+	expectStatus(t, w, http.StatusOK)
+	got := decodeBody(t, w)
+	if got["name"] != "Inverter" || got["description"] != "5kVA pure sine" || got["serial_pattern"] != "^INV[0-9]{6}$" || got["warranty_months"] != float64(24) {
+		t.Errorf("details = %v", got)
+	}
+	if got["image_url"] != productImageURL(productID) {
+		t.Errorf("image_url = %v", got["image_url"])
+	}
+	if _, ok := got["serial"]; ok || strings.Contains(w.Body.String(), "ADMIN_") {
+		t.Errorf("placeholder serial exposed: %s", w.Body.String())
+	}
+
+	expectStatus(t, p.request(http.MethodGet, fmt.Sprintf("/customer/product/%d", inactiveID), token, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, "/customer/product/9999", token, nil), http.StatusNotFound)
+}
+
+func TestProductImage(t *testing.T) {
+	p := newTestPortal(t)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	w := p.upload("/admin/product", p.admin, map[string]string{"name": "Inverter", "active": "1"}, testFile{"image", "inverter.png", png})
+	expectStatus(t, w, http.StatusOK)
+	var productID int
+	var image string
+	p.db.QueryRow("SELECT id, image FROM products WHERE name = 'Inverter'").Scan(&productID, &image)
+	if _, err := os.Stat(filepath.Join(os.Getenv("DATA_DIR"), "products", image)); image == "" || err != nil {
+		t.Fatalf("image %q not stored under DATA_DIR/products: %v", image, err)
+	}
+
+	w = p.request(http.MethodGet, productImageURL(productID), "", nil)
+	expectStatus(t, w, http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), png) || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("served %q as %s", w.Body.Bytes(), w.Header().Get("Content-Type"))
+	}
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	products := decodeList(t, p.request(http.MethodGet, "/customer/active-products", token, nil))
+	if len(products) != 1 || products[0]["image_url"] != productImageURL(productID) {
+		t.Errorf("active products = %v", products)
+	}
+
+	// Products without an image get the placeholder
+	plainID := p.product("Battery", nil)
+	w = p.request(http.MethodGet, productImageURL(plainID), "", nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Content-Type") != "image/svg+xml" || w.Body.String() != productImagePlaceholder {
+		t.Errorf("placeholder served as %s", w.Header().Get("Content-Type"))
+	}
+	expectStatus(t, p.request(http.MethodGet, "/products/image/9999", "", nil), http.StatusNotFound)
+
+	// Other file types and files that aren't images are refused
+	w = p.upload("/admin/product", p.admin, map[string]string{"name": "Charger"}, testFile{"image", "charger.pdf", testPDF})
+	expectStatus(t, w, http.StatusBadRequest)
+	w = p.upload("/admin/product", p.admin, map[string]string{"name": "Charger"}, testFile{"image", "charger.png", testPDF})
+	expectStatus(t, w, http.StatusBadRequest)
+	if n := p.count("SELECT COUNT(*) FROM products WHERE name = 'Charger'"); n != 0 {
+		t.Errorf("refused image still created the product")
+	}
+}
+
+func TestSetProductsActive(t *testing.T) {
+	p := newTestPortal(t)
+	a, b, c := p.product("Inverter A", nil), p.product("Inverter B", nil), p.product("Battery", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	// Fill the active products cache before the batch change
+	if n := len(decodeList(t, p.request(http.MethodGet, "/customer/active-products", token, nil))); n != 3 {
+		t.Fatalf("%d active products, want 3", n)
+	}
+
+	w := p.request(http.MethodPost, "/admin/products/active", p.admin, gin.H{"ids": []int{a, b, 9999}, "active": 0})
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody(t, w)["updated"]; got != float64(2) {
+		t.Errorf("updated = %v, want 2", got)
+	}
+	products := decodeList(t, p.request(http.MethodGet, "/customer/active-products", token, nil))
+	if len(products) != 1 || products[0]["id"] != float64(c) {
+		t.Errorf("active products after disabling = %v", products)
+	}
+	expectStatus(t, p.request(http.MethodGet, fmt.Sprintf("/customer/product/%d", a), token, nil), http.StatusNotFound)
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/products/active", p.admin, gin.H{"ids": []int{a}, "active": 1}), http.StatusOK)
+	if n := len(decodeList(t, p.request(http.MethodGet, "/customer/active-products", token, nil))); n != 2 {
+		t.Errorf("%d active products after enabling one, want 2", n)
+	}
+
+	expectStatus(t, p.request(http.MethodPost, "/admin/products/active", p.admin, gin.H{"ids": []int{a}}), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPost, "/admin/products/active", p.admin, gin.H{"ids": []int{a}, "active": 2}), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPost, "/admin/products/active", p.admin, gin.H{"ids": []int{}, "active": 0}), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodPost, "/admin/products/active", token, gin.H{"ids": []int{c}, "active": 0}), http.StatusForbidden)
+}
+
+func TestRootIndex(t *testing.T) {
+	p := newTestPortal(t)
+	w := p.request(http.MethodGet, "/", "", nil)
+	expectStatus(t, w, http.StatusOK)
+	links, _ := decodeBody(t, w)["links"].(map[string]interface{})
+	for _, path := range []string{"/health", "/docs", "/version"} {
+		found := false
+		for _, v := range links {
+			found = found || v == path
+		}
+		if !found {
+			t.Errorf("index links %v miss %s", links, path)
+		}
+	}
+
+	t.Setenv("ROOT_REDIRECT", "https://portal.example.com/docs")
+	w = p.request(http.MethodGet, "/", "", nil)
+	expectStatus(t, w, http.StatusFound)
+	if loc := w.Header().Get("Location"); loc != "https://portal.example.com/docs" {
+		t.Errorf("Location = %q", loc)
+	}
+}
+
+func TestForceWALCheckpoint(t *testing.T) {
+	dbDir := t.TempDir()
+	p := startTestPortal(t, filepath.Join(dbDir, "portal.db")+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	// checkpointWAL measures DATA_DIR/portal.db-wal
+	t.Setenv("DATA_DIR", dbDir)
+	for i := 0; i < 50; i++ {
+		p.product(fmt.Sprintf("Product %d", i), gin.H{"description": strings.Repeat("x", 500)})
+	}
+	if walFileSize() == 0 {
+		t.Fatal("no WAL written")
+	}
+
+	w := p.request(http.MethodPost, "/admin/db/checkpoint", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	got := decodeBody(t, w)
+	if got["busy"] != float64(0) || got["wal_bytes_before"].(float64) == 0 || got["wal_bytes_after"] != float64(0) {
+		t.Errorf("checkpoint = %v, want the WAL truncated", got)
+	}
+	if size := walFileSize(); size != 0 {
+		t.Errorf("WAL is %d bytes after the checkpoint", size)
+	}
+	if n := p.count("SELECT COUNT(*) FROM products"); n != 50 {
+		t.Errorf("%d products after the checkpoint, want 50", n)
+	}
+	expectStatus(t, p.request(http.MethodPost, "/admin/db/checkpoint", p.customer("9876543210", "27ABCDE1234F1Z5"), nil), http.StatusForbidden)
+}
+
+func TestUpsertUserConflictIgnoresSelf(t *testing.T) {
+	p := newTestPortal(t)
+	p.customer("9876543210", "27ABCDE1234F1Z5")
+	p.customer("9876543211", "27ABCDE1234F1Z6")
+	a := p.userID("9876543210")
+	edit := func(fields gin.H) *httptest.ResponseRecorder {
+		var version int
+		p.db.QueryRow("SELECT version FROM users WHERE id = ?", a).Scan(&version)
+		body := gin.H{"id": a, "username": "userA", "mobile": "9876543210", "company": "Acme Traders", "gst": "27ABCDE1234F1Z5", "role": roleCustomer, "active": 1, "version": version}
+		for k, v := range fields {
+			body[k] = v
+		}
+		return p.request(http.MethodPost, "/admin/user", p.admin, body)
+	}
+
+	// Saving A with its own mobile and GST isn't a conflict
+	expectStatus(t, edit(nil), http.StatusOK)
+
+	w := edit(gin.H{"mobile": "9876543211"})
+	expectStatus(t, w, http.StatusConflict)
+	if got := decodeBody(t, w); got["field"] != "mobile" || got["error"] != "Mobile already registered" {
+		t.Errorf("mobile conflict = %v", got)
+	}
+	w = edit(gin.H{"gst": "27ABCDE1234F1Z6"})
+	expectStatus(t, w, http.StatusConflict)
+	if got := decodeBody(t, w); got["field"] != "gst" || got["error"] != "GST already registered" {
+		t.Errorf("GST conflict = %v", got)
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE id = ? AND mobile = '9876543210' AND gst = '27ABCDE1234F1Z5'", a); n != 1 {
+		t.Errorf("refused edit changed user A")
+	}
+
+	// A soft-deleted user's mobile can be reused
+	p.db.Exec("UPDATE users SET deleted_at = ? WHERE mobile = '9876543211'", time.Now())
+	expectStatus(t, edit(gin.H{"mobile": "9876543211"}), http.StatusOK)
+}
+
+func TestExportAuditCSV(t *testing.T) {
+	p := newTestPortal(t)
+	p.db.Exec("DELETE FROM audit_log")
+	for _, e := range [][4]string{
+		{"admin", "product.created", "product:1", "2025-03-31 23:00:00"},
+		{"admin", "user.updated", "user:2", "2025-04-10 09:00:00"},
+		{"clerk", "registration.reviewed", "registration:3", "2025-04-12 10:00:00"},
+		{"admin", "product.updated", "product:1", "2025-04-30 18:00:00"},
+		{"admin", "user.deleted", "user:2", "2025-05-01 08:00:00"},
+	} {
+		p.db.Exec("INSERT INTO audit_log (actor, action, target, detail, created_at) VALUES (?, ?, ?, 'x;y', ?)", e[0], e[1], e[2], e[3])
+	}
+
+	w := p.request(http.MethodGet, "/admin/export/audit.csv?actor=admin&from=2025-04-01&to=2025-04-30", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	records := readCSV(t, w)
+	if len(records) != 3 || strings.Join(records[0], ",") != "Actor,Action,Target,Detail,Timestamp" {
+		t.Fatalf("records = %v, want the header and two entries", records)
+	}
+	if records[1][1] != "user.updated" || records[2][1] != "product.updated" || records[1][0] != "admin" || records[1][3] != "x;y" {
+		t.Errorf("records = %v", records)
+	}
+
+	// Filters are bound, so a quote in the actor matches nothing rather than breaking the query
+	w = p.request(http.MethodGet, "/admin/export/audit.csv?actor="+url.QueryEscape("admin' OR '1'='1"), p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if records := readCSV(t, w); len(records) != 1 {
+		t.Errorf("injected actor matched %d rows", len(records)-1)
+	}
+
+	// Same delimiter and BOM options as the registrations export
+	w = p.request(http.MethodGet, "/admin/export/audit.csv?actor=clerk&delimiter=semicolon&bom=true", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "\uFEFFActor;Action;") || !strings.Contains(body, "clerk;registration.reviewed;registration:3;\"x;y\";") {
+		t.Errorf("semicolon export = %q", body)
+	}
+
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/audit.csv?from=April", p.admin, nil), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodGet, "/admin/export/audit.csv", "", nil), http.StatusUnauthorized)
+}
+
+func TestBlockedMobilePrefixes(t *testing.T) {
+	p := newTestPortal(t)
+	t.Setenv("BLOCKED_MOBILE_PREFIXES", " 140, +911800 ,")
+	for _, mobile := range []string{"1400123456", "+91 1400 123457", "01800123456"} {
+		w := p.request(http.MethodPost, "/register", "", gin.H{"mobile": mobile, "company": "Spam Co", "gst": "27ABCDE1234F1Z5"})
+		expectStatus(t, w, http.StatusForbidden)
+		if msg := decodeBody(t, w)["error"]; msg != "Registration not allowed" {
+			t.Errorf("%s refused with %v", mobile, msg)
+		}
+	}
+	if n := p.count("SELECT COUNT(*) FROM users WHERE company = 'Spam Co'"); n != 0 {
+		t.Errorf("%d blocked users created", n)
+	}
+
+	// Only a leading match blocks; the prefix elsewhere in the number is fine
+	p.customer("9140012345", "27ABCDE1234F1Z5")
+	p.customer("+91 98765 43210", "27ABCDE1234F1Z6")
+
+	if got := blockedMobilePrefixes(); fmt.Sprint(got) != "[140 1800]" {
+		t.Errorf("prefixes = %v", got)
+	}
+}
+
+// Hold the write lock on another connection for d, as a concurrent writer would
+func holdWriteLock(t *testing.T, db *sql.DB, d time.Duration) {
+	t.Helper()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("opening connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("taking write lock: %v", err)
+	}
+	time.AfterFunc(d, func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+	})
+}
+
+func TestWritesRetryWhileDatabaseBusy(t *testing.T) {
+	// Without busy_timeout every write the lock blocks fails at once with SQLITE_BUSY
+	p := startTestPortal(t, filepath.Join(t.TempDir(), "portal.db")+"?_foreign_keys=on&_busy_timeout=0&_txlock=immediate")
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	holdWriteLock(t, p.db, 100*time.Millisecond)
+	expectStatus(t, p.request(http.MethodPost, "/admin/product", p.admin, gin.H{"name": "Battery", "active": 1}), http.StatusOK)
+	holdWriteLock(t, p.db, 100*time.Millisecond)
+	expectStatus(t, p.registerProduct(token, productID, "BUSY1,BUSY2"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registration_history WHERE serial IN ('BUSY1', 'BUSY2')"); n != 2 {
+		t.Errorf("%d history rows, want 2", n)
+	}
+
+	// Concurrent registrations all get through
+	tokens := make([]string, 8)
+	for i := range tokens {
+		tokens[i] = p.customer(fmt.Sprintf("98765432%02d", 20+i), fmt.Sprintf("27ABCDE%04dF1Z5", i))
+	}
+	holdWriteLock(t, p.db, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	codes := make([]int, len(tokens))
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			codes[i] = p.registerProduct(token, productID, fmt.Sprintf("CONC%d", i)).Code
+		}(i, token)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("registration %d: status %d", i, code)
+		}
+	}
+}
+
+func TestRetryBusyGivesUp(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	if !retryBusy(busy, 1, time.Now()) {
+		t.Error("first busy error not retried")
+	}
+	if retryBusy(busy, maxBusyRetries, time.Now()) {
+		t.Error("retried past maxBusyRetries")
+	}
+	// An attempt that waited out busy_timeout has used up the budget
+	if retryBusy(busy, 1, time.Now().Add(-busyRetryBudget)) {
+		t.Error("retried past busyRetryBudget")
+	}
+	if retryBusy(errors.New("no such table"), 1, time.Now()) {
+		t.Error("retried an error that isn't busy")
+	}
+}
+
+func TestViewBillInline(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	owner := p.customer("9876543210", "27ABCDE1234F1Z5")
+	other := p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(owner, productID, "VIEW1"), http.StatusOK)
+	var bill string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'VIEW1'").Scan(&bill)
+	viewPath := "/bills/view/" + strings.TrimPrefix(bill, "bills/")
+
+	for _, token := range []string{owner, p.admin} {
+		w := p.request(http.MethodGet, viewPath, token, nil)
+		expectStatus(t, w, http.StatusOK)
+		if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+			t.Errorf("Content-Type = %q, want application/pdf", ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "inline;") {
+			t.Errorf("Content-Disposition = %q, want inline", cd)
+		}
+		if !bytes.Equal(w.Body.Bytes(), testPDF) {
+			t.Errorf("served %q", w.Body.String())
+		}
+	}
+	expectStatus(t, p.request(http.MethodGet, viewPath, other, nil), http.StatusNotFound)
+	expectStatus(t, p.request(http.MethodGet, "/bills/view/missing.pdf", p.admin, nil), http.StatusNotFound)
+
+	os.WriteFile(filepath.Join(os.Getenv("DATA_DIR"), "secret.txt"), []byte("secret"), 0644)
+	for _, path := range []string{"/bills/view/..%5Csecret.txt", "/bills/view/..%2Fsecret.txt", "/bills/view/sub/..%2F..%2Fsecret.txt"} {
+		if w := p.request(http.MethodGet, path, p.admin, nil); w.Code == http.StatusOK {
+			t.Errorf("%s served %q", path, w.Body.String())
+		}
+	}
+}
+
+func TestRegistrationMeta(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"meta_schema": []gin.H{
+		{"name": "dealer_invoice", "label": "Dealer invoice number", "required": true},
+		{"name": "installer"},
+	}})
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	register := func(serial string, meta map[string]string) *httptest.ResponseRecorder {
+		fields := map[string]string{"serial": serial, "product_id": fmt.Sprint(productID)}
+		for k, v := range meta {
+			fields[k] = v
+		}
+		return p.upload("/register-product", token, fields, testFile{"bill", "bill.pdf", testPDF})
+	}
+
+	rejectedField(t, register("META1", map[string]string{"installer": "Ravi"}), "dealer_invoice")
+	rejectedField(t, register("META1", map[string]string{"dealer_invoice": strings.Repeat("9", maxMetaValueLength+1)}), "dealer_invoice")
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'META1'"); n != 0 {
+		t.Fatal("refused registration stored")
+	}
+
+	// Fields outside the schema are dropped
+	expectStatus(t, register("META1", map[string]string{"dealer_invoice": " INV-42 ", "notes_extra": "x"}), http.StatusOK)
+	var meta string
+	p.db.QueryRow("SELECT registration_meta FROM registrations WHERE serial = 'META1'").Scan(&meta)
+	if meta != `{"dealer_invoice":"INV-42"}` {
+		t.Errorf("registration_meta = %s", meta)
+	}
+
+	regs := decodeList(t, p.request(http.MethodGet, "/admin/registrations", p.admin, nil))
+	if len(regs) != 1 || fmt.Sprint(regs[0]["meta"]) != "map[dealer_invoice:INV-42]" {
+		t.Errorf("listed registrations = %v", regs)
+	}
+
+	// Bad schemas are refused
+	for _, schema := range [][]gin.H{{{"name": "Dealer Invoice"}}, {{"name": "serial"}}, {{"name": "a"}, {"name": "a"}}} {
+		rejectedField(t, p.request(http.MethodPost, "/admin/product", p.admin, gin.H{"name": "Battery", "meta_schema": schema}), "meta_schema")
+	}
+}
+
+func TestConfigBundleCarriesProductSettings(t *testing.T) {
+	source := newTestPortal(t)
+	source.product("Inverter", gin.H{
+		"warranty_months":              24,
+		"meta_schema":                  []gin.H{{"name": "dealer_invoice", "required": true}},
+		"serial_transform":             "^SN-",
+		"serial_transform_replacement": "",
+	})
+	source.db.Exec("UPDATE products SET image = 'inverter.png'")
+	w := source.request(http.MethodGet, "/admin/export/config", source.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	bundle := w.Body.Bytes()
+
+	target := newTestPortal(t)
+	expectStatus(t, target.request(http.MethodPost, "/admin/import/config", target.admin, bundle), http.StatusOK)
+	var warranty int
+	var metaSchema, transform, image string
+	target.db.QueryRow("SELECT warranty_months, meta_schema, serial_transform, image FROM products WHERE name = 'Inverter'").Scan(&warranty, &metaSchema, &transform, &image)
+	if warranty != 24 || metaSchema != `[{"name":"dealer_invoice","required":true}]` || transform != "^SN-" || image != "inverter.png" {
+		t.Errorf("imported warranty %d, meta_schema %s, transform %q, image %q", warranty, metaSchema, transform, image)
+	}
+
+	for _, p := range []gin.H{
+		{"name": "Long", "serial_transform": strings.Repeat("a", maxSerialPatternLength+1)},
+		{"name": "Long", "serial_transform": "^SN-", "serial_transform_replacement": strings.Repeat("a", maxSerialPatternLength+1)},
+		{"name": "Broken", "serial_transform": "(["},
+		{"name": "Negative", "warranty_months": -1},
+		{"name": "Reserved", "meta_schema": []gin.H{{"name": "serial"}}},
+	} {
+		expectStatus(t, target.request(http.MethodPost, "/admin/import/config", target.admin, gin.H{"products": []gin.H{p}}), http.StatusBadRequest)
+	}
+}
+
+func TestAdminIPAllowlist(t *testing.T) {
+	p := newTestPortal(t)
+	allowlist, err := parseIPAllowlist(" 10.0.0.0/8, 192.168.1.7 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.router = setupRouter(p.db, p.db, nil, newEventBroker(), allowlist)
+	from := func(remoteAddr, forwarded, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", p.admin)
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return p.serve(req).Code
+	}
+
+	for _, addr := range []string{"10.1.2.3:4000", "192.168.1.7:4000"} {
+		if code := from(addr, "", "/admin/dashboard"); code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", addr, code)
+		}
+	}
+	for _, path := range []string{"/admin/dashboard", "/admin/export/csv/" + adminPassword()} {
+		if code := from("192.168.1.8:4000", "", path); code != http.StatusForbidden {
+			t.Errorf("%s from a blocked IP: status %d, want 403", path, code)
+		}
+	}
+	if code := from("192.168.1.8:4000", "", "/health"); code != http.StatusOK {
+		t.Errorf("non-admin route blocked: status %d", code)
+	}
+
+	// X-Forwarded-For only counts behind a trusted proxy
+	if code := from("192.168.1.8:4000", "10.1.2.3", "/admin/dashboard"); code != http.StatusForbidden {
+		t.Errorf("spoofed X-Forwarded-For: status %d, want 403", code)
+	}
+	t.Setenv("TRUST_PROXY", "true")
+	if code := from("192.168.1.8:4000", "10.1.2.3, 192.168.1.8", "/admin/dashboard"); code != http.StatusOK {
+		t.Errorf("allowed client behind a proxy: status %d, want 200", code)
+	}
+	if code := from("10.1.2.3:4000", "203.0.113.9", "/admin/dashboard"); code != http.StatusForbidden {
+		t.Errorf("blocked client behind a proxy: status %d, want 403", code)
+	}
+
+	if _, err := parseIPAllowlist("10.0.0.0/8,office"); err == nil {
+		t.Error("invalid entry accepted")
+	}
+}
+
+func TestExportBillsListsMissing(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "MB1"), http.StatusOK)
+	expectStatus(t, p.registerProduct(token, productID, "MB2"), http.StatusOK)
+	var lost string
+	p.db.QueryRow("SELECT bill_file FROM registrations WHERE serial = 'MB2'").Scan(&lost)
+	os.Remove(filepath.Join(os.Getenv("DATA_DIR"), lost))
+
+	w := p.request(http.MethodGet, "/admin/export/bills", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-Missing-Count"); got != "1" {
+		t.Errorf("X-Missing-Count = %s, want 1", got)
+	}
+	entries := readZip(t, w)
+	manifest := string(entries[missingBillsManifest])
+	if !strings.Contains(manifest, fmt.Sprintf("registration %d\tserial MB2\t", p.registrationID("MB2"))) || !strings.Contains(manifest, lost) {
+		t.Errorf("%s = %q, want MB2's bill", missingBillsManifest, manifest)
+	}
+	if strings.Contains(manifest, "MB1") {
+		t.Errorf("%s lists MB1, whose bill is there", missingBillsManifest)
+	}
+	bills := 0
+	for name := range entries {
+		if strings.HasSuffix(name, ".pdf") {
+			bills++
+		}
+	}
+	if bills != 1 {
+		t.Errorf("%d bills in the zip, want 1", bills)
+	}
+
+	// With every bill present there's no manifest
+	p.db.Exec("DELETE FROM registrations WHERE serial = 'MB2'")
+	w = p.request(http.MethodGet, "/admin/export/bills", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if _, ok := readZip(t, w)[missingBillsManifest]; ok || w.Header().Get("X-Missing-Count") != "0" {
+		t.Errorf("manifest or X-Missing-Count %s with no missing bills", w.Header().Get("X-Missing-Count"))
+	}
+}
+
+func TestSerialTransformDeduplicates(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"serial_transform": "^SN-", "serial_transform_replacement": ""})
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+
+	expectStatus(t, p.registerProduct(token, productID, "sn-00123"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = '00123'"); n != 1 {
+		t.Fatal("serial not stored transformed")
+	}
+	expectStatus(t, p.registerProduct(token, productID, "00123"), http.StatusConflict)
+	expectStatus(t, p.registerProduct(token, productID, "SN-00123"), http.StatusConflict)
+	// Serials repeated once transformed count once
+	expectStatus(t, p.registerProduct(token, productID, "SN-00124,00124"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = '00124'"); n != 1 {
+		t.Errorf("%d registrations for 00124, want 1", n)
+	}
+
+	w := p.registerProduct(token, productID, "SN-")
+	rejectedField(t, w, "serial")
+	if msg := decodeBody(t, w)["error"]; msg == "All fields required and bill file must be uploaded" {
+		t.Errorf("a serial emptied by the transform reported as missing fields")
+	}
+
+	// Lookups take the serial in either form
+	w = p.request(http.MethodGet, "/admin/registration/search?serial=SN-00123", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody(t, w)["serial"]; got != "00123" {
+		t.Errorf("search found %v", got)
+	}
+	w = p.request(http.MethodGet, "/admin/serial/SN-00123/history", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if history, _ := decodeBody(t, w)["history"].([]interface{}); len(history) != 1 {
+		t.Errorf("history = %v, want the 00123 registration", history)
+	}
+
+	// An admin's serial edit is transformed the same way
+	expectStatus(t, p.review("00123", gin.H{"serial": "SN-00999"}), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = '00999'"); n != 1 {
+		t.Error("edited serial not stored transformed")
+	}
+	rejectedField(t, p.review("00999", gin.H{"serial": "sn-"}), "serial")
+}
+
+func TestUpsertProductKeepsOmittedSettings(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{
+		"warranty_months":              24,
+		"serial_transform":             "^SN-",
+		"serial_transform_replacement": "",
+		"meta_schema":                  []gin.H{{"name": "dealer_invoice", "required": true}},
+	})
+	settings := func() string {
+		var warranty int
+		var transform, metaSchema string
+		p.db.QueryRow("SELECT warranty_months, serial_transform, meta_schema FROM products WHERE id = ?", productID).Scan(&warranty, &transform, &metaSchema)
+		return fmt.Sprintf("%d %s %s", warranty, transform, metaSchema)
+	}
+	want := settings()
+
+	// An edit from a client that only knows the original fields
+	expectStatus(t, p.request(http.MethodPost, "/admin/product", p.admin, gin.H{"id": productID, "name": "Inverter 5kVA", "active": 1}), http.StatusOK)
+	if got := settings(); got != want {
+		t.Errorf("settings after a plain edit = %s, want %s", got, want)
+	}
+	expectStatus(t, p.upload("/admin/product", p.admin, map[string]string{"id": fmt.Sprint(productID), "name": "Inverter 5kVA", "active": "1"}), http.StatusOK)
+	if got := settings(); got != want {
+		t.Errorf("settings after a multipart edit = %s, want %s", got, want)
+	}
+
+	// Given explicitly, they're changed or cleared
+	expectStatus(t, p.request(http.MethodPost, "/admin/product", p.admin, gin.H{"id": productID, "name": "Inverter 5kVA", "active": 1, "warranty_months": 0, "serial_transform": "", "meta_schema": []gin.H{}}), http.StatusOK)
+	if got := settings(); got != "0  " {
+		t.Errorf("settings after clearing = %q", got)
+	}
+}
+
+func TestUserStatusMatrix(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	a := p.customer("9876543210", "27ABCDE1234F1Z5")
+	b := p.customer("9876543211", "27ABCDE1234F1Z6")
+	p.customer("9876543212", "27ABCDE1234F1Z7")
+	expectStatus(t, p.registerProduct(a, productID, "SM1,SM2,SM3,SM4"), http.StatusOK)
+	expectStatus(t, p.registerProduct(b, productID, "SM5,SM6"), http.StatusOK)
+	expectStatus(t, p.review("SM2", gin.H{"status": "approved"}), http.StatusOK)
+	expectStatus(t, p.review("SM3", gin.H{"status": "approved"}), http.StatusOK)
+	expectStatus(t, p.review("SM4", gin.H{"status": "rejected"}), http.StatusOK)
+	expectStatus(t, p.review("SM5", gin.H{"status": "needs_info", "notes": "Bill is blurred"}), http.StatusOK)
+
+	w := p.request(http.MethodGet, "/admin/users/status-matrix", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	rows := decodeList(t, w)
+	got := map[string]string{}
+	for _, row := range rows {
+		got[fmt.Sprint(row["mobile"])] = fmt.Sprintf("%v/%v/%v/%v/%v", row["total"], row["pending"], row["needs_info"], row["approved"], row["rejected"])
+	}
+	want := map[string]string{"9876543210": "4/1/0/2/1", "9876543211": "2/1/1/0/0", "9876543212": "0/0/0/0/0"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("matrix (total/pending/needs_info/approved/rejected) = %v, want %v", got, want)
+	}
+
+	w = p.request(http.MethodGet, "/admin/users/status-matrix?limit=2&page=2", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if page := decodeList(t, w); len(page) != 1 || page[0]["mobile"] != "9876543212" || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("second page = %v, total %s", page, w.Header().Get("X-Total-Count"))
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/users/status-matrix", a, nil), http.StatusForbidden)
+}
+
+func TestLogLevel(t *testing.T) {
+	t.Setenv("DEBUG_HTTP", "true")
+	p := newTestPortal(t)
+	logs := captureLog(t)
+	t.Setenv("LOG_LEVEL", "info")
+	setupLogLevel()
+
+	logDebug("debug line")
+	logInfo("info line")
+	logWarn("warn line")
+	// Routine chatter: per-request bodies and the dev session fallback
+	p.request(http.MethodGet, "/customer/active-products", "stale-token", nil)
+	out := logs.String()
+	if strings.Contains(out, "debug line") || strings.Contains(out, "DEBUG:") {
+		t.Errorf("DEBUG lines logged at LOG_LEVEL=INFO:\n%s", out)
+	}
+	if !strings.Contains(out, "INFO: info line") || !strings.Contains(out, "WARN: warn line") {
+		t.Errorf("INFO and WARN lines missing:\n%s", out)
+	}
+
+	logs.Reset()
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	setupLogLevel()
+	p.request(http.MethodGet, "/customer/active-products", "stale-token", nil)
+	if out := logs.String(); !strings.Contains(out, "DEBUG: HTTP GET /customer/active-products") || !strings.Contains(out, "DEBUG: Invalid token or inactive user") {
+		t.Errorf("debug request lines missing at LOG_LEVEL=DEBUG:\n%s", out)
+	}
+
+	logs.Reset()
+	t.Setenv("LOG_LEVEL", "WARN")
+	setupLogLevel()
+	logInfo("info line")
+	t.Setenv("LOG_LEVEL", "loud")
+	setupLogLevel()
+	if logLevel != levelWarn || strings.Contains(logs.String(), "info line") || !strings.Contains(logs.String(), `Invalid LOG_LEVEL "LOUD"`) {
+		t.Errorf("level %d, log:\n%s", logLevel, logs.String())
+	}
+}
+
+func TestBlockedMobileLogIsMasked(t *testing.T) {
+	p := newTestPortal(t)
+	logs := captureLog(t)
+	t.Setenv("BLOCKED_MOBILE_PREFIXES", "140")
+	expectStatus(t, p.request(http.MethodPost, "/register", "", gin.H{"mobile": "1400123456", "company": "Spam Co", "gst": "27ABCDE1234F1Z5"}), http.StatusForbidden)
+	if out := logs.String(); strings.Contains(out, "1400123456") || !strings.Contains(out, "******3456") {
+		t.Errorf("blocked mobile not masked:\n%s", out)
+	}
+}
+
+func TestFailedRegistrationRemovesSavedBill(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	billsDir := filepath.Join(os.Getenv("DATA_DIR"), "bills")
+	savedBills := func() []string {
+		entries, _ := os.ReadDir(billsDir)
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	for _, table := range []string{"registrations", "registration_files"} {
+		trigger := "fail_" + table
+		if _, err := p.db.Exec("CREATE TRIGGER " + trigger + " BEFORE INSERT ON " + table + " BEGIN SELECT RAISE(ABORT, 'forced failure'); END"); err != nil {
+			t.Fatal(err)
+		}
+		w := p.upload("/register-product", token, map[string]string{"serial": "FAIL1,FAIL2", "product_id": fmt.Sprint(productID)},
+			testFile{"bill", "bill.pdf", testPDF}, testFile{"warranty", "card.pdf", testPDF})
+		if w.Code == http.StatusOK {
+			t.Errorf("failing %s inserts: registration succeeded", table)
+		}
+		if names := savedBills(); len(names) != 0 {
+			t.Errorf("failing %s inserts left files behind: %v", table, names)
+		}
+		if n := p.count("SELECT COUNT(*) FROM registrations"); n != 0 {
+			t.Errorf("failing %s inserts left %d registrations", table, n)
+		}
+		p.db.Exec("DROP TRIGGER " + trigger)
+	}
+
+	// With the inserts working again the files stay
+	expectStatus(t, p.registerProduct(token, productID, "FAIL1"), http.StatusOK)
+	if names := savedBills(); len(names) != 1 {
+		t.Errorf("saved bills = %v, want the one registered", names)
+	}
+}
+
+func TestListNonconformingRegistrations(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "INV000001,INV000002,OLD-17,X9"), http.StatusOK)
+	expectStatus(t, p.review("X9", gin.H{"status": "approved"}), http.StatusOK)
+	path := fmt.Sprintf("/admin/product/%d/nonconforming", productID)
+	serialsOf := func(w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		expectStatus(t, w, http.StatusOK)
+		serials := []string{}
+		regs, _ := decodeBody(t, w)["registrations"].([]interface{})
+		for _, reg := range regs {
+			serials = append(serials, fmt.Sprint(reg.(map[string]interface{})["serial"]))
+		}
+		return serials
+	}
+
+	// Without a pattern every serial conforms
+	if got := serialsOf(p.request(http.MethodGet, path, p.admin, nil)); len(got) != 0 {
+		t.Errorf("nonconforming without a pattern = %v", got)
+	}
+	// A proposed pattern is checked before it's saved
+	if got := serialsOf(p.request(http.MethodGet, path+"?pattern="+url.QueryEscape("^INV[0-9]{6}$"), p.admin, nil)); fmt.Sprint(got) != "[OLD-17 X9]" {
+		t.Errorf("nonconforming with a proposed pattern = %v", got)
+	}
+	if n := p.count("SELECT COUNT(*) FROM products WHERE id = ? AND COALESCE(serial_pattern, '') = ''", productID); n != 1 {
+		t.Error("previewing a pattern saved it")
+	}
+
+	expectStatus(t, p.request(http.MethodPatch, fmt.Sprintf("/admin/product/%d", productID), p.admin, gin.H{"serial_pattern": "^(INV[0-9]{6}|X9)$"}), http.StatusOK)
+	w := p.request(http.MethodGet, path+"?limit=1", p.admin, nil)
+	if got := serialsOf(w); fmt.Sprint(got) != "[OLD-17]" || w.Header().Get("X-Total-Count") != "1" {
+		t.Errorf("nonconforming with the saved pattern = %v", got)
+	}
+	// Listing doesn't touch the registrations
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE status = 'pending'"); n != 3 {
+		t.Errorf("%d pending registrations after listing, want 3", n)
+	}
+
+	expectStatus(t, p.request(http.MethodGet, path+"?pattern=%5B", p.admin, nil), http.StatusBadRequest)
+	expectStatus(t, p.request(http.MethodGet, "/admin/product/9999/nonconforming", p.admin, nil), http.StatusNotFound)
+}
+
+func TestDuplicateGraceBoundary(t *testing.T) {
+	t.Setenv("DUPLICATE_GRACE_DAYS", "30")
+	p := newTestPortal(t)
+	productID := p.product("Inverter", nil)
+	first := p.customer("9876543210", "27ABCDE1234F1Z5")
+	second := p.customer("9876543211", "27ABCDE1234F1Z6")
+	expectStatus(t, p.registerProduct(first, productID, "GR1,GR2,GR3,GR4,GR5"), http.StatusOK)
+	for _, serial := range []string{"GR1", "GR2", "GR3"} {
+		expectStatus(t, p.review(serial, gin.H{"status": "rejected"}), http.StatusOK)
+	}
+	expectStatus(t, p.review("GR4", gin.H{"status": "approved"}), http.StatusOK)
+	// Every registration is old; only when it was rejected differs
+	p.db.Exec("UPDATE registrations SET created_at = ?", time.Now().AddDate(0, 0, -100).Format("2006-01-02 15:04:05"))
+	rejectedAt := func(serial string, days int) {
+		p.db.Exec("UPDATE registration_history SET created_at = ? WHERE serial = ? AND event = 'updated'", time.Now().AddDate(0, 0, -days).Add(time.Minute).Format("2006-01-02 15:04:05"), serial)
+	}
+	rejectedAt("GR1", 31)
+	rejectedAt("GR2", 30) // a minute inside the grace period
+	rejectedAt("GR3", 1)
+
+	expectStatus(t, p.registerProduct(second, productID, "GR1"), http.StatusOK)
+	if n := p.count("SELECT COUNT(*) FROM registrations WHERE serial = 'GR1' AND user_id = ? AND status = 'pending'", p.userID("9876543211")); n != 1 {
+		t.Error("GR1 not re-registered past the grace period")
+	}
+	for _, serial := range []string{"GR2", "GR3", "GR4", "GR5"} {
+		expectStatus(t, p.registerProduct(second, productID, serial), http.StatusConflict)
+	}
+
+	// Registrations from before the history was kept fall back to created_at
+	p.db.Exec("DELETE FROM registration_history WHERE serial = 'GR3'")
+	expectStatus(t, p.registerProduct(second, productID, "GR3"), http.StatusOK)
+
+	w := p.request(http.MethodPost, "/customer/check-serials", second, gin.H{"serials": []string{"GR2", "NEW1"}, "product_id": productID})
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); !strings.Contains(got, `"serial":"GR2","status":"registered"`) || !strings.Contains(got, `"serial":"NEW1","status":"available"`) {
+		t.Errorf("check-serials = %s", got)
+	}
+}
+
+func TestSerialLookupsUseNocaseIndex(t *testing.T) {
+	p := newTestPortal(t)
+	queries := map[string]string{
+		"holders":  "SELECT r.id FROM registrations r WHERE r.serial = ? COLLATE NOCASE",
+		"wildcard": `SELECT r.id FROM registrations r JOIN users u ON r.user_id=u.id JOIN products p ON r.product_id=p.id WHERE r.serial LIKE ? ESCAPE '\' ORDER BY r.serial LIMIT 100`,
+	}
+	for name, query := range queries {
+		var plan, detail string
+		var id, parent, unused int
+		rows, err := p.db.Query("EXPLAIN QUERY PLAN "+query, "AB%")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			rows.Scan(&id, &parent, &unused, &detail)
+			plan += detail
+		}
+		rows.Close()
+		if !strings.Contains(plan, "idx_registrations_serial_nocase") {
+			t.Errorf("%s lookup doesn't use the index: %s", name, plan)
+		}
+	}
+
+	// Lower-case input still finds the serial
+	productID := p.product("Inverter", nil)
+	customer := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(customer, productID, "CASE1"), http.StatusOK)
+	if _, blocked := serialHolders(p.db, "case1"); !blocked {
+		t.Error("case1 not held by CASE1")
+	}
+}
+
+func TestReadDatabaseHandle(t *testing.T) {
+	p := newFileTestPortal(t)
+	var seq int
+	var name, path string
+	if err := p.db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &path); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("READ_DB_PATH", path)
+	readDB := setupReadDatabase(p.db)
+	if readDB == p.db {
+		t.Fatal("READ_DB_PATH didn't open a second handle")
+	}
+	t.Cleanup(func() { readDB.Close() })
+	p.router = setupRouter(p.db, readDB, nil, newEventBroker(), nil)
+
+	// The handle is read-only, so these writes can only have gone to the primary
+	if _, err := readDB.Exec("INSERT INTO products (name, serial) VALUES ('Direct', 'DIRECT')"); err == nil {
+		t.Fatal("read handle accepted a write")
+	}
+	productID := p.product("Inverter", nil)
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	expectStatus(t, p.registerProduct(token, productID, "RO1,RO2"), http.StatusOK)
+	expectStatus(t, p.review("RO2", gin.H{"status": "approved"}), http.StatusOK)
+
+	// Read handlers on the read-only handle see them
+	w := p.request(http.MethodGet, "/admin/dashboard", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decodeBody(t, w); body["total_registrations"] != float64(2) || body["pending_approvals"] != float64(1) || body["approved"] != float64(1) {
+		t.Errorf("dashboard = %v", body)
+	}
+	w = p.request(http.MethodGet, "/admin/export/csv", p.admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	if records := readCSV(t, w); len(records) != 3 {
+		t.Errorf("export = %v, want a header and two registrations", records)
+	}
+}
+
+func TestRotateAdminTokenOnStart(t *testing.T) {
+	p := newFileTestPortal(t)
+	adminToken := func() string {
+		var token string
+		p.db.QueryRow("SELECT token FROM users WHERE username = 'admin'").Scan(&token)
+		return token
+	}
+	session := p.admin
+
+	// Off by default: a restart keeps the session
+	ensureAdmin(p.db)
+	expectStatus(t, p.request(http.MethodGet, "/admin/dashboard", session, nil), http.StatusOK)
+
+	t.Setenv("ROTATE_ADMIN_TOKEN_ON_START", "true")
+	ensureAdmin(p.db)
+	first := adminToken()
+	ensureAdmin(p.db)
+	second := adminToken()
+	if first == "" || first == second || first == session {
+		t.Errorf("tokens across startups: %q, %q (session %q)", first, second, session)
+	}
+	expectStatus(t, p.request(http.MethodGet, "/admin/dashboard", session, nil), http.StatusUnauthorized)
+	expectStatus(t, p.request(http.MethodGet, "/admin/dashboard", p.login("admin", adminPassword()), nil), http.StatusOK)
+}
+
+func TestPatchProductActiveOnly(t *testing.T) {
+	p := newTestPortal(t)
+	productID := p.product("Inverter", gin.H{"description": "5kVA pure sine", "serial_pattern": "^INV[0-9]+$", "warranty_months": 24})
+	path := fmt.Sprintf("/admin/product/%d", productID)
+	product := func() string {
+		var name, description, pattern string
+		var active, warranty int
+		p.db.QueryRow("SELECT name, description, active, serial_pattern, warranty_months FROM products WHERE id = ?", productID).Scan(&name, &description, &active, &pattern, &warranty)
+		return fmt.Sprintf("%s|%s|%d|%s|%d", name, description, active, pattern, warranty)
+	}
+
+	expectStatus(t, p.request(http.MethodPatch, path, p.admin, gin.H{"active": 0}), http.StatusOK)
+	if got := product(); got != "Inverter|5kVA pure sine|0|^INV[0-9]+$|24" {
+		t.Errorf("after patching active = %s", got)
+	}
+	token := p.customer("9876543210", "27ABCDE1234F1Z5")
+	if n := len(decodeList(t, p.request(http.MethodGet, "/customer/active-products", token, nil))); n != 0 {
+		t.Errorf("%d active products after disabling, want 0", n)
+	}
+
+	expectStatus(t, p.request(http.MethodPatch, path, p.admin, gin.H{"description": "", "active": 1}), http.StatusOK)
+	if got := product(); got != "Inverter||1|^INV[0-9]+$|24" {
+		t.Errorf("after clearing description = %s", got)
+	}
+
+	rejectedField(t, p.request(http.MethodPatch, path, p.admin, gin.H{"name": ""}), "name")
+	rejectedField(t, p.request(http.MethodPatch, path, p.admin, gin.H{"active": 2}), "active")
+	expectStatus(t, p.request(http.MethodPatch, "/admin/product/9999", p.admin, gin.H{"active": 1}), http.StatusNotFound)
+	if got := product(); got != "Inverter||1|^INV[0-9]+$|24" {
+		t.Errorf("refused patches changed the product: %s", got)
+	}
+}